@@ -17,37 +17,70 @@
 
 // Package balancer implements a capacity based load balancer where each entity
 // periodically reports its actual processing capacity and the balancer issues
-// requests based on those numbers.
+// requests based on those numbers (or according to another, pluggable strategy).
+// Requests carrying a routing key are instead
+// pinned to an entity by weighted rendezvous hashing, so that membership changes
+// only move the keys of the joining or leaving entities.
 package balancer
 
 import (
 	"fmt"
+	"hash/fnv"
+	"math"
 	"math/big"
-	"math/rand"
 	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 // The load balancer for a single topic.
 type Balancer struct {
 	members  entitySlice  // Entries to which to balace to
 	capacity int          // Total message capacity of the topic
+	strategy Strategy     // Strategy picking the balancing destinations
+	stateful bool         // Whether the strategy needs exclusive access to pick
 	lock     sync.RWMutex // Mutex to allow reentrant balancing
 }
 
-// Creates a new - empty - load balancer.
+// Reusable buffers of the candidates of a single balancing.
+type pick struct {
+	cands  []*Candidate
+	store  []Candidate
+	owners []*entity
+}
+
+// Pool of balancing buffers to avoid allocating them for every message.
+var picks = sync.Pool{New: func() interface{} { return new(pick) }}
+
+// Creates a new - empty - load balancer, using the weighted random strategy.
 func New() *Balancer {
 	return &Balancer{
-		members: []*entity{},
+		members:  []*entity{},
+		strategy: new(weightedRandom),
 	}
 }
 
+// Replaces the balancing strategy with a new instance of the named one.
+func (b *Balancer) Strategize(name string) error {
+	strategy, err := NewStrategy(name)
+	if err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.strategy = strategy
+	_, stateless := strategy.(Stateless)
+	b.stateful = !stateless
+	return nil
+}
+
 // Registers an entity to load balance to (no duplicate checks are done).
 func (b *Balancer) Register(id *big.Int) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	b.members = append(b.members, &entity{id: id, cap: 1})
+	b.members = append(b.members, &entity{id: id, cap: 1, weight: 1})
 	sort.Sort(b.members)
 	b.capacity += 1
 }
@@ -98,43 +131,151 @@ func (b *Balancer) Update(id *big.Int, cap int) error {
 	return nil
 }
 
-// Returns an id to which to send the next message to. The optional ex (can be
-// nil) is used to exclude an entity from balancing to (if it's the only one
-// available then this guarantee will be forfeit).
+// Updates an entry's key affinity weight (i.e. the number of members behind).
+func (b *Balancer) Weigh(id *big.Int, weight int) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Zero weight would starve the entry of keys while still being a member
+	if weight <= 0 {
+		weight = 1
+	}
+	idx := b.members.Search(id)
+	if idx < len(b.members) && b.members[idx].id.Cmp(id) == 0 {
+		b.members[idx].weight = weight
+	} else {
+		return fmt.Errorf("non-registered entity: %v", id)
+	}
+	return nil
+}
+
+// Updates an entry's outstanding message count as reported by it, dropping the
+// local estimate of messages sent since.
+func (b *Balancer) UpdatePending(id *big.Int, pend int) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	idx := b.members.Search(id)
+	if idx < len(b.members) && b.members[idx].id.Cmp(id) == 0 {
+		b.members[idx].pend = pend
+		atomic.StoreInt32(&b.members[idx].sent, 0)
+	} else {
+		return fmt.Errorf("non-registered entity: %v", id)
+	}
+	return nil
+}
+
+// Returns an id to which to send the next message to, as picked by the active
+// strategy. The optional ex (can be nil) is used to exclude an entity from
+// balancing to (if it's the only one available then this guarantee will be
+// forfeit).
 func (b *Balancer) Balance(ex *big.Int) (*big.Int, error) {
+	// Stateless strategies pick concurrently, stateful ones get exclusive access
 	b.lock.RLock()
-	defer b.lock.RUnlock()
+	if b.stateful {
+		b.lock.RUnlock()
+		b.lock.Lock()
+		defer b.lock.Unlock()
+	} else {
+		defer b.lock.RUnlock()
+	}
 
 	// Make sure there is actually somebody to balance to
 	if b.capacity == 0 {
 		return nil, fmt.Errorf("no capacity to balance")
 	}
-	// Calculate the available capacity with ex excluded
-	available := b.capacity
+	// Collect the candidates with ex excluded (unless it's the only capacity)
 	exclude := -1
 	if ex != nil {
 		idx := b.members.Search(ex)
 		if idx < len(b.members) && b.members[idx].id.Cmp(ex) == 0 {
-			if available != b.members[idx].cap {
-				available -= b.members[idx].cap
+			if b.capacity != b.members[idx].cap {
 				exclude = idx
 			}
 		}
 	}
-	// Generate a uniform random capacity and send to the associated entity
-	cap := rand.Intn(available)
+	p := picks.Get().(*pick)
+	defer picks.Put(p)
+
+	p.store, p.owners, p.cands = p.store[:0], p.owners[:0], p.cands[:0]
 	for i, m := range b.members {
-		// Skip the excluded source entity
-		if i == exclude {
+		if i == exclude || m.cap == 0 {
+			continue
+		}
+		p.store = append(p.store, Candidate{Id: m.id, Capacity: m.cap, Pending: m.pend + int(atomic.LoadInt32(&m.sent))})
+		p.owners = append(p.owners, m)
+	}
+	for i := range p.store {
+		p.cands = append(p.cands, &p.store[i])
+	}
+	// Let the strategy pick one and account for the message
+	idx := b.strategy.Pick(p.cands)
+	if idx < 0 || idx >= len(p.owners) {
+		panic("balanced out of bounds")
+	}
+	owner := p.owners[idx]
+	atomic.AddInt32(&owner.sent, 1)
+	return owner.id, nil
+}
+
+// Returns the id owning the given routing key, i.e. the one with the highest
+// rendezvous score. The optional ex (can be nil) is excluded like in Balance.
+func (b *Balancer) BalanceKey(key string, ex *big.Int) (*big.Int, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	// Make sure there is actually somebody to balance to
+	if len(b.members) == 0 {
+		return nil, fmt.Errorf("no members to balance")
+	}
+	// Pick the highest scoring entity, skipping ex if others are available
+	var owner *big.Int
+	best := math.Inf(-1)
+	for _, m := range b.members {
+		if ex != nil && len(b.members) > 1 && m.id.Cmp(ex) == 0 {
 			continue
 		}
-		cap -= m.cap
-		if cap < 0 {
-			return m.id, nil
+		if score := Rendezvous(key, m.id, m.weight); score > best {
+			owner, best = m.id, score
+		}
+	}
+	return owner, nil
+}
+
+// Calculates the weighted rendezvous hashing score of an entity for a routing
+// key. Out of a set of entities, the highest scoring one owns the key, with the
+// chance of owning proportional to the weight.
+func Rendezvous(key string, id *big.Int, weight int) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	hash.Write([]byte{0})
+	hash.Write(id.Bytes())
+
+	// Mix the bits (FNV alone avalanches poorly) and map them into (0, 1)
+	h := hash.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+	return float64(weight) / -math.Log(u)
+}
+
+// Returns the total number of outstanding messages of the entities, optionally
+// with ex excluded from the count.
+func (b *Balancer) Pending(ex *big.Int) int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	pend := 0
+	for _, m := range b.members {
+		if ex == nil || m.id.Cmp(ex) != 0 {
+			pend += m.pend + int(atomic.LoadInt32(&m.sent))
 		}
 	}
-	// Just in case to prevent bugs
-	panic("balanced out of bounds")
+	return pend
 }
 
 // Returns the total capacity that the balancer can handle, optionally with ex
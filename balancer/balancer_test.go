@@ -18,8 +18,11 @@
 package balancer
 
 import (
+	"fmt"
+	"math"
 	"math/big"
 	"math/rand"
+	"sync"
 	"testing"
 )
 
@@ -101,3 +104,248 @@ func TestBalancer(t *testing.T) {
 		}
 	}
 }
+
+func TestBalanceKey(t *testing.T) {
+	entities := 10
+	keys := 10000
+
+	// Generate a handful of nodes and register them with equal weights
+	ids := make([]*big.Int, entities)
+	for i := 0; i < len(ids); i++ {
+		ids[i] = big.NewInt(rand.Int63())
+	}
+	bal := New()
+	for i := 0; i < entities; i++ {
+		bal.Register(ids[i])
+	}
+	// Assign all the keys and check that they are sticky and fairly spread
+	owners := make(map[string]string)
+	hist := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		id, err := bal.BalanceKey(key, nil)
+		if err != nil {
+			t.Fatalf("failed to balance key: %v.", err)
+		}
+		if again, _ := bal.BalanceKey(key, nil); again.Cmp(id) != 0 {
+			t.Fatalf("key %s owner mismatch: have %v, want %v.", key, again, id)
+		}
+		owners[key] = id.String()
+		hist[id.String()]++
+	}
+	for i, id := range ids {
+		if diff := math.Abs(float64(hist[id.String()]-keys/entities)) / float64(keys/entities); diff > 0.15 {
+			t.Fatalf("entity %d: unbalanced key share: have %v, want %v.", i, hist[id.String()], keys/entities)
+		}
+	}
+	// Remove an entity and check that only its keys moved
+	bal.Unregister(ids[0])
+	for key, owner := range owners {
+		id, err := bal.BalanceKey(key, nil)
+		if err != nil {
+			t.Fatalf("failed to balance key: %v.", err)
+		}
+		if owner != ids[0].String() && id.String() != owner {
+			t.Fatalf("key %s moved needlessly: have %v, want %v.", key, id, owner)
+		}
+	}
+	// Double the weight of an entity and check that keys only moved to it
+	bal.Weigh(ids[1], 2)
+	moved := 0
+	for key, owner := range owners {
+		if owner == ids[0].String() {
+			continue
+		}
+		id, _ := bal.BalanceKey(key, nil)
+		if id.String() != owner {
+			if id.Cmp(ids[1]) != 0 {
+				t.Fatalf("key %s moved to non-weighed entity: have %v, want %v.", key, id, ids[1])
+			}
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatalf("no keys moved to the heavier entity.")
+	}
+	// Check that exclusion works, unless it's the only entity
+	for key := range owners {
+		owner, _ := bal.BalanceKey(key, nil)
+		if id, _ := bal.BalanceKey(key, owner); id.Cmp(owner) == 0 {
+			t.Fatalf("key %s balanced to excluded entity %v.", key, owner)
+		}
+		break
+	}
+	single := New()
+	single.Register(ids[0])
+	if id, err := single.BalanceKey("key", ids[0]); err != nil || id.Cmp(ids[0]) != 0 {
+		t.Fatalf("single entity exclusion mismatch: have %v/%v, want %v.", id, err, ids[0])
+	}
+}
+
+// Tests the key movement of a two level topic tree, where the root balances the
+// keys between its edges weighed by member counts, and each edge between its own
+// members. A join into one edge moves 1/9 of the keys onto the new member (the
+// minimum), but also 1/18 from the other edge, spread over the joined one.
+func TestBalanceKeyTree(t *testing.T) {
+	keys := 20000
+
+	// Build a root with two edges, each holding four members
+	root := New()
+	edges := []*Balancer{New(), New()}
+	edgeIds := []*big.Int{big.NewInt(rand.Int63()), big.NewInt(rand.Int63())}
+	members := make(map[string]int)
+	for i, edge := range edges {
+		root.Register(edgeIds[i])
+		root.Weigh(edgeIds[i], 4)
+		for j := 0; j < 4; j++ {
+			id := big.NewInt(rand.Int63())
+			edge.Register(id)
+			members[id.String()] = i
+		}
+	}
+	resolve := func(key string) string {
+		edgeId, _ := root.BalanceKey(key, nil)
+		for i, id := range edgeIds {
+			if id.Cmp(edgeId) == 0 {
+				member, _ := edges[i].BalanceKey(key, nil)
+				return member.String()
+			}
+		}
+		panic("unknown edge")
+	}
+	owners := make(map[string]string)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners[key] = resolve(key)
+	}
+	// Join a new member into the first edge and count the moved keys
+	joined := big.NewInt(rand.Int63())
+	edges[0].Register(joined)
+	root.Weigh(edgeIds[0], 5)
+
+	moved, siblings := 0, 0
+	for key, owner := range owners {
+		now := resolve(key)
+		if now == owner {
+			continue
+		}
+		moved++
+		if now != joined.String() {
+			// Keys moving between old members must cross into the joined edge
+			if members[now] != 0 || members[owner] != 1 {
+				t.Fatalf("key %s moved within an edge: have %v, want %v.", key, now, owner)
+			}
+			siblings++
+		}
+	}
+	minimal := keys / 9
+	if siblings == 0 {
+		t.Fatalf("no keys moved onto the joined edge's old members.")
+	}
+	if limit := minimal + keys/18; moved > limit*11/10 {
+		t.Fatalf("moved key count mismatch: have %v, want at most %v (minimal %v).", moved, limit, minimal)
+	}
+}
+
+// Strategy always picking the last candidate.
+type lastStrategy struct{}
+
+func (s *lastStrategy) Pick(cands []*Candidate) int { return len(cands) - 1 }
+
+func TestStrategies(t *testing.T) {
+	// Generate a handful of nodes
+	ids := make([]*big.Int, 4)
+	for i := 0; i < len(ids); i++ {
+		ids[i] = big.NewInt(int64(i + 1))
+	}
+	bal := New()
+	for _, id := range ids {
+		bal.Register(id)
+	}
+	// Round robin should cycle through the entities, skipping the excluded one
+	if err := bal.Strategize(RoundRobin); err != nil {
+		t.Fatalf("failed to set round robin strategy: %v.", err)
+	}
+	for i := 0; i < 2*len(ids); i++ {
+		if id, err := bal.Balance(nil); err != nil || id.Cmp(ids[i%len(ids)]) != 0 {
+			t.Fatalf("round robin pick %d mismatch: have %v/%v, want %v.", i, id, err, ids[i%len(ids)])
+		}
+	}
+	for i := 0; i < 2*len(ids); i++ {
+		if id, _ := bal.Balance(ids[0]); id.Cmp(ids[0]) == 0 {
+			t.Fatalf("round robin pick %d: balanced to excluded entity.", i)
+		}
+	}
+	// Least pending should fill up the entities evenly, preferring the idle ones
+	if err := bal.Strategize(LeastPending); err != nil {
+		t.Fatalf("failed to set least pending strategy: %v.", err)
+	}
+	for i, id := range ids {
+		bal.UpdatePending(id, 10*i)
+	}
+	for i := 0; i < 10; i++ {
+		if id, _ := bal.Balance(nil); id.Cmp(ids[0]) != 0 {
+			t.Fatalf("least pending pick %d mismatch: have %v, want %v.", i, id, ids[0])
+		}
+	}
+	if pend := bal.Pending(nil); pend != 10+10+20+30 {
+		t.Fatalf("pending count mismatch: have %v, want %v.", pend, 10+10+20+30)
+	}
+	if pend := bal.Pending(ids[3]); pend != 10+10+20 {
+		t.Fatalf("excluded pending count mismatch: have %v, want %v.", pend, 10+10+20)
+	}
+	// Power of two should never pick the most loaded of the entities
+	if err := bal.Strategize(PowerOfTwo); err != nil {
+		t.Fatalf("failed to set power of two strategy: %v.", err)
+	}
+	for i, id := range ids {
+		bal.UpdatePending(id, 1000*i)
+	}
+	for i := 0; i < 100; i++ {
+		if id, _ := bal.Balance(nil); id.Cmp(ids[len(ids)-1]) == 0 {
+			t.Fatalf("power of two pick %d: balanced to the most loaded entity.", i)
+		}
+	}
+	// Unknown strategies should be rejected, registered ones accepted
+	if err := bal.Strategize("no-such-strategy"); err == nil {
+		t.Fatalf("unknown strategy accepted.")
+	}
+	RegisterStrategy("last", func() Strategy { return new(lastStrategy) })
+	if err := bal.Strategize("last"); err != nil {
+		t.Fatalf("failed to set custom strategy: %v.", err)
+	}
+	if id, _ := bal.Balance(nil); id.Cmp(ids[len(ids)-1]) != 0 {
+		t.Fatalf("custom strategy pick mismatch: have %v, want %v.", id, ids[len(ids)-1])
+	}
+}
+
+// Tests that concurrent balancing accounts for every message, with both stateless
+// and stateful strategies.
+func TestBalanceConcurrent(t *testing.T) {
+	workers, messages := 8, 1000
+
+	for _, strategy := range []string{WeightedRandom, RoundRobin} {
+		bal := New()
+		for i := 0; i < 4; i++ {
+			bal.Register(big.NewInt(int64(i + 1)))
+		}
+		if err := bal.Strategize(strategy); err != nil {
+			t.Fatalf("failed to set %s strategy: %v.", strategy, err)
+		}
+		var pend sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			pend.Add(1)
+			go func() {
+				defer pend.Done()
+				for j := 0; j < messages; j++ {
+					bal.Balance(nil)
+				}
+			}()
+		}
+		pend.Wait()
+
+		if have, want := bal.Pending(nil), workers*messages; have != want {
+			t.Fatalf("%s: pending count mismatch: have %v, want %v.", strategy, have, want)
+		}
+	}
+}
@@ -27,8 +27,11 @@ import (
 
 // Entity and related information.
 type entity struct {
-	id  *big.Int // Unique identifier of the entity
-	cap int      // Message capacity as reported by entity
+	id     *big.Int // Unique identifier of the entity
+	cap    int      // Message capacity as reported by entity
+	weight int      // Number of members behind the entity (key affinity share)
+	pend   int      // Outstanding messages as reported by entity
+	sent   int32    // Messages balanced to the entity since the last report (atomic)
 }
 
 // Entity slice implementing sort.Interface.
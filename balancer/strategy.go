@@ -0,0 +1,168 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the pluggable balancing strategies. A strategy picks the destination
+// of the next message out of the candidate entities, each described by its
+// reported capacity and its outstanding messages (as last reported, plus those
+// balanced to it since). Apart from the built-in ones, additional strategies can
+// be registered by name.
+
+package balancer
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sync"
+)
+
+// Names of the built-in balancing strategies.
+const (
+	WeightedRandom = "weighted-random" // Random pick, weighted by capacity (default)
+	PowerOfTwo     = "power-of-two"    // Less loaded of two random picks
+	RoundRobin     = "round-robin"     // Cycling through the entities in order
+	LeastPending   = "least-pending"   // Entity with the fewest outstanding messages
+)
+
+// Balancing state of a single entity, as exposed to the strategies.
+type Candidate struct {
+	Id       *big.Int // Unique identifier of the entity
+	Capacity int      // Message capacity as reported by the entity
+	Pending  int      // Outstanding messages (last reported plus balanced since)
+}
+
+// Strategy picking the destination of the next message. The candidates are never
+// empty, always in the same (id) order and only valid during the call. Calls are
+// serialized by the balancer, unless the strategy is Stateless.
+type Strategy interface {
+	// Returns the index of the chosen candidate.
+	Pick(cands []*Candidate) int
+}
+
+// Optional interface of the strategies keeping no state between picks, which
+// the balancer lets pick concurrently.
+type Stateless interface {
+	Strategy
+
+	// Marks the strategy as safe for concurrent use.
+	Stateless()
+}
+
+// Constructors of the available strategies.
+var strategies = map[string]func() Strategy{
+	WeightedRandom: func() Strategy { return new(weightedRandom) },
+	PowerOfTwo:     func() Strategy { return new(powerOfTwo) },
+	RoundRobin:     func() Strategy { return new(roundRobin) },
+	LeastPending:   func() Strategy { return new(leastPending) },
+}
+var strategiesLock sync.RWMutex
+
+// Registers a custom balancing strategy, overriding any existing one with the
+// same name.
+func RegisterStrategy(name string, maker func() Strategy) {
+	strategiesLock.Lock()
+	defer strategiesLock.Unlock()
+
+	strategies[name] = maker
+}
+
+// Creates a new instance of a named balancing strategy.
+func NewStrategy(name string) (Strategy, error) {
+	strategiesLock.RLock()
+	defer strategiesLock.RUnlock()
+
+	maker, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown balancing strategy: %s", name)
+	}
+	return maker(), nil
+}
+
+// Random pick proportional to the reported capacities.
+type weightedRandom struct{}
+
+func (s *weightedRandom) Stateless() {}
+
+func (s *weightedRandom) Pick(cands []*Candidate) int {
+	total := 0
+	for _, c := range cands {
+		total += c.Capacity
+	}
+	cap := rand.Intn(total)
+	for i, c := range cands {
+		if cap -= c.Capacity; cap < 0 {
+			return i
+		}
+	}
+	// Just in case to prevent bugs
+	panic("balanced out of bounds")
+}
+
+// Picks two distinct candidates at random, choosing the one with less load
+// relative to its capacity.
+type powerOfTwo struct{}
+
+func (s *powerOfTwo) Stateless() {}
+
+func (s *powerOfTwo) Pick(cands []*Candidate) int {
+	if len(cands) == 1 {
+		return 0
+	}
+	i := rand.Intn(len(cands))
+	j := rand.Intn(len(cands) - 1)
+	if j >= i {
+		j++
+	}
+	// Compare (pending+1)/capacity ratios without division
+	if (cands[i].Pending+1)*cands[j].Capacity <= (cands[j].Pending+1)*cands[i].Capacity {
+		return i
+	}
+	return j
+}
+
+// Cycles through the candidates in order.
+type roundRobin struct {
+	next int
+}
+
+func (s *roundRobin) Pick(cands []*Candidate) int {
+	idx := s.next % len(cands)
+	s.next = idx + 1
+	return idx
+}
+
+// Picks the candidate with the fewest outstanding messages, breaking ties at
+// random.
+type leastPending struct{}
+
+func (s *leastPending) Stateless() {}
+
+func (s *leastPending) Pick(cands []*Candidate) int {
+	best, ties := 0, 1
+	for i := 1; i < len(cands); i++ {
+		switch {
+		case cands[i].Pending < cands[best].Pending:
+			best, ties = i, 1
+		case cands[i].Pending == cands[best].Pending:
+			// Reservoir sample among the equally loaded ones
+			if ties++; rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	return best
+}
@@ -15,13 +15,15 @@
 // and conditions contained in a signed written agreement between you and the
 // author(s).
 
-// Package config contains the hard-coded configuration values of the system.
+// Package config contains the configuration values of the system. The node
+// local tunables have sane defaults, but can be overridden from a file via Load.
 package config
 
 import (
 	"crypto"
 	"crypto/aes"
 	"crypto/md5"
+	_ "crypto/sha256" // Registers the hash for ScribeAclHash
 	"math/big"
 	"time"
 )
@@ -139,6 +141,18 @@ var SessionCipherBits = 128
 // Hash creator for the session HMAC.
 var SessionHash = md5.New
 
+// Weakest cipher suite accepted during session and tunnel negotiation. The
+// default "legacy" keeps talking to nodes predating suite negotiation, whose STS
+// signatures, HKDF and HMAC use the hashes above, so that a cluster can upgrade
+// node by node; upgraded nodes still negotiate the strongest suite among each
+// other. As the legacy exchange cannot authenticate the offer, a man-in-the-middle
+// may force it between upgraded nodes sharing a cluster key (nodes with their own
+// identities detect it). Once no old nodes remain, raise the minimum (e.g. to
+// "sha256-aes128-gcm") to stop accepting the legacy exchange. The "x25519-" suites run the STS exchange over
+// Curve25519; requiring them spares the group exponentiations altogether, but
+// refuses nodes without elliptic curve support.
+var SessionMinSuite = "legacy"
+
 // Maximum allowed time to complete a session connection.
 var SessionDialTimeout = time.Second
 
@@ -160,6 +174,35 @@ var PacketCipher = aes.NewCipher
 // Key size for the temporary cipher (bits).
 var PacketCipherBits = 128
 
+// Runs the overlay on the IPv4 interface addresses.
+var NetIPv4 = true
+
+// Runs the overlay on the IPv6 (global and unique local) interface addresses.
+var NetIPv6 = false
+
+// Runs the overlay exclusively on the loopback interfaces (single host cluster).
+var NetLoopback = false
+
+// Consecutive IPv4 loopback addresses (from 127.0.0.1) the nodes spread over in
+// loopback mode, at most len(BootPorts) nodes sharing one. Set it to 1 on hosts
+// routing only 127.0.0.1 (e.g. OS X).
+var NetLoopbackHosts = 256
+
+// Interface names (glob patterns) to run the overlay on (empty = all).
+var NetAllowIfaces = []string(nil)
+
+// Interface names (glob patterns) never to run the overlay on.
+var NetDenyIfaces = []string(nil)
+
+// Networks (CIDR) to run the overlay on (empty = all).
+var NetAllowNets = []string(nil)
+
+// Networks (CIDR) never to run the overlay on.
+var NetDenyNets = []string(nil)
+
+// Host (IP or DNS name) to advertise to remote peers instead of the listener IPs.
+var NetAdvertise = ""
+
 // Bootstrapping ports to use.
 var BootPorts = []int{14142, 27182, 31415, 45654, 22222, 33333}
 
@@ -175,6 +218,12 @@ var BootSlowProbe = 1000
 // Scanning interval during bootstrapping (ms).
 var BootScan = 100
 
+// Link-local multicast group to probe on IPv6 networks (too large to scan).
+var BootGroup = "ff02::1:4952"
+
+// Multicast port to probe on IPv6 networks (must differ from the BootPorts).
+var BootGroupPort = 14141
+
 // Virtual address space (bits).
 var PastrySpace = 40
 
@@ -217,6 +266,15 @@ var PastryAuthThreads = 8
 // Maximum number of state exchanges allowed concurrently.
 var PastryExchThreads = 128
 
+// TCP port for the overlay session listeners (0 = random).
+var PastryListenPort = 0
+
+// Static peer addresses (host:port) to dial besides the bootstrapped ones.
+var PastrySeeds = []string(nil)
+
+// Retry period for dialing the static seeds if none of them are connected.
+var PastrySeedPeriod = time.Minute
+
 // Heartbeat period to distribute current CPU load and also check liveliness (ms).
 var ScribeBeatPeriod = time.Second
 
@@ -229,6 +287,37 @@ var ScribeSpace = 32
 // Number of messages to buffer for application delivery before dropping.
 var ScribeAppBuffer = 128
 
+// Roles of the local node, matched against the topic access control lists. Not
+// used with node identities, the roles being certified in the node certificate.
+var ScribeRoles = []string(nil)
+
+// Hash type for the topic access control list signatures.
+var ScribeAclHash = crypto.SHA256
+
+// Folder to persist the durable topic journals into (empty = memory only).
+var ScribeJournalDir = ""
+
+// Maximum number of events retained by a durable topic journal.
+var ScribeJournalCount = 10000
+
+// Maximum total payload size retained by a durable topic journal (bytes).
+var ScribeJournalSize = 64 * 1024 * 1024
+
+// Maximum size of a single persisted journal record (bytes).
+var ScribeJournalRecordLimit = 16 * 1024 * 1024
+
+// Maximum age of the events retained by a durable topic journal.
+var ScribeJournalAge = 24 * time.Hour
+
+// Number of leaf set neighbors to replicate the durable topic journals to.
+var ScribeJournalReplicas = 2
+
+// Time to wait for a subtree to acknowledge a reliable publish before resending.
+var ScribeAckTimeout = 2 * time.Second
+
+// Number of reliable publish retransmissions before giving up on a subtree.
+var ScribeAckRetries = 3
+
 // Number of sub-clusters an app cluster or topic is split into.
 var IrisClusterSplits = 5
 
@@ -244,6 +333,23 @@ var IrisTunnelInitTimeout = time.Second
 // Send and receive window for tunnel ordering and throttling.
 var IrisTunnelBuffer = 256
 
+// Topic name patterns to publish durably (journaled and replayable).
+var IrisDurableTopics = []string(nil)
+
+// Maximum time to wait for a durable topic replay to complete.
+var IrisReplayTimeout = 10 * time.Second
+
+// Period of the cluster census polls done by membership watchers to refresh the
+// capacity and catch members vanishing without a notice.
+var IrisPresencePoll = time.Second
+
+// Time a census of a wildcard index topic is trusted before being refreshed.
+var IrisIndexInterest = time.Second
+
+// Balancing strategies of clusters as "pattern=strategy" entries (first match).
+// Custom strategies must be registered with the balancer before booting Iris.
+var IrisClusterStrategies = []string(nil)
+
 // Use in case of federated applications.
 var AppParentId = []byte(nil)
 
@@ -264,3 +370,12 @@ var RelayTunnelTimeout = 3 * time.Second
 
 // Block time when trying a tunnel read.
 var RelayTunnelPoll = time.Second
+
+// Maximum time to wait for in-flight operations when draining the relay.
+var RelayDrainTimeout = 30 * time.Second
+
+// Access permissions (octal) of the relay's Unix domain socket.
+var RelaySocketMode = "0660"
+
+// Group owning the relay's Unix domain socket (empty = process default).
+var RelaySocketGroup = ""
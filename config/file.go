@@ -0,0 +1,471 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the configuration file loader, which allows overriding the tunable
+// parameters of a node without recompiling it. Both JSON and a flat subset of
+// TOML are accepted, the keys being the names of the configuration variables.
+//
+// Only node local tunables are exposed. Values that need to be identical on
+// every member of the network (crypto primitives, address space, cluster
+// splits, protocol version) stay hard-coded.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A single overridable configuration variable with its permitted range.
+type setting struct {
+	value interface{} // Pointer to the configuration variable
+	min   int64       // Minimum permitted value (or element value for lists)
+	max   int64       // Maximum permitted value (or element value for lists)
+}
+
+// Configuration variables that can be overridden from a file.
+var settings = map[string]*setting{
+	"SessionDialTimeout":   {&SessionDialTimeout, int64(10 * time.Millisecond), int64(time.Minute)},
+	"SessionAcceptTimeout": {&SessionAcceptTimeout, int64(10 * time.Millisecond), int64(time.Minute)},
+	"SessionShakeTimeout":  {&SessionShakeTimeout, int64(10 * time.Millisecond), int64(time.Minute)},
+	"SessionLinkTimeout":   {&SessionLinkTimeout, int64(10 * time.Millisecond), int64(time.Minute)},
+	"SessionGraceTimeout":  {&SessionGraceTimeout, int64(10 * time.Millisecond), int64(time.Minute)},
+	"SessionMinSuite":      {&SessionMinSuite, 0, 0},
+
+	"NetIPv4":          {&NetIPv4, 0, 0},
+	"NetIPv6":          {&NetIPv6, 0, 0},
+	"NetLoopback":      {&NetLoopback, 0, 0},
+	"NetLoopbackHosts": {&NetLoopbackHosts, 1, 1<<24 - 2},
+	"NetAllowIfaces":   {&NetAllowIfaces, 0, 0},
+	"NetDenyIfaces":    {&NetDenyIfaces, 0, 0},
+	"NetAllowNets":     {&NetAllowNets, 0, 0},
+	"NetDenyNets":      {&NetDenyNets, 0, 0},
+	"NetAdvertise":     {&NetAdvertise, 0, 0},
+
+	"BootPorts":       {&BootPorts, 1, 65535},
+	"BootBeatsBuffer": {&BootBeatsBuffer, 1, 65536},
+	"BootFastProbe":   {&BootFastProbe, 10, 60000},
+	"BootSlowProbe":   {&BootSlowProbe, 10, 600000},
+	"BootScan":        {&BootScan, 1, 60000},
+	"BootGroup":       {&BootGroup, 0, 0},
+	"BootGroupPort":   {&BootGroupPort, 1, 65535},
+
+	"PastryBootTimeout":   {&PastryBootTimeout, int64(100 * time.Millisecond), int64(10 * time.Minute)},
+	"PastryConvTimeout":   {&PastryConvTimeout, int64(10 * time.Millisecond), int64(10 * time.Minute)},
+	"PastryBeatPeriod":    {&PastryBeatPeriod, int64(100 * time.Millisecond), int64(10 * time.Minute)},
+	"PastryKillCount":     {&PastryKillCount, 1, 100},
+	"PastryAcceptTimeout": {&PastryAcceptTimeout, int64(10 * time.Millisecond), int64(time.Minute)},
+	"PastryInitTimeout":   {&PastryInitTimeout, int64(10 * time.Millisecond), int64(time.Minute)},
+	"PastrySendTimeout":   {&PastrySendTimeout, int64(10 * time.Millisecond), int64(time.Minute)},
+	"PastryNetBuffer":     {&PastryNetBuffer, 16, 128},
+	"PastryAuthThreads":   {&PastryAuthThreads, 1, 1024},
+	"PastryExchThreads":   {&PastryExchThreads, 1, 4096},
+	"PastryListenPort":    {&PastryListenPort, 0, 65535},
+	"PastrySeeds":         {&PastrySeeds, 0, 0},
+	"PastrySeedPeriod":    {&PastrySeedPeriod, int64(time.Second), int64(time.Hour)},
+
+	"ScribeBeatPeriod": {&ScribeBeatPeriod, int64(100 * time.Millisecond), int64(10 * time.Minute)},
+	"ScribeKillCount":  {&ScribeKillCount, 1, 100},
+	"ScribeAppBuffer":  {&ScribeAppBuffer, 1, 65536},
+	"ScribeRoles":      {&ScribeRoles, 0, 0},
+
+	"ScribeJournalDir":         {&ScribeJournalDir, 0, 0},
+	"ScribeJournalCount":       {&ScribeJournalCount, 1, 10000000},
+	"ScribeJournalSize":        {&ScribeJournalSize, 1024, 1024 * 1024 * 1024},
+	"ScribeJournalRecordLimit": {&ScribeJournalRecordLimit, 1024, 1024 * 1024 * 1024},
+	"ScribeJournalAge":         {&ScribeJournalAge, int64(time.Second), int64(365 * 24 * time.Hour)},
+	"ScribeJournalReplicas":    {&ScribeJournalReplicas, 0, 16},
+
+	"ScribeAckTimeout": {&ScribeAckTimeout, int64(10 * time.Millisecond), int64(10 * time.Minute)},
+	"ScribeAckRetries": {&ScribeAckRetries, 0, 100},
+
+	"IrisHandlerThreads":      {&IrisHandlerThreads, 1, 4096},
+	"IrisTunnelAcceptTimeout": {&IrisTunnelAcceptTimeout, int64(10 * time.Millisecond), int64(time.Minute)},
+	"IrisTunnelInitTimeout":   {&IrisTunnelInitTimeout, int64(10 * time.Millisecond), int64(time.Minute)},
+	"IrisTunnelBuffer":        {&IrisTunnelBuffer, 1, 65536},
+	"IrisDurableTopics":       {&IrisDurableTopics, 0, 0},
+	"IrisReplayTimeout":       {&IrisReplayTimeout, int64(100 * time.Millisecond), int64(10 * time.Minute)},
+	"IrisPresencePoll":        {&IrisPresencePoll, int64(100 * time.Millisecond), int64(10 * time.Minute)},
+	"IrisIndexInterest":       {&IrisIndexInterest, int64(100 * time.Millisecond), int64(10 * time.Minute)},
+	"IrisClusterStrategies":   {&IrisClusterStrategies, 0, 0},
+
+	"RelayHandlerThreads":   {&RelayHandlerThreads, 1, 4096},
+	"RelayTunnelChunkLimit": {&RelayTunnelChunkLimit, 1024, 16 * 1024 * 1024},
+	"RelayTunnelBuffer":     {&RelayTunnelBuffer, 1024, 1024 * 1024 * 1024},
+	"RelayTunnelTimeout":    {&RelayTunnelTimeout, int64(10 * time.Millisecond), int64(time.Minute)},
+	"RelayTunnelPoll":       {&RelayTunnelPoll, int64(10 * time.Millisecond), int64(time.Minute)},
+	"RelayDrainTimeout":     {&RelayDrainTimeout, 0, int64(time.Hour)},
+	"RelaySocketMode":       {&RelaySocketMode, 0, 0},
+	"RelaySocketGroup":      {&RelaySocketGroup, 0, 0},
+}
+
+// Loads a configuration file, validates all the contained values and if every
+// one of them is acceptable, overrides the defaults. On failure nothing is
+// modified. The format is selected based on the file extension (.json, .toml),
+// falling back to content sniffing otherwise.
+func Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); {
+	case ext == ".json":
+		values, err = parseJson(data)
+	case ext == ".toml":
+		values, err = parseToml(data)
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")):
+		values, err = parseJson(data)
+	default:
+		values, err = parseToml(data)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if err := apply(values); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Validates a batch of textual key-value pairs and applies them if all pass.
+func apply(values map[string]interface{}) error {
+	// Process the keys in a deterministic order to get stable error messages
+	keys := make([]string, 0, len(values))
+	for key, _ := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Convert and validate all the values before touching anything
+	updates := make([]func(), 0, len(keys))
+	for _, key := range keys {
+		set, ok := settings[key]
+		if !ok {
+			return fmt.Errorf("unknown configuration key: %s", key)
+		}
+		update, err := set.convert(values[key])
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+		updates = append(updates, update)
+	}
+	// Cross check the values which depend on each other
+	chunk, buffer := RelayTunnelChunkLimit, RelayTunnelBuffer
+	if v, ok := values["RelayTunnelChunkLimit"]; ok {
+		n, _ := toInt(v)
+		chunk = int(n)
+	}
+	if v, ok := values["RelayTunnelBuffer"]; ok {
+		n, _ := toInt(v)
+		buffer = int(n)
+	}
+	if buffer < chunk {
+		return fmt.Errorf("RelayTunnelBuffer (%d) smaller than RelayTunnelChunkLimit (%d)", buffer, chunk)
+	}
+	// Make sure the cluster strategy entries parse (names are resolved on boot)
+	if v, ok := values["IrisClusterStrategies"]; ok {
+		entries := []string{}
+		for _, item := range v.([]interface{}) {
+			entries = append(entries, item.(string))
+		}
+		if _, err := ParseStrategies(entries); err != nil {
+			return fmt.Errorf("invalid value for IrisClusterStrategies: %v", err)
+		}
+	}
+	// Everything checks out, override the defaults
+	for _, update := range updates {
+		update()
+	}
+	return nil
+}
+
+// Converts a raw value into the type of the configuration variable, checks its
+// range and returns a closure which applies the new value.
+func (s *setting) convert(raw interface{}) (func(), error) {
+	switch ptr := s.value.(type) {
+	case *int:
+		n, err := toInt(raw)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.check(n, fmt.Sprintf("%d", n)); err != nil {
+			return nil, err
+		}
+		return func() { *ptr = int(n) }, nil
+
+	case *time.Duration:
+		text, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("duration must be a string (e.g. \"3s\"), have %v", raw)
+		}
+		dur, err := time.ParseDuration(text)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.check(int64(dur), dur.String()); err != nil {
+			return nil, err
+		}
+		return func() { *ptr = dur }, nil
+
+	case *[]int:
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("list expected, have %v", raw)
+		}
+		if len(list) == 0 {
+			return nil, fmt.Errorf("empty list")
+		}
+		nums := make([]int, len(list))
+		for i, item := range list {
+			n, err := toInt(item)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.check(n, fmt.Sprintf("%d", n)); err != nil {
+				return nil, err
+			}
+			nums[i] = int(n)
+		}
+		return func() { *ptr = nums }, nil
+
+	case *string:
+		str, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("string expected, have %v", raw)
+		}
+		return func() { *ptr = str }, nil
+
+	case *bool:
+		flag, ok := raw.(bool)
+		if !ok {
+			return nil, fmt.Errorf("boolean expected, have %v", raw)
+		}
+		return func() { *ptr = flag }, nil
+
+	case *[]string:
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("list expected, have %v", raw)
+		}
+		strs := make([]string, len(list))
+		for i, item := range list {
+			str, ok := item.(string)
+			if !ok || str == "" {
+				return nil, fmt.Errorf("non-empty string expected, have %v", item)
+			}
+			strs[i] = str
+		}
+		return func() { *ptr = strs }, nil
+
+	default:
+		panic(fmt.Sprintf("unsupported configuration type: %T", s.value))
+	}
+}
+
+// Ensures a numeric value is within the permitted range of the setting.
+func (s *setting) check(n int64, text string) error {
+	if n < s.min || n > s.max {
+		if _, ok := s.value.(*time.Duration); ok {
+			return fmt.Errorf("%s out of range [%v, %v]", text, time.Duration(s.min), time.Duration(s.max))
+		}
+		return fmt.Errorf("%s out of range [%d, %d]", text, s.min, s.max)
+	}
+	return nil
+}
+
+// A parsed cluster balancing strategy entry.
+type StrategyRule struct {
+	Pattern  string // Glob pattern matching the cluster names
+	Strategy string // Balancing strategy of the matching clusters
+}
+
+// Parses "pattern=strategy" entries (see IrisClusterStrategies), checking the
+// syntax of the patterns. The strategy names are not resolved.
+func ParseStrategies(entries []string) ([]StrategyRule, error) {
+	rules := make([]StrategyRule, 0, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("entry %q: missing '='", entry)
+		}
+		rule := StrategyRule{
+			Pattern:  strings.TrimSpace(parts[0]),
+			Strategy: strings.TrimSpace(parts[1]),
+		}
+		if rule.Pattern == "" || rule.Strategy == "" {
+			return nil, fmt.Errorf("entry %q: empty pattern or strategy", entry)
+		}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("entry %q: %v", entry, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Converts a decoded numeric value into an integer, rejecting fractions.
+func toInt(raw interface{}) (int64, error) {
+	switch n := raw.(type) {
+	case int64:
+		return n, nil
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		return 0, fmt.Errorf("integer expected, have %v", n)
+	default:
+		return 0, fmt.Errorf("integer expected, have %v", raw)
+	}
+}
+
+// Parses a JSON configuration object into generic key-value pairs.
+func parseJson(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	values := make(map[string]interface{})
+	if err := dec.Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Parses a flat TOML configuration (key = value pairs, comments, strings,
+// integers, booleans and single line arrays) into generic key-value pairs.
+// Tables and multi-line constructs are not supported.
+func parseToml(data []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: tables not supported", i+1)
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: missing '='", i+1)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if key == "" {
+			return nil, fmt.Errorf("line %d: missing key", i+1)
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key: %s", i+1, key)
+		}
+		value, err := parseTomlValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// Parses a single TOML value: string, integer, boolean or an array of these.
+func parseTomlValue(text string) (interface{}, error) {
+	switch {
+	case text == "":
+		return nil, fmt.Errorf("missing value")
+
+	case text == "true" || text == "false":
+		return text == "true", nil
+
+	case strings.HasPrefix(text, "\""):
+		if len(text) < 2 || !strings.HasSuffix(text, "\"") {
+			return nil, fmt.Errorf("unterminated string: %s", text)
+		}
+		return strconv.Unquote(text)
+
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("unterminated array: %s", text)
+		}
+		list := []interface{}{}
+		for _, item := range splitArray(text[1 : len(text)-1]) {
+			value, err := parseTomlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+
+	default:
+		n, err := strconv.ParseInt(strings.Replace(text, "_", "", -1), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value: %s", text)
+		}
+		return n, nil
+	}
+}
+
+// Removes a trailing comment from a line, ignoring '#'s within strings.
+func stripComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case '#':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// Splits the contents of a single line array into its trimmed elements,
+// ignoring commas within strings and a trailing separator.
+func splitArray(text string) []string {
+	items := []string{}
+	quoted, start := false, 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				items = append(items, strings.TrimSpace(text[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if last := strings.TrimSpace(text[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
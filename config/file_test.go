@@ -0,0 +1,136 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Writes a configuration file into a temporary folder and loads it.
+func loadTemp(t *testing.T, name string, content string) error {
+	dir, err := ioutil.TempDir("", "iris-config")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config file: %v.", err)
+	}
+	return Load(path)
+}
+
+func TestLoadJson(t *testing.T) {
+	defer func(beat time.Duration, buffer int, ports []int) {
+		PastryBeatPeriod, ScribeAppBuffer, BootPorts = beat, buffer, ports
+	}(PastryBeatPeriod, ScribeAppBuffer, BootPorts)
+
+	config := `{
+		"PastryBeatPeriod": "5s",
+		"ScribeAppBuffer": 256,
+		"BootPorts": [10000, 20000]
+	}`
+	if err := loadTemp(t, "iris.json", config); err != nil {
+		t.Fatalf("failed to load config: %v.", err)
+	}
+	if PastryBeatPeriod != 5*time.Second {
+		t.Fatalf("beat period mismatch: have %v, want %v.", PastryBeatPeriod, 5*time.Second)
+	}
+	if ScribeAppBuffer != 256 {
+		t.Fatalf("app buffer mismatch: have %v, want %v.", ScribeAppBuffer, 256)
+	}
+	if !reflect.DeepEqual(BootPorts, []int{10000, 20000}) {
+		t.Fatalf("boot ports mismatch: have %v, want %v.", BootPorts, []int{10000, 20000})
+	}
+}
+
+func TestLoadToml(t *testing.T) {
+	defer func(beat time.Duration, threads int, ports []int, seeds []string, advertise string) {
+		ScribeBeatPeriod, IrisHandlerThreads, BootPorts, PastrySeeds, NetAdvertise = beat, threads, ports, seeds, advertise
+	}(ScribeBeatPeriod, IrisHandlerThreads, BootPorts, PastrySeeds, NetAdvertise)
+
+	config := `
+		# Staging overrides
+		ScribeBeatPeriod   = "500ms" # faster failure detection
+		IrisHandlerThreads = 32
+		BootPorts          = [ 10000, 20_000, ]
+		PastrySeeds        = ["10.0.1.5:40000", "seed.example.com:40000"]
+		NetAdvertise       = "node1.example.com"
+	`
+	if err := loadTemp(t, "iris.toml", config); err != nil {
+		t.Fatalf("failed to load config: %v.", err)
+	}
+	if ScribeBeatPeriod != 500*time.Millisecond {
+		t.Fatalf("beat period mismatch: have %v, want %v.", ScribeBeatPeriod, 500*time.Millisecond)
+	}
+	if IrisHandlerThreads != 32 {
+		t.Fatalf("handler threads mismatch: have %v, want %v.", IrisHandlerThreads, 32)
+	}
+	if !reflect.DeepEqual(BootPorts, []int{10000, 20000}) {
+		t.Fatalf("boot ports mismatch: have %v, want %v.", BootPorts, []int{10000, 20000})
+	}
+	if seeds := []string{"10.0.1.5:40000", "seed.example.com:40000"}; !reflect.DeepEqual(PastrySeeds, seeds) {
+		t.Fatalf("seeds mismatch: have %v, want %v.", PastrySeeds, seeds)
+	}
+	if NetAdvertise != "node1.example.com" {
+		t.Fatalf("advertised host mismatch: have %v, want %v.", NetAdvertise, "node1.example.com")
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"unknown.json", `{"PastryBeatPeriods": "3s"}`},
+		{"protocol.json", `{"PastrySpace": 64}`},
+		{"range.json", `{"ScribeAppBuffer": 0}`},
+		{"fraction.json", `{"ScribeAppBuffer": 1.5}`},
+		{"duration.json", `{"PastryBeatPeriod": 3}`},
+		{"ports.json", `{"BootPorts": [1, 70000]}`},
+		{"seeds.json", `{"PastrySeeds": ["10.0.1.5:40000", 40000]}`},
+		{"advertise.json", `{"NetAdvertise": 10}`},
+		{"relay.json", `{"RelayTunnelBuffer": 2048, "RelayTunnelChunkLimit": 4096}`},
+		{"strategy.json", `{"IrisClusterStrategies": ["api-*=round-robin", "db-*"]}`},
+		{"pattern.json", `{"IrisClusterStrategies": ["api-[=round-robin"]}`},
+		{"syntax.json", `{"ScribeAppBuffer": }`},
+		{"table.toml", "[pastry]\nPastryKillCount = 5"},
+		{"string.toml", `PastryBeatPeriod = "3s`},
+		{"duplicate.toml", "PastryKillCount = 5\nPastryKillCount = 6"},
+	}
+	for i, tt := range tests {
+		// Set the first valid value in the batch, which must be rolled back
+		defer func(count int) { PastryKillCount = count }(PastryKillCount)
+		content := tt.content
+		if filepath.Ext(tt.name) == ".json" {
+			content = `{"PastryKillCount": 99, ` + content[1:]
+		}
+		if err := loadTemp(t, tt.name, content); err == nil {
+			t.Fatalf("test %d (%s): invalid config accepted.", i, tt.name)
+		}
+		if PastryKillCount == 99 {
+			t.Fatalf("test %d (%s): partial config applied.", i, tt.name)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the per-node identities of a cluster: instead of sharing one cluster
+// key, each node has its own key pair and a certificate chain issued by the
+// cluster certificate authority (CA). Peers verify each other's chains against
+// the CA and its certificate revocation list (CRL), so a compromised node can be
+// banned individually by revoking its certificate.
+
+package keys
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+var ErrRevoked = errors.New("certificate revoked")
+
+// Certificate authority of a cluster, verifying node certificate chains.
+type Authority struct {
+	roots   *x509.CertPool      // Trusted CA certificates
+	cas     []*x509.Certificate // Same as above, for checking the CRL signatures
+	revoked map[string]struct{} // Serial numbers of the revoked certificates
+
+	caPath  string // Path of the CA certificates file (empty if not loaded)
+	crlPath string // Path of the revocation list file (empty if none)
+
+	lock sync.RWMutex
+}
+
+// Creates a certificate authority from in-memory CA certificates and optional
+// revocation lists signed by them.
+func NewAuthority(cas []*x509.Certificate, revoked ...*x509.RevocationList) (*Authority, error) {
+	auth := new(Authority)
+	if err := auth.install(cas, revoked); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// Loads a certificate authority from disk: one or more PEM encoded CA certificates
+// from a file, and an optional PEM or DER encoded revocation list.
+func LoadAuthority(caPath, crlPath string) (*Authority, error) {
+	auth := &Authority{
+		caPath:  caPath,
+		crlPath: crlPath,
+	}
+	if err := auth.Reload(); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// Reloads the CA certificates and revocation list the authority was loaded from.
+// If any of them fails to load, the current ones are retained.
+func (a *Authority) Reload() error {
+	if a.caPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(a.caPath)
+	if err != nil {
+		return err
+	}
+	cas, err := parseCertificates(data)
+	if err != nil {
+		return fmt.Errorf("CA certificates %s: %v", a.caPath, err)
+	}
+	crls := []*x509.RevocationList{}
+	if a.crlPath != "" {
+		data, err := ioutil.ReadFile(a.crlPath)
+		if err != nil {
+			return err
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return fmt.Errorf("revocation list %s: %v", a.crlPath, err)
+		}
+		crls = append(crls, crl)
+	}
+	return a.install(cas, crls)
+}
+
+// Checks the revocation lists against the CA certificates and swaps them in.
+func (a *Authority) install(cas []*x509.Certificate, crls []*x509.RevocationList) error {
+	if len(cas) == 0 {
+		return errors.New("no CA certificates")
+	}
+	roots := x509.NewCertPool()
+	for _, ca := range cas {
+		roots.AddCert(ca)
+	}
+	revoked := make(map[string]struct{})
+	for _, crl := range crls {
+		signed := false
+		for _, ca := range cas {
+			if crl.CheckSignatureFrom(ca) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return errors.New("revocation list not signed by any CA")
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[entry.SerialNumber.String()] = struct{}{}
+		}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.roots, a.cas, a.revoked = roots, cas, revoked
+	return nil
+}
+
+// Verifies a DER encoded certificate chain (leaf first) against the CA and the
+// revocation list, returning the leaf certificate if accepted.
+func (a *Authority) Verify(chain [][]byte) (*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate")
+	}
+	certs := make([]*x509.Certificate, len(chain))
+	for i, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, cert := range chains[0] {
+		if _, ok := a.revoked[cert.SerialNumber.String()]; ok {
+			return nil, ErrRevoked
+		}
+	}
+	return certs[0], nil
+}
+
+// Certified identity of a cluster node: its own private key and the certificate
+// chain binding it to the cluster CA. It implements crypto.Signer, signing with
+// the node key, so it can stand in for a cluster key anywhere.
+type Identity struct {
+	key   crypto.Signer     // Private key of the node
+	chain [][]byte          // DER encoded certificate chain, leaf first
+	leaf  *x509.Certificate // Parsed leaf certificate of the chain
+	auth  *Authority        // Authority verifying the own and remote chains
+
+	keyPath  string // Path of the private key file (empty if not loaded)
+	certPath string // Path of the certificate chain file (empty if not loaded)
+
+	lock sync.RWMutex
+}
+
+// Creates a node identity from an in-memory key and certificate chain, verifying
+// that the chain is accepted by the authority and certifies the key.
+func NewIdentity(key crypto.Signer, chain [][]byte, auth *Authority) (*Identity, error) {
+	id := &Identity{auth: auth}
+	if err := id.install(key, chain); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Loads a node identity from disk: the private key from a file and the PEM
+// encoded certificate chain (leaf first) from another.
+func LoadIdentity(keyPath, certPath string, auth *Authority) (*Identity, error) {
+	id := &Identity{
+		auth:     auth,
+		keyPath:  keyPath,
+		certPath: certPath,
+	}
+	if err := id.Reload(); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Reloads the authority, followed by the key and certificate chain files the
+// identity was loaded from. The node key itself must not change, only its chain
+// (e.g. renewed certificates). On failure the current identity is retained.
+func (id *Identity) Reload() error {
+	if err := id.auth.Reload(); err != nil {
+		return err
+	}
+	if id.keyPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(id.keyPath)
+	if err != nil {
+		return err
+	}
+	key, err := Parse(data)
+	if err != nil {
+		return fmt.Errorf("node key %s: %v", id.keyPath, err)
+	}
+	if data, err = ioutil.ReadFile(id.certPath); err != nil {
+		return err
+	}
+	certs, err := parseCertificates(data)
+	if err != nil {
+		return fmt.Errorf("node certificate %s: %v", id.certPath, err)
+	}
+	chain := make([][]byte, len(certs))
+	for i, cert := range certs {
+		chain[i] = cert.Raw
+	}
+	return id.install(key, chain)
+}
+
+// Checks the chain against the key and the authority, and swaps them in.
+func (id *Identity) install(key crypto.Signer, chain [][]byte) error {
+	leaf, err := id.auth.Verify(chain)
+	if err != nil {
+		return fmt.Errorf("node certificate: %v", err)
+	}
+	if pub, ok := key.Public().(interface {
+		Equal(crypto.PublicKey) bool
+	}); !ok || !pub.Equal(leaf.PublicKey) {
+		return errors.New("node certificate doesn't match node key")
+	}
+	id.lock.Lock()
+	defer id.lock.Unlock()
+
+	if id.key != nil {
+		if pub := id.key.Public().(interface {
+			Equal(crypto.PublicKey) bool
+		}); !pub.Equal(key.Public()) {
+			return errors.New("node key changed, restart required")
+		}
+	}
+	id.key, id.chain, id.leaf = key, chain, leaf
+	return nil
+}
+
+// Returns the private key of the node.
+func (id *Identity) Key() crypto.Signer {
+	id.lock.RLock()
+	defer id.lock.RUnlock()
+
+	return id.key
+}
+
+// Returns the DER encoded certificate chain of the node, leaf first.
+func (id *Identity) Chain() [][]byte {
+	id.lock.RLock()
+	defer id.lock.RUnlock()
+
+	return append([][]byte{}, id.chain...)
+}
+
+// Returns the leaf certificate of the node.
+func (id *Identity) Certificate() *x509.Certificate {
+	id.lock.RLock()
+	defer id.lock.RUnlock()
+
+	return id.leaf
+}
+
+// Verifies a remote certificate chain against the cluster authority.
+func (id *Identity) Verify(chain [][]byte) (*x509.Certificate, error) {
+	return id.auth.Verify(chain)
+}
+
+// Returns the public key of the node.
+func (id *Identity) Public() crypto.PublicKey {
+	return id.Key().Public()
+}
+
+// Signs a digest with the node key, following the conventions of Sign.
+func (id *Identity) Sign(random io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return Sign(random, id.Key(), opts.HashFunc(), digest)
+}
+
+// Parses a series of PEM encoded certificates.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+		data = rest
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM encoded certificates")
+	}
+	return certs, nil
+}
@@ -0,0 +1,175 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package keys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Creates a self signed CA certificate.
+func createCA(t *testing.T, name string) (crypto.Signer, *x509.Certificate) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v.", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return key, cert
+}
+
+// Creates a node key and certificate issued by a CA.
+func createNode(t *testing.T, caKey crypto.Signer, ca *x509.Certificate, serial int64) (crypto.Signer, []byte) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatalf("failed to create node certificate: %v.", err)
+	}
+	return key, der
+}
+
+// Creates a revocation list of the given serial numbers, signed by a CA.
+func createCRL(t *testing.T, caKey crypto.Signer, ca *x509.Certificate, serials ...int64) *x509.RevocationList {
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca, caKey)
+	if err != nil {
+		t.Fatalf("failed to create revocation list: %v.", err)
+	}
+	crl, _ := x509.ParseRevocationList(der)
+	return crl
+}
+
+func TestAuthority(t *testing.T) {
+	caKey, ca := createCA(t, "cluster")
+	badKey, bad := createCA(t, "rogue")
+
+	_, good := createNode(t, caKey, ca, 2)
+	_, revoked := createNode(t, caKey, ca, 3)
+	_, rogue := createNode(t, badKey, bad, 2)
+
+	auth, err := NewAuthority([]*x509.Certificate{ca}, createCRL(t, caKey, ca, 3))
+	if err != nil {
+		t.Fatalf("failed to create authority: %v.", err)
+	}
+	if _, err := auth.Verify([][]byte{good}); err != nil {
+		t.Fatalf("failed to verify valid certificate: %v.", err)
+	}
+	if _, err := auth.Verify([][]byte{revoked}); err != ErrRevoked {
+		t.Fatalf("revoked certificate verification mismatch: have %v, want %v.", err, ErrRevoked)
+	}
+	if _, err := auth.Verify([][]byte{rogue}); err == nil {
+		t.Fatalf("certificate of foreign CA verified.")
+	}
+	if _, err := auth.Verify(nil); err == nil {
+		t.Fatalf("missing certificate verified.")
+	}
+	// Revocation lists by foreign CAs should be rejected
+	if _, err := NewAuthority([]*x509.Certificate{ca}, createCRL(t, badKey, bad, 2)); err == nil {
+		t.Fatalf("foreign revocation list accepted.")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iris-identity")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caKey, ca := createCA(t, "cluster")
+	nodeKey, nodeCert := createNode(t, caKey, ca, 2)
+	otherKey, _ := createNode(t, caKey, ca, 3)
+
+	// Write out the CA, node key and certificate
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "node.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: nodeCert}), 0600)
+	writeKey(t, filepath.Join(dir, "node.key"), nodeKey)
+
+	auth, err := LoadAuthority(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.crl"))
+	if err == nil {
+		t.Fatalf("missing revocation list accepted.")
+	}
+	if auth, err = LoadAuthority(filepath.Join(dir, "ca.pem"), ""); err != nil {
+		t.Fatalf("failed to load authority: %v.", err)
+	}
+	id, err := LoadIdentity(filepath.Join(dir, "node.key"), filepath.Join(dir, "node.pem"), auth)
+	if err != nil {
+		t.Fatalf("failed to load identity: %v.", err)
+	}
+	checkSign(t, "identity", id)
+	if cert := id.Certificate(); cert.SerialNumber.Int64() != 2 {
+		t.Fatalf("certificate serial mismatch: have %v, want %v.", cert.SerialNumber, 2)
+	}
+	// Certificates not matching the key should be rejected
+	if _, err := NewIdentity(otherKey, [][]byte{nodeCert}, auth); err == nil {
+		t.Fatalf("mismatching node key accepted.")
+	}
+	// Key swaps on reload should be rejected, the identity retained
+	writeKey(t, filepath.Join(dir, "node.key"), otherKey)
+	if err := id.Reload(); err == nil {
+		t.Fatalf("node key swap accepted.")
+	}
+	if !id.Public().(ed25519.PublicKey).Equal(nodeKey.Public()) {
+		t.Fatalf("node key changed by failed reload.")
+	}
+	// Nodes with revoked certificates shouldn't be able to load their identity
+	crl := createCRL(t, caKey, ca, 2)
+	writeKey(t, filepath.Join(dir, "node.key"), nodeKey)
+	ioutil.WriteFile(filepath.Join(dir, "ca.crl"), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl.Raw}), 0600)
+
+	auth, _ = LoadAuthority(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.crl"))
+	if _, err := LoadIdentity(filepath.Join(dir, "node.key"), filepath.Join(dir, "node.pem"), auth); err == nil {
+		t.Fatalf("revoked node identity loaded.")
+	}
+}
@@ -0,0 +1,159 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Package keys loads the private keys authenticating the cluster members and
+// signs or verifies data with them, independent of the key algorithm.
+//
+// RSA, ECDSA and Ed25519 keys are supported, in PKCS #1 (RSA only), SEC 1 (ECDSA
+// only), PKCS #8 and unencrypted OpenSSH formats, either PEM armored or as plain
+// DER. RSA keys sign with PKCS #1 v1.5 and ECDSA keys with ASN.1 signatures over
+// the digest of the data, whereas Ed25519 keys sign the digest itself as the
+// message (keeping the API uniform).
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported key type")
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Parses a private key, auto-detecting both its encoding and algorithm.
+func Parse(data []byte) (crypto.Signer, error) {
+	// Try processing as PEM format
+	if block, _ := pem.Decode(data); block != nil {
+		if x509.IsEncryptedPEMBlock(block) {
+			return nil, errors.New("encrypted PEM keys are not supported")
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			return parsePKCS8(block.Bytes)
+		case "OPENSSH PRIVATE KEY":
+			return parseOpenSSH(block.Bytes)
+		default:
+			return nil, fmt.Errorf("unknown PEM block type: %s", block.Type)
+		}
+	}
+	// Give it a shot as simple binary DER
+	if key, err := x509.ParsePKCS1PrivateKey(data); err == nil {
+		return key, nil
+	}
+	if key, err := parsePKCS8(data); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(data); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("failed to parse key from both PEM and DER format")
+}
+
+// Parses a PKCS #8 private key, accepting only the signing algorithms.
+func parsePKCS8(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return key.(crypto.Signer), nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// Returns the name of the key algorithm, for logging and diagnostics.
+func Algorithm(key crypto.PublicKey) string {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA-" + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return "unknown"
+	}
+}
+
+// Signs the digest of some data (hashed with the given hash function).
+func Sign(random io.Reader, key crypto.Signer, hash crypto.Hash, digest []byte) ([]byte, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(random, key, hash, digest)
+	case *ecdsa.PrivateKey:
+		return ecdsa.SignASN1(random, key, digest)
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, digest), nil
+	case *Ring, *Identity:
+		return Sign(random, Unwrap(key), hash, digest)
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// Resolves the concrete key signing on behalf of a key ring (its primary key) or
+// node identity (the node key). Other keys are returned as is.
+func Unwrap(key crypto.Signer) crypto.Signer {
+	switch key := key.(type) {
+	case *Ring:
+		return key.Primary()
+	case *Identity:
+		return key.Key()
+	default:
+		return key
+	}
+}
+
+// Verifies a signature over the digest of some data (hashed with the given hash
+// function). If a Set is given, any of its keys may have made the signature.
+func Verify(key crypto.PublicKey, hash crypto.Hash, digest []byte, sig []byte) error {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, sig) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest, sig) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case Set:
+		for _, member := range key {
+			if Verify(member, hash, digest, sig) == nil {
+				return nil
+			}
+		}
+		return ErrInvalidSignature
+	default:
+		return ErrUnsupportedKey
+	}
+}
@@ -0,0 +1,234 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the parser of the OpenSSH private key format (openssh-key-v1), as
+// generated by ssh-keygen since version 7.8, and of the public key lines of the
+// authorized_keys files. Only unencrypted private keys are loaded.
+//
+// Reference: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+
+package keys
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Magic header of the OpenSSH private key format.
+const opensshMagic = "openssh-key-v1\x00"
+
+var errTruncated = errors.New("truncated OpenSSH key")
+
+// Wire format reader of the SSH primitive types.
+type sshReader struct {
+	data []byte
+	err  error
+}
+
+// Reads a 32 bit big endian integer.
+func (r *sshReader) uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 4 {
+		r.err = errTruncated
+		return 0
+	}
+	n := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return n
+}
+
+// Reads a length prefixed byte string.
+func (r *sshReader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	if uint32(len(r.data)) < n {
+		r.err = errTruncated
+		return nil
+	}
+	blob := r.data[:n]
+	r.data = r.data[n:]
+	return blob
+}
+
+// Reads a length prefixed, two's complement big integer (only positive ones).
+func (r *sshReader) mpint() *big.Int {
+	blob := r.bytes()
+	if len(blob) > 0 && blob[0]&0x80 != 0 {
+		r.err = errors.New("negative OpenSSH integer")
+	}
+	return new(big.Int).SetBytes(blob)
+}
+
+// Parses an unencrypted OpenSSH private key from the PEM block contents.
+func parseOpenSSH(data []byte) (crypto.Signer, error) {
+	if !bytes.HasPrefix(data, []byte(opensshMagic)) {
+		return nil, errors.New("invalid OpenSSH key magic")
+	}
+	r := &sshReader{data: data[len(opensshMagic):]}
+
+	cipher, kdf := string(r.bytes()), string(r.bytes())
+	r.bytes() // KDF options
+	count := r.uint32()
+	r.bytes() // Public key
+	r = &sshReader{data: r.bytes(), err: r.err}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if cipher != "none" || kdf != "none" {
+		return nil, errors.New("encrypted OpenSSH keys are not supported")
+	}
+	if count != 1 {
+		return nil, fmt.Errorf("unsupported OpenSSH key count: %d", count)
+	}
+	// Private section, guarded by two matching check integers
+	if check1, check2 := r.uint32(), r.uint32(); r.err == nil && check1 != check2 {
+		return nil, errors.New("corrupt OpenSSH key")
+	}
+	var key crypto.Signer
+	switch kind := string(r.bytes()); kind {
+	case "ssh-ed25519":
+		r.bytes() // Public key, embedded into the private one too
+		priv := r.bytes()
+		if r.err == nil && len(priv) != ed25519.PrivateKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		key = ed25519.PrivateKey(append([]byte{}, priv...))
+
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		curve, err := sshCurve(kind, string(r.bytes()))
+		if err != nil {
+			return nil, err
+		}
+		r.bytes() // Public point
+		d := r.mpint()
+		if r.err != nil {
+			return nil, r.err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if (d.BitLen()+7)/8 > size {
+			return nil, errors.New("invalid ECDSA key size")
+		}
+		ec, err := ecdsa.ParseRawPrivateKey(curve, d.FillBytes(make([]byte, size)))
+		if err != nil {
+			return nil, err
+		}
+		key = ec
+
+	case "ssh-rsa":
+		n, e, d := r.mpint(), r.mpint(), r.mpint()
+		r.mpint() // CRT coefficient, recalculated below
+		p, q := r.mpint(), r.mpint()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA public exponent")
+		}
+		rk := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		if err := rk.Validate(); err != nil {
+			return nil, err
+		}
+		rk.Precompute()
+		key = rk
+
+	default:
+		return nil, fmt.Errorf("unsupported OpenSSH key type: %s", kind)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return key, nil
+}
+
+// Parses an OpenSSH public key from its wire format (the base64 decoded middle
+// field of an authorized_keys line).
+func parseOpenSSHPublic(blob []byte) (crypto.PublicKey, error) {
+	r := &sshReader{data: blob}
+
+	var key crypto.PublicKey
+	switch kind := string(r.bytes()); kind {
+	case "ssh-ed25519":
+		pub := r.bytes()
+		if r.err == nil && len(pub) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		key = ed25519.PublicKey(append([]byte{}, pub...))
+
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		curve, err := sshCurve(kind, string(r.bytes()))
+		if err != nil {
+			return nil, err
+		}
+		point := r.bytes()
+		if r.err != nil {
+			return nil, r.err
+		}
+		ec, err := ecdsa.ParseUncompressedPublicKey(curve, point)
+		if err != nil {
+			return nil, err
+		}
+		key = ec
+
+	case "ssh-rsa":
+		e, n := r.mpint(), r.mpint()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA public exponent")
+		}
+		key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+	default:
+		return nil, fmt.Errorf("unsupported OpenSSH key type: %s", kind)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return key, nil
+}
+
+// Resolves the curve of an OpenSSH ECDSA key, checking that it matches the type.
+func sshCurve(kind, name string) (elliptic.Curve, error) {
+	if kind != "ecdsa-sha2-"+name {
+		return nil, errors.New("mismatching OpenSSH key curve")
+	}
+	switch name {
+	case "nistp256":
+		return elliptic.P256(), nil
+	case "nistp384":
+		return elliptic.P384(), nil
+	default:
+		return elliptic.P521(), nil
+	}
+}
@@ -0,0 +1,187 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the key ring of a cluster member, allowing the cluster key to be
+// rolled through a live network in phases:
+//   1. Add the new public key to every node's accepted set
+//   2. Switch the nodes' primary (signing) key to the new one
+//   3. Retire the old key from the accepted sets
+//
+// Each phase is applied by updating the key files on disk and reloading the
+// ring, no node ever having to reject a peer still in the previous phase.
+
+package keys
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Set of public keys, a signature made by any of them verifying.
+type Set []crypto.PublicKey
+
+// Key ring signing with a primary key and verifying with a set of accepted ones
+// (the primary included). It implements crypto.Signer, with Public returning
+// the accepted Set, so it can stand in for a single key anywhere.
+type Ring struct {
+	primary  crypto.Signer // Key signing all outgoing authentications
+	accepted Set           // Keys verifying incoming authentications
+
+	primaryPath string // Path of the primary key file (empty if not loaded)
+	acceptDir   string // Folder of the additionally accepted keys (empty if none)
+
+	lock sync.RWMutex
+}
+
+// Creates a key ring from an in-memory primary key and optional extra accepted
+// public keys.
+func NewRing(primary crypto.Signer, accepted ...crypto.PublicKey) *Ring {
+	return &Ring{
+		primary:  primary,
+		accepted: merge(primary, accepted),
+	}
+}
+
+// Loads a key ring from disk: the primary private key from a file, and the extra
+// accepted keys (public or private) from all the non-hidden files of a folder.
+func LoadRing(primaryPath, acceptDir string) (*Ring, error) {
+	ring := &Ring{
+		primaryPath: primaryPath,
+		acceptDir:   acceptDir,
+	}
+	if err := ring.Reload(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// Reloads the key files the ring was loaded from. If any of them fails to load,
+// the current keys are retained.
+func (r *Ring) Reload() error {
+	if r.primaryPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.primaryPath)
+	if err != nil {
+		return err
+	}
+	primary, err := Parse(data)
+	if err != nil {
+		return fmt.Errorf("primary key %s: %v", r.primaryPath, err)
+	}
+	accepted := []crypto.PublicKey{}
+	if r.acceptDir != "" {
+		files, err := ioutil.ReadDir(r.acceptDir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			path := filepath.Join(r.acceptDir, file.Name())
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			key, err := ParsePublic(data)
+			if err != nil {
+				return fmt.Errorf("accepted key %s: %v", path, err)
+			}
+			accepted = append(accepted, key)
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.primary, r.accepted = primary, merge(primary, accepted)
+	return nil
+}
+
+// Returns the primary key of the ring.
+func (r *Ring) Primary() crypto.Signer {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.primary
+}
+
+// Returns the set of currently accepted public keys, primary first.
+func (r *Ring) Public() crypto.PublicKey {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return append(Set{}, r.accepted...)
+}
+
+// Signs a digest with the primary key, following the conventions of Sign.
+func (r *Ring) Sign(random io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return Sign(random, r.Primary(), opts.HashFunc(), digest)
+}
+
+// Assembles an accepted set from a primary and extra keys, dropping duplicates.
+func merge(primary crypto.Signer, extra []crypto.PublicKey) Set {
+	set := Set{primary.Public()}
+	for _, key := range extra {
+		duplicate := false
+		for _, old := range set {
+			if eq, ok := old.(interface {
+				Equal(crypto.PublicKey) bool
+			}); ok && eq.Equal(key) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			set = append(set, key)
+		}
+	}
+	return set
+}
+
+// Parses a public key: PKIX or PKCS #1 PEM, a single OpenSSH public key line, or
+// any private key accepted by Parse (of which the public part is returned).
+func ParsePublic(data []byte) (crypto.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		switch block.Type {
+		case "PUBLIC KEY":
+			return x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			return x509.ParsePKCS1PublicKey(block.Bytes)
+		}
+	} else if fields := strings.Fields(string(data)); len(fields) >= 2 && (strings.HasPrefix(fields[0], "ssh-") || strings.HasPrefix(fields[0], "ecdsa-")) {
+		blob, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return parseOpenSSHPublic(blob)
+	}
+	key, err := Parse(data)
+	if err != nil {
+		return nil, errors.New("failed to parse public or private key")
+	}
+	return key.Public(), nil
+}
@@ -0,0 +1,168 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package keys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Public halves of the OpenSSH test keys, in authorized_keys format.
+var opensshPublicTests = []string{
+	"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINPniznK2AMq6PsGRY0nWbCQY41kzeACAMCCbVLahvWz",
+	"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBOJNvGzWp70BsjVQsyrbf4w8VAxTRJTS9vEf4mGKUUAtsK6c6pZiypXCN7IRgekX48pILxGOtXhEKNWrqgLyXu4=",
+	"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQC1bQ3Mg8oPIpiJksmk3LLq6OVBTFij8rvPobsS2RjCTbVi1bfr2zQLCpgzdgsj8FMcl/GQ9wSz9KnXiTHWwxodm0wA3DOmWNMSEOUZq3pdmoO5r0UMy3t7/En5VqxPMo7j9QxTc44wZIG79TdJZ1C7pBlrzFavBnwk00AkVjpJWw==",
+}
+
+func TestParsePublic(t *testing.T) {
+	for i, tt := range opensshTests {
+		priv, _ := Parse([]byte(tt.data))
+		pub, err := ParsePublic([]byte(opensshPublicTests[i]))
+		if err != nil {
+			t.Fatalf("test %d: failed to parse OpenSSH public key: %v.", i, err)
+		}
+		if !priv.Public().(interface {
+			Equal(crypto.PublicKey) bool
+		}).Equal(pub) {
+			t.Fatalf("test %d: public key mismatch.", i)
+		}
+		// Round trip through PKIX and the private key too
+		der, _ := x509.MarshalPKIXPublicKey(pub)
+		for j, data := range [][]byte{pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), []byte(tt.data)} {
+			if parsed, err := ParsePublic(data); err != nil {
+				t.Fatalf("test %d, encoding %d: failed to parse public key: %v.", i, j, err)
+			} else if Algorithm(parsed) != tt.algo {
+				t.Fatalf("test %d, encoding %d: algorithm mismatch: have %v, want %v.", i, j, Algorithm(parsed), tt.algo)
+			}
+		}
+	}
+}
+
+// Writes a PKCS #8 PEM encoded private key into a file.
+func writeKey(t *testing.T, path string, key crypto.Signer) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v.", err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write key: %v.", err)
+	}
+}
+
+// Writes a PKIX PEM encoded public key into a file.
+func writePublic(t *testing.T, path string, key crypto.PublicKey) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v.", err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write public key: %v.", err)
+	}
+}
+
+// Tests that a key can be rolled through two rings in phases, the rings always
+// accepting each other's signatures.
+func TestRingRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iris-keys")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	// Create two nodes with the old key as primary
+	rings := make([]*Ring, 2)
+	for i := 0; i < len(rings); i++ {
+		node := filepath.Join(dir, string('a'+rune(i)))
+		os.MkdirAll(filepath.Join(node, "accepted"), 0700)
+		writeKey(t, filepath.Join(node, "primary.pem"), oldKey)
+
+		if rings[i], err = LoadRing(filepath.Join(node, "primary.pem"), filepath.Join(node, "accepted")); err != nil {
+			t.Fatalf("node %d: failed to load key ring: %v.", i, err)
+		}
+	}
+	// Checks whether each ring accepts the signatures of the other
+	check := func(phase string, accept bool) {
+		digest := sha256.Sum256([]byte(phase))
+		for i, signer := range rings {
+			sig, err := Sign(rand.Reader, signer, crypto.SHA256, digest[:])
+			if err != nil {
+				t.Fatalf("%s: node %d: failed to sign: %v.", phase, i, err)
+			}
+			for j, verifier := range rings {
+				if err := Verify(verifier.Public(), crypto.SHA256, digest[:], sig); (err == nil) != (accept || i == j) {
+					t.Fatalf("%s: node %d signature verification by node %d: have %v, want accepted %v.", phase, i, j, err, accept || i == j)
+				}
+			}
+		}
+	}
+	check("initial", true)
+
+	// Phase 1: add the new key to the accepted sets
+	for i, ring := range rings {
+		writePublic(t, filepath.Join(dir, string('a'+rune(i)), "accepted", "new.pem"), newKey.Public())
+		if err := ring.Reload(); err != nil {
+			t.Fatalf("node %d: failed to reload key ring: %v.", i, err)
+		}
+	}
+	check("add", true)
+
+	// Phase 2: switch the primary key one node at a time
+	for i, ring := range rings {
+		node := filepath.Join(dir, string('a'+rune(i)))
+		writeKey(t, filepath.Join(node, "primary.pem"), newKey)
+		os.Remove(filepath.Join(node, "accepted", "new.pem"))
+		writePublic(t, filepath.Join(node, "accepted", "old.pem"), oldKey.Public())
+		if err := ring.Reload(); err != nil {
+			t.Fatalf("node %d: failed to reload key ring: %v.", i, err)
+		}
+		check("switch", true)
+	}
+	// Phase 3: retire the old key from the first node only, it should still talk
+	// to the second (both sign with the new key)
+	os.Remove(filepath.Join(dir, "a", "accepted", "old.pem"))
+	if err := rings[0].Reload(); err != nil {
+		t.Fatalf("failed to reload key ring: %v.", err)
+	}
+	check("retire", true)
+	if set := rings[0].Public().(Set); len(set) != 1 {
+		t.Fatalf("accepted set size mismatch: have %d, want %d.", len(set), 1)
+	}
+	// A corrupt key file should leave the ring intact
+	ioutil.WriteFile(filepath.Join(dir, "a", "accepted", "junk.pem"), []byte("junk"), 0600)
+	if err := rings[0].Reload(); err == nil {
+		t.Fatalf("corrupt key file accepted.")
+	}
+	if set := rings[0].Public().(Set); len(set) != 1 {
+		t.Fatalf("accepted set size mismatch after failed reload: have %d, want %d.", len(set), 1)
+	}
+	// Rings with disjoint keys shouldn't accept each other
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	rings[1] = NewRing(otherKey)
+	check("disjoint", false)
+}
@@ -21,7 +21,7 @@
 //
 // Although STS is a generic key exchange protocol, some assumptions were hard
 // coded into the implementation:
-//   The asymmetric signature algorithm is RSA
+//   The asymmetric signature algorithm is RSA, ECDSA or Ed25519 (see crypto/keys)
 //   The symmetric encryption uses CTR mode
 //   The stream crypto key and IV are expanded with HKDF from the master key
 //
@@ -31,18 +31,23 @@
 //   AES-128: 2248 bits
 //   AES-192: 5912 bits
 //   AES-256: 11920 bits
+//
+// Alternatively the exchange can run over an elliptic curve (X25519 or P-256),
+// matching AES-128 at a fraction of the finite field cost. The exponentials are
+// then the encoded public points, still passed around as big integers.
 package sts
 
 import (
 	"crypto"
 	"crypto/cipher"
-	"crypto/rsa"
+	"crypto/ecdh"
 	"errors"
 	"hash"
 	"io"
 	"math/big"
 
 	"code.google.com/p/go.crypto/hkdf"
+	"github.com/project-iris/iris/crypto/keys"
 )
 
 // Current step in the protocol to prevent user errors
@@ -63,6 +68,9 @@ type Session struct {
 	group     *big.Int
 	generator *big.Int
 
+	curve   ecdh.Curve
+	private *ecdh.PrivateKey
+
 	exponent   *big.Int
 	localExp   *big.Int
 	foreignExp *big.Int
@@ -71,6 +79,8 @@ type Session struct {
 	hash    crypto.Hash
 	crypter func([]byte) (cipher.Block, error)
 	keybits int
+
+	binding []byte
 }
 
 // Ensure unique key expansion for STS
@@ -109,28 +119,99 @@ func New(random io.Reader, group, generator *big.Int, cipher func([]byte) (ciphe
 	return ses, nil
 }
 
+// Creates a new STS session running over an elliptic curve instead of a cyclic group. Only X25519 and P-256 are
+// supported. The rest of the parameters are the same as for the finite field sessions.
+func NewCurve(random io.Reader, curve ecdh.Curve, cipher func([]byte) (cipher.Block, error),
+	bits int, hash crypto.Hash) (*Session, error) {
+	if curve != ecdh.X25519() && curve != ecdh.P256() {
+		return nil, errors.New("unsupported curve")
+	}
+	// Generate a random private scalar (retry if out of range for the curve)
+	secret := make([]byte, 32)
+	for {
+		n, err := io.ReadFull(random, secret)
+		if n != len(secret) || err != nil {
+			return nil, err
+		}
+		if key, err := curve.NewPrivateKey(secret); err == nil {
+			ses := new(Session)
+			ses.curve = curve
+			ses.private = key
+			ses.hash = hash
+			ses.crypter = cipher
+			ses.keybits = bits
+
+			return ses, nil
+		}
+	}
+}
+
 // Initiates an STS exchange session, returning the local exponential to connect with.
 func (s *Session) Initiate() (*big.Int, error) {
 	// Sanity check
 	if s.state != created {
 		return nil, errors.New("only a new session can initiate key exchanges")
 	}
-	s.localExp = new(big.Int).Exp(s.generator, s.exponent, s.group)
+	s.localExp = s.exponential()
 	s.state = initiated
 	return s.localExp, nil
 }
 
+// Calculates the local exponential (or public point in the curve case).
+func (s *Session) exponential() *big.Int {
+	if s.curve != nil {
+		return new(big.Int).SetBytes(s.private.PublicKey().Bytes())
+	}
+	return new(big.Int).Exp(s.generator, s.exponent, s.group)
+}
+
+// Calculates the shared secret from the foreign exponential (or public point).
+func (s *Session) agree(exp *big.Int) error {
+	if s.curve == nil {
+		s.secret = new(big.Int).Exp(exp, s.exponent, s.group)
+		return nil
+	}
+	size := len(s.private.PublicKey().Bytes())
+	if exp.Sign() < 0 || (exp.BitLen()+7)/8 > size {
+		return errors.New("invalid foreign exponential")
+	}
+	pub, err := s.curve.NewPublicKey(exp.FillBytes(make([]byte, size)))
+	if err != nil {
+		return err
+	}
+	shared, err := s.private.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	s.secret = new(big.Int).SetBytes(shared)
+	return nil
+}
+
+// Binds the session to a signature hash and some extra data agreed upon after session creation (e.g. a negotiated
+// cipher suite). The data is covered by the authorization tokens, so both sides must bind the same before exchanging
+// them, otherwise the verification fails.
+func (s *Session) Bind(hash crypto.Hash, data []byte) error {
+	// Sanity check
+	if s.state != created && s.state != initiated {
+		return errors.New("only a new or initiated session can be bound")
+	}
+	s.hash = hash
+	s.binding = append([]byte(nil), data...)
+	return nil
+}
+
 // Accepts an incoming STS exchange session, returning the local exponential and the authorization token. The key is
 // used to authenticate the token for teh other side, whilst the exp is the foreign exponential.
-func (s *Session) Accept(random io.Reader, key *rsa.PrivateKey, exp *big.Int) (*big.Int, []byte, error) {
+func (s *Session) Accept(random io.Reader, key crypto.Signer, exp *big.Int) (*big.Int, []byte, error) {
 	// Sanity check
 	if s.state != created {
 		return nil, nil, errors.New("only a new session can accept key exchange requests")
 	}
-	s.localExp = new(big.Int).Exp(s.generator, s.exponent, s.group)
+	s.localExp = s.exponential()
 	s.foreignExp = exp
-	s.secret = new(big.Int).Exp(exp, s.exponent, s.group)
-
+	if err := s.agree(exp); err != nil {
+		return nil, nil, err
+	}
 	token, err := s.genToken(random, key)
 	if err != nil {
 		return nil, nil, err
@@ -142,7 +223,7 @@ func (s *Session) Accept(random io.Reader, key *rsa.PrivateKey, exp *big.Int) (*
 // Verifies the authenticity of a remote STS acceptor and returns the local auth token if successful. The exp is the
 // foreign exponential used in calculating the token. pkey is used to verify the foreign signature whilst skey to
 // generate the local signature.
-func (s *Session) Verify(random io.Reader, skey *rsa.PrivateKey, pkey *rsa.PublicKey,
+func (s *Session) Verify(random io.Reader, skey crypto.Signer, pkey crypto.PublicKey,
 	exp *big.Int, token []byte) ([]byte, error) {
 	// Sanity check
 	if s.state != initiated {
@@ -150,7 +231,9 @@ func (s *Session) Verify(random io.Reader, skey *rsa.PrivateKey, pkey *rsa.Publi
 	}
 	// Verify the authorization token
 	s.foreignExp = exp
-	s.secret = new(big.Int).Exp(exp, s.exponent, s.group)
+	if err := s.agree(exp); err != nil {
+		return nil, err
+	}
 	err := s.verToken(pkey, token)
 	if err != nil {
 		return nil, err
@@ -166,7 +249,7 @@ func (s *Session) Verify(random io.Reader, skey *rsa.PrivateKey, pkey *rsa.Publi
 
 // Finalizes an STS key exchange by authenticating the initiator's token with the local public key. Returns nil error
 // if verification succeeded.
-func (s *Session) Finalize(key *rsa.PublicKey, token []byte) error {
+func (s *Session) Finalize(key crypto.PublicKey, token []byte) error {
 	// Sanity check
 	if s.state != accepted {
 		return errors.New("only an initiated session can verify the acceptor")
@@ -188,17 +271,19 @@ func (s *Session) Secret() ([]byte, error) {
 	return s.secret.Bytes(), nil
 }
 
-// Calculates the authorization token: the encrypted RSA signature of the two exponentials (local first!)
-func (s *Session) genToken(random io.Reader, key *rsa.PrivateKey) ([]byte, error) {
-	// Calculate the RSA signature
+// Calculates the authorization token: the encrypted signature of the two exponentials (local first!) and the bound
+// data
+func (s *Session) genToken(random io.Reader, key crypto.Signer) ([]byte, error) {
+	// Calculate the signature
 	hasher := s.hash.New()
 	hasher.Write(append(s.localExp.Bytes(), s.foreignExp.Bytes()...))
+	hasher.Write(s.binding)
 	hashsum := hasher.Sum(nil)
-	sig, err := rsa.SignPKCS1v15(random, key, s.hash, hashsum)
+	sig, err := keys.Sign(random, key, s.hash, hashsum)
 	if err != nil {
 		return nil, err
 	}
-	// Create a stream cipher and encrypt the RSA signature
+	// Create a stream cipher and encrypt the signature
 	stream, err := s.makeCipher()
 	if err != nil {
 		return nil, err
@@ -207,14 +292,16 @@ func (s *Session) genToken(random io.Reader, key *rsa.PrivateKey) ([]byte, error
 	return sig, nil
 }
 
-// Verify the authorization token: the encrypted RSA signature of the two exponentials (foreign first!)
-func (s *Session) verToken(key *rsa.PublicKey, token []byte) error {
+// Verify the authorization token: the encrypted signature of the two exponentials (foreign first!) and the bound
+// data
+func (s *Session) verToken(key crypto.PublicKey, token []byte) error {
 	// Calculate the required hash sum
 	hasher := s.hash.New()
 	hasher.Write(append(s.foreignExp.Bytes(), s.localExp.Bytes()...))
+	hasher.Write(s.binding)
 	hashsum := hasher.Sum(nil)
 
-	// Create the stream cipher and decrypt the RSA signature
+	// Create the stream cipher and decrypt the signature
 	stream, err := s.makeCipher()
 	if err != nil {
 		return err
@@ -222,7 +309,7 @@ func (s *Session) verToken(key *rsa.PublicKey, token []byte) error {
 	stream.XORKeyStream(token, token)
 
 	// Verify the signature
-	return rsa.VerifyPKCS1v15(key, s.hash, hashsum, token)
+	return keys.Verify(key, s.hash, hashsum, token)
 }
 
 // Extracts a usable sized symmetric key and IV for the stream cipher from the huge master key, and
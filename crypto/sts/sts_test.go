@@ -23,10 +23,12 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/des"
+	"crypto/ecdh"
 	_ "crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
 	_ "crypto/sha256"
+	"encoding/hex"
 	"math/big"
 	"testing"
 )
@@ -466,3 +468,126 @@ func TestSecret(t *testing.T) {
 		}
 	}
 }
+
+func TestBind(t *testing.T) {
+	iniKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	accKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	tt := stsTests[0]
+	for i, bind := range [][]byte{[]byte("suite"), []byte("other")} {
+		iniSes, _ := New(bytes.NewReader(tt.iniExponent.Bytes()), tt.group, tt.generator, tt.cipher, tt.bits, tt.hash)
+		accSes, _ := New(bytes.NewReader(tt.accExponent.Bytes()), tt.group, tt.generator, tt.cipher, tt.bits, tt.hash)
+		iniExp, _ := iniSes.Initiate()
+
+		// Bind the acceptor to a fixed value and the initiator to the current one
+		if err := accSes.Bind(crypto.SHA256, []byte("suite")); err != nil {
+			t.Fatalf("test %d: failed to bind acceptor: %v", i, err)
+		}
+		accExp, accToken, _ := accSes.Accept(rand.Reader, accKey, iniExp)
+		if err := accSes.Bind(crypto.SHA256, bind); err == nil {
+			t.Fatalf("test %d: accepted session rebound", i)
+		}
+		if err := iniSes.Bind(crypto.SHA256, bind); err != nil {
+			t.Fatalf("test %d: failed to bind initiator: %v", i, err)
+		}
+		_, err := iniSes.Verify(rand.Reader, iniKey, &accKey.PublicKey, accExp, accToken)
+		if i == 0 && err != nil {
+			t.Errorf("test %d: failed to verify matching binding: %v", i, err)
+		} else if i != 0 && err == nil {
+			t.Errorf("test %d: mismatching binding verified", i)
+		}
+	}
+}
+
+// X25519 test vectors from RFC 7748, section 6.1.
+var curveTest = struct {
+	iniPrivate string
+	iniPublic  string
+	accPrivate string
+	accPublic  string
+	secret     string
+}{
+	"77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a",
+	"8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a",
+	"5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb",
+	"de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f",
+	"4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742",
+}
+
+func TestCurve(t *testing.T) {
+	iniKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	accKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	decode := func(data string) []byte {
+		blob, _ := hex.DecodeString(data)
+		return blob
+	}
+	iniSes, err := NewCurve(bytes.NewReader(decode(curveTest.iniPrivate)), ecdh.X25519(), aes.NewCipher, 128, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("failed to create initiator session: %v", err)
+	}
+	accSes, err := NewCurve(bytes.NewReader(decode(curveTest.accPrivate)), ecdh.X25519(), aes.NewCipher, 128, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("failed to create acceptor session: %v", err)
+	}
+	iniExp, err := iniSes.Initiate()
+	if err != nil {
+		t.Fatalf("failed to initiate session: %v", err)
+	}
+	if have, want := iniExp, new(big.Int).SetBytes(decode(curveTest.iniPublic)); have.Cmp(want) != 0 {
+		t.Fatalf("initiator exponential mismatch: have %x, want %x", have, want)
+	}
+	accExp, accToken, err := accSes.Accept(rand.Reader, accKey, iniExp)
+	if err != nil {
+		t.Fatalf("failed to accept incoming exchange: %v", err)
+	}
+	if have, want := accExp, new(big.Int).SetBytes(decode(curveTest.accPublic)); have.Cmp(want) != 0 {
+		t.Fatalf("acceptor exponential mismatch: have %x, want %x", have, want)
+	}
+	iniToken, err := iniSes.Verify(rand.Reader, iniKey, &accKey.PublicKey, accExp, accToken)
+	if err != nil {
+		t.Fatalf("failed to verify auth token: %v", err)
+	}
+	if err := accSes.Finalize(&iniKey.PublicKey, iniToken); err != nil {
+		t.Fatalf("failed to finalize key exchange: %v", err)
+	}
+	iniSecret, _ := iniSes.Secret()
+	accSecret, _ := accSes.Secret()
+	if want := decode(curveTest.secret); !bytes.Equal(iniSecret, want) || !bytes.Equal(accSecret, want) {
+		t.Fatalf("secret mismatch: initiator %x, acceptor %x, want %x", iniSecret, accSecret, want)
+	}
+	// Make sure invalid points and unsupported curves are rejected
+	bad, _ := NewCurve(rand.Reader, ecdh.X25519(), aes.NewCipher, 128, crypto.SHA256)
+	if _, _, err := bad.Accept(rand.Reader, accKey, big.NewInt(0)); err == nil {
+		t.Fatalf("low order point accepted")
+	}
+	if _, err := NewCurve(rand.Reader, ecdh.P384(), aes.NewCipher, 128, crypto.SHA256); err == nil {
+		t.Fatalf("unsupported curve accepted")
+	}
+}
+
+func TestCurveP256(t *testing.T) {
+	iniKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	accKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	iniSes, _ := NewCurve(rand.Reader, ecdh.P256(), aes.NewCipher, 128, crypto.SHA256)
+	accSes, _ := NewCurve(rand.Reader, ecdh.P256(), aes.NewCipher, 128, crypto.SHA256)
+
+	iniExp, _ := iniSes.Initiate()
+	accExp, accToken, err := accSes.Accept(rand.Reader, accKey, iniExp)
+	if err != nil {
+		t.Fatalf("failed to accept incoming exchange: %v", err)
+	}
+	iniToken, err := iniSes.Verify(rand.Reader, iniKey, &accKey.PublicKey, accExp, accToken)
+	if err != nil {
+		t.Fatalf("failed to verify auth token: %v", err)
+	}
+	if err := accSes.Finalize(&iniKey.PublicKey, iniToken); err != nil {
+		t.Fatalf("failed to finalize key exchange: %v", err)
+	}
+	iniSecret, _ := iniSes.Secret()
+	accSecret, _ := accSes.Secret()
+	if !bytes.Equal(iniSecret, accSecret) {
+		t.Fatalf("secret mismatch: initiator %x, acceptor %x", iniSecret, accSecret)
+	}
+}
@@ -18,30 +18,62 @@
 package main
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	rng "math/rand"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
 	"strings"
+	"syscall"
 
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/crypto/keys"
 	"github.com/project-iris/iris/proto/iris"
+	"github.com/project-iris/iris/proto/link"
+	"github.com/project-iris/iris/service/admin"
 	"github.com/project-iris/iris/service/relay"
+	"github.com/project-iris/iris/system"
 )
 
 // Command line flags
 var devMode = flag.Bool("dev", false, "start in local developer mode (random cluster and key)")
-var relayPort = flag.Int("port", 55555, "relay endpoint for locally connecting clients")
+var relayPort = flag.Int("port", 55555, "relay endpoint for locally connecting clients (0 = disabled)")
+var socketPath = flag.String("socket", "", "path of a Unix domain socket relay endpoint, disabled if empty")
+var socketMode = flag.String("socketmode", "0660", "access permissions (octal) of the Unix socket relay endpoint")
+var socketGroup = flag.String("socketgroup", "", "group owning the Unix socket relay endpoint")
+var policyPath = flag.String("policy", "", "path to a JSON relay policy authenticating and authorizing clients")
+var aclPath = flag.String("acl", "", "path to a JSON topic access control list to sign and distribute")
+var aclAdmin = flag.String("acladmin", "", "path to the ACL authority key (public, or private on the node distributing -acl)")
+var nodeRoles = flag.String("roles", "", "comma separated roles of the node, checked against the topic ACLs (certified instead with -ca)")
+var durableTopics = flag.String("durable", "", "comma separated topic patterns to journal for replay")
+var journalDir = flag.String("journal", "", "folder to persist the durable topic journals into (empty = memory only)")
 var clusterName = flag.String("net", "", "name of the cluster to join or create")
-var rsaKeyPath = flag.String("rsa", "", "path to the RSA private key to use for data security")
+var rsaKeyPath = flag.String("rsa", "", "path to the cluster (or with -ca, node) private key (RSA, ECDSA or Ed25519; PKCS #1, PKCS #8, SEC 1 or OpenSSH)")
+var acceptDir = flag.String("keys", "", "folder of further (public) keys to accept from peers during key rotation, reloaded on SIGHUP")
+var caPath = flag.String("ca", "", "path to the cluster CA certificates (PEM), enabling per-node identities")
+var certPath = flag.String("cert", "", "path to the node certificate chain (PEM) signed by the cluster CA")
+var crlPath = flag.String("crl", "", "path to the cluster certificate revocation list (PEM or DER), reloaded on SIGHUP")
+var configPath = flag.String("config", "", "path to a JSON or TOML file overriding the default tunables")
+var seedList = flag.String("seeds", "", "comma separated peer addresses (host:port) to join through")
+var seedFile = flag.String("seedfile", "", "path to a file listing peer addresses to join through (one per line)")
+var peerPort = flag.Int("peerport", 0, "overlay listener port for remote peers (0 = random)")
+var ipv4 = flag.Bool("ipv4", true, "run the overlay on IPv4 interface addresses")
+var ipv6 = flag.Bool("ipv6", false, "run the overlay on IPv6 interface addresses")
+var loopback = flag.Bool("loopback", false, "run the overlay on the loopback interface only (single host cluster)")
+var allowIfaces = flag.String("ifaces", "", "comma separated interface names (globs) to run the overlay on")
+var denyIfaces = flag.String("noifaces", "", "comma separated interface names (globs) to never run the overlay on")
+var allowNets = flag.String("nets", "", "comma separated networks (CIDR) to run the overlay on")
+var denyNets = flag.String("nonets", "", "comma separated networks (CIDR) to never run the overlay on")
+var advertise = flag.String("advertise", "", "host to advertise to remote peers instead of the listener addresses")
+var adminAddr = flag.String("admin", "", "address (e.g. :8080) of the HTTP statistics server, disabled if empty")
 
 var cpuProfile = flag.String("cpuprof", "", "path to CPU profiling results")
 var heapProfile = flag.String("heapprof", "", "path to memory heap profiling results")
@@ -75,18 +107,107 @@ func usage() {
 }
 
 // Parses the command line flags and checks their validity
-func parseFlags() (int, string, *rsa.PrivateKey) {
-	var rsaKey *rsa.PrivateKey
+func parseFlags() (int, string, crypto.Signer) {
+	var clusterKey crypto.Signer
 
 	// Read the command line arguments
 	flag.Usage = usage
 	flag.Parse()
 
 	// Check the relay port range
-	if *relayPort <= 0 || *relayPort >= 65536 {
-		fmt.Fprintf(os.Stderr, "Invalid relay port: have %v, want [1-65535].\n", *relayPort)
+	if *relayPort < 0 || *relayPort >= 65536 {
+		fmt.Fprintf(os.Stderr, "Invalid relay port: have %v, want [0-65535].\n", *relayPort)
 		os.Exit(-1)
 	}
+	if *relayPort == 0 && *socketPath == "" {
+		fmt.Fprintf(os.Stderr, "No relay endpoint specified, need a port (-port) or socket (-socket).\n")
+		os.Exit(-1)
+	}
+	// Override the default tunables if a config file was specified
+	if *configPath != "" {
+		if err := config.Load(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Loading config file failed: %v.\n", err)
+			os.Exit(-1)
+		}
+	}
+	// Collect the static seeds, overriding any set in the config file
+	seeds := []string{}
+	if *seedList != "" {
+		seeds = append(seeds, splitList(*seedList)...)
+	}
+	if *seedFile != "" {
+		data, err := ioutil.ReadFile(*seedFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Reading seed file failed: %v.\n", err)
+			os.Exit(-1)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				seeds = append(seeds, line)
+			}
+		}
+	}
+	if len(seeds) > 0 {
+		config.PastrySeeds = seeds
+	}
+	for _, seed := range config.PastrySeeds {
+		if _, _, err := net.SplitHostPort(seed); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid seed address %v: %v.\n", seed, err)
+			os.Exit(-1)
+		}
+	}
+	// Override the peer listener port, network selection, roles and durability if explicitly requested
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ipv4":
+			config.NetIPv4 = *ipv4
+		case "ipv6":
+			config.NetIPv6 = *ipv6
+		case "loopback":
+			config.NetLoopback = *loopback
+		case "roles":
+			config.ScribeRoles = splitList(*nodeRoles)
+		case "durable":
+			config.IrisDurableTopics = splitList(*durableTopics)
+		case "journal":
+			config.ScribeJournalDir = *journalDir
+		case "ifaces":
+			config.NetAllowIfaces = splitList(*allowIfaces)
+		case "noifaces":
+			config.NetDenyIfaces = splitList(*denyIfaces)
+		case "nets":
+			config.NetAllowNets = splitList(*allowNets)
+		case "nonets":
+			config.NetDenyNets = splitList(*denyNets)
+		case "advertise":
+			config.NetAdvertise = *advertise
+		case "socketmode":
+			config.RelaySocketMode = *socketMode
+		case "socketgroup":
+			config.RelaySocketGroup = *socketGroup
+		case "peerport":
+			if *peerPort < 0 || *peerPort >= 65536 {
+				fmt.Fprintf(os.Stderr, "Invalid peer port: have %v, want [0-65535].\n", *peerPort)
+				os.Exit(-1)
+			}
+			config.PastryListenPort = *peerPort
+		}
+	})
+	if err := system.CheckNetConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid network selection: %v.\n", err)
+		os.Exit(-1)
+	}
+	// Make sure the minimum session suite exists, warning if still at legacy
+	if _, err := link.Lookup(config.SessionMinSuite); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid minimum session suite: %v.\n", err)
+		os.Exit(-1)
+	}
+	if config.SessionMinSuite == link.LegacySuite {
+		log.Printf("main: accepting the legacy %v based session suite, raise SessionMinSuite once all nodes are upgraded.", config.StsSigHash)
+	}
 	// User random cluster id and RSA key in developer mode
 	if *devMode {
 		// Generate a secure RSA key
@@ -97,7 +218,7 @@ func parseFlags() (int, string, *rsa.PrivateKey) {
 			os.Exit(-2)
 		} else {
 			fmt.Printf("done.\n")
-			rsaKey = key
+			clusterKey = keys.NewRing(key)
 		}
 		// Generate a probably unique cluster name
 		fmt.Printf("Generating random cluster name... ")
@@ -105,44 +226,95 @@ func parseFlags() (int, string, *rsa.PrivateKey) {
 		fmt.Printf("done.\n")
 		fmt.Println()
 	} else {
-		// Production mode, read the cluster id and RSA key from teh arguments
+		// Production mode, read the cluster id and private key from teh arguments
 		if *clusterName == "" {
 			fmt.Fprintf(os.Stderr, "No cluster specified (-net), did you intend developer mode (-dev)?\n")
 			os.Exit(-1)
 		}
 		if *rsaKeyPath == "" {
-			fmt.Fprintf(os.Stderr, "No RSA key specified (-rsa), did you intend developer mode (-dev)?\n")
+			fmt.Fprintf(os.Stderr, "No private key specified (-rsa), did you intend developer mode (-dev)?\n")
 			os.Exit(-1)
 		}
-		if rsaData, err := ioutil.ReadFile(*rsaKeyPath); err != nil {
-			fmt.Fprintf(os.Stderr, "Reading RSA key failed: %v.\n", err)
-			os.Exit(-1)
-		} else {
-			// Try processing as PEM format
-			if block, _ := pem.Decode(rsaData); block != nil {
-				if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
-					fmt.Fprintf(os.Stderr, "Parsing RSA key from PEM format failed: %v.\n", err)
-					os.Exit(-1)
-				} else {
-					rsaKey = key
-				}
+		if *caPath == "" {
+			if *certPath != "" || *crlPath != "" {
+				fmt.Fprintf(os.Stderr, "Node certificate or revocation list specified without a cluster CA (-ca).\n")
+				os.Exit(-1)
+			}
+			// Load the primary and accepted keys, detecting formats and algorithms automatically
+			if ring, err := keys.LoadRing(*rsaKeyPath, *acceptDir); err != nil {
+				fmt.Fprintf(os.Stderr, "Loading cluster keys failed: %v.\n", err)
+				os.Exit(-1)
 			} else {
-				// Give it a shot as simple binary DER
-				if key, err := x509.ParsePKCS1PrivateKey(rsaData); err != nil {
-					fmt.Fprintf(os.Stderr, "Failed to parse RSA key from both PEM and DER format.\n")
-					os.Exit(-1)
-				} else {
-					rsaKey = key
-				}
+				clusterKey = ring
+			}
+		} else {
+			if *certPath == "" {
+				fmt.Fprintf(os.Stderr, "No node certificate specified (-cert), required by the cluster CA (-ca).\n")
+				os.Exit(-1)
+			}
+			if *acceptDir != "" {
+				fmt.Fprintf(os.Stderr, "Accepted keys (-keys) cannot be combined with node identities (-ca).\n")
+				os.Exit(-1)
+			}
+			if *nodeRoles != "" {
+				fmt.Fprintf(os.Stderr, "Node roles (-roles) cannot be combined with node identities (-ca), certify them instead.\n")
+				os.Exit(-1)
 			}
+			// Load the cluster authority and the node's own certified identity
+			auth, err := keys.LoadAuthority(*caPath, *crlPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Loading cluster authority failed: %v.\n", err)
+				os.Exit(-1)
+			}
+			identity, err := keys.LoadIdentity(*rsaKeyPath, *certPath, auth)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Loading node identity failed: %v.\n", err)
+				os.Exit(-1)
+			}
+			clusterKey = identity
 		}
 	}
-	return *relayPort, *clusterName, rsaKey
+	return *relayPort, *clusterName, clusterKey
+}
+
+// Splits a comma separated flag value into its non-empty, trimmed elements.
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func main() {
 	// Extract the command line arguments
-	relayPort, clusterId, rsaKey := parseFlags()
+	relayPort, clusterId, clusterKey := parseFlags()
+	overlay := iris.New(clusterId, clusterKey)
+
+	// Reload the cluster keys on SIGHUP (from boot on), rolling key rotations and
+	// revocations through
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			switch key := clusterKey.(type) {
+			case *keys.Ring:
+				if err := key.Reload(); err != nil {
+					log.Printf("main: failed to reload cluster keys, keeping current ones: %v.", err)
+				} else {
+					log.Printf("main: reloaded cluster keys: %s primary, %d accepted.", keys.Algorithm(key.Primary().Public()), len(key.Public().(keys.Set)))
+				}
+			case *keys.Identity:
+				if err := key.Reload(); err != nil {
+					log.Printf("main: failed to reload node identity, keeping current one: %v.", err)
+				} else {
+					log.Printf("main: reloaded node identity, dropped %d revoked peers.", overlay.Revalidate())
+				}
+			}
+		}
+	}()
 
 	// Check for CPU profiling
 	if *cpuProfile != "" {
@@ -171,36 +343,102 @@ func main() {
 		defer pprof.Lookup("block").WriteTo(prof, 0)
 	}
 
+	// Load the topic access control list and its authority, if any, before joining the network
+	var acl *iris.Acl
+	aclKey := clusterKey
+	if *aclAdmin != "" {
+		data, err := ioutil.ReadFile(*aclAdmin)
+		if err != nil {
+			log.Fatalf("main: failed to read acl authority key: %v.", err)
+		}
+		admin, err := keys.ParsePublic(data)
+		if err != nil {
+			log.Fatalf("main: failed to parse acl authority key: %v.", err)
+		}
+		overlay.SetAclAuthority(admin)
+
+		if *aclPath != "" {
+			if aclKey, err = keys.Parse(data); err != nil {
+				log.Fatalf("main: distributing an acl needs the private authority key: %v.", err)
+			}
+		}
+	}
+	if *aclPath != "" {
+		var err error
+		if acl, err = iris.LoadAcl(*aclPath); err != nil {
+			log.Fatalf("main: failed to load topic acl: %v.", err)
+		}
+	}
 	// Create and boot a new carrier
 	log.Printf("main: booting iris overlay...")
-	overlay := iris.New(clusterId, rsaKey)
 	if peers, err := overlay.Boot(); err != nil {
 		log.Fatalf("main: failed to boot iris overlay: %v.", err)
 	} else {
 		log.Printf("main: iris overlay converged with %v remote connections.", peers)
 	}
+	if acl != nil {
+		if err := overlay.SetAcl(acl, aclKey); err != nil {
+			log.Fatalf("main: failed to distribute topic acl: %v.", err)
+		}
+	}
 	// Create and boot a new relay
 	log.Printf("main: booting relay service...")
-	rel, err := relay.New(relayPort, overlay)
+	rel, err := relay.New(relayPort, *socketPath, overlay)
 	if err != nil {
 		log.Fatalf("main: failed to create relay service: %v.", err)
 	}
+	if *policyPath != "" {
+		policy, err := relay.LoadPolicy(*policyPath)
+		if err != nil {
+			log.Fatalf("main: failed to load relay policy: %v.", err)
+		}
+		rel.SetPolicy(policy)
+	}
 	if err := rel.Boot(); err != nil {
 		log.Fatalf("main: failed to boot relay: %v.", err)
 	}
+	// Create and boot the admin server if requested
+	var adm *admin.Admin
+	if *adminAddr != "" {
+		log.Printf("main: booting admin service...")
+		adm = admin.New(*adminAddr, overlay, rel)
+		if err := adm.Boot(); err != nil {
+			log.Fatalf("main: failed to boot admin service: %v.", err)
+		}
+		log.Printf("main: admin service listening on %v.", adm.Addr())
+	}
 
-	// Capture termination signals
+	// Capture termination (interrupt) and drain (SIGTERM) signals
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
 	// Report success
-	log.Printf("main: iris successfully booted, listening on port %d.", relayPort)
+	switch {
+	case relayPort == 0:
+		log.Printf("main: iris successfully booted, listening on socket %s.", *socketPath)
+	case *socketPath == "":
+		log.Printf("main: iris successfully booted, listening on port %d.", relayPort)
+	default:
+		log.Printf("main: iris successfully booted, listening on port %d and socket %s.", relayPort, *socketPath)
+	}
 
 	// Wait for termination request, clean up and exit
-	<-quit
-	log.Printf("main: terminating relay service...")
-	if err := rel.Terminate(); err != nil {
-		log.Printf("main: failed to terminate relay service: %v.", err)
+	if sig := <-quit; sig == syscall.SIGTERM {
+		log.Printf("main: draining relay service (max %v)...", config.RelayDrainTimeout)
+		if err := rel.Drain(config.RelayDrainTimeout); err != nil {
+			log.Printf("main: failed to drain relay service: %v.", err)
+		}
+	} else {
+		log.Printf("main: terminating relay service...")
+		if err := rel.Terminate(); err != nil {
+			log.Printf("main: failed to terminate relay service: %v.", err)
+		}
+	}
+	if adm != nil {
+		log.Printf("main: terminating admin service...")
+		if err := adm.Terminate(); err != nil {
+			log.Printf("main: failed to terminate admin service: %v.", err)
+		}
 	}
 	log.Printf("main: terminating carrier...")
 	if err := overlay.Shutdown(); err != nil {
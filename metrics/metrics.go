@@ -0,0 +1,290 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Package metrics implements a minimal set of instrumentation primitives
+// (counters, gauges and histograms) which can be exported in the Prometheus
+// text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default latency buckets (seconds) for timing histograms.
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Valid metric name format.
+var nameFormat = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+// A single metric able to export itself.
+type metric interface {
+	write(w io.Writer, name string) error
+}
+
+// Metric with its description, as stored in the registry.
+type entry struct {
+	help string
+	kind string
+	data metric
+}
+
+// Collection of metrics exported together.
+type Registry struct {
+	metrics map[string]*entry
+	lock    sync.RWMutex
+}
+
+// Registry used by the package level constructors.
+var Default = NewRegistry()
+
+// Creates a new, empty metrics registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]*entry),
+	}
+}
+
+// Inserts a new metric into the registry. Invalid or duplicate names are
+// programming errors and cause a panic.
+func (r *Registry) register(name, help, kind string, data metric) {
+	if !nameFormat.MatchString(name) {
+		panic(fmt.Sprintf("invalid metric name: %s", name))
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("duplicate metric: %s", name))
+	}
+	r.metrics[name] = &entry{help: help, kind: kind, data: data}
+}
+
+// Creates and registers a new counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := new(Counter)
+	r.register(name, help, "counter", c)
+	return c
+}
+
+// Creates and registers a new gauge.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := new(Gauge)
+	r.register(name, help, "gauge", g)
+	return g
+}
+
+// Creates and registers a new histogram with the given upper bucket bounds.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.register(name, help, "histogram", h)
+	return h
+}
+
+// Writes all the registered metrics, ordered by name, in the Prometheus text
+// exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name, _ := range r.metrics {
+		names = append(names, name)
+	}
+	entries := make([]*entry, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		entries[i] = r.metrics[name]
+	}
+	r.lock.RUnlock()
+
+	buf := bufio.NewWriter(w)
+	for i, name := range names {
+		if _, err := fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(entries[i].help), name, entries[i].kind); err != nil {
+			return err
+		}
+		if err := entries[i].data.write(buf, name); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// Creates and registers a new counter in the default registry.
+func NewCounter(name, help string) *Counter {
+	return Default.NewCounter(name, help)
+}
+
+// Creates and registers a new gauge in the default registry.
+func NewGauge(name, help string) *Gauge {
+	return Default.NewGauge(name, help)
+}
+
+// Creates and registers a new histogram in the default registry.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
+
+// Writes all the metrics of the default registry.
+func Write(w io.Writer) error {
+	return Default.Write(w)
+}
+
+// Monotonically increasing counter.
+type Counter struct {
+	value uint64 // Current value (atomic, take care)
+}
+
+// Increments the counter by one.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Increments the counter by the given amount.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "%s %d\n", name, c.Value())
+	return err
+}
+
+// Arbitrary value that can go up and down.
+type Gauge struct {
+	bits uint64 // Float64 bits of the current value (atomic, take care)
+}
+
+// Sets the gauge to the given value.
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Adds the given (possibly negative) value to the gauge.
+func (g *Gauge) Add(v float64) {
+	addFloat(&g.bits, v)
+}
+
+// Increments the gauge by one.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Decrements the gauge by one.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) write(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "%s %s\n", name, formatFloat(g.Value()))
+	return err
+}
+
+// Distribution of observed values in cumulative buckets.
+type Histogram struct {
+	bounds []float64 // Upper bounds of the buckets (sorted, +Inf implicit)
+	counts []uint64  // Observations in each bucket, non-cumulative (atomic)
+	total  uint64    // Total number of observations (atomic)
+	sum    uint64    // Float64 bits of the observation sum (atomic)
+}
+
+// Creates a histogram with the given bucket bounds.
+func newHistogram(buckets []float64) *Histogram {
+	bounds := append([]float64{}, buckets...)
+	sort.Float64s(bounds)
+	if n := len(bounds); n > 0 && math.IsInf(bounds[n-1], 1) {
+		bounds = bounds[:n-1]
+	}
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Records a single observation.
+func (h *Histogram) Observe(v float64) {
+	atomic.AddUint64(&h.counts[sort.SearchFloat64s(h.bounds, v)], 1)
+	atomic.AddUint64(&h.total, 1)
+	addFloat(&h.sum, v)
+}
+
+// Returns the number of observations and their sum.
+func (h *Histogram) Value() (uint64, float64) {
+	return atomic.LoadUint64(&h.total), math.Float64frombits(atomic.LoadUint64(&h.sum))
+}
+
+func (h *Histogram) write(w io.Writer, name string) error {
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative); err != nil {
+			return err
+		}
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	count, sum := h.Value()
+	if count < cumulative {
+		count = cumulative // Racing observation, keep the output consistent
+	}
+	_, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", name, count, name, formatFloat(sum), name, count)
+	return err
+}
+
+// Atomically adds a value to a float64 stored as its bits.
+func addFloat(bits *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		if atomic.CompareAndSwapUint64(bits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Formats a float in the exposition format representation.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// Escapes the backslashes and newlines in a help string.
+func escapeHelp(help string) string {
+	return strings.Replace(strings.Replace(help, "\\", "\\\\", -1), "\n", "\\n", -1)
+}
@@ -0,0 +1,108 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package metrics
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	c := new(Counter)
+
+	var pend sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		pend.Add(1)
+		go func() {
+			defer pend.Done()
+			c.Inc()
+			c.Add(2)
+		}()
+	}
+	pend.Wait()
+
+	if v := c.Value(); v != 300 {
+		t.Fatalf("counter mismatch: have %v, want %v.", v, 300)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	g := new(Gauge)
+	g.Set(10)
+	g.Inc()
+	g.Add(-2.5)
+	g.Dec()
+	if v := g.Value(); v != 7.5 {
+		t.Fatalf("gauge mismatch: have %v, want %v.", v, 7.5)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 5, 10})
+	for _, v := range []float64{0.5, 1, 3, 7, 100} {
+		h.Observe(v)
+	}
+	if count, sum := h.Value(); count != 5 || sum != 111.5 {
+		t.Fatalf("histogram mismatch: have %v/%v, want %v/%v.", count, sum, 5, 111.5)
+	}
+	buf := new(bytes.Buffer)
+	if err := h.write(buf, "test"); err != nil {
+		t.Fatalf("failed to write histogram: %v.", err)
+	}
+	want := "test_bucket{le=\"1\"} 2\n" +
+		"test_bucket{le=\"5\"} 3\n" +
+		"test_bucket{le=\"10\"} 4\n" +
+		"test_bucket{le=\"+Inf\"} 5\n" +
+		"test_sum 111.5\n" +
+		"test_count 5\n"
+	if have := buf.String(); have != want {
+		t.Fatalf("histogram output mismatch: have\n%v\nwant\n%v", have, want)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewGauge("b_gauge", "Some gauge.").Set(-1)
+	reg.NewCounter("a_total", "Some\ncounter.").Add(3)
+
+	buf := new(bytes.Buffer)
+	if err := reg.Write(buf); err != nil {
+		t.Fatalf("failed to write registry: %v.", err)
+	}
+	want := "# HELP a_total Some\\ncounter.\n" +
+		"# TYPE a_total counter\n" +
+		"a_total 3\n" +
+		"# HELP b_gauge Some gauge.\n" +
+		"# TYPE b_gauge gauge\n" +
+		"b_gauge -1\n"
+	if have := buf.String(); have != want {
+		t.Fatalf("registry output mismatch: have\n%v\nwant\n%v", have, want)
+	}
+	// Ensure invalid registrations are caught
+	for _, name := range []string{"a_total", "1st", "with-dash"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("invalid metric name accepted: %v.", name)
+				}
+			}()
+			reg.NewCounter(name, "")
+		}()
+	}
+}
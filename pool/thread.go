@@ -118,6 +118,30 @@ func (t *ThreadPool) Clear() {
 	t.tasks.Reset()
 }
 
+// Returns the number of tasks waiting for a free worker.
+func (t *ThreadPool) Backlog() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.tasks == nil {
+		return 0
+	}
+	return t.tasks.Size()
+}
+
+// Returns the number of workers currently running tasks.
+func (t *ThreadPool) Busy() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.total - t.idle
+}
+
+// Returns the maximum number of concurrently running tasks.
+func (t *ThreadPool) Capacity() int {
+	return t.total
+}
+
 // Runs an initial task, fetching new ones until available.
 func (t *ThreadPool) runner(task Task) {
 	// Make sure the idle count is incremented back even if we panic
@@ -240,3 +240,43 @@ func TestTerminate(t *testing.T) {
 		}
 	}
 }
+
+// Tests that the queue depth and worker usage are reported correctly.
+func TestBacklog(t *testing.T) {
+	t.Parallel()
+
+	workers := 4
+	release := make(chan struct{})
+
+	// Create the pool and schedule more work than workers
+	pool := NewThreadPool(workers)
+	for i := 0; i < workers*3; i++ {
+		if err := pool.Schedule(func() { <-release }); err != nil {
+			t.Fatalf("failed to schedule task: %v.", err)
+		}
+	}
+	if backlog := pool.Backlog(); backlog != workers*3 {
+		t.Fatalf("unstarted backlog mismatch: have %d, want %d.", backlog, workers*3)
+	}
+	if busy := pool.Busy(); busy != 0 {
+		t.Fatalf("unstarted busy workers mismatch: have %d, want %d.", busy, 0)
+	}
+	// Start the pool and check that the workers took their share
+	pool.Start()
+	if backlog := pool.Backlog(); backlog != workers*2 {
+		t.Fatalf("started backlog mismatch: have %d, want %d.", backlog, workers*2)
+	}
+	if busy := pool.Busy(); busy != workers {
+		t.Fatalf("started busy workers mismatch: have %d, want %d.", busy, workers)
+	}
+	// Release all the tasks and wait for them to finish
+	close(release)
+	pool.Terminate(false)
+
+	if backlog := pool.Backlog(); backlog != 0 {
+		t.Fatalf("terminated backlog mismatch: have %d, want %d.", backlog, 0)
+	}
+	if busy := pool.Busy(); busy != 0 {
+		t.Fatalf("terminated busy workers mismatch: have %d, want %d.", busy, 0)
+	}
+}
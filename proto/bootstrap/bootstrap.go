@@ -21,21 +21,28 @@
 // In every scanning cycle all configured UDP ports are checked (to prevent
 // slowdowns due to large config space).
 //
+// IPv6 subnets are too large to probe randomly or scan linearly, so on those
+// interfaces the probes are sent to a link-local multicast group instead, and
+// the scanning is limited to the local host.
+//
 // Since the heartbeats are on UDP, each one is flagged as a beat request or
 // response (i.e. reply to requests, but don't loop indefinitely).
 package bootstrap
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"math/big"
 	"math/rand"
 	"net"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/gobber"
+	"github.com/project-iris/iris/system"
 )
 
 // Constants for the protocol UDP layer
@@ -63,6 +70,10 @@ type Bootstrapper struct {
 	sock *net.UDPConn
 	mask *net.IPMask
 
+	group *net.UDPAddr   // Multicast probe group (IPv6 only)
+	mcast *net.UDPConn   // Multicast probe listener (IPv6 only)
+	mgob  *gobber.Gobber // Datagram gobber for the multicast listener
+
 	magic    []byte // Filters side-by-side Iris networks
 	request  []byte // Pre-generated request packet
 	response []byte // Pre-generated response packet
@@ -80,29 +91,65 @@ type Bootstrapper struct {
 // is used to filter multiple Iris networks in the same physical network, while
 // the overlay is the TCP listener port of the DHT.
 func New(ipnet *net.IPNet, magic []byte, node *big.Int, overlay int) (*Bootstrapper, chan *Event, error) {
+	sock, err := listen(ipnet.IP)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewFromConn(ipnet, sock, magic, node, overlay)
+}
+
+// Opens the bootstrap socket of an interface ahead of creating the bootstrapper.
+// On an IPv4 loopback network, the first loopback address with a free primary
+// bootstrap port is claimed, so that the nodes of a single host cluster spread
+// over distinct addresses (the scan finds them on the neighboring ones). The
+// socket is held on to, preventing other processes from grabbing the address in
+// the meantime. The returned network holds the chosen address.
+func Listen(ipnet *net.IPNet) (*net.IPNet, *net.UDPConn, error) {
+	if len(config.BootPorts) > 0 {
+		for _, host := range system.LoopbackHosts(ipnet) {
+			sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: host.IP, Port: config.BootPorts[0]})
+			if err == nil {
+				return host, sock, nil
+			}
+			if !errors.Is(err, syscall.EADDRINUSE) {
+				break
+			}
+		}
+	}
+	sock, err := listen(ipnet.IP)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ipnet, sock, nil
+}
+
+// Opens a bootstrap socket on the first free configured port of an address.
+func listen(ip net.IP) (*net.UDPConn, error) {
+	for _, port := range config.BootPorts {
+		if sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port}); err == nil {
+			return sock, nil
+		}
+	}
+	return nil, fmt.Errorf("no available ports")
+}
+
+// Creates a new bootstrapper like New, but taking over an already opened socket
+// (see Listen) on the given interface.
+func NewFromConn(ipnet *net.IPNet, sock *net.UDPConn, magic []byte, node *big.Int, overlay int) (*Bootstrapper, chan *Event, error) {
 	bs := &Bootstrapper{
 		magic: magic,
 		beats: make(chan *Event, config.BootBeatsBuffer),
 		fast:  true,
+		sock:  sock,
+		addr:  &net.UDPAddr{IP: ipnet.IP, Port: sock.LocalAddr().(*net.UDPAddr).Port},
+		mask:  &ipnet.Mask,
 	}
-	// Open the server socket
-	var err error
-	for _, port := range config.BootPorts {
-		bs.addr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(ipnet.IP.String(), strconv.Itoa(port)))
-		if err != nil {
+	// Join the multicast probe group on non-loopback IPv6 interfaces
+	if ipnet.IP.To4() == nil && !ipnet.IP.IsLoopback() {
+		if err := bs.join(); err != nil {
+			bs.sock.Close()
 			return nil, nil, err
 		}
-		bs.sock, err = net.ListenUDP("udp", bs.addr)
-		if err != nil {
-			continue
-		} else {
-			bs.addr.Port = bs.sock.LocalAddr().(*net.UDPAddr).Port
-			bs.mask = &ipnet.Mask
-			break
-		}
-	}
-	if err != nil {
-		return nil, nil, fmt.Errorf("no available ports")
 	}
 	// Generate the local heartbeat messages (request and response)
 	bs.magic = magic
@@ -134,25 +181,78 @@ func New(ipnet *net.IPNet, magic []byte, node *big.Int, overlay int) (*Bootstrap
 	return bs, bs.beats, nil
 }
 
+// Joins the IPv6 multicast probe group on the interface owning the listener
+// address. If the interface is not multicast capable, the join is skipped.
+func (bs *Bootstrapper) join() error {
+	group := net.ParseIP(config.BootGroup)
+	if group == nil || !group.IsMulticast() {
+		return fmt.Errorf("invalid multicast group: %v", config.BootGroup)
+	}
+	iface, err := owner(bs.addr.IP)
+	if err != nil {
+		return err
+	}
+	if iface.Flags&net.FlagMulticast == 0 {
+		return nil
+	}
+	bs.group = &net.UDPAddr{IP: group, Port: config.BootGroupPort, Zone: iface.Name}
+	if bs.mcast, err = net.ListenMulticastUDP("udp6", iface, bs.group); err != nil {
+		return fmt.Errorf("failed to join multicast group: %v", err)
+	}
+	bs.mgob = gobber.New()
+	bs.mgob.Init(new(Message))
+	return nil
+}
+
+// Looks up the network interface owning a local IP address.
+func owner(ip net.IP) (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(ifaces); i++ {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no interface with address %v", ip)
+}
+
 // Starts accepting bootstrap events and initiates peer discovery.
 func (bs *Bootstrapper) Boot() error {
-	bs.quit = make(chan chan error, 3)
+	bs.quit = make(chan chan error, bs.routines())
 
 	go bs.accept()
 	go bs.probe()
 	go bs.scan()
-
+	if bs.mcast != nil {
+		go bs.listen()
+	}
 	return nil
 }
 
+// Returns the number of concurrent routines run by the bootstrapper.
+func (bs *Bootstrapper) routines() int {
+	if bs.mcast != nil {
+		return 4
+	}
+	return 3
+}
+
 // Closes the bootstrap listener and terminates all probing procedures.
 func (bs *Bootstrapper) Terminate() error {
 	// Make sure the bootstrapper was actually started
 	if bs.quit == nil {
 		return fmt.Errorf("non-booted bootstrapper")
 	}
-	// Retrieve three errors for the acceptor, prober and scanner routines
-	errc := make([]chan error, 3)
+	// Retrieve the errors for the acceptor, prober, scanner (and listener) routines
+	errc := make([]chan error, bs.routines())
 	errs := []error{}
 	for i := 0; i < len(errc); i++ {
 		errc[i] = make(chan error, 1)
@@ -163,6 +263,8 @@ func (bs *Bootstrapper) Terminate() error {
 			errs = append(errs, err)
 		}
 	}
+	close(bs.beats)
+
 	// Report the errors and return
 	switch len(errs) {
 	case 0:
@@ -196,35 +298,70 @@ func (bs *Bootstrapper) accept() {
 			// Wait for a UDP packet (with a reasonable timeout)
 			bs.sock.SetReadDeadline(time.Now().Add(acceptTimeout))
 			if size, from, err := bs.sock.ReadFromUDP(buf); err == nil {
-				msg := new(Message)
-				if err := bs.gob.Decode(buf[:size], msg); err == nil {
-					if config.ProtocolVersion == msg.Version && msg.Magic != nil && bytes.Compare(bs.magic, msg.Magic) == 0 {
-						// If it's a beat request, respond to it
-						if msg.Request {
-							bs.sock.WriteToUDP(bs.response, from)
-						}
-						// Notify the maintenance routine
-						host := net.JoinHostPort(from.IP.String(), strconv.Itoa(msg.Overlay))
-						if addr, err := net.ResolveTCPAddr("tcp", host); err == nil {
-							bs.beats <- &Event{
-								Peer: msg.NodeId,
-								Addr: addr,
-								Resp: !msg.Request,
-							}
-						}
-					}
-				}
+				bs.process(bs.gob, buf[:size], from)
 			}
 		}
 	}
 	// Clean up resources and report results
-	close(bs.beats)
 	errc <- bs.sock.Close()
 }
 
+// Multicast probe acceptor routine. It listens for beat requests sent to the
+// IPv6 probe group and processes them the same way as the unicast ones, apart
+// from skipping the local requests looped back by the network stack.
+func (bs *Bootstrapper) listen() {
+	buf := make([]byte, 1500) // UDP MTU
+	var errc chan error
+
+	// Repeat the packet processing until termination is requested
+	for errc == nil {
+		select {
+		case errc = <-bs.quit:
+			break
+		default:
+			// Wait for a UDP packet (with a reasonable timeout)
+			bs.mcast.SetReadDeadline(time.Now().Add(acceptTimeout))
+			if size, from, err := bs.mcast.ReadFromUDP(buf); err == nil {
+				if !from.IP.Equal(bs.addr.IP) || from.Port != bs.addr.Port {
+					bs.process(bs.mgob, buf[:size], from)
+				}
+			}
+		}
+	}
+	// Clean up resources and report results
+	errc <- bs.mcast.Close()
+}
+
+// Decodes a bootstrap packet and verifies that the protocol version and magic
+// number match the local one. If so, beat requests are responded to and the
+// remote overlay's address reported to the maintenance thread.
+func (bs *Bootstrapper) process(gob *gobber.Gobber, packet []byte, from *net.UDPAddr) {
+	msg := new(Message)
+	if err := gob.Decode(packet, msg); err != nil {
+		return
+	}
+	if config.ProtocolVersion != msg.Version || msg.Magic == nil || bytes.Compare(bs.magic, msg.Magic) != 0 {
+		return
+	}
+	// If it's a beat request, respond to it
+	if msg.Request {
+		bs.sock.WriteToUDP(bs.response, from)
+	}
+	// Notify the maintenance routine
+	host := net.JoinHostPort(from.IP.String(), strconv.Itoa(msg.Overlay))
+	if addr, err := net.ResolveTCPAddr("tcp", host); err == nil {
+		bs.beats <- &Event{
+			Peer: msg.NodeId,
+			Addr: addr,
+			Resp: !msg.Request,
+		}
+	}
+}
+
 // Sends heartbeat messages to random hosts on the listener-local address. The
 // IP addresses are generated uniformly inside the subnet and all ports in the
-// config array are tried simultaneously. Self connection is disabled.
+// config array are tried simultaneously. Self connection is disabled. On IPv6
+// networks a single request is multicast to the probe group instead.
 func (bs *Bootstrapper) probe() {
 	// Set up some initial parameters
 	ones, bits := bs.mask.Size()
@@ -240,26 +377,21 @@ func (bs *Bootstrapper) probe() {
 		case errc = <-bs.quit:
 			break
 		default:
-			// Generate a random IP address within the subnet (ignore net and bcast)
-			host := bs.addr.IP
-			for host.Equal(bs.addr.IP) {
-				subip := rand.Intn(1<<uint(bits-ones)-2) + 1
-				host = bs.addr.IP.Mask(*bs.mask)
-				for i := len(host) - 1; i >= 0; i-- {
-					host[i] |= byte(subip & 255)
-					subip >>= 8
-				}
-			}
-			// Iterate over every bootstrap port
-			for _, port := range config.BootPorts {
-				dest := net.JoinHostPort(host.String(), strconv.Itoa(port))
-
-				// Resolve the address, connect to it and send a beat request
-				raddr, err := net.ResolveUDPAddr("udp", dest)
-				if err != nil {
-					panic(fmt.Sprintf("failed to resolve remote bootstrapper (%v): %v.", dest, err))
+			if bs.group != nil {
+				// Multicast a beat request to the IPv6 probe group
+				bs.sock.WriteToUDP(bs.request, bs.group)
+			} else if bs.addr.IP.To4() != nil {
+				// Generate a random IP address within the subnet (ignore net and bcast)
+				host := bs.addr.IP
+				for host.Equal(bs.addr.IP) {
+					subip := rand.Intn(1<<uint(bits-ones)-2) + 1
+					host = bs.addr.IP.Mask(*bs.mask)
+					for i := len(host) - 1; i >= 0; i-- {
+						host[i] |= byte(subip & 255)
+						subip >>= 8
+					}
 				}
-				bs.sock.WriteToUDP(bs.request, raddr)
+				bs.beacon(host)
 			}
 			// Wait for the next cycle
 			var wake <-chan time.Time
@@ -279,8 +411,15 @@ func (bs *Bootstrapper) probe() {
 }
 
 // Scans the network linearly from the current address, sending heartbeat
-// messages. Self connection is disabled.
+// messages. Self connection is disabled. On IPv6 networks only the local host
+// is scanned (i.e. multiple nodes on the same machine).
 func (bs *Bootstrapper) scan() {
+	if bs.addr.IP.To4() == nil {
+		bs.beacon(bs.addr.IP)
+		errc := <-bs.quit
+		errc <- nil
+		return
+	}
 	// Set up some initial parameters
 	size := len(bs.addr.IP)
 	ones, bits := bs.mask.Size()
@@ -326,21 +465,8 @@ func (bs *Bootstrapper) scan() {
 				host[i] |= byte(scanip & 255)
 				scanip >>= 8
 			}
-			// Iterate over every bootstrap port
-			for _, port := range config.BootPorts {
-				// Don't connect to ourselves
-				if port == bs.addr.Port && host.Equal(bs.addr.IP) {
-					continue
-				}
-				dest := net.JoinHostPort(host.String(), strconv.Itoa(port))
+			bs.beacon(host)
 
-				// Resolve the address, connect to it and send a beat request
-				raddr, err := net.ResolveUDPAddr("udp", dest)
-				if err != nil {
-					panic(fmt.Sprintf("failed to resolve remote bootstrapper (%v): %v.", dest, err))
-				}
-				bs.sock.WriteToUDP(bs.request, raddr)
-			}
 			// Wait for the next cycle
 			select {
 			case errc = <-bs.quit:
@@ -354,3 +480,22 @@ func (bs *Bootstrapper) scan() {
 	}
 	errc <- nil
 }
+
+// Sends a beat request to every bootstrap port of a remote host. Self connection
+// is disabled.
+func (bs *Bootstrapper) beacon(host net.IP) {
+	for _, port := range config.BootPorts {
+		// Don't connect to ourselves
+		if port == bs.addr.Port && host.Equal(bs.addr.IP) {
+			continue
+		}
+		dest := net.JoinHostPort(host.String(), strconv.Itoa(port))
+
+		// Resolve the address, connect to it and send a beat request
+		raddr, err := net.ResolveUDPAddr("udp", dest)
+		if err != nil {
+			panic(fmt.Sprintf("failed to resolve remote bootstrapper (%v): %v.", dest, err))
+		}
+		bs.sock.WriteToUDP(bs.request, raddr)
+	}
+}
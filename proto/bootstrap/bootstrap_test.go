@@ -49,6 +49,38 @@ func TestPortSelection(t *testing.T) {
 	}
 }
 
+// Tests that loopback bootstrap sockets spread over distinct addresses, holding
+// on to each claimed one.
+func TestLoopbackListen(t *testing.T) {
+	ipnet := &net.IPNet{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Mask: net.IPv4Mask(0xff, 0, 0, 0),
+	}
+	first, sock1, err := Listen(ipnet)
+	if err != nil {
+		t.Fatalf("failed to claim first loopback socket: %v.", err)
+	}
+	defer sock1.Close()
+
+	second, sock2, err := Listen(ipnet)
+	if err != nil {
+		t.Fatalf("failed to claim second loopback socket: %v.", err)
+	}
+	defer sock2.Close()
+
+	if first.IP.Equal(second.IP) {
+		t.Fatalf("loopback address reused: have %v, want distinct.", second.IP)
+	}
+	for i, pair := range []struct {
+		ipnet *net.IPNet
+		sock  *net.UDPConn
+	}{{first, sock1}, {second, sock2}} {
+		if addr := pair.sock.LocalAddr().(*net.UDPAddr); !addr.IP.Equal(pair.ipnet.IP) || addr.Port != config.BootPorts[0] {
+			t.Fatalf("socket %d: address mismatch: have %v, want %v:%v.", i, addr, pair.ipnet.IP, config.BootPorts[0])
+		}
+	}
+}
+
 func TestBroadcastPanic(t *testing.T) {
 	// Create the localhost IP net
 	ipnet := &net.IPNet{
@@ -178,3 +210,48 @@ func TestMagic(t *testing.T) {
 
 // Missing test for probing. A bit complicated as a small subnet is needed with
 // scanning disabled. Delay for now.
+
+func TestScanIPv6(t *testing.T) {
+	// Define some local constants
+	over1, _ := net.ResolveTCPAddr("tcp", "[::1]:33333")
+	over2, _ := net.ResolveTCPAddr("tcp", "[::1]:55555")
+	ipnet := &net.IPNet{
+		IP:   net.IPv6loopback,
+		Mask: net.CIDRMask(128, 128),
+	}
+	// Start up two bootstrappers on the same host
+	bs1, evs1, err := New(ipnet, []byte("magic"), big.NewInt(1), over1.Port)
+	if err != nil {
+		t.Skipf("IPv6 unavailable: %v.", err)
+	}
+	if err := bs1.Boot(); err != nil {
+		t.Fatalf("failed to boot first booter: %v.", err)
+	}
+	defer bs1.Terminate()
+
+	bs2, evs2, err := New(ipnet, []byte("magic"), big.NewInt(2), over2.Port)
+	if err != nil {
+		t.Fatalf("failed to create second booter: %v.", err)
+	}
+	if err := bs2.Boot(); err != nil {
+		t.Fatalf("failed to boot second booter: %v.", err)
+	}
+	defer bs2.Terminate()
+
+	// Wait and make sure the host scan found the other and not itself
+	timeout := time.After(time.Second)
+	for _, want := range []*net.TCPAddr{over2, over1} {
+		evs := evs1
+		if want == over1 {
+			evs = evs2
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("timeout waiting for %v.", want)
+		case e := <-evs:
+			if !e.Addr.IP.Equal(want.IP) || e.Addr.Port != want.Port {
+				t.Fatalf("invalid address: have %v, want %v.", e.Addr, want)
+			}
+		}
+	}
+}
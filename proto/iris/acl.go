@@ -0,0 +1,155 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the loading of the topic access control lists and their translation
+// into the split scribe topics.
+
+package iris
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/project-iris/iris/proto/scribe"
+)
+
+// Topic access control list, mapping application topics to the node roles that
+// may subscribe or publish to them.
+type Acl struct {
+	Version uint64        `json:"version"` // Monotonically increasing list version
+	Topics  []scribe.Rule `json:"topics"`  // Per topic access rules
+}
+
+// Loads a JSON access control list from the given file. Rules may be given for
+// concrete topics, or for wildcard index topics (e.g. orders.>) to control the
+// pattern subscriptions explicitly.
+func LoadAcl(file string) (*Acl, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	acl := new(Acl)
+	if err := dec.Decode(acl); err != nil {
+		return nil, err
+	}
+	if acl.Version == 0 {
+		return nil, fmt.Errorf("missing acl version")
+	}
+	for i, rule := range acl.Topics {
+		if rule.Topic == "" {
+			return nil, fmt.Errorf("rule #%d: missing topic", i)
+		}
+		if isPattern(rule.Topic) && indexTopic(rule.Topic) != rule.Topic {
+			return nil, fmt.Errorf("rule #%d: pattern not an index topic: %s", i, rule.Topic)
+		}
+	}
+	return acl, nil
+}
+
+// Designates the key the access control lists must be signed with. It should be
+// set before booting the overlay.
+func (o *Overlay) SetAclAuthority(admin crypto.PublicKey) {
+	o.scribe.SetAclAuthority(admin)
+}
+
+// Signs the access control list with the authority key and distributes it
+// throughout the network. Each topic rule is expanded to all the internal topic
+// splits.
+func (o *Overlay) SetAcl(acl *Acl, admin crypto.Signer) error {
+	topics := append(append([]scribe.Rule{}, acl.Topics...), indexRules(acl.Topics)...)
+
+	rules := make([]scribe.Rule, 0, len(topics)*len(topicPrefixes))
+	for _, rule := range topics {
+		for _, prefix := range topicPrefixes {
+			split := rule
+			split.Topic = prefix + rule.Topic
+			rules = append(rules, split)
+		}
+	}
+	return o.scribe.SetAcl(acl.Version, rules, admin)
+}
+
+// Derives the rules of the wildcard index topics not explicitly listed, so that
+// pattern subscriptions cannot leak restricted events: only roles allowed to
+// subscribe to all restricted topics of an index may subscribe to it, whereas
+// any role allowed to publish into one of them may publish into the index.
+func indexRules(topics []scribe.Rule) []scribe.Rule {
+	explicit := make(map[string]struct{})
+	for _, rule := range topics {
+		if isPattern(rule.Topic) {
+			explicit[rule.Topic] = struct{}{}
+		}
+	}
+	derived := make(map[string]*scribe.Rule)
+	order := []string{}
+	for _, rule := range topics {
+		index := indexTopic(rule.Topic)
+		if index == "" || isPattern(rule.Topic) {
+			continue
+		}
+		if _, ok := explicit[index]; ok {
+			continue
+		}
+		if prev, ok := derived[index]; !ok {
+			derived[index] = &scribe.Rule{
+				Topic:     index,
+				Subscribe: append([]string{}, rule.Subscribe...),
+				Publish:   append([]string{}, rule.Publish...),
+			}
+			order = append(order, index)
+		} else {
+			prev.Subscribe = intersect(prev.Subscribe, rule.Subscribe)
+			prev.Publish = union(prev.Publish, rule.Publish)
+		}
+	}
+	rules := make([]scribe.Rule, 0, len(order))
+	for _, index := range order {
+		rules = append(rules, *derived[index])
+	}
+	return rules
+}
+
+// Returns the roles present in both lists.
+func intersect(a, b []string) []string {
+	res := []string{}
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				res = append(res, x)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// Returns the roles present in either list.
+func union(a, b []string) []string {
+	res := append([]string{}, a...)
+	for _, y := range b {
+		if len(intersect(res, []string{y})) == 0 {
+			res = append(res, y)
+		}
+	}
+	return res
+}
@@ -0,0 +1,51 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the key affine request routing. Requests with a routing key always
+// use the same cluster split (chosen by the key's hash), as different splits
+// form different topic trees. Within the split, scribe routes the request to the
+// node owning the key by rendezvous hashing, where the same scheme picks among
+// the local connections of the cluster.
+
+package iris
+
+import (
+	"hash/fnv"
+	"math"
+	"math/big"
+
+	"github.com/project-iris/iris/balancer"
+	"github.com/project-iris/iris/config"
+)
+
+// Returns the index of the cluster split to route a keyed request through.
+func keySplit(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(config.IrisClusterSplits))
+}
+
+// Picks the connection owning a routing key out of the live subscriptions.
+func keyOwner(key string, subs []uint64) uint64 {
+	owner, best := subs[0], math.Inf(-1)
+	for _, id := range subs {
+		if score := balancer.Rendezvous(key, new(big.Int).SetUint64(id), 1); score > best {
+			owner, best = id, score
+		}
+	}
+	return owner
+}
@@ -0,0 +1,108 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the capacity estimation of the service clusters, fed into the scribe
+// load reports instead of the cpu usage based default. Like the latter, it is
+// measured in requests per scribe beat: a connection's capacity is the number of
+// requests its handler threads can complete within a beat at the observed
+// handling latency, less the requests already queued up. Services may override
+// the measurement by reporting their capacity (per second) themselves.
+
+package iris
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+var ErrNotService = errors.New("not a service connection")
+
+// Smoothing factor (as a power of two divisor) of the request latency average.
+const latencyShift = 3
+
+// Sets the number of requests per second the service can handle, overriding the
+// capacity measured from its request latency and queue depth. A non-positive
+// value reverts to the measured capacity.
+func (c *Connection) ReportCapacity(capacity int) error {
+	if !c.registered() {
+		return ErrNotService
+	}
+	if capacity < 0 {
+		capacity = 0
+	}
+	atomic.StoreInt64(&c.reported, int64(capacity))
+	return nil
+}
+
+// Feeds the handling time of a request into the moving latency average.
+func (c *Connection) observe(latency time.Duration) {
+	if latency <= 0 {
+		latency = 1
+	}
+	for {
+		old := atomic.LoadInt64(&c.latency)
+		avg := int64(latency)
+		if old != 0 {
+			avg = old + (int64(latency)-old)>>latencyShift
+		}
+		if atomic.CompareAndSwapInt64(&c.latency, old, avg) {
+			return
+		}
+	}
+}
+
+// Returns the number of requests the connection can take over the next beat on
+// top of its current backlog. Until a latency is observed, a request per handler
+// thread is assumed, leaving room for the connection to be probed.
+func (c *Connection) capacity() int {
+	beat := int64(config.ScribeBeatPeriod)
+	if reported := atomic.LoadInt64(&c.reported); reported > 0 {
+		if cap := reported * beat / int64(time.Second); cap > 0 {
+			return int(cap)
+		}
+		return 1
+	}
+	threads := int64(c.workers.Capacity())
+	latency := atomic.LoadInt64(&c.latency)
+	if latency == 0 {
+		return int(threads)
+	}
+	return int(threads*beat/latency) - c.workers.Backlog()
+}
+
+// Creates a capacity provider of a cluster topic, summing up the capacities of
+// the local connections subscribed to it. Every split of a cluster is provided
+// the full capacity, as only the relative weights matter for balancing.
+func (o *Overlay) provider(topic string) func() int {
+	return func() int {
+		o.lock.RLock()
+		defer o.lock.RUnlock()
+
+		total := 0
+		for _, id := range o.subLive[topic] {
+			if conn, ok := o.conns[id]; ok {
+				if cap := conn.capacity(); cap > 0 {
+					total += cap
+				}
+			}
+		}
+		return total
+	}
+}
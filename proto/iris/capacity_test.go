@@ -0,0 +1,101 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Request handler taking a fixed amount of time to serve each request.
+type slowRequester struct {
+	requester
+	delay time.Duration
+}
+
+func (r *slowRequester) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	time.Sleep(r.delay)
+	return req, nil
+}
+
+// Tests that the capacity of a service is measured from its request latency, and
+// that the service may override it by reporting its own.
+func TestCapacity(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("capacity-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	cluster := "capacity-test-cluster"
+	delay := 10 * time.Millisecond
+	serv, err := node.Connect(cluster, &slowRequester{delay: delay})
+	if err != nil {
+		t.Fatalf("failed to register service: %v.", err)
+	}
+	defer serv.Close()
+
+	client, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	if err := client.ReportCapacity(100); err != ErrNotService {
+		t.Fatalf("client capacity report mismatch: have %v, want %v.", err, ErrNotService)
+	}
+	// Without any observations, a request per handler thread should be assumed
+	if cap := serv.capacity(); cap != config.IrisHandlerThreads {
+		t.Fatalf("unmeasured capacity mismatch: have %v, want %v.", cap, config.IrisHandlerThreads)
+	}
+	// Serve a few requests and check the measured capacity
+	for i := 0; i < 10; i++ {
+		if _, err := client.Request(cluster, []byte{0}, time.Second); err != nil {
+			t.Fatalf("failed to execute request: %v.", err)
+		}
+	}
+	limit := config.IrisHandlerThreads * int(config.ScribeBeatPeriod/delay)
+	if cap := serv.capacity(); cap > limit || cap < limit/2 {
+		t.Fatalf("measured capacity mismatch: have %v, want (%v, %v].", cap, limit/2, limit)
+	}
+	// Override the capacity and check that it's reported for the cluster
+	if err := serv.ReportCapacity(50); err != nil {
+		t.Fatalf("failed to report capacity: %v.", err)
+	}
+	perBeat := int(50 * config.ScribeBeatPeriod / time.Second)
+	for _, prefix := range clusterPrefixes {
+		if cap := node.provider(prefix + cluster)(); cap != perBeat {
+			t.Fatalf("provided capacity mismatch: have %v, want %v.", cap, perBeat)
+		}
+	}
+	// Revert to the measured capacity
+	if err := serv.ReportCapacity(0); err != nil {
+		t.Fatalf("failed to revert capacity: %v.", err)
+	}
+	if cap := serv.capacity(); cap > limit || cap < limit/2 {
+		t.Fatalf("reverted capacity mismatch: have %v, want (%v, %v].", cap, limit/2, limit)
+	}
+}
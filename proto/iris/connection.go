@@ -20,12 +20,15 @@ package iris
 import (
 	"errors"
 	"fmt"
+	"log"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/project-iris/iris/balancer"
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/pool"
+	"github.com/project-iris/iris/proto/scribe"
 )
 
 // Iris specific errors
@@ -75,49 +78,95 @@ type SubscriptionHandler interface {
 type Connection struct {
 	// Application layer fields
 	id      uint64            // Auto-incremented connection id
-	cluster string            // Cluster to which the client registers
+	cluster string            // Cluster to which the client registers (immutable)
+	unreg   int32             // Flag whether the service left its cluster (atomic)
 	handler ConnectionHandler // Handler for connection events
 	iris    *Overlay          // Interface into the distributed carrier
 
 	reqIdx  uint64                 // Index to assign the next request
 	reqReps map[uint64]chan []byte // Reply channels for active requests
 	reqErrs map[uint64]chan error  // Error channels for active requests
+	reqAlls map[uint64]*gather     // Reply collectors for active scatter-gather requests
 	reqLock sync.RWMutex           // Mutex to protect the result channel maps
 
-	subLive map[string]SubscriptionHandler // Active subscriptions
-	subLock sync.RWMutex                   // Mutex to protect the subscription map
+	subLive  map[string]SubscriptionHandler // Active subscriptions
+	wildLive map[string]SubscriptionHandler // Active wildcard pattern subscriptions
+	wildRefs map[string]int                 // Number of patterns using each index topic
+	subLock  sync.RWMutex                   // Mutex to protect the subscription maps
+
+	replaying map[string]*replay  // Durable topic replays in progress
+	durFloor  map[string]position // Last sequence covered by a finished replay
+	durLock   sync.Mutex          // Mutex to protect the durable topic state
 
 	tunIdx  uint64             // Index to assign the next tunnel
 	tunLive map[uint64]*Tunnel // Tunnels either live, or being established
 	tunLock sync.RWMutex       // Mutex to protect the tunnel map
 
+	watches  map[string]*watch // Membership watches of clusters
+	presLock sync.Mutex        // Mutex to protect the membership watches
+
 	// Quality of service fields
-	workers *pool.ThreadPool // Concurrent threads handling the connection
-	splitId uint32           // Id of the next prefix for split cluster round-robin
+	workers  *pool.ThreadPool // Concurrent threads handling the connection
+	splitId  uint32           // Id of the next prefix for split cluster round-robin
+	latency  int64            // Moving average of the request handling time (atomic)
+	reported int64            // Capacity reported by the service, zero if measured (atomic)
 
 	// Bookkeeping fields
 	quit chan chan error // Quit channel to synchronize termination
 	term chan struct{}   // Channel to signal termination to blocked go-routines
 }
 
+// Optional settings of a service registration.
+type ConnectOptions struct {
+	// Balancing strategy the cluster's requests should be distributed with (see
+	// the balancer package). Empty means the configured one, or weighted random.
+	Strategy string
+}
+
 // Connects to the iris overlay. The parameters can be either both specified, in
 // the case of a service registration, or both skipped in the case of a client
 // connection. Others combinations will fail.
 func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connection, error) {
+	return o.ConnectWithOptions(cluster, handler, nil)
+}
+
+// Connects to the iris overlay, configuring the service registration with the
+// given options (nil for the defaults).
+func (o *Overlay) ConnectWithOptions(cluster string, handler ConnectionHandler, opts *ConnectOptions) (*Connection, error) {
 	// Make sure only valid argument combinations pass
 	if (cluster == "" && handler != nil) || (cluster != "" && handler == nil) {
 		return nil, fmt.Errorf("invalid connection arguments: cluster '%v', handler %v", cluster, handler)
 	}
+	strategy := ""
+	if cluster != "" {
+		if opts != nil && opts.Strategy != "" {
+			strategy = opts.Strategy
+		} else {
+			strategy = o.clusterStrategy(cluster)
+		}
+		if strategy != "" {
+			if _, err := balancer.NewStrategy(strategy); err != nil {
+				return nil, err
+			}
+		}
+	}
 	// Create the connection object
 	c := &Connection{
 		cluster: cluster,
 		handler: handler,
 		iris:    o,
 
-		reqReps: make(map[uint64]chan []byte),
-		reqErrs: make(map[uint64]chan error),
-		subLive: make(map[string]SubscriptionHandler),
-		tunLive: make(map[uint64]*Tunnel),
+		reqReps:  make(map[uint64]chan []byte),
+		reqErrs:  make(map[uint64]chan error),
+		reqAlls:  make(map[uint64]*gather),
+		subLive:  make(map[string]SubscriptionHandler),
+		wildLive: make(map[string]SubscriptionHandler),
+		wildRefs: make(map[string]int),
+		tunLive:  make(map[uint64]*Tunnel),
+		watches:  make(map[string]*watch),
+
+		replaying: make(map[string]*replay),
+		durFloor:  make(map[string]position),
 
 		// Quality of service
 		workers: pool.NewThreadPool(config.IrisHandlerThreads),
@@ -138,7 +187,16 @@ func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connectio
 			if err := c.iris.subscribe(c.id, prefix+cluster); err != nil {
 				return nil, err
 			}
+			if strategy != "" {
+				if err := c.iris.scribe.Strategize(prefix+cluster, strategy); err != nil {
+					return nil, err
+				}
+			}
+			if err := c.iris.scribe.Provide(prefix+cluster, c.iris.provider(prefix+cluster)); err != nil {
+				return nil, err
+			}
 		}
+		c.announce(true)
 	}
 	c.workers.Start()
 
@@ -152,9 +210,32 @@ func (c *Connection) Broadcast(cluster string, msg []byte) error {
 	return c.iris.scribe.Publish(clusterPrefixes[prefixIdx]+cluster, c.assembleBroadcast(msg))
 }
 
+// Optional settings of a request.
+type RequestOptions struct {
+	// Declares the request safe to execute multiple times, allowing it to be
+	// retried on another cluster member if the serving node dies meanwhile.
+	Idempotent bool
+
+	// Routing key pinning all requests with the same key to the same cluster
+	// member (as long as the membership doesn't change). Empty means random.
+	//
+	// When the membership changes, the moved keys are not limited to those of
+	// the joining or leaving member: the topic tree splits the keys between its
+	// branches by member counts, so a join also pulls some keys from the other
+	// branches onto existing members of its own (a leave pushes some out). Any
+	// moved key either concerns the changed member or crosses its branch.
+	Key string
+}
+
 // Executes a synchronous request to cluster (load balanced between all active),
 // and returns the received reply, or an error if a timeout is reached.
 func (c *Connection) Request(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+	return c.RequestWithOptions(cluster, req, timeout, nil)
+}
+
+// Executes a synchronous request to cluster, configured by the given options
+// (nil for the defaults).
+func (c *Connection) RequestWithOptions(cluster string, req []byte, timeout time.Duration, opts *RequestOptions) ([]byte, error) {
 	// Create a reply and error channel for the results
 	repc := make(chan []byte, 1)
 	errc := make(chan error, 1)
@@ -176,25 +257,50 @@ func (c *Connection) Request(cluster string, req []byte, timeout time.Duration)
 		c.reqLock.Unlock()
 	}()
 	// Send the request
+	requestsIssued.Inc()
+	requestsPending.Inc()
+	defer requestsPending.Dec()
+
+	start := time.Now()
 	prefixIdx := int(reqId) % config.IrisClusterSplits
-	c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, c.assembleRequest(reqId, req, timeout))
+	switch {
+	case opts != nil && opts.Key != "":
+		budget := time.Duration(0)
+		if opts.Idempotent {
+			budget = timeout
+		}
+		msg := c.assembleKeyedRequest(reqId, req, timeout, opts.Key)
+		c.iris.scribe.BalanceKey(clusterPrefixes[keySplit(opts.Key)]+cluster, opts.Key, msg, budget)
+	case opts != nil && opts.Idempotent:
+		c.iris.scribe.BalanceFailover(clusterPrefixes[prefixIdx]+cluster, c.assembleRequest(reqId, req, timeout), timeout)
+	default:
+		c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, c.assembleRequest(reqId, req, timeout))
+	}
 
 	// Retrieve the results, time out or fail if terminating
 	select {
 	case <-c.term:
+		requestFailures.Inc()
 		return nil, ErrTerminating
 	case <-time.After(timeout):
+		requestTimeouts.Inc()
 		return nil, ErrTimeout
 	case reply := <-repc:
+		requestLatency.Observe(time.Since(start).Seconds())
 		return reply, nil
 	case err := <-errc:
+		requestFailures.Inc()
 		return nil, err
 	}
 }
 
-// Subscribes to topic, using handler as the callback for arriving events. An
+// Subscribes to topic, using handler as the callback for arriving events. The
+// topic may also be a wildcard pattern (e.g. orders.*.created or metrics.>). An
 // error is returned if subscription fails.
 func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error {
+	if isPattern(topic) {
+		return c.subscribePattern(topic, handler)
+	}
 	// Make sure there are no double subscriptions and not closing
 	c.subLock.Lock()
 	select {
@@ -212,9 +318,17 @@ func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error
 	}
 	c.subLock.Unlock()
 
-	// Subscribe through the carrier
-	for _, prefix := range topicPrefixes {
+	// Subscribe through the carrier, rolling back on failure (e.g. ACL denial)
+	for i, prefix := range topicPrefixes {
 		if err := c.iris.subscribe(c.id, prefix+topic); err != nil {
+			for _, prefix := range topicPrefixes[:i] {
+				c.iris.unsubscribe(c.id, prefix+topic)
+			}
+			c.subLock.Lock()
+			for _, prefix := range topicPrefixes {
+				delete(c.subLive, prefix+topic)
+			}
+			c.subLock.Unlock()
 			return err
 		}
 	}
@@ -222,14 +336,66 @@ func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error
 }
 
 // Publishes an event asynchronously to topic. No guarantees are made that all
-// subscribers receive the message.
+// subscribers receive the message. Hierarchical topics are also published into
+// their index topic if it has members, reaching the wildcard subscribers best
+// effort, whereas durable topics are journaled by their root for later replay.
 func (c *Connection) Publish(topic string, msg []byte) error {
+	if isPattern(topic) {
+		return ErrPattern
+	}
 	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
-	return c.iris.scribe.Publish(topicPrefixes[prefixIdx]+topic, c.assemblePublish(msg))
+	if durable(topic) {
+		if err := c.iris.scribe.PublishDurable(topicPrefixes[0]+topic, c.assemblePublish(msg)); err != nil {
+			return err
+		}
+	} else if err := c.iris.scribe.Publish(topicPrefixes[prefixIdx]+topic, c.assemblePublish(msg)); err != nil {
+		return err
+	}
+	c.publishIndex(prefixIdx, topic, msg)
+	return nil
+}
+
+// Publishes an event into the index topic of its hierarchical topic, if any and
+// if wildcard subscribers are present. These are notified best effort, so any
+// failures are only logged, not failing the publish of the event itself.
+func (c *Connection) publishIndex(prefixIdx int, topic string, msg []byte) {
+	index := indexTopic(topic)
+	if index == "" || !c.iris.indexed(index) {
+		return
+	}
+	if err := c.iris.scribe.Publish(topicPrefixes[prefixIdx]+index, c.assembleIndexPublish(topic, msg)); err != nil {
+		log.Printf("iris: failed to publish into index topic %s: %v.", index, err)
+	}
 }
 
-// Unsubscribes from topic, receiving no more event notifications for it.
+// Publishes an event into topic, waiting until the subscribed nodes acknowledge
+// its delivery, or the timeout is reached. The receipt lists the overlay nodes
+// confirming the delivery and the subtrees that failed to, retransmissions
+// included. Wildcard subscribers are notified best effort only.
+func (c *Connection) PublishReliable(topic string, msg []byte, timeout time.Duration) (*scribe.Receipt, error) {
+	if isPattern(topic) {
+		return nil, ErrPattern
+	}
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	c.publishIndex(prefixIdx, topic, msg)
+
+	split, dur := topicPrefixes[prefixIdx]+topic, durable(topic)
+	if dur {
+		split = topicPrefixes[0] + topic
+	}
+	rec, err := c.iris.scribe.PublishReliable(split, c.assemblePublish(msg), dur, timeout)
+	if err == scribe.ErrTimeout {
+		return nil, ErrTimeout
+	}
+	return rec, err
+}
+
+// Unsubscribes from topic (or wildcard pattern), receiving no more event
+// notifications for it.
 func (c *Connection) Unsubscribe(topic string) error {
+	if isPattern(topic) {
+		return c.unsubscribePattern(topic)
+	}
 	// Remove subscription if present
 	c.subLock.Lock()
 	select {
@@ -247,6 +413,10 @@ func (c *Connection) Unsubscribe(topic string) error {
 	}
 	c.subLock.Unlock()
 
+	c.durLock.Lock()
+	delete(c.durFloor, topicPrefixes[0]+topic)
+	c.durLock.Unlock()
+
 	// Notify the carrier of the removal
 	for _, prefix := range topicPrefixes {
 		if err := c.iris.unsubscribe(c.id, prefix+topic); err != nil {
@@ -273,17 +443,23 @@ func (c *Connection) Tunnel(cluster string, timeout time.Duration) (*Tunnel, err
 
 // Closes the service aspect of the connection, but leave the client alive.
 func (c *Connection) Unregister() error {
-	if c.cluster != "" {
-		// Remove the cluster subscriptions
-		for _, prefix := range clusterPrefixes {
-			c.iris.unsubscribe(c.id, prefix+c.cluster)
-		}
-		// Make sure the service is marked unregistered
-		c.cluster = ""
+	// Make sure the service leaves only once, even if unregistered concurrently
+	if c.cluster == "" || !atomic.CompareAndSwapInt32(&c.unreg, 0, 1) {
+		return nil
+	}
+	// Remove the cluster subscriptions and notify the watchers
+	for _, prefix := range clusterPrefixes {
+		c.iris.unsubscribe(c.id, prefix+c.cluster)
 	}
+	c.announce(false)
 	return nil
 }
 
+// Checks whether the connection is a service still registered into its cluster.
+func (c *Connection) registered() bool {
+	return c.cluster != "" && atomic.LoadInt32(&c.unreg) == 0
+}
+
 // Gracefully terminates the connection, all subscriptions and all tunnels.
 func (c *Connection) Close() error {
 	// Signal the connection as terminating
@@ -307,8 +483,22 @@ func (c *Connection) Close() error {
 	for topic, _ := range c.subLive {
 		c.iris.unsubscribe(c.id, topic)
 	}
+	for index, _ := range c.wildRefs {
+		for _, prefix := range topicPrefixes {
+			c.iris.unsubscribe(c.id, prefix+index)
+		}
+	}
 	c.subLock.Unlock()
 
+	// Drop all membership watches
+	c.presLock.Lock()
+	for cluster, w := range c.watches {
+		close(w.quit)
+		c.iris.unsubscribe(c.id, presencePrefix+cluster)
+	}
+	c.watches = make(map[string]*watch)
+	c.presLock.Unlock()
+
 	// Leave the cluster if it was a service connection
 	if err := c.Unregister(); err != nil {
 		return err
@@ -0,0 +1,281 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the durable topic subscriptions. Topics matching the configured
+// durable patterns are always published into the first topic split (giving a
+// single journal and sequence per topic), and can be subscribed to with a replay
+// of the journaled history.
+//
+// While a replay is in progress, the live events of the topic are buffered, and
+// once the replay ends (or times out), the history and buffered events are
+// delivered in sequence order, without duplicates. Later live events are only
+// filtered against the replayed range while they belong to the same journal
+// epoch; an epoch change means the sequence regressed (the journal had to be
+// restarted without its history), which is logged and lifts the filter.
+
+package iris
+
+import (
+	"errors"
+	"log"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/scribe"
+)
+
+// Durable topic specific errors
+var ErrNotDurable = errors.New("topic not durable")
+
+// Optional extension of the subscription handler for durable topics, receiving
+// also the journal sequence number of each event (usable as a replay cursor).
+type DurableHandler interface {
+	HandleDurableEvent(seq uint64, msg []byte)
+}
+
+// A sequenced durable topic event.
+type event struct {
+	epoch uint64
+	seq   uint64
+	data  []byte
+}
+
+// Position within the journal of a durable topic.
+type position struct {
+	epoch uint64 // Sequence numbering of the journal
+	seq   uint64 // Sequence number within the numbering
+}
+
+// State of a single durable topic replay in progress.
+type replay struct {
+	conn    *Connection         // Connection requesting the replay
+	topic   string              // Split topic being replayed
+	handler SubscriptionHandler // Handler to deliver the events to
+
+	history []event    // Events replayed from the journal
+	live    []event    // Live events buffered during the replay
+	lock    sync.Mutex // Protects the replayed history
+}
+
+// Checks whether a topic is configured to be durable.
+func durable(topic string) bool {
+	for _, pattern := range config.IrisDurableTopics {
+		if ok, _ := path.Match(pattern, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivers an event to a subscription handler, passing along the sequence number
+// if the handler is interested in it.
+func deliver(handler SubscriptionHandler, seq uint64, msg []byte) {
+	if dur, ok := handler.(DurableHandler); ok && seq != 0 {
+		dur.HandleDurableEvent(seq, msg)
+		return
+	}
+	handler.HandleEvent(msg)
+}
+
+// Subscribes to a durable topic, first delivering its journaled events from the
+// given position, followed by the live ones.
+func (c *Connection) SubscribeReplay(topic string, handler SubscriptionHandler, from scribe.Cursor) error {
+	if isPattern(topic) {
+		return ErrPattern
+	}
+	if !durable(topic) {
+		return ErrNotDurable
+	}
+	split := topicPrefixes[0] + topic
+
+	// Start buffering the live events before subscribing
+	r := &replay{
+		conn:    c,
+		topic:   split,
+		handler: handler,
+	}
+	c.durLock.Lock()
+	if _, ok := c.replaying[split]; ok {
+		c.durLock.Unlock()
+		return ErrSubscribed
+	}
+	c.replaying[split] = r
+	c.durLock.Unlock()
+
+	if err := c.Subscribe(topic, handler); err != nil {
+		c.durLock.Lock()
+		delete(c.replaying, split)
+		c.durLock.Unlock()
+		return err
+	}
+	// Request the replay from the topic root, giving up after a timeout
+	tag := c.iris.trackReplay(r)
+	if err := c.iris.scribe.Replay(split, from, tag); err != nil {
+		c.iris.untrackReplay(tag)
+		c.durLock.Lock()
+		delete(c.replaying, split)
+		c.durLock.Unlock()
+		c.Unsubscribe(topic)
+		return err
+	}
+	time.AfterFunc(config.IrisReplayTimeout, func() {
+		if c.iris.untrackReplay(tag) {
+			log.Printf("iris: replay of %v timed out, switching to live events.", topic)
+			c.workers.Schedule(func() { c.finishReplay(r, 0, 0) })
+		}
+	})
+	return nil
+}
+
+// Registers a replay in progress, returning the tag identifying it.
+func (o *Overlay) trackReplay(r *replay) uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.replayIdx++
+	o.replays[o.replayIdx] = r
+	return o.replayIdx
+}
+
+// Removes a replay from the tracked ones, reporting whether it was still live.
+func (o *Overlay) untrackReplay(tag uint64) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	_, ok := o.replays[tag]
+	delete(o.replays, tag)
+	return ok
+}
+
+// Implements proto.scribe.Callback.HandleReplay. Collects the replayed events,
+// and once the end marker arrives, schedules their delivery.
+func (o *Overlay) HandleReplay(tag uint64, epoch uint64, seq uint64, msg *proto.Message) {
+	o.lock.RLock()
+	r, ok := o.replays[tag]
+	o.lock.RUnlock()
+	if !ok {
+		return // Timed out or already finished
+	}
+	if msg != nil {
+		r.lock.Lock()
+		r.history = append(r.history, event{epoch, seq, msg.Data})
+		r.lock.Unlock()
+		return
+	}
+	if o.untrackReplay(tag) {
+		r.conn.workers.Schedule(func() { r.conn.finishReplay(r, epoch, seq) })
+	}
+}
+
+// Checks a live durable event against the replays in progress, buffering it if
+// needed, and dropping it if within the range of a finished replay of the same
+// journal epoch. Returns whether the event should be delivered.
+func (c *Connection) sequence(topic string, epoch uint64, seq uint64, msg []byte) bool {
+	c.durLock.Lock()
+	defer c.durLock.Unlock()
+
+	if r, ok := c.replaying[topic]; ok {
+		r.live = append(r.live, event{epoch, seq, msg})
+		return false
+	}
+	if floor, ok := c.durFloor[topic]; ok {
+		if epoch != floor.epoch {
+			log.Printf("iris: durable topic %v sequence regressed: epoch %v, seq %v after epoch %v, seq %v.", topic, epoch, seq, floor.epoch, floor.seq)
+			delete(c.durFloor, topic)
+		} else if seq <= floor.seq {
+			return false
+		}
+	}
+	return true
+}
+
+// Finishes a replay, delivering the replayed and buffered events in sequence
+// order and switching the topic over to live delivery. Buffered events of a new
+// journal epoch cannot be ordered against the replayed ones, so they are only
+// delivered after them.
+func (c *Connection) finishReplay(r *replay, epoch uint64, last uint64) {
+	c.durLock.Lock()
+	delete(c.replaying, r.topic)
+
+	// Live events are not ordered by the worker pool, so only the replayed range
+	// can be used to filter the late duplicates
+	r.lock.Lock()
+	for _, e := range r.history {
+		epoch = e.epoch
+		if e.seq > last {
+			last = e.seq
+		}
+	}
+	events, regressed := append([]event{}, r.history...), []event{}
+	for _, e := range r.live {
+		if epoch == 0 || e.epoch == epoch {
+			events = append(events, e)
+		} else {
+			regressed = append(regressed, e)
+		}
+	}
+	r.lock.Unlock()
+
+	unique := dedup(events)
+	if len(regressed) > 0 {
+		log.Printf("iris: durable topic %v sequence regressed during replay: epoch %v after epoch %v.", r.topic, regressed[0].epoch, epoch)
+
+		regressed = dedup(regressed)
+		unique = append(unique, regressed...)
+		epoch, last = regressed[len(regressed)-1].epoch, regressed[len(regressed)-1].seq
+	}
+	if epoch != 0 {
+		c.durFloor[r.topic] = position{epoch, last}
+	} else {
+		delete(c.durFloor, r.topic)
+	}
+	c.durLock.Unlock()
+
+	// Deliver the events, unless unsubscribed meanwhile
+	c.subLock.RLock()
+	_, ok := c.subLive[r.topic]
+	c.subLock.RUnlock()
+	if !ok {
+		return
+	}
+	for _, e := range unique {
+		deliver(r.handler, e.seq, e.data)
+	}
+}
+
+// Orders a batch of events by sequence number, dropping the duplicates.
+func dedup(events []event) []event {
+	sort.Sort(eventSorter(events))
+	unique := make([]event, 0, len(events))
+	for _, e := range events {
+		if len(unique) == 0 || unique[len(unique)-1].seq != e.seq {
+			unique = append(unique, e)
+		}
+	}
+	return unique
+}
+
+// Sorter for the replayed events to order them by sequence number.
+type eventSorter []event
+
+func (s eventSorter) Len() int           { return len(s) }
+func (s eventSorter) Less(i, j int) bool { return s[i].seq < s[j].seq }
+func (s eventSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,157 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/scribe"
+)
+
+// Durable subscription handler collecting the event sequence numbers.
+type durableSubscriber struct {
+	seqs []uint64
+	lock sync.Mutex
+}
+
+func (s *durableSubscriber) HandleEvent(msg []byte) {
+	panic("sequence number not passed to durable handler")
+}
+
+func (s *durableSubscriber) HandleDurableEvent(seq uint64, msg []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seqs = append(s.seqs, seq)
+}
+
+func TestDurableReplay(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	defer func(topics []string) { config.IrisDurableTopics = topics }(config.IrisDurableTopics)
+	config.IrisDurableTopics = []string{"audit.*"}
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("durable-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Non durable topics cannot be replayed
+	sub := new(durableSubscriber)
+	if err := conn.SubscribeReplay("metrics.cpu", sub, scribe.Cursor{}); err != ErrNotDurable {
+		t.Fatalf("non-durable replay result mismatch: have %v, want %v.", err, ErrNotDurable)
+	}
+	// Publish a few events before subscribing, then replay and publish some more
+	for i := 0; i < 3; i++ {
+		if err := conn.Publish("audit.login", []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to publish: %v.", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if err := conn.SubscribeReplay("audit.login", sub, scribe.Cursor{Seq: 2}); err != nil {
+		t.Fatalf("failed to subscribe with replay: %v.", err)
+	}
+	for i := 3; i < 5; i++ {
+		if err := conn.Publish("audit.login", []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to publish: %v.", err)
+		}
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	// Live events are unordered, but must be delivered exactly once
+	sort.Sort(seqSorter(sub.seqs))
+
+	want := []uint64{2, 3, 4, 5}
+	if len(sub.seqs) != len(want) {
+		t.Fatalf("sequence mismatch: have %v, want %v.", sub.seqs, want)
+	}
+	for i, seq := range want {
+		if sub.seqs[i] != seq {
+			t.Fatalf("sequence mismatch: have %v, want %v.", sub.seqs, want)
+		}
+	}
+}
+
+// Sorter for the delivered sequence numbers.
+// Tests that live events are filtered against a finished replay only within its
+// journal epoch, and that a regressed sequence lifts the filter.
+func TestDurableRegression(t *testing.T) {
+	sub := &durableSubscriber{}
+	topic := topicPrefixes[0] + "regressed"
+
+	conn := &Connection{
+		subLive:   map[string]SubscriptionHandler{topic: sub},
+		replaying: make(map[string]*replay),
+		durFloor:  make(map[string]position),
+	}
+	// Finish a replay with a buffered event from a restarted journal
+	r := &replay{
+		conn:    conn,
+		topic:   topic,
+		handler: sub,
+		history: []event{{1, 1, nil}, {1, 2, nil}},
+		live:    []event{{1, 2, nil}, {1, 3, nil}, {2, 1, nil}},
+	}
+	conn.replaying[topic] = r
+	conn.finishReplay(r, 1, 2)
+
+	if want := []uint64{1, 2, 3, 1}; !reflect.DeepEqual(sub.seqs, want) {
+		t.Fatalf("replayed sequence mismatch: have %v, want %v.", sub.seqs, want)
+	}
+	// Live events are filtered by the new epoch, and regressions detected
+	tests := []struct {
+		epoch, seq uint64
+		deliver    bool
+	}{
+		{2, 1, false},
+		{2, 2, true},
+		{3, 1, true},
+		{3, 1, true},
+	}
+	for i, tt := range tests {
+		if have := conn.sequence(topic, tt.epoch, tt.seq, nil); have != tt.deliver {
+			t.Errorf("test %d: delivery mismatch: have %v, want %v.", i, have, tt.deliver)
+		}
+	}
+}
+
+type seqSorter []uint64
+
+func (s seqSorter) Len() int           { return len(s) }
+func (s seqSorter) Less(i, j int) bool { return s[i] < s[j] }
+func (s seqSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -31,7 +31,7 @@ import (
 
 // Implements proto.iris.ConnectionCallback.HandlePublish. Extracts the data from
 // the Iris envelope and calls the appropriate handler.
-func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message) {
+func (o *Overlay) HandlePublish(src *big.Int, topic string, epoch uint64, seq uint64, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
 
 	// Fetch the message recipients
@@ -54,8 +54,16 @@ func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message)
 		switch head.Op {
 		case opBcast:
 			conn.workers.Schedule(func() { conn.handleBroadcast(msg.Data) })
+		case opReqAll:
+			conn.workers.Schedule(func() { conn.handleRequestAll(src, head.Src, head.ReqId, msg.Data, head.ReqTime) })
 		case opPub:
-			conn.workers.Schedule(func() { conn.handlePublish(topic, msg.Data) })
+			if head.Topic != "" {
+				conn.workers.Schedule(func() { conn.handleWildcard(head.Topic, msg.Data) })
+			} else {
+				conn.workers.Schedule(func() { conn.handlePublish(topic, epoch, seq, msg.Data) })
+			}
+		case opJoin, opLeave:
+			conn.workers.Schedule(func() { conn.handleMembership(topic, head.Op == opJoin) })
 		default:
 			log.Printf("iris: invalid publish opcode: %v.", head.Op)
 		}
@@ -67,24 +75,37 @@ func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message)
 func (o *Overlay) HandleBalance(src *big.Int, topic string, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
 
-	// Fetch the possible message recipients and pick one at random
+	// Fetch the possible message recipients and pick one at random (or the owner
+	// of the routing key, if any)
 	o.lock.RLock()
 	subs, ok := o.subLive[topic]
 	if !ok {
 		o.lock.RUnlock()
+		o.scribe.Done(topic, msg)
 		log.Printf("iris: non-existent topic: %v.", topic)
 		return
 	}
-	conn := o.conns[subs[rand.Intn(len(subs))]]
+	id := subs[rand.Intn(len(subs))]
+	if head.ReqKey != "" {
+		id = keyOwner(head.ReqKey, subs)
+	}
+	conn := o.conns[id]
 	o.lock.RUnlock()
 
-	// Balance to the chose one
+	// Balance to the chose one, notifying the carrier when done
 	switch head.Op {
 	case opReq:
-		conn.workers.Schedule(func() { conn.handleRequest(src, head.Src, head.ReqId, msg.Data, head.ReqTime) })
+		conn.workers.Schedule(func() {
+			conn.handleRequest(src, head.Src, head.ReqId, msg.Data, head.ReqTime)
+			o.scribe.Done(topic, msg)
+		})
 	case opTun:
-		conn.workers.Schedule(func() { conn.handleTunnelRequest(head.Src, head.TunId, head.TunKey, head.TunAddrs, head.TunTime) })
+		conn.workers.Schedule(func() {
+			conn.handleTunnelRequest(head.Src, head.TunId, head.TunKey, head.TunSuites, head.TunAddrs, head.TunTime)
+			o.scribe.Done(topic, msg)
+		})
 	default:
+		o.scribe.Done(topic, msg)
 		log.Printf("iris: invalid balance opcode: %v.", head.Op)
 	}
 }
@@ -106,6 +127,10 @@ func (o *Overlay) HandleDirect(src *big.Int, msg *proto.Message) {
 	switch head.Op {
 	case opRep:
 		conn.workers.Schedule(func() { conn.handleReply(head.ReqId, head.ReqFail, msg.Data) })
+	case opRepAll:
+		conn.workers.Schedule(func() { conn.handleReplyAll(src, head.Src, head.ReqId, head.ReqFail, msg.Data) })
+	case opAckAll:
+		conn.workers.Schedule(func() { conn.handleAckAll(src, head.Src, head.ReqId) })
 	default:
 		log.Printf("iris: invalid direct opcode: %v.", head.Op)
 	}
@@ -120,7 +145,9 @@ func (c *Connection) handleBroadcast(msg []byte) {
 // under which the reply must be sent back. Either a reply or a binding side
 // failure is forwarded to the remote node.
 func (c *Connection) handleRequest(srcNode *big.Int, srcConn uint64, reqId uint64, msg []byte, timeout time.Duration) {
+	start := time.Now()
 	rep, err := c.handler.HandleRequest(msg, timeout)
+	c.observe(time.Since(start))
 	if err == ErrTerminating || err == ErrTimeout {
 		return
 	}
@@ -128,7 +155,8 @@ func (c *Connection) handleRequest(srcNode *big.Int, srcConn uint64, reqId uint6
 }
 
 // Looks up the result channel for the pending request and inserts the reply. If
-// the channel doesn't exist any more the reply is silently dropped.
+// the channel doesn't exist any more, or a reply was already inserted (failover
+// duplicate), the reply is silently dropped.
 func (c *Connection) handleReply(reqId uint64, failed bool, data []byte) {
 	c.reqLock.RLock()
 	defer c.reqLock.RUnlock()
@@ -136,39 +164,46 @@ func (c *Connection) handleReply(reqId uint64, failed bool, data []byte) {
 	// Interpret the data as either a reply or a failure string
 	if !failed {
 		if repc, ok := c.reqReps[reqId]; ok {
-			repc <- data
+			select {
+			case repc <- data:
+			default:
+			}
 		}
 	} else {
 		if errc, ok := c.reqErrs[reqId]; ok {
-			errc <- errors.New(string(data))
+			select {
+			case errc <- errors.New(string(data)):
+			default:
+			}
 		}
 	}
 }
 
 // Delivers a topic event to a subscribed handler. If the subscription does not
-// exist the message is silently dropped.
-func (c *Connection) handlePublish(topic string, msg []byte) {
+// exist the message is silently dropped. Durable topic events (non-zero seq) may
+// be held back by a replay in progress.
+func (c *Connection) handlePublish(topic string, epoch uint64, seq uint64, msg []byte) {
 	// Fetch the handler
 	c.subLock.RLock()
 	handler, ok := c.subLive[topic]
 	c.subLock.RUnlock()
 
 	// Deliver the event
-	if ok {
-		handler.HandleEvent(msg)
+	if ok && (seq == 0 || c.sequence(topic, epoch, seq, msg)) {
+		deliver(handler, seq, msg)
 	}
 }
 
 // Accepts the inbound tunnel, notifies the remote endpoint of the success and
 // starts the local handler.
-func (c *Connection) handleTunnelRequest(conn uint64, id uint64, key []byte, addrs []string, timeout time.Duration) {
+func (c *Connection) handleTunnelRequest(conn uint64, id uint64, key []byte, suites []byte, addrs []string, timeout time.Duration) {
 	// Validate the remote address list
 	if len(addrs) == 0 {
 		log.Printf("iris: empty address list for tunnel request.")
 		return
 	}
 	// Try to establish the outbound tunnel
-	if tun, err := c.buildTunnel(conn, id, key, addrs, timeout); err != nil {
+	if tun, err := c.buildTunnel(conn, id, key, suites, addrs, timeout); err != nil {
 		log.Printf("iris: failed to accept tunnel: %v.", err)
 	} else {
 		c.handler.HandleTunnel(tun)
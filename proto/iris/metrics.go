@@ -0,0 +1,39 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the instrumentation counters of the iris communication primitives.
+
+package iris
+
+import (
+	"github.com/project-iris/iris/metrics"
+)
+
+// Number of requests issued by local connections.
+var requestsIssued = metrics.NewCounter("iris_requests_total", "Requests issued by local connections.")
+
+// Number of requests currently waiting for a reply.
+var requestsPending = metrics.NewGauge("iris_requests_pending", "Requests currently waiting for a reply.")
+
+// Number of requests that timed out before a reply arrived.
+var requestTimeouts = metrics.NewCounter("iris_request_timeouts_total", "Requests timed out before a reply arrived.")
+
+// Number of requests that failed remotely or due to termination.
+var requestFailures = metrics.NewCounter("iris_request_failures_total", "Requests failed remotely or due to local termination.")
+
+// Distribution of the round trip time of successful requests.
+var requestLatency = metrics.NewHistogram("iris_request_duration_seconds", "Round trip time of successful requests.", metrics.DefBuckets)
@@ -19,12 +19,12 @@
 package iris
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"fmt"
 	"log"
-	"net"
 	"sync"
 
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto/scribe"
 )
 
@@ -39,6 +39,14 @@ type Overlay struct {
 	subLive map[string][]uint64     // Live members of each subscribed topic
 	subLock map[string]sync.RWMutex // Locks protecting the individual topics
 
+	replayIdx uint64             // Tag to assign to the next durable topic replay
+	replays   map[uint64]*replay // Durable topic replays in progress
+
+	indexes   map[string]*interest // Cached interest in the index and presence topics
+	indexLock sync.Mutex           // Protects the topic interest cache
+
+	strategies []config.StrategyRule // Balancing strategies of the clusters
+
 	tunAddrs []string          // Listener addresses for the tunnel endpoints
 	tunQuits []chan chan error // Quit channels for the tunnel acceptors
 
@@ -46,13 +54,17 @@ type Overlay struct {
 }
 
 // Creates a new iris overlay.
-func New(overId string, key *rsa.PrivateKey) *Overlay {
+func New(overId string, key crypto.Signer) *Overlay {
 	// Create and initialize the overlay
 	o := &Overlay{
 		autoid:  1, // Zero's a special case with gob, skip it
 		conns:   make(map[uint64]*Connection),
 		subLive: make(map[string][]uint64),
 		subLock: make(map[string]sync.RWMutex),
+		replays: make(map[uint64]*replay),
+		indexes: make(map[string]*interest),
+
+		strategies: parseStrategies(),
 	}
 	o.scribe = scribe.New(overId, key, o)
 	return o
@@ -60,39 +72,25 @@ func New(overId string, key *rsa.PrivateKey) *Overlay {
 
 // Boots the overlay, returning the number of remote peers.
 func (o *Overlay) Boot() (int, error) {
+	// Refuse to start with balancing strategies that could not be honored
+	if err := o.checkStrategies(); err != nil {
+		return 0, err
+	}
 	// Boot the underlay and wait until it converges
 	peers, err := o.scribe.Boot()
 	if err != nil {
 		return 0, err
 	}
-	// Start a tunnel acceptor on each network interface
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		return 0, err
-	}
-	for _, addr := range addrs {
-		// Workaround for upstream Go issue #5395, extract IP from both IPNet and IPAddr
-		var ip net.IP
-		switch addr.(type) {
-		case *net.IPNet:
-			ip = addr.(*net.IPNet).IP
-		case *net.IPAddr:
-			ip = addr.(*net.IPAddr).IP
-		default:
-			log.Printf("iris: unknown interface address type for: %v.", addr)
-			continue
-		}
-		// Start the tunnel acceptor on non-localhost IPv4 networks
-		if !ip.IsLoopback() && ip.To4() != nil {
-			// Create a quit channel
-			quit := make(chan chan error)
-			o.tunQuits = append(o.tunQuits, quit)
-
-			// Start and sync the acceptor
-			live := make(chan struct{})
-			go o.tunneler(ip, live, quit)
-			<-live
-		}
+	// Start a tunnel acceptor on each network interface the underlay chose
+	for _, ipnet := range o.scribe.Interfaces() {
+		// Create a quit channel
+		quit := make(chan chan error)
+		o.tunQuits = append(o.tunQuits, quit)
+
+		// Start and sync the acceptor
+		live := make(chan struct{})
+		go o.tunneler(ipnet.IP, live, quit)
+		<-live
 	}
 	return peers, nil
 }
@@ -126,6 +124,13 @@ func (o *Overlay) Shutdown() error {
 	}
 }
 
+// Re-verifies the certificates of the connected peers against the cluster
+// authority after a reload, dropping the ones revoked since. Returns the number
+// of dropped peers.
+func (o *Overlay) Revalidate() int {
+	return o.scribe.Revalidate()
+}
+
 // Subscribes to a new topic, or adds the current connection to the list of live
 // subscriptions.
 func (o *Overlay) subscribe(id uint64, topic string) error {
@@ -145,10 +150,17 @@ func (o *Overlay) subscribe(id uint64, topic string) error {
 	}
 	o.lock.Unlock()
 
-	// If a new subscription was requested, do it
+	// If a new subscription was requested, do it (dropping it if refused)
 	if cascade {
-		return o.scribe.Subscribe(topic)
+		if err := o.scribe.Subscribe(topic); err != nil {
+			o.lock.Lock()
+			delete(o.subLive, topic)
+			delete(o.subLock, topic)
+			o.lock.Unlock()
+			return err
+		}
 	}
+	o.weigh(topic)
 	return nil
 }
 
@@ -196,5 +208,19 @@ func (o *Overlay) unsubscribe(id uint64, topic string) error {
 		return o.scribe.Unsubscribe(topic)
 	}
 	o.lock.Unlock()
+
+	o.weigh(topic)
 	return nil
 }
+
+// Updates the weight of a scribe subscription to the number of connections
+// sharing it, so that each counts as a separate member of the topic.
+func (o *Overlay) weigh(topic string) {
+	o.lock.RLock()
+	subs, ok := o.subLive[topic]
+	o.lock.RUnlock()
+
+	if ok {
+		o.scribe.Weigh(topic, len(subs))
+	}
+}
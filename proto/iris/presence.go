@@ -0,0 +1,261 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the cluster presence extension. Each service connection counts as a
+// member of its cluster: the local subscriptions of the cluster splits are
+// weighed by the number of connections sharing them, and the scribe census sums
+// these up through the topic trees.
+//
+// Membership watchers are notified of the individual joins and leaves through a
+// presence topic per cluster, into which service connections publish a notice
+// when registering and unregistering. Members vanishing without a notice (e.g.
+// crashed nodes, lost notices) are caught by periodically polling the census:
+// once it settled on a count differing from the tracked one, the difference is
+// reported as joins or leaves. The polls also refresh the reported capacity.
+
+package iris
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/scribe"
+)
+
+// Approximate membership of an iris cluster.
+type Presence struct {
+	Members  int // Number of service connections registered into the cluster
+	Capacity int // Total requests per second the members can take on
+}
+
+// Prefix of the topics carrying the membership notices of the clusters.
+const presencePrefix = "p#-"
+
+// Handler for the membership changes of a watched cluster.
+type MembershipHandler interface {
+	// Handles count members joining the cluster (one unless reconciled).
+	HandleJoin(count int, now *Presence)
+
+	// Handles count members leaving the cluster (one unless reconciled).
+	HandleLeave(count int, now *Presence)
+}
+
+// State of a cluster membership watch.
+type watch struct {
+	handler MembershipHandler // Handler to notify of the membership changes
+	pres    Presence          // Membership as tracked from notices and census
+	census  int               // Member count of the last census (-1 if none yet)
+	notice  time.Time         // Arrival time of the last membership notice
+	quit    chan struct{}     // Quit channel of the census poller
+	lock    sync.Mutex        // Mutex serializing the handler notifications
+}
+
+// Retrieves the approximate membership of cluster, waiting at most timeout for
+// the census of its topic trees.
+func (c *Connection) Presence(cluster string, timeout time.Duration) (*Presence, error) {
+	// Query the census of all the cluster splits concurrently
+	cens := make(chan *scribe.Census, config.IrisClusterSplits)
+	errc := make(chan error, config.IrisClusterSplits)
+	for _, prefix := range clusterPrefixes {
+		go func(topic string) {
+			if census, err := c.iris.scribe.Census(topic, timeout); err != nil {
+				errc <- err
+			} else {
+				cens <- census
+			}
+		}(prefix + cluster)
+	}
+	// Members and their capacities are in every split, so report a single split's
+	// worth (the average, to smooth out any staleness between the splits)
+	pres, perBeat := new(Presence), 0
+	for i := 0; i < config.IrisClusterSplits; i++ {
+		select {
+		case <-c.term:
+			return nil, ErrTerminating
+		case err := <-errc:
+			if err == scribe.ErrTimeout {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		case census := <-cens:
+			if census.Members > pres.Members {
+				pres.Members = census.Members
+			}
+			perBeat += census.Capacity
+		}
+	}
+	// The census counts the capacity per beat, convert it to the reported unit
+	pres.Capacity = int(int64(perBeat) * int64(time.Second) / (int64(config.ScribeBeatPeriod) * int64(config.IrisClusterSplits)))
+	return pres, nil
+}
+
+// Waits until at least members are present in cluster, or the timeout is
+// reached. It is meant to gate startup on the availability of the backends.
+func (c *Connection) AwaitPresence(cluster string, members int, timeout time.Duration) (*Presence, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		// Poll the cluster, bounding the query by the remaining time
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return nil, ErrTimeout
+		}
+		if wait > config.IrisPresencePoll {
+			wait = config.IrisPresencePoll
+		}
+		pres, err := c.Presence(cluster, wait)
+		switch {
+		case err == nil && pres.Members >= members:
+			return pres, nil
+		case err != nil && err != ErrTimeout:
+			return nil, err
+		}
+		// Not enough members yet, retry after a poll period
+		select {
+		case <-c.term:
+			return nil, ErrTerminating
+		case <-time.After(config.IrisPresencePoll):
+		}
+	}
+}
+
+// Starts watching the membership of cluster, reporting the joins and leaves to
+// handler until unwatched. The members already present are reported as joins.
+func (c *Connection) WatchMembership(cluster string, handler MembershipHandler) error {
+	c.presLock.Lock()
+	defer c.presLock.Unlock()
+
+	select {
+	case <-c.term:
+		return ErrTerminating
+	default:
+		if _, ok := c.watches[cluster]; ok {
+			return ErrSubscribed
+		}
+	}
+	w := &watch{
+		handler: handler,
+		census:  -1,
+		quit:    make(chan struct{}),
+	}
+	c.watches[cluster] = w
+	if err := c.iris.subscribe(c.id, presencePrefix+cluster); err != nil {
+		delete(c.watches, cluster)
+		return err
+	}
+	c.iris.resetInterest(presencePrefix + cluster)
+	go c.pollMembership(cluster, w)
+	return nil
+}
+
+// Stops watching the membership of cluster.
+func (c *Connection) UnwatchMembership(cluster string) error {
+	c.presLock.Lock()
+	defer c.presLock.Unlock()
+
+	w, ok := c.watches[cluster]
+	if !ok {
+		return ErrNotSubscribed
+	}
+	delete(c.watches, cluster)
+	close(w.quit)
+	return c.iris.unsubscribe(c.id, presencePrefix+cluster)
+}
+
+// Publishes a membership notice of the connection into its cluster's presence
+// topic, reaching the watchers. Notices are skipped while the last census found
+// nobody watching, which the periodic polls of any new watcher make up for.
+func (c *Connection) announce(joined bool) {
+	op := opLeave
+	if joined {
+		op = opJoin
+	}
+	topic := presencePrefix + c.cluster
+	if !c.iris.interested(topic) {
+		return
+	}
+	c.iris.scribe.Publish(topic, c.assemblePacket(&header{Op: op}, nil))
+}
+
+// Notifies the watcher of a cluster about a member joining or leaving.
+func (c *Connection) handleMembership(topic string, joined bool) {
+	c.presLock.Lock()
+	w, ok := c.watches[strings.TrimPrefix(topic, presencePrefix)]
+	c.presLock.Unlock()
+	if !ok {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.notice = time.Now()
+	if joined {
+		w.pres.Members++
+		now := w.pres
+		w.handler.HandleJoin(1, &now)
+	} else if w.pres.Members > 0 {
+		w.pres.Members--
+		now := w.pres
+		w.handler.HandleLeave(1, &now)
+	}
+}
+
+// Periodically polls the census of a watched cluster, refreshing the capacity
+// and reconciling the tracked member count.
+func (c *Connection) pollMembership(cluster string, w *watch) {
+	for {
+		if pres, err := c.Presence(cluster, config.IrisPresencePoll); err == nil {
+			w.reconcile(pres)
+		}
+		select {
+		case <-w.quit:
+			return
+		case <-c.term:
+			return
+		case <-time.After(config.IrisPresencePoll):
+		}
+	}
+}
+
+// Reconciles the tracked membership with a census. The first one reports the
+// members present before the watch, later ones are only trusted if they match
+// the previous one and no notices arrived for long enough to let the topic trees
+// catch up with them.
+func (w *watch) reconcile(pres *Presence) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	settle := time.Duration(config.ScribeKillCount+2) * config.ScribeBeatPeriod
+	initial := w.census < 0 && pres.Members > w.pres.Members
+	stable := pres.Members == w.census && time.Since(w.notice) > settle
+
+	w.pres.Capacity, w.census = pres.Capacity, pres.Members
+	if !initial && !stable {
+		return
+	}
+	diff := pres.Members - w.pres.Members
+	w.pres.Members = pres.Members
+
+	now := w.pres
+	switch {
+	case diff > 0:
+		w.handler.HandleJoin(diff, &now)
+	case diff < 0:
+		w.handler.HandleLeave(-diff, &now)
+	}
+}
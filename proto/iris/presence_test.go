@@ -0,0 +1,157 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Membership handler recording the changes.
+type presenceRecorder struct {
+	joins  int
+	leaves int
+	last   *Presence
+	lock   sync.Mutex
+}
+
+func (p *presenceRecorder) HandleJoin(count int, now *Presence) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.joins += count
+	p.last = now
+}
+
+func (p *presenceRecorder) HandleLeave(count int, now *Presence) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.leaves += count
+	p.last = now
+}
+
+// Tests that cluster presence is counted per connection, and that membership
+// watchers are notified of joins and leaves, even without a leave notice.
+func TestPresence(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	poll := config.IrisPresencePoll
+	config.IrisPresencePoll = 100 * time.Millisecond
+	defer func() { config.IrisPresencePoll = poll }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("presence-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	client, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	// Start watching the cluster before anybody joins
+	cluster := "presence-test-cluster"
+	watcher := &presenceRecorder{}
+	if err := client.WatchMembership(cluster, watcher); err != nil {
+		t.Fatalf("failed to watch cluster presence: %v.", err)
+	}
+	if err := client.WatchMembership(cluster, watcher); err != ErrSubscribed {
+		t.Fatalf("double watch mismatch: have %v, want %v.", err, ErrSubscribed)
+	}
+	// Register a few members into the cluster and wait for them
+	members := make([]*Connection, 3)
+	for i := 0; i < len(members); i++ {
+		conn, err := node.Connect(cluster, &requester{0, 0})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		members[i] = conn
+	}
+	pres, err := client.AwaitPresence(cluster, len(members), 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to await cluster members: %v.", err)
+	}
+	if pres.Members != len(members) {
+		t.Fatalf("member count mismatch: have %v, want %v.", pres.Members, len(members))
+	}
+	// Report the member capacities and check that the cluster totals them once
+	rate := 20
+	for _, member := range members {
+		if err := member.ReportCapacity(rate); err != nil {
+			t.Fatalf("failed to report capacity: %v.", err)
+		}
+	}
+	time.Sleep(3 * config.ScribeBeatPeriod)
+
+	if pres, err = client.Presence(cluster, time.Second); err != nil {
+		t.Fatalf("failed to retrieve cluster presence: %v.", err)
+	}
+	if pres.Capacity != len(members)*rate {
+		t.Fatalf("capacity mismatch: have %v, want %v.", pres.Capacity, len(members)*rate)
+	}
+	// Drop a member and check the notifications
+	members[0].Close()
+	defer members[1].Close()
+	defer members[2].Close()
+
+	time.Sleep(5 * config.IrisPresencePoll)
+
+	watcher.lock.Lock()
+	if watcher.joins != len(members) || watcher.leaves != 1 {
+		t.Fatalf("membership change mismatch: have %v/%v joins/leaves, want %v/%v.", watcher.joins, watcher.leaves, len(members), 1)
+	}
+	if watcher.last.Members != len(members)-1 {
+		t.Fatalf("last presence mismatch: have %v, want %v.", watcher.last.Members, len(members)-1)
+	}
+	watcher.lock.Unlock()
+
+	// Drop a member silently (crash), and check that the census catches it
+	atomic.StoreInt32(&members[1].unreg, 1)
+	for _, prefix := range clusterPrefixes {
+		node.unsubscribe(members[1].id, prefix+cluster)
+	}
+	time.Sleep(time.Duration(config.ScribeKillCount+4)*config.ScribeBeatPeriod + 3*config.IrisPresencePoll)
+
+	watcher.lock.Lock()
+	if watcher.joins != len(members) || watcher.leaves != 2 {
+		t.Fatalf("reconciled change mismatch: have %v/%v joins/leaves, want %v/%v.", watcher.joins, watcher.leaves, len(members), 2)
+	}
+	if watcher.last.Members != len(members)-2 {
+		t.Fatalf("reconciled presence mismatch: have %v, want %v.", watcher.last.Members, len(members)-2)
+	}
+	watcher.lock.Unlock()
+
+	if err := client.UnwatchMembership(cluster); err != nil {
+		t.Fatalf("failed to unwatch cluster presence: %v.", err)
+	}
+	// An empty cluster should time out awaiting members
+	if _, err := client.AwaitPresence("presence-test-none", 1, 300*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("empty cluster await mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+}
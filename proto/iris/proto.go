@@ -30,29 +30,39 @@ import (
 type opcode uint8
 
 const (
-	opBcast opcode = iota // Cluster broadcast
-	opReq                 // Cluster request
-	opRep                 // Cluster reply
-	opPub                 // Topic publish
-	opTun                 // Tunneling request
+	opBcast  opcode = iota // Cluster broadcast
+	opReq                  // Cluster request
+	opRep                  // Cluster reply
+	opPub                  // Topic publish
+	opTun                  // Tunneling request
+	opReqAll               // Cluster scatter-gather request
+	opRepAll               // Cluster scatter-gather reply
+	opAckAll               // Cluster scatter-gather acknowledgement
+	opJoin                 // Cluster member join notice
+	opLeave                // Cluster member leave notice
 )
 
 // Extra headers for the Iris layer.
 type header struct {
 	Op   opcode // Operation code of the message
-	Src  uint64 // Connection id of the sender (requests, tunnel)
+	Src  uint64 // Connection id of the sender (requests, gather replies, tunnel)
 	Dest uint64 // Connection id of the recipient (direct messages)
 
+	// Optional fields for publishes
+	Topic string // Concrete topic of an index topic event
+
 	// Optional fields for requests and replies
 	ReqId   uint64        // Request/response identifier
 	ReqFail bool          // Flag whether a request failed
 	ReqTime time.Duration // Maximum amount of time spendable on the request
+	ReqKey  string        // Routing key of a key affine request
 
 	// Optional fields for tunnels
-	TunId    uint64        // Id of the tunnel being requested
-	TunKey   []byte        // Secret symmetric key of the tunnel
-	TunAddrs []string      // Tunnel listener endpoints
-	TunTime  time.Duration // Maximum time to establish tunnel
+	TunId     uint64        // Id of the tunnel being requested
+	TunKey    []byte        // Secret symmetric key of the tunnel
+	TunAddrs  []string      // Tunnel listener endpoints
+	TunTime   time.Duration // Maximum time to establish tunnel
+	TunSuites []byte        // Cipher suites offered for the tunnel link
 }
 
 // Make sure the header struct is registered with gob.
@@ -82,6 +92,13 @@ func (c *Connection) assembleRequest(reqId uint64, req []byte, timeout time.Dura
 	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout}, req)
 }
 
+// Assembles a key affine application request message, which apart from the
+// routing key (needed to pick the serving connection) is identical to a normal
+// request.
+func (c *Connection) assembleKeyedRequest(reqId uint64, req []byte, timeout time.Duration, key string) *proto.Message {
+	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout, ReqKey: key}, req)
+}
+
 // Assembles the reply message to an application request. It consists of the
 // reply opcode, the original request's id and the payload itself.
 func (c *Connection) assembleReply(dest uint64, reqId uint64, rep []byte, err error) *proto.Message {
@@ -92,15 +109,43 @@ func (c *Connection) assembleReply(dest uint64, reqId uint64, rep []byte, err er
 	}
 }
 
+// Assembles a scatter-gather request message. It consists of the request-all
+// opcode, the locally unique request id and the payload.
+func (c *Connection) assembleRequestAll(reqId uint64, req []byte, timeout time.Duration) *proto.Message {
+	return c.assemblePacket(&header{Op: opReqAll, Src: c.id, ReqId: reqId, ReqTime: timeout}, req)
+}
+
+// Assembles a member reply to a scatter-gather request. Apart from the opcode,
+// it differs from a normal reply in also identifying the replying connection.
+func (c *Connection) assembleReplyAll(dest uint64, reqId uint64, rep []byte, err error) *proto.Message {
+	if err == nil {
+		return c.assemblePacket(&header{Op: opRepAll, Src: c.id, Dest: dest, ReqId: reqId}, rep)
+	}
+	return c.assemblePacket(&header{Op: opRepAll, Src: c.id, Dest: dest, ReqId: reqId, ReqFail: true}, []byte(err.Error()))
+}
+
+// Assembles the acknowledgement of a scatter-gather request, identifying the
+// member that received it.
+func (c *Connection) assembleAckAll(dest uint64, reqId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opAckAll, Src: c.id, Dest: dest, ReqId: reqId}, nil)
+}
+
 // Assembles an event message to be published in a topic. It consists of the
 // publish opcode and the payload.
 func (c *Connection) assemblePublish(msg []byte) *proto.Message {
 	return c.assemblePacket(&header{Op: opPub}, msg)
 }
 
+// Assembles an event message to be published in an index topic. Beside the
+// publish opcode and payload, it also contains the concrete topic of the event
+// to allow filtering by the wildcard subscribers.
+func (c *Connection) assembleIndexPublish(topic string, msg []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opPub, Topic: topic}, msg)
+}
+
 // Assembles a tunneling request message, consisting of the tunneling opcode,
-// local tunnel id, assigned secret key and reachability infos for the reverse
-// stream connection.
-func (c *Connection) assembleTunnelRequest(tunId uint64, key []byte, addrs []string, timeout time.Duration) *proto.Message {
-	return c.assemblePacket(&header{Op: opTun, Src: c.id, TunId: tunId, TunKey: key, TunAddrs: addrs, TunTime: timeout}, nil)
+// local tunnel id, assigned secret key, offered cipher suites and reachability
+// infos for the reverse stream connection.
+func (c *Connection) assembleTunnelRequest(tunId uint64, key []byte, suites []byte, addrs []string, timeout time.Duration) *proto.Message {
+	return c.assemblePacket(&header{Op: opTun, Src: c.id, TunId: tunId, TunKey: key, TunSuites: suites, TunAddrs: addrs, TunTime: timeout}, nil)
 }
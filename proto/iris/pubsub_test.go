@@ -154,3 +154,49 @@ func testPubSub(t *testing.T, nodes, conns, msgs int) {
 		}
 	}
 }
+
+// Tests that reliable publishes report the delivering nodes.
+func TestPublishReliable(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reliable-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	sub := &subscriber{make(chan []byte, 1)}
+	if err := conn.Subscribe("reliable", sub); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	// Publish a few events, each should be acknowledged by the local node
+	for i := 0; i < 3; i++ {
+		rec, err := conn.PublishReliable("reliable", []byte{byte(i)}, time.Second)
+		if err != nil {
+			t.Fatalf("failed to publish reliably: %v.", err)
+		}
+		if len(rec.Delivered) != 1 || len(rec.Missing) != 0 {
+			t.Fatalf("receipt mismatch: have %+v, want single delivery.", rec)
+		}
+		select {
+		case msg := <-sub.msgs:
+			if msg[0] != byte(i) {
+				t.Fatalf("event mismatch: have %v, want %v.", msg[0], i)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("event not delivered.")
+		}
+	}
+	if _, err := conn.PublishReliable("reliable.*", nil, time.Second); err != ErrPattern {
+		t.Fatalf("pattern publish result mismatch: have %v, want %v.", err, ErrPattern)
+	}
+}
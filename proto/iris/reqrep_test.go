@@ -159,3 +159,283 @@ func testReqRep(t *testing.T, nodes, conns, reqs int) {
 		}
 	}
 }
+
+// Tests that idempotent requests (with failover) are served like normal ones.
+func TestReqRepIdempotent(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("reqrep-test-idempotent", &requester{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	opts := &RequestOptions{Idempotent: true}
+	for i := 0; i < 100; i++ {
+		req := []byte{byte(i)}
+		if rep, err := conn.RequestWithOptions("reqrep-test-idempotent", req, time.Second, opts); err != nil {
+			t.Fatalf("failed to send request: %v.", err)
+		} else if bytes.Compare(req, rep) != 0 {
+			t.Fatalf("req/rep mismatch: have %v, want %v.", rep, req)
+		}
+	}
+}
+
+// Tests that a service can leave its cluster while it's being inspected and
+// while it's closing, without further requests reaching it.
+func TestUnregister(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	cluster := "reqrep-test-unregister"
+	serv, err := node.Connect(cluster, &requester{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	client, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Request(cluster, []byte{0x01}, time.Second); err != nil {
+		t.Fatalf("failed to execute request: %v.", err)
+	}
+	// Unregister concurrently with inspecting the connection
+	var pend sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		pend.Add(2)
+		go func() {
+			defer pend.Done()
+			serv.Unregister()
+		}()
+		go func() {
+			defer pend.Done()
+			node.Stats()
+			serv.ReportCapacity(10)
+		}()
+	}
+	pend.Wait()
+
+	if err := serv.ReportCapacity(10); err != ErrNotService {
+		t.Fatalf("unregistered capacity report mismatch: have %v, want %v.", err, ErrNotService)
+	}
+	if _, err := client.Request(cluster, []byte{0x01}, 250*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("unregistered request mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	if err := serv.Close(); err != nil {
+		t.Fatalf("failed to close unregistered service: %v.", err)
+	}
+}
+
+// Request handler failing every request.
+type faultyRequester struct {
+	requester
+}
+
+func (r *faultyRequester) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	return nil, fmt.Errorf("failed: %v", req)
+}
+
+// Tests that scatter-gather requests collect a reply from every cluster member.
+func TestRequestAll(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Register a few members into the cluster, one of them failing requests
+	cluster := "reqrep-test-all"
+	for i := 0; i < 3; i++ {
+		var handler ConnectionHandler = &requester{0, 0}
+		if i == 2 {
+			handler = &faultyRequester{}
+		}
+		conn, err := node.Connect(cluster, handler)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+	}
+	client, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	// Scatter a request and check the gathered replies, arriving before the timeout
+	start := time.Now()
+	replies, err := client.RequestAll(cluster, []byte{0x01}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to execute scatter-gather request: %v.", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("gathering not finished early: have %v, want < %v.", elapsed, time.Second)
+	}
+	if len(replies) != 3 {
+		t.Fatalf("reply count mismatch: have %v, want %v.", len(replies), 3)
+	}
+	members := make(map[string]struct{})
+	faults := 0
+	for _, reply := range replies {
+		members[reply.Member] = struct{}{}
+		if reply.Err != nil {
+			faults++
+		} else if bytes.Compare(reply.Reply, []byte{0x01}) != 0 {
+			t.Fatalf("reply mismatch: have %v, want %v.", reply.Reply, []byte{0x01})
+		}
+	}
+	if len(members) != 3 {
+		t.Fatalf("distinct member count mismatch: have %v, want %v.", len(members), 3)
+	}
+	if faults != 1 {
+		t.Fatalf("member fault count mismatch: have %v, want %v.", faults, 1)
+	}
+	// Requests to an empty cluster should gather nothing
+	if replies, err := client.RequestAll("reqrep-test-none", nil, 100*time.Millisecond); err != nil || len(replies) != 0 {
+		t.Fatalf("empty cluster result mismatch: have %v/%v, want none.", replies, err)
+	}
+}
+
+// Request handler stalling longer than the requests allow.
+type stalledRequester struct {
+	requester
+}
+
+func (r *stalledRequester) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	time.Sleep(4 * timeout)
+	return req, nil
+}
+
+// Tests that scatter-gather requests report the members failing to reply in time.
+func TestRequestAllMissing(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Register a live and a stalled member into the cluster
+	cluster := "reqrep-test-missing"
+	live, err := node.Connect(cluster, &requester{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer live.Close()
+
+	stalled, err := node.Connect(cluster, &stalledRequester{})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer stalled.Close()
+
+	client, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	// Scatter a request and check that the stalled member is reported
+	replies, err := client.RequestAll(cluster, []byte{0x01}, 250*time.Millisecond)
+	gerr, ok := err.(*GatherError)
+	if !ok {
+		t.Fatalf("gather error mismatch: have %v, want *GatherError.", err)
+	}
+	if len(replies) != 1 {
+		t.Fatalf("reply count mismatch: have %v, want %v.", len(replies), 1)
+	}
+	if len(gerr.Missing) != 1 || gerr.Unknown != 0 {
+		t.Fatalf("missing members mismatch: have %v/%v, want 1/0.", gerr.Missing, gerr.Unknown)
+	}
+	if gerr.Missing[0] == replies[0].Member {
+		t.Fatalf("replying member reported missing: %v.", gerr.Missing[0])
+	}
+}
+
+// Request handler replying with its own identifier.
+type namedRequester struct {
+	requester
+	name byte
+}
+
+func (r *namedRequester) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	return []byte{r.name}, nil
+}
+
+// Tests that requests with the same routing key are served by the same member.
+func TestReqRepKeyed(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Register a few members into the cluster, each replying with its own name
+	cluster := "reqrep-test-keyed"
+	for i := 0; i < 4; i++ {
+		conn, err := node.Connect(cluster, &namedRequester{name: byte(i)})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+	}
+	client, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	// Send a batch of keyed requests a few times over, checking the owners
+	owners := make(map[string]byte)
+	members := make(map[byte]struct{})
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 32; i++ {
+			opts := &RequestOptions{Key: fmt.Sprintf("user-%d", i)}
+			rep, err := client.RequestWithOptions(cluster, nil, time.Second, opts)
+			if err != nil {
+				t.Fatalf("failed to send keyed request: %v.", err)
+			}
+			if owner, ok := owners[opts.Key]; ok && owner != rep[0] {
+				t.Fatalf("key %s owner mismatch: have %v, want %v.", opts.Key, rep[0], owner)
+			}
+			owners[opts.Key] = rep[0]
+			members[rep[0]] = struct{}{}
+		}
+	}
+	if len(members) < 2 {
+		t.Fatalf("keys not spread among members: owners %v.", members)
+	}
+}
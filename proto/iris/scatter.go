@@ -0,0 +1,207 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the scatter-gather requests. A request to all members of a cluster is
+// published into one of the cluster's topic splits, reaching every member like a
+// broadcast would, and each member acknowledges the request and later replies
+// directly to the requester, tagging both with its own identity. Meanwhile the
+// requester runs a census of the cluster to learn the number of members, and
+// collects the replies until all of them answered or the deadline passes. In
+// the latter case the acknowledged but unanswered members are reported.
+
+package iris
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Reply of a single cluster member to a scatter-gather request.
+type MemberReply struct {
+	Member string // Identifier of the replying member (node and connection id)
+	Reply  []byte // Reply data, nil if the member failed
+	Err    error  // Member side failure, if any
+}
+
+// Failure of a scatter-gather request to collect a reply from every member the
+// cluster census expected within the timeout.
+type GatherError struct {
+	Missing []string // Members that acknowledged the request but did not reply
+	Unknown int      // Further members counted by the census that did not even acknowledge
+}
+
+// Implements the error interface, listing the missing members.
+func (e *GatherError) Error() string {
+	return fmt.Sprintf("timeout: %d members missing: %v (+%d unacknowledged)", len(e.Missing)+e.Unknown, e.Missing, e.Unknown)
+}
+
+// Replies collected for a scatter-gather request in progress.
+type gather struct {
+	replies []*MemberReply
+	members map[string]struct{} // Members that already replied
+	acked   map[string]struct{} // Members that acknowledged the request
+	expect  int                 // Number of members in the cluster (-1 until the census answers)
+	done    chan struct{}       // Closed when all the expected members replied
+}
+
+// Closes the done channel if all the expected members replied. The caller must
+// hold the request lock.
+func (g *gather) check() {
+	if g.expect >= 0 && len(g.replies) >= g.expect {
+		select {
+		case <-g.done:
+		default:
+			close(g.done)
+		}
+	}
+}
+
+// Executes a synchronous request to all members of cluster, and returns the
+// replies (or member side failures) of those answering within the timeout. The
+// call returns as soon as every member counted by the cluster census replied;
+// if some did not in time, the gathered replies are returned together with a
+// *GatherError. As the census is approximate, a member joining mid-request may
+// be missed.
+func (c *Connection) RequestAll(cluster string, req []byte, timeout time.Duration) ([]*MemberReply, error) {
+	g := &gather{
+		replies: []*MemberReply{},
+		members: make(map[string]struct{}),
+		acked:   make(map[string]struct{}),
+		expect:  -1,
+		done:    make(chan struct{}),
+	}
+	c.reqLock.Lock()
+	reqId := c.reqIdx
+	c.reqIdx++
+	c.reqAlls[reqId] = g
+	c.reqLock.Unlock()
+
+	// Make sure the collector is cleaned up
+	defer func() {
+		c.reqLock.Lock()
+		delete(c.reqAlls, reqId)
+		c.reqLock.Unlock()
+	}()
+	// Count the members concurrently to know when the gathering is complete
+	go func() {
+		if pres, err := c.Presence(cluster, timeout); err == nil {
+			c.reqLock.Lock()
+			g.expect = pres.Members
+			g.check()
+			c.reqLock.Unlock()
+		}
+	}()
+	// Scatter the request to the cluster members
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	if err := c.iris.scribe.Publish(clusterPrefixes[prefixIdx]+cluster, c.assembleRequestAll(reqId, req, timeout)); err != nil {
+		return nil, err
+	}
+	// Gather the replies until all arrive or the deadline passes, or fail if terminating
+	select {
+	case <-c.term:
+		return nil, ErrTerminating
+	case <-g.done:
+	case <-time.After(timeout):
+	}
+	c.reqLock.Lock()
+	defer c.reqLock.Unlock()
+
+	replies := g.replies
+	g.replies = nil
+
+	sort.Sort(memberReplySorter(replies))
+
+	// Report the members missing according to the census, if any
+	if g.expect < 0 || len(replies) >= g.expect {
+		return replies, nil
+	}
+	missing := []string{}
+	for member := range g.acked {
+		if _, ok := g.members[member]; !ok {
+			missing = append(missing, member)
+		}
+	}
+	sort.Strings(missing)
+
+	unknown := g.expect - len(replies) - len(missing)
+	if unknown < 0 {
+		unknown = 0
+	}
+	return replies, &GatherError{Missing: missing, Unknown: unknown}
+}
+
+// Acknowledges a scatter-gather request and passes it up to the application
+// handler, forwarding the reply or the binding side failure to the requester.
+func (c *Connection) handleRequestAll(srcNode *big.Int, srcConn uint64, reqId uint64, msg []byte, timeout time.Duration) {
+	c.iris.scribe.Direct(srcNode, c.assembleAckAll(srcConn, reqId))
+
+	rep, err := c.handler.HandleRequest(msg, timeout)
+	if err == ErrTerminating || err == ErrTimeout {
+		return
+	}
+	c.iris.scribe.Direct(srcNode, c.assembleReplyAll(srcConn, reqId, rep, err))
+}
+
+// Inserts a member reply into the collector of a scatter-gather request, if it
+// is still in progress. Duplicate replies from the same member are dropped.
+func (c *Connection) handleReplyAll(srcNode *big.Int, srcConn uint64, reqId uint64, failed bool, data []byte) {
+	c.reqLock.Lock()
+	defer c.reqLock.Unlock()
+
+	g, ok := c.reqAlls[reqId]
+	if !ok || g.replies == nil {
+		return
+	}
+	member := fmt.Sprintf("%v/%d", srcNode, srcConn)
+	if _, ok := g.members[member]; ok {
+		return
+	}
+	g.members[member] = struct{}{}
+
+	reply := &MemberReply{Member: member}
+	if failed {
+		reply.Err = errors.New(string(data))
+	} else {
+		reply.Reply = data
+	}
+	g.replies = append(g.replies, reply)
+	g.check()
+}
+
+// Records the acknowledgement of a scatter-gather request by a member, used to
+// identify it if the reply does not arrive in time.
+func (c *Connection) handleAckAll(srcNode *big.Int, srcConn uint64, reqId uint64) {
+	c.reqLock.Lock()
+	defer c.reqLock.Unlock()
+
+	if g, ok := c.reqAlls[reqId]; ok && g.replies != nil {
+		g.acked[fmt.Sprintf("%v/%d", srcNode, srcConn)] = struct{}{}
+	}
+}
+
+// Sorter for the member replies to order them by member id.
+type memberReplySorter []*MemberReply
+
+func (s memberReplySorter) Len() int           { return len(s) }
+func (s memberReplySorter) Less(i, j int) bool { return s[i].Member < s[j].Member }
+func (s memberReplySorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
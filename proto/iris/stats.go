@@ -0,0 +1,109 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the statistics snapshot of the iris overlay, exposing the attached
+// client connections and their subscriptions.
+
+package iris
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/project-iris/iris/proto/scribe"
+)
+
+// Snapshot of the iris overlay state.
+type Stats struct {
+	Connections   []ConnectionStats `json:"connections"`      // Live client connections
+	Subscriptions map[string]int    `json:"subscriptions"`    // Scribe topics with the number of local subscribers
+	Scribe        *scribe.Stats     `json:"scribe,omitempty"` // Snapshot of the underlying scribe overlay
+}
+
+// Snapshot of a single client connection.
+type ConnectionStats struct {
+	Id       uint64   `json:"id"`       // Auto-incremented connection id
+	Cluster  string   `json:"cluster"`  // Cluster registered into (empty for clients)
+	Topics   []string `json:"topics"`   // Topics subscribed to
+	Requests int      `json:"requests"` // Pending outbound requests
+	Tunnels  int      `json:"tunnels"`  // Live or initializing tunnels
+}
+
+// Gathers a snapshot of the iris, scribe and pastry overlay states.
+func (o *Overlay) Stats() *Stats {
+	stats := &Stats{
+		Subscriptions: make(map[string]int),
+	}
+	o.lock.RLock()
+	conns := make([]*Connection, 0, len(o.conns))
+	for _, conn := range o.conns {
+		conns = append(conns, conn)
+	}
+	for topic, ids := range o.subLive {
+		stats.Subscriptions[topic] = len(ids)
+	}
+	o.lock.RUnlock()
+
+	stats.Connections = make([]ConnectionStats, 0, len(conns))
+	for _, conn := range conns {
+		stats.Connections = append(stats.Connections, conn.stats())
+	}
+	sort.Sort(connStatsSorter(stats.Connections))
+
+	stats.Scribe = o.scribe.Stats()
+	return stats
+}
+
+// Gathers a snapshot of the connection state.
+func (c *Connection) stats() ConnectionStats {
+	stats := ConnectionStats{
+		Id:     c.id,
+		Topics: []string{},
+	}
+	if c.registered() {
+		stats.Cluster = c.cluster
+	}
+	// Collect the topics (stripping the split prefixes) and patterns
+	c.subLock.RLock()
+	for topic, _ := range c.subLive {
+		if strings.HasPrefix(topic, topicPrefixes[0]) {
+			stats.Topics = append(stats.Topics, strings.TrimPrefix(topic, topicPrefixes[0]))
+		}
+	}
+	for pattern, _ := range c.wildLive {
+		stats.Topics = append(stats.Topics, pattern)
+	}
+	c.subLock.RUnlock()
+	sort.Strings(stats.Topics)
+
+	c.reqLock.RLock()
+	stats.Requests = len(c.reqReps)
+	c.reqLock.RUnlock()
+
+	c.tunLock.RLock()
+	stats.Tunnels = len(c.tunLive)
+	c.tunLock.RUnlock()
+
+	return stats
+}
+
+// Sorter for the connection snapshots to get a stable listing.
+type connStatsSorter []ConnectionStats
+
+func (s connStatsSorter) Len() int           { return len(s) }
+func (s connStatsSorter) Less(i, j int) bool { return s[i].Id < s[j].Id }
+func (s connStatsSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
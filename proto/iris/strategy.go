@@ -0,0 +1,65 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the resolution of the load balancing strategies configured for the
+// service clusters, the first "pattern=strategy" entry matching a cluster name
+// deciding which strategy its requests are distributed with. The syntax of the
+// entries is validated by the configuration loader, whereas the strategy names
+// are only resolved when booting, to allow registering custom ones until then.
+
+package iris
+
+import (
+	"fmt"
+	"log"
+	"path"
+
+	"github.com/project-iris/iris/balancer"
+	"github.com/project-iris/iris/config"
+)
+
+// Parses the configured cluster strategies, dropping all of them if malformed
+// (only possible if the configuration was modified bypassing the loader).
+func parseStrategies() []config.StrategyRule {
+	rules, err := config.ParseStrategies(config.IrisClusterStrategies)
+	if err != nil {
+		log.Printf("iris: invalid cluster strategies: %v.", err)
+		return nil
+	}
+	return rules
+}
+
+// Checks that all the configured cluster strategies are known to the balancer.
+func (o *Overlay) checkStrategies() error {
+	for _, rule := range o.strategies {
+		if _, err := balancer.NewStrategy(rule.Strategy); err != nil {
+			return fmt.Errorf("cluster strategy for %q: %v", rule.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// Looks up the configured balancing strategy of a cluster, returning an empty
+// string if no entry matches (i.e. the default strategy).
+func (o *Overlay) clusterStrategy(cluster string) string {
+	for _, rule := range o.strategies {
+		if ok, _ := path.Match(rule.Pattern, cluster); ok {
+			return rule.Strategy
+		}
+	}
+	return ""
+}
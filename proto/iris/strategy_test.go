@@ -0,0 +1,47 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that cluster strategies are resolved by the first matching entry, and
+// that unknown strategy names prevent the overlay from booting.
+func TestClusterStrategies(t *testing.T) {
+	defer func(rules []string) { config.IrisClusterStrategies = rules }(config.IrisClusterStrategies)
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	config.IrisClusterStrategies = []string{"api-*=round-robin", "*=least-pending"}
+	overlay := New(overId, key)
+	if err := overlay.checkStrategies(); err != nil {
+		t.Fatalf("failed to check known strategies: %v.", err)
+	}
+	for cluster, strategy := range map[string]string{"api-v1": "round-robin", "db": "least-pending"} {
+		if have := overlay.clusterStrategy(cluster); have != strategy {
+			t.Fatalf("cluster %s: strategy mismatch: have %v, want %v.", cluster, have, strategy)
+		}
+	}
+	config.IrisClusterStrategies = []string{"api-*=fastest"}
+	if _, err := New(overId, key).Boot(); err == nil {
+		t.Fatalf("booted with unknown strategy.")
+	}
+}
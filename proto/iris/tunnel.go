@@ -35,12 +35,14 @@ import (
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/link"
 	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/system"
 )
 
 // The initialization packet when the tunnel is set up.
 type initPacket struct {
 	ConnId uint64 // Id of the Iris client connection requesting the tunnel
 	TunId  uint64 // Id of the tunnel being built
+	Suite  byte   // Cipher suite chosen for the link (zero, i.e. legacy, for legacy nodes)
 }
 
 // Authorization packet to send over the established encrypted tunnels.
@@ -74,7 +76,7 @@ func (o *Overlay) tunneler(ip net.IP, live chan struct{}, quit chan chan error)
 
 	// Save the new listener address into the local (sorted) address list
 	o.lock.Lock()
-	o.tunAddrs = append(o.tunAddrs, addr.String())
+	o.tunAddrs = append(o.tunAddrs, system.AdvertisedAddr(addr))
 	sort.Strings(o.tunAddrs)
 	o.lock.Unlock()
 
@@ -119,6 +121,7 @@ type Tunnel struct {
 
 	conn   *link.Link // Encrypted data link of the tunnel
 	secret []byte     // Master key from which to derive the link keys
+	offer  []byte     // Cipher suites offered for the link
 
 	init chan *link.Link // Channel to receive the reverse tunnel link
 	term chan struct{}   // Channel to signal termination to blocked go-routines
@@ -142,17 +145,22 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 	c.tunLive[tunId] = tun
 	c.tunLock.Unlock()
 
-	// Create the master encryption key
+	// Create the master encryption key and the cipher suite offer
 	tun.secret = make([]byte, config.StsCipherBits>>3)
 	if _, err := io.ReadFull(rand.Reader, tun.secret); err != nil {
 		return nil, err
 	}
+	offer, err := link.Offer()
+	if err != nil {
+		return nil, err
+	}
+	tun.offer = offer
+
 	// Send the tunneling request
 	prefixIdx := int(tunId) % config.IrisClusterSplits
-	c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, c.assembleTunnelRequest(tunId, tun.secret, c.iris.tunAddrs, timeout))
+	c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, c.assembleTunnelRequest(tunId, tun.secret, tun.offer, c.iris.tunAddrs, timeout))
 
 	// Retrieve the results, time out or terminate
-	var err error
 	select {
 	case <-c.term:
 		err = ErrTerminating
@@ -171,7 +179,7 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 			tun.conn = conn
 		}
 		// Clean up init fields and return established tunnel
-		tun.secret, tun.init = nil, nil
+		tun.secret, tun.offer, tun.init = nil, nil, nil
 		return tun, nil
 	}
 	// Tunneling failed, clean up and report error
@@ -184,7 +192,7 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 
 // Accepts an incoming tunneling request from a remote, initializes and stores
 // the new tunnel into the connection state.
-func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []string, timeout time.Duration) (*Tunnel, error) {
+func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, suites []byte, addrs []string, timeout time.Duration) (*Tunnel, error) {
 	deadline := time.Now().Add(timeout)
 
 	// Create the local tunnel endpoint
@@ -211,7 +219,7 @@ func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []s
 	// If no error occurred, initialize the client endpoint
 	if err == nil {
 		var conn *link.Link
-		conn, err = c.initClientTunnel(strm, remote, id, key, deadline)
+		conn, err = c.initClientTunnel(strm, remote, id, key, suites, deadline)
 		if err != nil {
 			if err := strm.Close(); err != nil {
 				log.Printf("iris: failed to close uninitialized client tunnel stream: %v.", err)
@@ -262,10 +270,12 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 	if !ok {
 		return errors.New("tunnel not found")
 	}
-	// Create the encrypted link
-	hasher := func() hash.Hash { return config.HkdfHash.New() }
-	hkdf := hkdf.New(hasher, tun.secret, config.HkdfSalt, config.HkdfInfo)
-	conn := link.New(strm, hkdf, true)
+	// Make sure the chosen cipher suite was offered, and create the encrypted link
+	suite, err := link.Verify(tun.offer, init.Suite)
+	if err != nil {
+		return err
+	}
+	conn := link.New(strm, tunnelKdf(tun.secret, tun.offer, suite), true, suite)
 
 	// Send and retrieve an authorization to verify both directions
 	auth := &proto.Message{
@@ -296,20 +306,23 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 }
 
 // Initializes a stream into an encrypted tunnel link.
-func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uint64, key []byte, deadline time.Time) (*link.Link, error) {
+func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uint64, key []byte, suites []byte, deadline time.Time) (*link.Link, error) {
 	// Set a socket deadline for finishing the handshake
 	strm.Sock().SetDeadline(deadline)
 	defer strm.Sock().SetDeadline(time.Time{})
 
-	// Send the unencrypted tunnel id to associate with the remote tunnel
-	init := &initPacket{ConnId: remote, TunId: id}
+	// Pick the cipher suite of the link
+	suite, err := link.Choose(suites)
+	if err != nil {
+		return nil, err
+	}
+	// Send the unencrypted tunnel id and suite to associate with the remote tunnel
+	init := &initPacket{ConnId: remote, TunId: id, Suite: suite.Id}
 	if err := strm.Send(init); err != nil {
 		return nil, err
 	}
 	// Create the encrypted link and authorize it
-	hasher := func() hash.Hash { return config.HkdfHash.New() }
-	hkdf := hkdf.New(hasher, key, config.HkdfSalt, config.HkdfInfo)
-	conn := link.New(strm, hkdf, false)
+	conn := link.New(strm, tunnelKdf(key, suites, suite), false, suite)
 
 	// Send and retrieve an authorization to verify both directions
 	auth := &proto.Message{
@@ -331,6 +344,18 @@ func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uin
 	return conn, nil
 }
 
+// Creates the key derivation function of a tunnel link. Unless the legacy suite
+// was chosen, the negotiation is mixed into the keys, so a tampered choice fails
+// the link authorization.
+func tunnelKdf(secret []byte, offer []byte, suite *link.Suite) io.Reader {
+	info := config.HkdfInfo
+	if suite.Name != link.LegacySuite {
+		info = append(append([]byte(nil), info...), link.Transcript(offer, suite.Id)...)
+	}
+	hasher := func() hash.Hash { return suite.KdfHash.New() }
+	return hkdf.New(hasher, secret, config.HkdfSalt, info)
+}
+
 // Closes the tunnel connection.
 func (t *Tunnel) Close() error {
 	if t.owner.handleTunnelClose(t.id) {
@@ -0,0 +1,270 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the wildcard topic subscriptions. Topics are hierarchical, with dot
+// separated segments. A pattern may contain '*' segments matching exactly one
+// segment, and a trailing '>' segment matching one or more segments, but its
+// first segment must be literal (e.g. orders.*.created, metrics.>).
+//
+// Since scribe routes each topic to a single rendezvous point, patterns cannot
+// be resolved directly. Instead, every hierarchical topic has an index topic
+// named after its first segment (e.g. orders.>), into which all its events are
+// published too, tagged with the concrete topic. Pattern subscribers join the
+// index tree and filter the events locally.
+//
+// To keep the index roots from becoming hotspots, events are only published into
+// an index if a census of its tree found members, cached for IrisIndexInterest.
+// A new pattern may thus miss the events published by other nodes during that
+// period after subscribing.
+
+package iris
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Wildcard specific errors
+var ErrPattern = errors.New("invalid topic pattern")
+
+// Topic segment separator and wildcard tokens.
+const (
+	topicSep   = "."
+	wildSingle = "*"
+	wildMulti  = ">"
+)
+
+// Checks whether a topic contains any wildcard segments.
+func isPattern(topic string) bool {
+	for _, seg := range strings.Split(topic, topicSep) {
+		if seg == wildSingle || seg == wildMulti {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifies that a pattern is well formed: no empty segments, a literal first
+// segment and a multi-segment wildcard only at the end.
+func checkPattern(pattern string) error {
+	segs := strings.Split(pattern, topicSep)
+	if len(segs) < 2 || segs[0] == wildSingle || segs[0] == wildMulti {
+		return ErrPattern
+	}
+	for i, seg := range segs {
+		if seg == "" || (seg == wildMulti && i != len(segs)-1) {
+			return ErrPattern
+		}
+	}
+	return nil
+}
+
+// Checks whether a wildcard pattern covers a topic, which may itself be a
+// pattern: every concrete topic matched by the latter must be matched by the
+// former too. For a concrete topic this is a plain match.
+func CoversTopic(pattern, topic string) bool {
+	pats, segs := strings.Split(pattern, topicSep), strings.Split(topic, topicSep)
+	for i, pat := range pats {
+		if pat == wildMulti {
+			return len(segs) > i
+		}
+		if i >= len(segs) {
+			return false
+		}
+		switch pat {
+		case wildSingle:
+			if segs[i] == wildMulti {
+				return false
+			}
+		default:
+			if pat != segs[i] {
+				return false
+			}
+		}
+	}
+	return len(pats) == len(segs)
+}
+
+// Returns the name of the index topic collecting the events of a hierarchical
+// topic or pattern, or the empty string if the topic is not hierarchical.
+func indexTopic(topic string) string {
+	if i := strings.Index(topic, topicSep); i > 0 {
+		return topic[:i] + topicSep + wildMulti
+	}
+	return ""
+}
+
+// Interest in a scribe topic, as of the last census of its tree.
+type interest struct {
+	live    bool      // Whether the topic tree had any members
+	expiry  time.Time // Time after which the census is refreshed
+	pending bool      // Whether a refreshing census is in flight
+}
+
+// Reports whether an index topic has wildcard subscribers to publish to (all
+// patterns join every split, so the first one suffices).
+func (o *Overlay) indexed(index string) bool {
+	return o.interested(topicPrefixes[0] + index)
+}
+
+// Drops the cached interest in an index topic, so that local publishes reach a
+// freshly joined pattern without waiting for the next census.
+func (o *Overlay) resetIndex(index string) {
+	o.resetInterest(topicPrefixes[0] + index)
+}
+
+// Reports whether a scribe topic has any members to publish to. Expired census
+// results are refreshed in the background, with interest assumed until the first
+// one answers, so no events are lost to a cold cache.
+func (o *Overlay) interested(topic string) bool {
+	o.indexLock.Lock()
+	defer o.indexLock.Unlock()
+
+	in, ok := o.indexes[topic]
+	if !ok {
+		in = &interest{live: true}
+		o.indexes[topic] = in
+	}
+	if !in.pending && time.Now().After(in.expiry) {
+		in.pending = true
+		go o.refreshInterest(topic, in)
+	}
+	return in.live
+}
+
+// Refreshes the interest in a scribe topic with a census of its tree. Interest
+// is kept assumed if the census fails.
+func (o *Overlay) refreshInterest(topic string, in *interest) {
+	census, err := o.scribe.Census(topic, config.IrisIndexInterest)
+
+	o.indexLock.Lock()
+	defer o.indexLock.Unlock()
+
+	in.live = err != nil || census.Members > 0
+	in.expiry = time.Now().Add(config.IrisIndexInterest)
+	in.pending = false
+}
+
+// Drops the cached interest in a scribe topic (any census still in flight updates
+// the dropped entry only).
+func (o *Overlay) resetInterest(topic string) {
+	o.indexLock.Lock()
+	defer o.indexLock.Unlock()
+
+	delete(o.indexes, topic)
+}
+
+// Subscribes to a wildcard pattern, joining the index topic if this is the first
+// pattern of the connection using it.
+func (c *Connection) subscribePattern(pattern string, handler SubscriptionHandler) error {
+	if err := checkPattern(pattern); err != nil {
+		return err
+	}
+	index := indexTopic(pattern)
+
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.wildLive[pattern]; ok {
+			c.subLock.Unlock()
+			return ErrSubscribed
+		}
+	}
+	c.wildLive[pattern] = handler
+	c.wildRefs[index]++
+	join := c.wildRefs[index] == 1
+	c.subLock.Unlock()
+
+	if !join {
+		return nil
+	}
+	// First pattern in the index, subscribe through the carrier
+	for i, prefix := range topicPrefixes {
+		if err := c.iris.subscribe(c.id, prefix+index); err != nil {
+			for _, prefix := range topicPrefixes[:i] {
+				c.iris.unsubscribe(c.id, prefix+index)
+			}
+			c.subLock.Lock()
+			delete(c.wildLive, pattern)
+			if c.wildRefs[index]--; c.wildRefs[index] == 0 {
+				delete(c.wildRefs, index)
+			}
+			c.subLock.Unlock()
+			return err
+		}
+	}
+	c.iris.resetIndex(index)
+	return nil
+}
+
+// Unsubscribes from a wildcard pattern, leaving the index topic if no other
+// pattern of the connection uses it.
+func (c *Connection) unsubscribePattern(pattern string) error {
+	index := indexTopic(pattern)
+
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.wildLive[pattern]; !ok {
+			c.subLock.Unlock()
+			return ErrNotSubscribed
+		}
+	}
+	delete(c.wildLive, pattern)
+	c.wildRefs[index]--
+	leave := c.wildRefs[index] == 0
+	if leave {
+		delete(c.wildRefs, index)
+	}
+	c.subLock.Unlock()
+
+	if !leave {
+		return nil
+	}
+	for _, prefix := range topicPrefixes {
+		if err := c.iris.unsubscribe(c.id, prefix+index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delivers an index topic event to all the wildcard handlers matching the
+// concrete topic it was published to.
+func (c *Connection) handleWildcard(topic string, msg []byte) {
+	c.subLock.RLock()
+	handlers := []SubscriptionHandler{}
+	for pattern, handler := range c.wildLive {
+		if CoversTopic(pattern, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.subLock.RUnlock()
+
+	for _, handler := range handlers {
+		handler.HandleEvent(msg)
+	}
+}
@@ -0,0 +1,227 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/scribe"
+)
+
+func TestCoversTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.eu.deleted", false},
+		{"orders.*.created", "orders.created", false},
+		{"orders.*.created", "orders.eu.x.created", false},
+		{"metrics.>", "metrics.cpu", true},
+		{"metrics.>", "metrics.cpu.load", true},
+		{"metrics.>", "metrics", false},
+		{"metrics.*", "metrics.cpu.load", false},
+		{"metrics.*.>", "metrics.cpu.load", true},
+		{"metrics.*.>", "metrics.cpu", false},
+		{"metrics.>", "metrics.*.load", true},
+		{"metrics.>", "metrics.>", true},
+		{"metrics.*", "metrics.*", true},
+		{"metrics.*", "metrics.>", false},
+		{"metrics.cpu", "metrics.*", false},
+		{"*.cpu", "metrics.cpu", true},
+		{">", "metrics.>", true},
+	}
+	for i, tt := range tests {
+		if match := CoversTopic(tt.pattern, tt.topic); match != tt.match {
+			t.Errorf("test %d: match mismatch for %s on %s: have %v, want %v.", i, tt.pattern, tt.topic, match, tt.match)
+		}
+	}
+}
+
+func TestCheckPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"orders.*.created", true},
+		{"metrics.>", true},
+		{"*.created", false},
+		{">", false},
+		{"metrics.>.load", false},
+		{"metrics..*", false},
+	}
+	for i, tt := range tests {
+		if err := checkPattern(tt.pattern); (err == nil) != tt.valid {
+			t.Errorf("test %d: validity mismatch for %s: have %v, want %v.", i, tt.pattern, err == nil, tt.valid)
+		}
+	}
+}
+
+func TestIndexRules(t *testing.T) {
+	topics := []scribe.Rule{
+		{Topic: "orders.eu", Subscribe: []string{"a", "b"}, Publish: []string{"x"}},
+		{Topic: "orders.us", Subscribe: []string{"b", "c"}, Publish: []string{"y"}},
+		{Topic: "metrics.cpu", Subscribe: []string{"a"}},
+		{Topic: "metrics.>", Subscribe: []string{"ops"}},
+		{Topic: "plain", Subscribe: []string{"a"}},
+	}
+	want := []scribe.Rule{
+		{Topic: "orders.>", Subscribe: []string{"b"}, Publish: []string{"x", "y"}},
+	}
+	if rules := indexRules(topics); !reflect.DeepEqual(rules, want) {
+		t.Fatalf("index rules mismatch: have %v, want %v.", rules, want)
+	}
+}
+
+// Tests that wildcard subscriptions receive the events of all matching topics.
+func TestWildcardSubscribe(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("wildcard-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Subscribe with a few overlapping patterns and an exact topic
+	created := &subscriber{make(chan []byte, 10)}
+	orders := &subscriber{make(chan []byte, 10)}
+	exact := &subscriber{make(chan []byte, 10)}
+
+	if err := conn.Subscribe("orders.*.created", created); err != nil {
+		t.Fatalf("failed to subscribe to pattern: %v.", err)
+	}
+	if err := conn.Subscribe("orders.>", orders); err != nil {
+		t.Fatalf("failed to subscribe to pattern: %v.", err)
+	}
+	if err := conn.Subscribe("orders.eu.created", exact); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	if err := conn.Subscribe("orders.>", orders); err != ErrSubscribed {
+		t.Fatalf("double subscription result mismatch: have %v, want %v.", err, ErrSubscribed)
+	}
+	if err := conn.Subscribe("*.created", created); err != ErrPattern {
+		t.Fatalf("invalid pattern result mismatch: have %v, want %v.", err, ErrPattern)
+	}
+	if err := conn.Publish("orders.*.created", []byte{0x00}); err != ErrPattern {
+		t.Fatalf("pattern publish result mismatch: have %v, want %v.", err, ErrPattern)
+	}
+	// Publish into a few topics and verify the arrivals
+	for _, topic := range []string{"orders.eu.created", "orders.us.deleted", "orders.us.x.created", "metrics.cpu"} {
+		if err := conn.Publish(topic, []byte(topic)); err != nil {
+			t.Fatalf("failed to publish into %s: %v.", topic, err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	counts := []struct {
+		name string
+		sub  *subscriber
+		want int
+	}{
+		{"created", created, 1},
+		{"orders", orders, 3},
+		{"exact", exact, 1},
+	}
+	for _, tt := range counts {
+		if n := len(tt.sub.msgs); n != tt.want {
+			t.Errorf("%s event count mismatch: have %v, want %v.", tt.name, n, tt.want)
+		}
+	}
+	// Unsubscribe one pattern and make sure the other still works
+	if err := conn.Unsubscribe("orders.>"); err != nil {
+		t.Fatalf("failed to unsubscribe from pattern: %v.", err)
+	}
+	if err := conn.Publish("orders.us.created", nil); err != nil {
+		t.Fatalf("failed to publish: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if n := len(created.msgs); n != 2 {
+		t.Errorf("created event count mismatch: have %v, want %v.", n, 2)
+	}
+	if n := len(orders.msgs); n != 3 {
+		t.Errorf("orders event count mismatch: have %v, want %v.", n, 3)
+	}
+}
+
+// Tests that events are only published into index topics with members, and that
+// joining a pattern locally takes effect immediately.
+func TestIndexInterest(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	defer func(period time.Duration) { config.IrisIndexInterest = period }(config.IrisIndexInterest)
+	config.IrisIndexInterest = 100 * time.Millisecond
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("index-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// A cold cache assumes interest, until the census finds the index empty
+	if !node.indexed("orders.>") {
+		t.Fatalf("interest not assumed for unknown index.")
+	}
+	time.Sleep(2 * config.IrisIndexInterest)
+	if node.indexed("orders.>") {
+		t.Fatalf("interest reported for empty index.")
+	}
+	// Subscribing a pattern resets the local cache, and the census confirms it
+	sub := &subscriber{make(chan []byte, 10)}
+	if err := conn.Subscribe("orders.>", sub); err != nil {
+		t.Fatalf("failed to subscribe to pattern: %v.", err)
+	}
+	if !node.indexed("orders.>") {
+		t.Fatalf("interest not reported after local subscription.")
+	}
+	time.Sleep(2 * config.IrisIndexInterest)
+	if !node.indexed("orders.>") {
+		t.Fatalf("interest not reported for subscribed index.")
+	}
+	if err := conn.Publish("orders.eu.created", nil); err != nil {
+		t.Fatalf("failed to publish: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(sub.msgs); n != 1 {
+		t.Fatalf("event count mismatch: have %v, want %v.", n, 1)
+	}
+}
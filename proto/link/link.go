@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
@@ -48,8 +49,13 @@ func init() {
 // Accomplishes secure and authenticated full duplex communication. Note, only
 // the headers are encrypted and decrypted. It is the responsibility of the
 // caller to call proto.Message.Encrypt/Decrypt (link would bottleneck).
+//
+// Depending on the cipher suite, the headers are either encrypted in CTR mode
+// and authenticated with an HMAC along with the payload, or sealed with GCM,
+// the payload being the additional authenticated data.
 type Link struct {
 	socket *stream.Stream
+	suite  *Suite
 
 	inCipher  cipher.Stream
 	outCipher cipher.Stream
@@ -57,6 +63,13 @@ type Link struct {
 	inMacer  hash.Hash
 	outMacer hash.Hash
 
+	inAead   cipher.AEAD
+	outAead  cipher.AEAD
+	inNonce  []byte // Nonce base of the inbound AEAD, xor-ed with the message counter
+	outNonce []byte // Nonce base of the outbound AEAD, xor-ed with the message counter
+	inSeq    uint64 // Counter of the inbound messages
+	outSeq   uint64 // Counter of the outbound messages
+
 	inBuffer  bytes.Buffer
 	outBuffer bytes.Buffer
 
@@ -72,20 +85,31 @@ type Link struct {
 	recvQuit chan chan error
 }
 
-// Creates a new, full-duplex encrypted link from the negotiated secret. The
-// client is used to decide the key derivation order for the two half-duplex
+// Creates a new, full-duplex encrypted link from the negotiated secret and suite.
+// The client is used to decide the key derivation order for the two half-duplex
 // channels (server keys first, client key second).
-func New(conn *stream.Stream, hkdf io.Reader, server bool) *Link {
+func New(conn *stream.Stream, hkdf io.Reader, server bool, suite *Suite) *Link {
 	l := &Link{
 		socket: conn,
+		suite:  suite,
 	}
 	// Create the duplex channel
-	sc, sm := makeHalfDuplex(hkdf)
-	cc, cm := makeHalfDuplex(hkdf)
-	if server {
-		l.inCipher, l.outCipher, l.inMacer, l.outMacer = cc, sc, cm, sm
+	if suite.Mac != nil {
+		sc, sm := makeHalfDuplex(hkdf, suite)
+		cc, cm := makeHalfDuplex(hkdf, suite)
+		if server {
+			l.inCipher, l.outCipher, l.inMacer, l.outMacer = cc, sc, cm, sm
+		} else {
+			l.inCipher, l.outCipher, l.inMacer, l.outMacer = sc, cc, sm, cm
+		}
 	} else {
-		l.inCipher, l.outCipher, l.inMacer, l.outMacer = sc, cc, sm, cm
+		sa, sn := makeHalfDuplexAead(hkdf, suite)
+		ca, cn := makeHalfDuplexAead(hkdf, suite)
+		if server {
+			l.inAead, l.outAead, l.inNonce, l.outNonce = ca, sa, cn, sn
+		} else {
+			l.inAead, l.outAead, l.inNonce, l.outNonce = sa, ca, sn, cn
+		}
 	}
 	// Create the gob coders
 	l.inCoder = gob.NewDecoder(&l.inBuffer)
@@ -96,14 +120,14 @@ func New(conn *stream.Stream, hkdf io.Reader, server bool) *Link {
 
 // Assembles the crypto primitives needed for a one way communication channel:
 // the stream cipher for encryption and the mac for authentication.
-func makeHalfDuplex(hkdf io.Reader) (cipher.Stream, hash.Hash) {
+func makeHalfDuplex(hkdf io.Reader, suite *Suite) (cipher.Stream, hash.Hash) {
 	// Extract the symmetric key and create the block cipher
-	key := make([]byte, config.SessionCipherBits/8)
+	key := make([]byte, suite.Bits/8)
 	n, err := io.ReadFull(hkdf, key)
 	if n != len(key) || err != nil {
 		panic(fmt.Sprintf("Failed to extract session key: %v", err))
 	}
-	block, err := config.SessionCipher(key)
+	block, err := suite.Cipher(key)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to create session cipher: %v", err))
 	}
@@ -116,16 +140,60 @@ func makeHalfDuplex(hkdf io.Reader) (cipher.Stream, hash.Hash) {
 	stream := cipher.NewCTR(block, iv)
 
 	// Extract the HMAC key and create the session MACer
-	salt := make([]byte, config.SessionHash().Size())
+	salt := make([]byte, suite.Mac().Size())
 	n, err = io.ReadFull(hkdf, salt)
 	if n != len(salt) || err != nil {
 		panic(fmt.Sprintf("Failed to extract session mac salt: %v", err))
 	}
-	mac := hmac.New(config.SessionHash, salt)
+	mac := hmac.New(suite.Mac, salt)
 
 	return stream, mac
 }
 
+// Assembles the authenticated cipher of a one way communication channel and the
+// nonce base that the message counter is mixed into.
+func makeHalfDuplexAead(hkdf io.Reader, suite *Suite) (cipher.AEAD, []byte) {
+	// Extract the symmetric key and create the block cipher
+	key := make([]byte, suite.Bits/8)
+	n, err := io.ReadFull(hkdf, key)
+	if n != len(key) || err != nil {
+		panic(fmt.Sprintf("Failed to extract session key: %v", err))
+	}
+	block, err := suite.Cipher(key)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create session cipher: %v", err))
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create session AEAD: %v", err))
+	}
+	// Extract the nonce base for the message counters
+	nonce := make([]byte, aead.NonceSize())
+	n, err = io.ReadFull(hkdf, nonce)
+	if n != len(nonce) || err != nil {
+		panic(fmt.Sprintf("Failed to extract session nonce: %v", err))
+	}
+	return aead, nonce
+}
+
+// Mixes a message counter into a nonce base, returning the per message nonce.
+func makeNonce(base []byte, seq uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], seq)
+	for i := 0; i < len(ctr); i++ {
+		nonce[len(nonce)-len(ctr)+i] ^= ctr[i]
+	}
+	return nonce
+}
+
+// Returns the cipher suite securing the link.
+func (l *Link) Suite() *Suite {
+	return l.suite
+}
+
 // Creates the buffer channels and starts the transfer processes.
 func (l *Link) Start(cap int) {
 	// Create the data and quit channels
@@ -169,9 +237,10 @@ func (l *Link) Close() error {
 	return res
 }
 
-// The actual message sending logic. Calculates the payload MAC, encrypts the
-// headers and sends it down to the stream. Direct send is public for handshake
-// simplifications. After that is done, the link should switch to channel mode.
+// The actual message sending logic. Encrypts the headers, authenticates them
+// along with the payload and sends it down to the stream. Direct send is public
+// for handshake simplifications. After that is done, the link should switch to
+// channel mode.
 func (l *Link) SendDirect(msg *proto.Message) error {
 	var err error
 
@@ -180,13 +249,29 @@ func (l *Link) SendDirect(msg *proto.Message) error {
 		log.Printf("link: unsecured data, send denied.")
 		return errors.New("unsecured data, send denied")
 	}
-	// Flatten and encrypt the headers
+	// Flatten the headers
 	if err = l.outCoder.Encode(msg.Head); err != nil {
 		return err
 	}
-	l.outCipher.XORKeyStream(l.outBuffer.Bytes(), l.outBuffer.Bytes())
 	defer l.outBuffer.Reset()
 
+	// In AEAD mode, seal the headers authenticating the payload too
+	if l.outAead != nil {
+		sealed := l.outAead.Seal(nil, makeNonce(l.outNonce, l.outSeq), l.outBuffer.Bytes(), msg.Data)
+		l.outSeq++
+
+		// Send the two-part message (sealed headers + payload)
+		if err = l.socket.Send(sealed); err != nil {
+			return err
+		}
+		if err = l.socket.Send(msg.Data); err != nil {
+			return err
+		}
+		return l.socket.Flush()
+	}
+	// Otherwise encrypt the headers and MAC them with the payload
+	l.outCipher.XORKeyStream(l.outBuffer.Bytes(), l.outBuffer.Bytes())
+
 	// Generate the MAC of the encrypted payload and headers
 	l.outMacer.Write(l.outBuffer.Bytes())
 	l.outMacer.Write(msg.Data)
@@ -205,8 +290,9 @@ func (l *Link) SendDirect(msg *proto.Message) error {
 }
 
 // The actual message receiving logic. Reads a message from the stream, verifies
-// its mac, decodes the headers and send it upwards. Direct receive is public for
-// handshake simplifications, after which the link should switch to channel mode.
+// its authenticity, decodes the headers and send it upwards. Direct receive is
+// public for handshake simplifications, after which the link should switch to
+// channel mode.
 func (l *Link) RecvDirect() (*proto.Message, error) {
 	var msg proto.Message
 	var err error
@@ -218,19 +304,29 @@ func (l *Link) RecvDirect() (*proto.Message, error) {
 	if err = l.socket.Recv(&msg.Data); err != nil {
 		return nil, err
 	}
-	if err = l.socket.Recv(&l.inMacBuf); err != nil {
-		return nil, err
-	}
-	// Verify the message contents (payload + header)
-	l.inMacer.Write(l.inHeadBuf)
-	l.inMacer.Write(msg.Data)
-	if !bytes.Equal(l.inMacBuf, l.inMacer.Sum(nil)) {
-		err = errors.New(fmt.Sprintf("mac mismatch: have %v, want %v.", l.inMacer.Sum(nil), l.inMacBuf))
-		return nil, err
+	if l.inAead != nil {
+		// Open the headers, verifying the payload too
+		head, err := l.inAead.Open(l.inHeadBuf[:0], makeNonce(l.inNonce, l.inSeq), l.inHeadBuf, msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		l.inSeq++
+		l.inBuffer.Write(head)
+	} else {
+		if err = l.socket.Recv(&l.inMacBuf); err != nil {
+			return nil, err
+		}
+		// Verify the message contents (payload + header)
+		l.inMacer.Write(l.inHeadBuf)
+		l.inMacer.Write(msg.Data)
+		if !bytes.Equal(l.inMacBuf, l.inMacer.Sum(nil)) {
+			err = errors.New(fmt.Sprintf("mac mismatch: have %v, want %v.", l.inMacer.Sum(nil), l.inMacBuf))
+			return nil, err
+		}
+		// Extract the package contents
+		l.inCipher.XORKeyStream(l.inHeadBuf, l.inHeadBuf)
+		l.inBuffer.Write(l.inHeadBuf)
 	}
-	// Extract the package contents
-	l.inCipher.XORKeyStream(l.inHeadBuf, l.inHeadBuf)
-	l.inBuffer.Write(l.inHeadBuf)
 	if err = l.inCoder.Decode(&msg.Head); err != nil {
 		return nil, err
 	}
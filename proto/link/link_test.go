@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"code.google.com/p/go.crypto/hkdf"
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/stream"
 )
@@ -44,8 +45,9 @@ func TestCiphers(t *testing.T) {
 	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 
-	client := New(nil, clientHKDF, false)
-	server := New(nil, serverHKDF, true)
+	suite, _ := Lookup(LegacySuite)
+	client := New(nil, clientHKDF, false, suite)
+	server := New(nil, serverHKDF, true, suite)
 
 	// Create some random data to operate on
 	clientData := make([]byte, 4096)
@@ -87,6 +89,12 @@ func TestCiphers(t *testing.T) {
 func TestDirectSendRecv(t *testing.T) {
 	t.Parallel()
 
+	for _, suite := range suites() {
+		testDirectSendRecv(t, suite)
+	}
+}
+
+func testDirectSendRecv(t *testing.T, suite *Suite) {
 	// Start a stream listener
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
 	if err != nil {
@@ -117,8 +125,8 @@ func TestDirectSendRecv(t *testing.T) {
 	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 
-	clientLink := New(clientStrm, clientHKDF, false)
-	serverLink := New(serverStrm, serverHKDF, true)
+	clientLink := New(clientStrm, clientHKDF, false, suite)
+	serverLink := New(serverStrm, serverHKDF, true, suite)
 
 	// Generate some random messages and pass around both ways
 	for i := 0; i < 1000; i++ {
@@ -135,19 +143,19 @@ func TestDirectSendRecv(t *testing.T) {
 
 		// Send the message from client to server
 		if err := clientLink.SendDirect(send); err != nil {
-			t.Fatalf("failed to send message to server: %v.", err)
+			t.Fatalf("%s: failed to send message to server: %v.", suite.Name, err)
 		}
 		if recv, err := serverLink.RecvDirect(); err != nil {
-			t.Fatalf("failed to receive message from client: %v.", err)
+			t.Fatalf("%s: failed to receive message from client: %v.", suite.Name, err)
 		} else if bytes.Compare(send.Head.Meta.([]byte), recv.Head.Meta.([]byte)) != 0 || bytes.Compare(send.Data, recv.Data) != 0 {
 			t.Fatalf("send/receive mismatch: have %+v, want %+v.", recv, send)
 		}
 		// Send the message from server to client
 		if err := serverLink.SendDirect(send); err != nil {
-			t.Fatalf("failed to send message to client: %v.", err)
+			t.Fatalf("%s: failed to send message to client: %v.", suite.Name, err)
 		}
 		if recv, err := clientLink.RecvDirect(); err != nil {
-			t.Fatalf("failed to receive message from server: %v.", err)
+			t.Fatalf("%s: failed to receive message from server: %v.", suite.Name, err)
 		} else if bytes.Compare(send.Head.Meta.([]byte), recv.Head.Meta.([]byte)) != 0 || bytes.Compare(send.Data, recv.Data) != 0 {
 			t.Fatalf("send/receive mismatch: have %+v, want %+v.", recv, send)
 		}
@@ -158,6 +166,12 @@ func TestDirectSendRecv(t *testing.T) {
 func TestSendRecv(t *testing.T) {
 	t.Parallel()
 
+	for _, suite := range suites() {
+		testSendRecv(t, suite)
+	}
+}
+
+func testSendRecv(t *testing.T, suite *Suite) {
 	// Start a stream listener
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
 	if err != nil {
@@ -185,8 +199,8 @@ func TestSendRecv(t *testing.T) {
 	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 
-	clientLink := New(clientStrm, clientHKDF, false)
-	serverLink := New(serverStrm, serverHKDF, true)
+	clientLink := New(clientStrm, clientHKDF, false, suite)
+	serverLink := New(serverStrm, serverHKDF, true, suite)
 
 	clientLink.Start(32)
 	serverLink.Start(32)
@@ -251,3 +265,97 @@ func TestSendRecv(t *testing.T) {
 		t.Fatalf("failed to close server link: %v.", err)
 	}
 }
+
+// Tests that links of mismatching cipher suites cannot talk to each other.
+func TestSuiteMismatch(t *testing.T) {
+	t.Parallel()
+
+	// Start a stream listener
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	// Establish a stream connection to the listener
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	defer clientStrm.Close()
+	defer serverStrm.Close()
+
+	// Initialize the links with different suites of the same key size
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	legacy, _ := Lookup(LegacySuite)
+	modern, _ := Lookup("sha256-aes128-gcm")
+
+	clientLink := New(clientStrm, clientHKDF, false, legacy)
+	serverLink := New(serverStrm, serverHKDF, true, modern)
+
+	send := &proto.Message{
+		Head: proto.Header{
+			Meta: make([]byte, 32),
+		},
+	}
+	if err := clientLink.SendDirect(send); err != nil {
+		t.Fatalf("failed to send message to server: %v.", err)
+	}
+	if _, err := serverLink.RecvDirect(); err == nil {
+		t.Fatalf("message accepted across mismatching suites.")
+	}
+}
+
+// Tests the local suite negotiation policies.
+func TestNegotiation(t *testing.T) {
+	defer func(min string) { config.SessionMinSuite = min }(config.SessionMinSuite)
+
+	// A modern policy shouldn't offer nor accept legacy suites
+	config.SessionMinSuite = "sha256-aes128-gcm"
+	if offer, err := Offer(); err != nil || !bytes.Equal(offer, []byte{4, 3, 2, 1}) {
+		t.Fatalf("modern offer mismatch: have %v/%v, want %v.", offer, err, []byte{4, 3, 2, 1})
+	}
+	if _, err := Choose(nil); err != ErrNoSuite {
+		t.Fatalf("legacy offer choice mismatch: have %v, want %v.", err, ErrNoSuite)
+	}
+	if suite, err := Choose([]byte{0, 1, 2}); err != nil || suite.Id != 2 {
+		t.Fatalf("strongest choice mismatch: have %v/%v, want %v.", suite, err, 2)
+	}
+	if _, err := Verify([]byte{2, 1}, 0); err == nil {
+		t.Fatalf("unoffered suite accepted.")
+	}
+	// A curve only policy shouldn't offer finite field suites
+	config.SessionMinSuite = "x25519-sha256-aes128-gcm"
+	if offer, err := Offer(); err != nil || !bytes.Equal(offer, []byte{4, 3}) {
+		t.Fatalf("curve offer mismatch: have %v/%v, want %v.", offer, err, []byte{4, 3})
+	}
+	if _, err := Choose([]byte{2, 1}); err != ErrNoSuite {
+		t.Fatalf("finite field offer choice mismatch: have %v, want %v.", err, ErrNoSuite)
+	}
+	// A legacy policy should interoperate with nodes predating negotiation
+	config.SessionMinSuite = LegacySuite
+	if suite, err := Choose(nil); err != nil || suite.Name != LegacySuite {
+		t.Fatalf("legacy choice mismatch: have %v/%v, want %v.", suite, err, LegacySuite)
+	}
+	if suite, err := Verify([]byte{2, 1, 0}, 0); err != nil || suite.Name != LegacySuite {
+		t.Fatalf("legacy verification mismatch: have %v/%v, want %v.", suite, err, LegacySuite)
+	}
+	// Invalid policies should be reported
+	config.SessionMinSuite = "rot13"
+	if _, err := Offer(); err == nil {
+		t.Fatalf("invalid policy accepted.")
+	}
+}
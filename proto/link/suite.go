@@ -0,0 +1,174 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the cipher suites securing the links, and the negotiation helpers of
+// the handshakes establishing them. The suite ids double as a strength order, a
+// higher id always meaning a stronger suite.
+//
+// The initiating side offers all the suites its policy permits, the accepting
+// side picks the strongest it also permits, and both authenticate the offer and
+// the choice to detect any tampering (downgrade) in between. Peers predating the
+// negotiation neither offer nor choose, which stands for the legacy suite. As the
+// legacy exchange cannot authenticate the negotiation, falling back to it is only
+// detectable against peers known to negotiate, such as ones with node identities.
+
+package link
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	_ "crypto/sha256" // Registers the hash for the SHA-256 suite
+	_ "crypto/sha512" // Registers the hash for the SHA-512 suite
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Name of the suite used with peers predating suite negotiation.
+const LegacySuite = "legacy"
+
+var ErrNoSuite = errors.New("no acceptable cipher suite")
+var ErrDowngrade = errors.New("cipher suite negotiation downgraded")
+
+// Crypto primitives securing a link and the handshake establishing it.
+type Suite struct {
+	Id   byte   // Identifier of the suite on the wire
+	Name string // Name of the suite in the configuration
+
+	SigHash crypto.Hash                        // Hash of the handshake signatures
+	KdfHash crypto.Hash                        // Hash of the HKDF key expansion
+	Cipher  func([]byte) (cipher.Block, error) // Block cipher of the link
+	Bits    int                                // Key size of the block cipher
+	Mac     func() hash.Hash                   // HMAC hash in CTR mode, nil for GCM
+	Curve   ecdh.Curve                         // Curve of the STS exchange, nil for the finite field group
+}
+
+// Returns the known cipher suites, weakest first. The legacy one is assembled
+// from the configured primitives.
+func suites() []*Suite {
+	return []*Suite{
+		{0, LegacySuite, config.StsSigHash, config.HkdfHash, config.SessionCipher, config.SessionCipherBits, config.SessionHash, nil},
+		{1, "sha256-aes128-gcm", crypto.SHA256, crypto.SHA256, aes.NewCipher, 128, nil, nil},
+		{2, "sha512-aes256-gcm", crypto.SHA512, crypto.SHA512, aes.NewCipher, 256, nil, nil},
+		{3, "x25519-sha256-aes128-gcm", crypto.SHA256, crypto.SHA256, aes.NewCipher, 128, nil, ecdh.X25519()},
+		{4, "x25519-sha512-aes256-gcm", crypto.SHA512, crypto.SHA512, aes.NewCipher, 256, nil, ecdh.X25519()},
+	}
+}
+
+// Looks up a cipher suite by name.
+func Lookup(name string) (*Suite, error) {
+	for _, suite := range suites() {
+		if suite.Name == name {
+			return suite, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown cipher suite: %s", name)
+}
+
+// Looks up a cipher suite by its wire id.
+func LookupId(id byte) (*Suite, error) {
+	for _, suite := range suites() {
+		if suite.Id == id {
+			return suite, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown cipher suite id: %d", id)
+}
+
+// Returns the weakest cipher suite permitted by the local policy.
+func minimum() (*Suite, error) {
+	return Lookup(config.SessionMinSuite)
+}
+
+// Returns the ids of the cipher suites permitted by the local policy, strongest
+// first.
+func Offer() ([]byte, error) {
+	min, err := minimum()
+	if err != nil {
+		return nil, err
+	}
+	all := suites()
+
+	offer := []byte{}
+	for i := len(all) - 1; i >= 0; i-- {
+		if all[i].Id >= min.Id {
+			offer = append(offer, all[i].Id)
+		}
+	}
+	return offer, nil
+}
+
+// Picks the strongest suite of a remote offer that the local policy permits. An
+// empty offer comes from a peer unaware of suites, which implies legacy.
+func Choose(offer []byte) (*Suite, error) {
+	min, err := minimum()
+	if err != nil {
+		return nil, err
+	}
+	if len(offer) == 0 {
+		offer = []byte{0}
+	}
+	var best *Suite
+	for _, id := range offer {
+		if suite, err := LookupId(id); err == nil && suite.Id >= min.Id && (best == nil || suite.Id > best.Id) {
+			best = suite
+		}
+	}
+	if best == nil {
+		return nil, ErrNoSuite
+	}
+	return best, nil
+}
+
+// Checks that the suite chosen by the remote side was in the local offer, and
+// is still permitted by the local policy.
+func Verify(offer []byte, id byte) (*Suite, error) {
+	min, err := minimum()
+	if err != nil {
+		return nil, err
+	}
+	for _, offered := range offer {
+		if offered == id {
+			suite, err := LookupId(id)
+			if err != nil {
+				return nil, err
+			}
+			if suite.Id < min.Id {
+				return nil, ErrNoSuite
+			}
+			return suite, nil
+		}
+	}
+	return nil, fmt.Errorf("cipher suite not offered: %d", id)
+}
+
+// Reports whether a negotiation settled for the legacy suite, even though the
+// offer was empty or contained stronger suites. With a peer known to negotiate
+// suites, this can only be the result of tampering with the offer.
+func Downgraded(offer []byte, id byte) bool {
+	return id == 0 && (len(offer) == 0 || offer[0] != 0)
+}
+
+// Assembles the negotiation transcript (offer and choice) that the handshakes
+// authenticate.
+func Transcript(offer []byte, id byte) []byte {
+	return append(append([]byte("iris.proto.link.suite"), offer...), id)
+}
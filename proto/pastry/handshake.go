@@ -28,12 +28,15 @@ import (
 	"math/big"
 	"net"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/crypto/keys"
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/bootstrap"
 	"github.com/project-iris/iris/proto/session"
+	"github.com/project-iris/iris/system"
 )
 
 // The initialization packet when the connection is set up.
@@ -49,9 +52,9 @@ func init() {
 
 // Starts up the overlay networking on a specified interface and fans in all the
 // inbound connections into the overlay-global channels.
-func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
-	// Listen for incoming session on the given interface and random port.
-	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ipnet.IP.String(), "0"))
+func (o *Overlay) acceptor(ipnet *net.IPNet, bootSock *net.UDPConn, quit chan chan error) {
+	// Listen for incoming session on the given interface and configured port.
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ipnet.IP.String(), strconv.Itoa(config.PastryListenPort)))
 	if err != nil {
 		panic(fmt.Sprintf("failed to resolve interface (%v): %v.", ipnet.IP, err))
 	}
@@ -65,10 +68,12 @@ func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
 	o.lock.Lock()
 	o.addrs = append(o.addrs, addr.String())
 	sort.Strings(o.addrs)
+	o.advAddrs = append(o.advAddrs, system.AdvertisedAddr(addr))
+	sort.Strings(o.advAddrs)
 	o.lock.Unlock()
 
 	// Start the bootstrapper on the specified interface
-	boot, discover, err := bootstrap.New(ipnet, []byte(o.authId), o.nodeId, addr.Port)
+	boot, discover, err := bootstrap.NewFromConn(ipnet, bootSock, []byte(o.authId), o.nodeId, addr.Port)
 	if err != nil {
 		panic(fmt.Sprintf("failed to create bootstrapper: %v.", err))
 	}
@@ -156,7 +161,11 @@ func (o *Overlay) filter(id *big.Int) bool {
 // Asynchronously connects to a remote overlay peer and executes handshake.
 func (o *Overlay) dial(addrs []*net.TCPAddr) {
 	// Sanity check to make sure self connections are not possible (i.e. malicious bootstrapper)
-	for _, ownAddr := range o.addrs {
+	o.lock.RLock()
+	own := append(append([]string{}, o.addrs...), o.advAddrs...)
+	o.lock.RUnlock()
+
+	for _, ownAddr := range own {
 		for _, peerAddr := range addrs {
 			if peerAddr.String() == ownAddr {
 				log.Printf("pastry: self connection not allowed: %v.", o.nodeId)
@@ -189,8 +198,8 @@ func (o *Overlay) shake(ses *session.Session) {
 	pkt.Id = new(big.Int).Set(o.nodeId)
 
 	o.lock.RLock()
-	pkt.Addrs = make([]string, len(o.addrs))
-	copy(pkt.Addrs, o.addrs)
+	pkt.Addrs = make([]string, len(o.advAddrs))
+	copy(pkt.Addrs, o.advAddrs)
 	o.lock.RUnlock()
 
 	msg := new(proto.Message)
@@ -215,6 +224,25 @@ func (o *Overlay) shake(ses *session.Session) {
 			p.nodeId = pkt.Id
 			p.addrs = pkt.Addrs
 
+			// Node ids must be bound to the certified identities, if running with any
+			if _, ok := o.authKey.(*keys.Identity); ok {
+				if want := certifiedId(ses.Peer()); p.nodeId.Cmp(want) != 0 {
+					log.Printf("pastry: node id %v not bound to certificate, want %v.", p.nodeId, want)
+					if err := ses.Close(); err != nil {
+						log.Printf("pastry: failed to close uncertified session: %v.", err)
+					}
+					return
+				}
+			}
+			// Seeds might point to the local node through an unknown address
+			if p.nodeId.Cmp(o.nodeId) == 0 {
+				log.Printf("pastry: self connection not allowed: %v.", o.nodeId)
+				if err := ses.Close(); err != nil {
+					log.Printf("pastry: failed to close self session: %v.", err)
+				}
+				return
+			}
+
 			// Everything ok, accept connection
 			o.dedup(p)
 		} else {
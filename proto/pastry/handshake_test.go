@@ -18,11 +18,21 @@
 package pastry
 
 import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/project-iris/iris/crypto/keys"
 )
 
 // Another private key to check security negotiation
@@ -156,3 +166,114 @@ func TestHandshake(t *testing.T) {
 		t.Fatalf("mallory (%v) found in the pool of bob: %v.", mallory.nodeId, bob.livePeers)
 	}
 }
+
+// Issues a PEM encoded certificate for a key, self signed if no issuer is given.
+func certify(t *testing.T, key crypto.Signer, serial int64, issuer *x509.Certificate, issuerKey crypto.Signer) (*x509.Certificate, []byte) {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: appId},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  issuer == nil,
+	}
+	if issuer == nil {
+		issuer, issuerKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v.", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// Writes a revocation list of the given serials, signed by the CA.
+func revoke(t *testing.T, path string, ca *x509.Certificate, caKey crypto.Signer, serials ...int64) {
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(int64(len(serials) + 1)),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca, caKey)
+	if err != nil {
+		t.Fatalf("failed to create revocation list: %v.", err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write revocation list: %v.", err)
+	}
+}
+
+// Tests that nodes with certified identities derive their ids from them, and
+// that revoked nodes get dropped.
+func TestIdentities(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	dir, err := ioutil.TempDir("", "iris-pastry")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create the cluster authority with an empty revocation list
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca, caPem := certify(t, caKey, 1, nil, nil)
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), caPem, 0600)
+	revoke(t, filepath.Join(dir, "ca.crl"), ca, caKey)
+
+	// Create and boot two nodes with their own identities
+	nodes := make([]*Overlay, 2)
+	ids := make([]*keys.Identity, 2)
+	for i := 0; i < len(nodes); i++ {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		_, certPem := certify(t, key, int64(i+2), ca, caKey)
+
+		auth, err := keys.LoadAuthority(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.crl"))
+		if err != nil {
+			t.Fatalf("node %d: failed to load authority: %v.", i, err)
+		}
+		block, _ := pem.Decode(certPem)
+		if ids[i], err = keys.NewIdentity(key, [][]byte{block.Bytes}, auth); err != nil {
+			t.Fatalf("node %d: failed to create identity: %v.", i, err)
+		}
+		nodes[i] = New(appId, ids[i], new(nopCallback))
+		if want := certifiedId(ids[i].Certificate()); nodes[i].Self().Cmp(want) != 0 {
+			t.Fatalf("node %d: id mismatch: have %v, want %v.", i, nodes[i].Self(), want)
+		}
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("node %d: failed to boot: %v.", i, err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	if _, ok := nodes[0].livePeers[nodes[1].nodeId.String()]; !ok {
+		t.Fatalf("second node missing from the pool of the first: %v.", nodes[0].livePeers)
+	}
+	// Revoke the second node and make sure the first drops it
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	revoke(t, filepath.Join(dir, "ca.crl"), ca, caKey, 3)
+	if err := ids[0].Reload(); err != nil {
+		t.Fatalf("failed to reload identity: %v.", err)
+	}
+	if dropped := nodes[0].Revalidate(); dropped != 1 {
+		t.Fatalf("dropped peer count mismatch: have %v, want %v.", dropped, 1)
+	}
+	time.Sleep(time.Second)
+
+	nodes[0].lock.RLock()
+	_, ok := nodes[0].livePeers[nodes[1].nodeId.String()]
+	nodes[0].lock.RUnlock()
+	if ok {
+		t.Fatalf("revoked node still in the pool: %v.", nodes[0].livePeers)
+	}
+}
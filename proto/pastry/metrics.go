@@ -0,0 +1,33 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the instrumentation counters of the pastry routing layer.
+
+package pastry
+
+import (
+	"github.com/project-iris/iris/metrics"
+)
+
+// Number of messages entering the routing algorithm.
+var routedMessages = metrics.NewCounter("iris_pastry_routed_messages_total", "Messages passed through the pastry routing.")
+
+// Number of messages forwarded to a remote peer.
+var forwardedMessages = metrics.NewCounter("iris_pastry_forwarded_messages_total", "Messages forwarded towards remote pastry peers.")
+
+// Number of messages delivered to the local node.
+var deliveredMessages = metrics.NewCounter("iris_pastry_delivered_messages_total", "Messages delivered to the local pastry node.")
@@ -20,8 +20,9 @@
 package pastry
 
 import (
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -30,8 +31,11 @@ import (
 	"sync"
 
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/crypto/keys"
 	"github.com/project-iris/iris/pool"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/bootstrap"
+	"github.com/project-iris/iris/system"
 )
 
 // Different status types in which the node can be.
@@ -53,11 +57,14 @@ type Callback interface {
 type Overlay struct {
 	app Callback // Upstream application callback
 
-	authId  string          // Iris network id
-	authKey *rsa.PrivateKey // Iris authentication key
+	authId  string        // Iris network id
+	authKey crypto.Signer // Iris authentication key
 
-	nodeId *big.Int // Pastry peer id
-	addrs  []string // Listener addresses
+	nodeId   *big.Int // Pastry peer id
+	addrs    []string // Listener addresses
+	advAddrs []string // Listener addresses advertised to remote peers
+
+	ipnets []*net.IPNet // Network interfaces the overlay listens on
 
 	livePeers map[string]*peer // Active connection pool
 	heart     *heartbeat       // Beater for the active peers
@@ -68,6 +75,7 @@ type Overlay struct {
 
 	acceptQuit []chan chan error // Quit sync channels for the acceptors
 	maintQuit  chan chan error   // Quit sync channel for the maintenance routine
+	seedQuit   chan chan error   // Quit sync channel for the seed dialer (if any)
 
 	authInit   *pool.ThreadPool // Locally initiated authentication pool
 	authAccept *pool.ThreadPool // Remotely initiated authentication pool
@@ -85,13 +93,19 @@ type Overlay struct {
 
 // Creates a new overlay structure with all internal state initialized, ready to
 // be booted.
-func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
-	// Generate the random node id for this overlay peer
-	peerId := make([]byte, config.PastrySpace/8)
-	if n, err := io.ReadFull(rand.Reader, peerId); n < len(peerId) || err != nil {
-		panic(fmt.Sprintf("failed to generate node id: %v", err))
+func New(id string, key crypto.Signer, app Callback) *Overlay {
+	// Generate the random node id for this overlay peer, or derive it from the
+	// certified identity if running with one
+	var nodeId *big.Int
+	if identity, ok := key.(*keys.Identity); ok {
+		nodeId = certifiedId(identity.Certificate())
+	} else {
+		peerId := make([]byte, config.PastrySpace/8)
+		if n, err := io.ReadFull(rand.Reader, peerId); n < len(peerId) || err != nil {
+			panic(fmt.Sprintf("failed to generate node id: %v", err))
+		}
+		nodeId = new(big.Int).SetBytes(peerId)
 	}
-	nodeId := new(big.Int).SetBytes(peerId)
 
 	// Assemble and return the overlay instance
 	o := &Overlay{
@@ -100,8 +114,9 @@ func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
 		authId:  id,
 		authKey: key,
 
-		nodeId: nodeId,
-		addrs:  []string{},
+		nodeId:   nodeId,
+		addrs:    []string{},
+		advAddrs: []string{},
 
 		livePeers: make(map[string]*peer),
 		routes:    newRoutingTable(nodeId),
@@ -123,37 +138,38 @@ func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
 }
 
 // Boots the overlay network: it starts up boostrappers and connection acceptors
-// on all local IPv4 interfaces, after which the overlay management is booted.
+// on all selected local interfaces (or only the loopback ones in loopback
+// mode), after which the overlay management is booted and the static seeds (if
+// any) dialed.
 // The method returns the number of remote peers after convergence is reached.
 func (o *Overlay) Boot() (int, error) {
-	// Start the individual acceptors
-	addrs, err := net.InterfaceAddrs()
+	// Claim the bootstrap sockets, settling the addresses to listen on
+	ipnets, err := system.InterfaceAddrs()
 	if err != nil {
 		return 0, err
 	}
-	for _, addr := range addrs {
-		// Workaround for upstream Go issue #5395, construct an IPNet if IPAddr is returned
-		var ipnet *net.IPNet
-		switch addr.(type) {
-		case *net.IPNet:
-			ipnet = addr.(*net.IPNet)
-		case *net.IPAddr:
-			log.Printf("pastry: OS returned no network mask, using defaults...")
-			ipnet = &net.IPNet{
-				IP:   addr.(*net.IPAddr).IP,
-				Mask: addr.(*net.IPAddr).IP.DefaultMask(),
+	if len(ipnets) == 0 {
+		return 0, errors.New("no usable network interfaces")
+	}
+	socks := make([]*net.UDPConn, len(ipnets))
+	for i, ipnet := range ipnets {
+		if ipnets[i], socks[i], err = bootstrap.Listen(ipnet); err != nil {
+			for _, sock := range socks[:i] {
+				sock.Close()
 			}
-		default:
-			log.Printf("pastry: unknown interface address type for: %v.", addr)
-			continue
+			return 0, fmt.Errorf("failed to open bootstrap socket: %v", err)
 		}
+	}
+	o.lock.Lock()
+	o.ipnets = ipnets
+	o.lock.Unlock()
 
-		if !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
-			// Create a quit channel and start the acceptor
-			quit := make(chan chan error)
-			o.acceptQuit = append(o.acceptQuit, quit)
-			go o.acceptor(ipnet, quit)
-		}
+	// Start the individual acceptors
+	for i, ipnet := range ipnets {
+		// Create a quit channel and start the acceptor
+		quit := make(chan chan error)
+		o.acceptQuit = append(o.acceptQuit, quit)
+		go o.acceptor(ipnet, socks[i], quit)
 	}
 	// Start the overlay processes
 	o.stable.Add(1)
@@ -164,6 +180,12 @@ func (o *Overlay) Boot() (int, error) {
 	o.authAccept.Start()
 	o.stateExch.Start()
 
+	// Connect to the statically configured seeds, if any
+	if len(config.PastrySeeds) > 0 {
+		o.seedQuit = make(chan chan error)
+		go o.seeder(o.seedQuit)
+	}
+
 	// Wait for convergence and report remote connections
 	o.stable.Wait()
 
@@ -193,6 +215,13 @@ func (o *Overlay) Shutdown() error {
 			errs = append(errs, err)
 		}
 	}
+	// Stop dialing the seeds
+	if o.seedQuit != nil {
+		o.seedQuit <- errc
+		if err := <-errc; err != nil {
+			errs = append(errs, err)
+		}
+	}
 	// Wait for all pending handshakes to finish
 	o.authAccept.Terminate(false)
 	o.authInit.Terminate(false)
@@ -225,6 +254,55 @@ func (o *Overlay) Self() *big.Int {
 	return o.nodeId
 }
 
+// Returns the network interfaces the overlay listens on, as chosen during boot.
+func (o *Overlay) Interfaces() []*net.IPNet {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return append([]*net.IPNet{}, o.ipnets...)
+}
+
+// Re-verifies the certificates of the connected peers against the cluster
+// authority (e.g. after a revocation list update), dropping the ones no longer
+// accepted. Returns the number of dropped peers, always zero when not running
+// with node identities.
+func (o *Overlay) Revalidate() int {
+	identity, ok := o.authKey.(*keys.Identity)
+	if !ok {
+		return 0
+	}
+	o.lock.RLock()
+	peers := make([]*peer, 0, len(o.livePeers))
+	for _, p := range o.livePeers {
+		peers = append(peers, p)
+	}
+	o.lock.RUnlock()
+
+	dropped := 0
+	for _, p := range peers {
+		if _, err := identity.Verify(p.conn.PeerChain()); err != nil {
+			log.Printf("pastry: dropping peer %v: %v.", p.nodeId, err)
+			o.drop(p)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// Returns the remote members of the local node's leaf set.
+func (o *Overlay) Leaves() []*big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	leaves := make([]*big.Int, 0, len(o.routes.leaves))
+	for _, leaf := range o.routes.leaves {
+		if leaf.Cmp(o.nodeId) != 0 {
+			leaves = append(leaves, leaf)
+		}
+	}
+	return leaves
+}
+
 // Sends a message to the closest node to the given destination.
 func (o *Overlay) Send(dest *big.Int, msg *proto.Message) {
 	// Package into overlay envelope
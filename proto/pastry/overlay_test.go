@@ -18,8 +18,11 @@
 package pastry
 
 import (
+	"crypto/x509"
 	"log"
 	"math/big"
+	"net"
+	"testing"
 	"time"
 
 	"github.com/project-iris/iris/config"
@@ -95,3 +98,67 @@ func (cb *nopCallback) Deliver(msg *proto.Message, key *big.Int) {
 func (cb *nopCallback) Forward(msg *proto.Message, key *big.Int) bool {
 	return true
 }
+
+func TestLoopback(t *testing.T) {
+	// Override the overlay configuration and switch to loopback mode
+	swapConfigs()
+	defer swapConfigs()
+
+	config.NetLoopback = true
+	defer func() { config.NetLoopback = false }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start more overlay nodes on the same host than there are bootstrap ports
+	nodes := make([]*Overlay, len(config.BootPorts)+1)
+	for i := 0; i < len(nodes); i++ {
+		nodes[i] = New(appId, key, new(nopCallback))
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node #%d: %v.", i, err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to shutdown node: %v.", err)
+			}
+		}(nodes[i])
+	}
+	// Verify that only loopback addresses are used, spread over multiple hosts
+	hosts := make(map[string]struct{})
+	for _, node := range nodes {
+		for _, addr := range node.addrs {
+			tcp, err := net.ResolveTCPAddr("tcp", addr)
+			if err != nil || !tcp.IP.IsLoopback() {
+				t.Fatalf("non-loopback listener address: %v.", addr)
+			}
+			hosts[tcp.IP.String()] = struct{}{}
+		}
+	}
+	if len(hosts) < 2 {
+		t.Fatalf("loopback hosts mismatch: have %v, want at least %v.", len(hosts), 2)
+	}
+	// Verify that the nodes found each other, even beyond the bootstrap ports
+	time.Sleep(convTimeout)
+
+	ids := make(map[string]*Overlay)
+	for _, node := range nodes {
+		ids[node.nodeId.String()] = node
+	}
+	reached := map[string]struct{}{nodes[0].nodeId.String(): {}}
+	pending := []*Overlay{nodes[0]}
+	for len(pending) > 0 {
+		node := pending[0]
+		pending = pending[1:]
+
+		node.lock.RLock()
+		for id, _ := range node.livePeers {
+			if _, ok := reached[id]; !ok {
+				reached[id] = struct{}{}
+				pending = append(pending, ids[id])
+			}
+		}
+		node.lock.RUnlock()
+	}
+	if len(reached) != len(nodes) {
+		t.Fatalf("overlay partitioned: have %v reachable nodes, want %v.", len(reached), len(nodes))
+	}
+}
@@ -81,11 +81,14 @@ func (o *Overlay) sendPacket(dest *peer, head *header) {
 }
 
 // Assembles an overlay join message, consisting of the join opcode and local
-// network addresses, sending it towards the destination node.
+// (advertised) network addresses, sending it towards the destination node.
 func (o *Overlay) sendJoin(dest *peer) {
+	o.lock.RLock()
 	state := &state{
-		Addrs: map[string][]string{o.nodeId.String(): o.addrs},
+		Addrs: map[string][]string{o.nodeId.String(): o.advAddrs},
 	}
+	o.lock.RUnlock()
+
 	o.sendPacket(dest, &header{Op: opJoin, Dest: o.nodeId, State: state})
 }
 
@@ -118,7 +121,7 @@ func (o *Overlay) sendState(dest *peer) {
 	}
 
 	// Serialize our own addresses, the leaf set and common row
-	s.Addrs[o.nodeId.String()] = o.addrs
+	s.Addrs[o.nodeId.String()] = o.advAddrs
 	for _, id := range o.routes.leaves {
 		sid := id.String()
 		if node, ok := o.livePeers[sid]; ok {
@@ -33,6 +33,8 @@ import (
 
 // Pastry routing algorithm.
 func (o *Overlay) route(src *peer, msg *proto.Message) {
+	routedMessages.Inc()
+
 	// Sync the routing table
 	o.lock.RLock() // Note, unlock is in deliver and forward!!!
 
@@ -89,6 +91,8 @@ func (o *Overlay) route(src *peer, msg *proto.Message) {
 
 // Delivers a message to the application layer or processes it if a system message.
 func (o *Overlay) deliver(src *peer, msg *proto.Message) {
+	deliveredMessages.Inc()
+
 	head := msg.Head.Meta.(*header)
 	if head.Op != opNop {
 		o.process(src, head)
@@ -104,6 +108,8 @@ func (o *Overlay) deliver(src *peer, msg *proto.Message) {
 // Forwards a message to the node with the given id and also checks its contents
 // if it's a system message.
 func (o *Overlay) forward(src *peer, msg *proto.Message, id *big.Int) {
+	forwardedMessages.Inc()
+
 	head := msg.Head.Meta.(*header)
 	if head.Op != opNop {
 		// Overlay system message, process and forward
@@ -0,0 +1,102 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the static seed dialer, which connects to a configured list of peers
+// directly instead of relying on the bootstrappers. This allows joining nodes
+// in other subnets, where the UDP probes and scans cannot reach.
+
+package pastry
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Dials all the configured seeds at startup, and then periodically retries them
+// if none of the seeds are connected (e.g. network partition or seeds coming up
+// after the local node).
+func (o *Overlay) seeder(quit chan chan error) {
+	o.seed(true)
+
+	var errc chan error
+	for errc == nil {
+		select {
+		case errc = <-quit:
+			continue
+		case <-time.After(config.PastrySeedPeriod):
+			o.seed(false)
+		}
+	}
+	errc <- nil
+}
+
+// Schedules a dial to each configured seed not yet connected. Unless forced,
+// nothing is done if any seed is live.
+func (o *Overlay) seed(force bool) {
+	// Dial each remaining seed separately, they are distinct nodes
+	for _, seed := range o.seeds(force) {
+		addr := seed
+		o.authInit.Schedule(func() { o.dial([]*net.TCPAddr{addr}) })
+	}
+}
+
+// Resolves the configured seed addresses and collects the ones needing a dial,
+// skipping the local and already connected ones. Unless forced, nothing is
+// returned if any seed is live.
+func (o *Overlay) seeds(force bool) []*net.TCPAddr {
+	// Resolve the seed addresses (each run, to follow DNS changes)
+	seeds := make([]*net.TCPAddr, 0, len(config.PastrySeeds))
+	for _, address := range config.PastrySeeds {
+		if addr, err := net.ResolveTCPAddr("tcp", address); err != nil {
+			log.Printf("pastry: failed to resolve seed %v: %v.", address, err)
+		} else {
+			seeds = append(seeds, addr)
+		}
+	}
+	// Collect the addresses already connected or owned locally
+	o.lock.RLock()
+	own := make(map[string]struct{})
+	for _, addr := range append(append([]string{}, o.addrs...), o.advAddrs...) {
+		own[addr] = struct{}{}
+	}
+	live := make(map[string]struct{})
+	for _, p := range o.livePeers {
+		for _, addr := range p.addrs {
+			live[addr] = struct{}{}
+		}
+	}
+	o.lock.RUnlock()
+
+	// Filter out the seeds not needing a connection
+	dials := make([]*net.TCPAddr, 0, len(seeds))
+	for _, seed := range seeds {
+		if _, ok := own[seed.String()]; ok {
+			continue
+		}
+		if _, ok := live[seed.String()]; ok {
+			if !force {
+				return nil
+			}
+			continue
+		}
+		dials = append(dials, seed)
+	}
+	return dials
+}
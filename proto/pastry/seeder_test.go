@@ -0,0 +1,107 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+func TestSeeds(t *testing.T) {
+	// Override the overlay configuration and switch to loopback mode
+	swapConfigs()
+	defer swapConfigs()
+
+	config.NetLoopback = true
+	defer func() { config.NetLoopback = false }()
+
+	// Start a fake seed never completing the handshake, counting the dials
+	fake, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake seed: %v.", err)
+	}
+	defer fake.Close()
+
+	dials := int32(0)
+	go func() {
+		for {
+			conn, err := fake.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dials, 1)
+			conn.Close()
+		}
+	}()
+	seeds, period := config.PastrySeeds, config.PastrySeedPeriod
+	defer func() { config.PastrySeeds, config.PastrySeedPeriod = seeds, period }()
+
+	config.PastrySeeds = []string{fake.Addr().String()}
+	config.PastrySeedPeriod = 100 * time.Millisecond
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot a node and check that the seed is dialed at boot and then redialed
+	alice := New(appId, key, new(nopCallback))
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer func() {
+		if err := alice.Shutdown(); err != nil {
+			t.Fatalf("failed to shutdown alice: %v.", err)
+		}
+	}()
+	if n := atomic.LoadInt32(&dials); n < 1 {
+		t.Fatalf("seed not dialed during boot: have %v dials, want at least %v.", n, 1)
+	}
+	time.Sleep(5 * config.PastrySeedPeriod / 2)
+	if n := atomic.LoadInt32(&dials); n < 3 {
+		t.Fatalf("seed not redialed while offline: have %v dials, want at least %v.", n, 3)
+	}
+	// Boot a second node seeding from the first, and check the dial selection
+	config.PastrySeeds = []string{alice.addrs[0], fake.Addr().String()}
+
+	bob := New(appId, key, new(nopCallback))
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer func() {
+		if err := bob.Shutdown(); err != nil {
+			t.Fatalf("failed to shutdown bob: %v.", err)
+		}
+	}()
+	if _, ok := bob.livePeers[alice.nodeId.String()]; !ok {
+		t.Fatalf("alice (%v) missing from the pool of bob: %v.", alice.nodeId, bob.livePeers)
+	}
+	// Alice skips herself, but no seed is live, so keeps dialing the fake one
+	if dials := alice.seeds(false); len(dials) != 1 || dials[0].String() != fake.Addr().String() {
+		t.Fatalf("alice seed selection mismatch: have %v, want [%v].", dials, fake.Addr())
+	}
+	// Bob has a live seed, so only dials the offline one if forced (boot)
+	if dials := bob.seeds(false); len(dials) != 0 {
+		t.Fatalf("bob redialing with a live seed: have %v, want [].", dials)
+	}
+	if dials := bob.seeds(true); len(dials) != 1 || dials[0].String() != fake.Addr().String() {
+		t.Fatalf("bob forced seed selection mismatch: have %v, want [%v].", dials, fake.Addr())
+	}
+}
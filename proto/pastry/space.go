@@ -22,6 +22,7 @@
 package pastry
 
 import (
+	"crypto/x509"
 	"io"
 	"math/big"
 
@@ -88,6 +89,12 @@ func prefix(a, b *big.Int) (int, int) {
 	return p, int(d)
 }
 
+// Derives the overlay id of a node from its certified public key, binding the id
+// to the node's identity (and keeping it across certificate renewals).
+func certifiedId(cert *x509.Certificate) *big.Int {
+	return Resolve("iris.node:" + string(cert.RawSubjectPublicKeyInfo))
+}
+
 // Converts a string id into an overlay id.
 func Resolve(id string) *big.Int {
 	// Hash the textual id
@@ -0,0 +1,93 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the statistics snapshot of the overlay, exposing the live peers and
+// the routing table for monitoring purposes.
+
+package pastry
+
+import (
+	"sort"
+)
+
+// Snapshot of the overlay state.
+type Stats struct {
+	Id     string       `json:"id"`     // Pastry node id
+	Addrs  []string     `json:"addrs"`  // Local listener addresses
+	Peers  []PeerStats  `json:"peers"`  // Live peer connections
+	Leaves []string     `json:"leaves"` // Leaf set (including the local node)
+	Routes []RouteStats `json:"routes"` // Occupied routing table cells
+}
+
+// Snapshot of a single peer connection.
+type PeerStats struct {
+	Id     string   `json:"id"`     // Remote node id
+	Addrs  []string `json:"addrs"`  // Remote listener addresses
+	Local  string   `json:"local"`  // Local endpoint of the connection
+	Remote string   `json:"remote"` // Remote endpoint of the connection
+	Active bool     `json:"active"` // Whether the peer is in the routing table
+}
+
+// Snapshot of a single routing table cell.
+type RouteStats struct {
+	Row int    `json:"row"` // Length of the common prefix (in digits)
+	Col int    `json:"col"` // Value of the next digit
+	Id  string `json:"id"`  // Node id in the cell
+}
+
+// Gathers a snapshot of the overlay state.
+func (o *Overlay) Stats() *Stats {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	stats := &Stats{
+		Id:     o.nodeId.String(),
+		Addrs:  append([]string{}, o.addrs...),
+		Peers:  make([]PeerStats, 0, len(o.livePeers)),
+		Leaves: make([]string, 0, len(o.routes.leaves)),
+		Routes: []RouteStats{},
+	}
+	for _, p := range o.livePeers {
+		stats.Peers = append(stats.Peers, PeerStats{
+			Id:     p.nodeId.String(),
+			Addrs:  append([]string{}, p.addrs...),
+			Local:  p.laddr,
+			Remote: p.raddr,
+			Active: o.active(p.nodeId),
+		})
+	}
+	sort.Sort(peerStatsSorter(stats.Peers))
+
+	for _, leaf := range o.routes.leaves {
+		stats.Leaves = append(stats.Leaves, leaf.String())
+	}
+	for i, row := range o.routes.routes {
+		for j, cell := range row {
+			if cell != nil {
+				stats.Routes = append(stats.Routes, RouteStats{Row: i, Col: j, Id: cell.String()})
+			}
+		}
+	}
+	return stats
+}
+
+// Sorter for the peer snapshots to get a stable listing.
+type peerStatsSorter []PeerStats
+
+func (s peerStatsSorter) Len() int           { return len(s) }
+func (s peerStatsSorter) Less(i, j int) bool { return s[i].Id < s[j].Id }
+func (s peerStatsSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
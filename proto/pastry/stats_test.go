@@ -0,0 +1,65 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start two overlay nodes and wait for them to find each other
+	alice := New(appId, key, new(nopCallback))
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer func() {
+		if err := alice.Shutdown(); err != nil {
+			t.Fatalf("failed to shutdown alice: %v.", err)
+		}
+	}()
+	bob := New(appId, key, new(nopCallback))
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer func() {
+		if err := bob.Shutdown(); err != nil {
+			t.Fatalf("failed to shutdown bob: %v.", err)
+		}
+	}()
+	// Verify that the snapshot of alice contains bob
+	stats := alice.Stats()
+	if stats.Id != alice.nodeId.String() {
+		t.Fatalf("node id mismatch: have %v, want %v.", stats.Id, alice.nodeId)
+	}
+	if len(stats.Peers) != 1 {
+		t.Fatalf("peer count mismatch: have %v, want %v.", len(stats.Peers), 1)
+	}
+	if peer := stats.Peers[0]; peer.Id != bob.nodeId.String() || !peer.Active {
+		t.Fatalf("peer mismatch: have %v/%v, want %v/%v.", peer.Id, peer.Active, bob.nodeId, true)
+	}
+	if len(stats.Leaves) != 2 {
+		t.Fatalf("leaf count mismatch: have %v, want %v.", len(stats.Leaves), 2)
+	}
+}
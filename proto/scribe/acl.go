@@ -0,0 +1,408 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the topic access control lists. An ACL is a versioned set of rules,
+// each listing the node roles permitted to subscribe and publish to a topic. It
+// is signed by the ACL authority, a designated admin key, and distributed to
+// every node through a reserved topic which all nodes subscribe to, with a new
+// member of that tree receiving the current list directly from its parent. If
+// no authority is configured, the cluster key is accepted in its place (i.e.
+// any node may issue lists), apart from when running with node identities.
+//
+// The rules are enforced at every hop of the topic trees, against the roles in
+// the credential carried by subscriptions and publishes. With node identities,
+// the roles are the organizational units certified in the originating node's
+// certificate, which it presents alongside a signature over the operation; the
+// chain is verified against the cluster CA, the same one the pastry sessions
+// authenticate peers (and bind their ids) with, so roles cannot be claimed by
+// anyone but a node certified to hold them. Subscriptions keep the credential
+// of the first subscriber while cascading up the tree, relaying nodes being
+// tree members anyway. When sharing a cluster key, the roles are only declared
+// by the originating node, trusting all key holders to do so truthfully.
+
+package scribe
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/crypto/keys"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/pastry"
+)
+
+// Custom access control error messages
+var ErrDenied = errors.New("permission denied")
+var errStaleAcl = errors.New("stale acl")
+var errNoAuthority = errors.New("no acl authority configured")
+var errNoCredential = errors.New("no credential")
+
+// Reserved topic used to distribute the access control lists.
+var aclTopic = "scribe#acl"
+
+// Access rule of a single topic. Empty role lists prohibit the operation.
+type Rule struct {
+	Topic     string   `json:"topic"`     // Topic the rule applies to
+	Subscribe []string `json:"subscribe"` // Roles permitted to subscribe to the topic
+	Publish   []string `json:"publish"`   // Roles permitted to publish to the topic
+}
+
+// Versioned set of topic access rules, signed by the ACL authority.
+type acl struct {
+	Version uint64
+	Rules   []Rule
+	Sig     []byte
+}
+
+// Access credential of a subscribing or publishing node. With a cluster key the
+// node declares its roles, whereas with node identities it presents its chain,
+// certifying the roles, and signs the operation with its own key.
+type credential struct {
+	Roles []string // Roles declared by the node (cluster key only)
+	Chain [][]byte // Certificate chain of the node, leaf first (identities only)
+	Sig   []byte   // Signature over the operation digest (identities only)
+}
+
+// Topic access permissions resolved to the topic ids.
+type perms struct {
+	subscribe map[string]struct{}
+	publish   map[string]struct{}
+}
+
+// Calculates the digest of the access control list contents to be signed.
+func (a *acl) digest() ([]byte, error) {
+	blob, err := json.Marshal(struct {
+		Version uint64
+		Rules   []Rule
+	}{a.Version, a.Rules})
+	if err != nil {
+		return nil, err
+	}
+	hasher := config.ScribeAclHash.New()
+	hasher.Write(blob)
+	return hasher.Sum(nil), nil
+}
+
+// Signs the access control list with the authority key.
+func (a *acl) sign(key crypto.Signer) error {
+	digest, err := a.digest()
+	if err != nil {
+		return err
+	}
+	a.Sig, err = keys.Sign(rand.Reader, key, config.ScribeAclHash, digest)
+	return err
+}
+
+// Verifies the signature of the access control list against the authority key.
+func (a *acl) verify(key crypto.PublicKey) error {
+	digest, err := a.digest()
+	if err != nil {
+		return err
+	}
+	return keys.Verify(key, config.ScribeAclHash, digest, a.Sig)
+}
+
+// Resolves the rules into a permission map indexed by topic id.
+func (a *acl) resolve() map[string]*perms {
+	res := make(map[string]*perms)
+	for _, rule := range a.Rules {
+		p := &perms{
+			subscribe: make(map[string]struct{}),
+			publish:   make(map[string]struct{}),
+		}
+		for _, role := range rule.Subscribe {
+			p.subscribe[role] = struct{}{}
+		}
+		for _, role := range rule.Publish {
+			p.publish[role] = struct{}{}
+		}
+		res[pastry.Resolve(rule.Topic).String()] = p
+	}
+	return res
+}
+
+// Designates the ACL authority, the key all access control lists must be signed
+// with. Nodes should be configured before booting, lest they drop the current
+// list pushed to them while joining.
+func (o *Overlay) SetAclAuthority(admin crypto.PublicKey) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.admin = admin
+}
+
+// Installs a new access control list, signing it with the authority key and then
+// distributing it to all the nodes in the overlay. The version must be greater
+// than that of any previous list, otherwise the nodes will discard it.
+func (o *Overlay) SetAcl(version uint64, rules []Rule, admin crypto.Signer) error {
+	// Sanity check the rules
+	topics := make(map[string]struct{})
+	for _, rule := range rules {
+		if rule.Topic == aclTopic {
+			return fmt.Errorf("reserved topic: %s", rule.Topic)
+		}
+		if _, ok := topics[rule.Topic]; ok {
+			return fmt.Errorf("duplicate rule: %s", rule.Topic)
+		}
+		topics[rule.Topic] = struct{}{}
+	}
+	// Sign and install locally
+	list := &acl{
+		Version: version,
+		Rules:   append([]Rule{}, rules...),
+	}
+	if err := list.sign(admin); err != nil {
+		return err
+	}
+	if err := o.installAcl(list); err != nil {
+		return err
+	}
+	// Distribute the list through the reserved topic
+	msg, err := o.assembleAcl(list)
+	if err != nil {
+		return err
+	}
+	o.sendPublish(pastry.Resolve(aclTopic), msg)
+	return nil
+}
+
+// Verifies an access control list against the authority and installs it if
+// newer than the current.
+func (o *Overlay) installAcl(list *acl) error {
+	o.lock.RLock()
+	admin := o.admin
+	o.lock.RUnlock()
+
+	if admin == nil {
+		if _, ok := o.key.(*keys.Identity); ok {
+			return errNoAuthority
+		}
+		admin = o.key.Public()
+	}
+	if err := list.verify(admin); err != nil {
+		return fmt.Errorf("invalid acl signature: %v", err)
+	}
+	perms := list.resolve()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.acl != nil && o.acl.Version >= list.Version {
+		return errStaleAcl
+	}
+	o.acl, o.perms = list, perms
+	log.Printf("scribe: installed acl version %v with %d rules.", list.Version, len(list.Rules))
+	return nil
+}
+
+// Retrieves the access permissions of a topic, or nil if it has no rules.
+func (o *Overlay) permissions(topicId *big.Int) *perms {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return o.perms[topicId.String()]
+}
+
+// Checks whether any of the given roles is permitted to subscribe to a topic.
+// Topics without rules are open to everyone.
+func (o *Overlay) canSubscribe(topicId *big.Int, roles []string) bool {
+	p := o.permissions(topicId)
+	return p == nil || permitted(p.subscribe, roles)
+}
+
+// Checks whether any of the given roles is permitted to publish to a topic.
+// Topics without rules are open to everyone.
+func (o *Overlay) canPublish(topicId *big.Int, roles []string) bool {
+	p := o.permissions(topicId)
+	return p == nil || permitted(p.publish, roles)
+}
+
+// Checks whether a credential permits a subscribe or publish operation on a
+// topic. The credential is only verified if the topic has rules at all. For
+// subscriptions, node is the id of the subscriber the credential must be bound
+// to, preventing others from replaying it to graft onto a restricted tree.
+func (o *Overlay) admit(cred *credential, op opcode, topicId, node *big.Int, data []byte) bool {
+	p := o.permissions(topicId)
+	if p == nil {
+		return true
+	}
+	roles, err := o.attested(cred, op, topicId, node, data)
+	if err != nil {
+		log.Printf("scribe: rejected credential for topic %v: %v.", topicId, err)
+		return false
+	}
+	if op == opSubscribe {
+		return permitted(p.subscribe, roles)
+	}
+	return permitted(p.publish, roles)
+}
+
+// Retrieves the roles of the local node: the ones certified by its identity if
+// running with one, or the configured ones otherwise.
+func (o *Overlay) localRoles() []string {
+	if identity, ok := o.key.(*keys.Identity); ok {
+		return identity.Certificate().Subject.OrganizationalUnit
+	}
+	return config.ScribeRoles
+}
+
+// Calculates the digest of a subscribe or publish operation, signed by the node
+// originating it. Subscriptions also bind the id of the subscribing node.
+func operationDigest(op opcode, topicId, node *big.Int, data []byte) []byte {
+	hasher := config.ScribeAclHash.New()
+	hasher.Write([]byte{byte(op)})
+	hasher.Write([]byte(topicId.String()))
+	hasher.Write([]byte{0})
+	if node != nil {
+		hasher.Write([]byte(node.String()))
+		hasher.Write([]byte{0})
+	}
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}
+
+// Assembles the credential of the local node for an operation on a topic. With
+// node identities, publishes into topics without rules are left unsigned to
+// spare a signature per event (subscriptions outlive ACL updates, so they are
+// always signed).
+func (o *Overlay) attest(op opcode, topicId *big.Int, data []byte) *credential {
+	identity, ok := o.key.(*keys.Identity)
+	if !ok {
+		return &credential{Roles: config.ScribeRoles}
+	}
+	if op == opPublish && o.permissions(topicId) == nil {
+		return nil
+	}
+	var node *big.Int
+	if op == opSubscribe {
+		node = o.pastry.Self()
+	}
+	sig, err := keys.Sign(rand.Reader, identity, config.ScribeAclHash, operationDigest(op, topicId, node, data))
+	if err != nil {
+		log.Printf("scribe: failed to sign credential: %v.", err)
+		return nil
+	}
+	return &credential{Chain: identity.Chain(), Sig: sig}
+}
+
+// Resolves the roles a credential attests for an operation on a topic. Declared
+// roles are taken as is with a cluster key, whereas with node identities the
+// chain and signature are verified, yielding the roles certified by the leaf.
+func (o *Overlay) attested(cred *credential, op opcode, topicId, node *big.Int, data []byte) ([]string, error) {
+	identity, ok := o.key.(*keys.Identity)
+	if !ok {
+		if cred == nil {
+			return nil, nil
+		}
+		return cred.Roles, nil
+	}
+	if cred == nil || len(cred.Chain) == 0 {
+		return nil, errNoCredential
+	}
+	leaf, err := o.certified(identity, cred.Chain)
+	if err != nil {
+		return nil, err
+	}
+	if err := keys.Verify(leaf.PublicKey, config.ScribeAclHash, operationDigest(op, topicId, node, data), cred.Sig); err != nil {
+		return nil, err
+	}
+	return leaf.Subject.OrganizationalUnit, nil
+}
+
+// Verifies a certificate chain against the cluster authority, caching accepted
+// leaves until the next revalidation.
+func (o *Overlay) certified(identity *keys.Identity, chain [][]byte) (*x509.Certificate, error) {
+	o.lock.RLock()
+	leaf, ok := o.certs[string(chain[0])]
+	o.lock.RUnlock()
+	if ok {
+		return leaf, nil
+	}
+	leaf, err := identity.Verify(chain)
+	if err != nil {
+		return nil, err
+	}
+	o.lock.Lock()
+	o.certs[string(chain[0])] = leaf
+	o.lock.Unlock()
+
+	return leaf, nil
+}
+
+// Checks whether any of the roles is in the permitted set.
+func permitted(allowed map[string]struct{}, roles []string) bool {
+	for _, role := range roles {
+		if _, ok := allowed[role]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Serializes an access control list into an encrypted scribe message.
+func (o *Overlay) assembleAcl(list *acl) (*proto.Message, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(list); err != nil {
+		return nil, err
+	}
+	msg := &proto.Message{Data: buf.Bytes()}
+	if err := msg.Encrypt(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Sends the current access control list (if any) directly to a node, used to
+// bring new members of the distribution tree up to date.
+func (o *Overlay) pushAcl(dest *big.Int) {
+	o.lock.RLock()
+	list := o.acl
+	o.lock.RUnlock()
+
+	if list == nil {
+		return
+	}
+	msg, err := o.assembleAcl(list)
+	if err != nil {
+		log.Printf("scribe: failed to assemble acl: %v.", err)
+		return
+	}
+	o.sendAcl(dest, msg)
+}
+
+// Handles the arrival of an access control list (already decrypted), either
+// published through the distribution tree or sent directly by a parent. Lists
+// not newer than the current one are silently dropped.
+func (o *Overlay) handleAcl(data []byte) error {
+	list := new(acl)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(list); err != nil {
+		return err
+	}
+	if err := o.installAcl(list); err != nil && err != errStaleAcl {
+		return err
+	}
+	return nil
+}
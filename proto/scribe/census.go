@@ -0,0 +1,107 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the topic census extension. Along with the load reports, every node
+// of a topic tree tells its neighbors the number of members on its own side of
+// the tree, so that each tree node can estimate the size of the whole tree. A
+// census query is routed towards the topic, answered by the first tree node it
+// reaches (or by the root with an empty census if the topic does not exist) and
+// sent back directly to the requester.
+
+package scribe
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/project-iris/iris/proto/pastry"
+)
+
+// Approximate membership of a topic tree.
+type Census struct {
+	Members  int // Number of members subscribed to the topic
+	Capacity int // Total messages the members can take per beat
+}
+
+// Sets the number of members the local subscription to a topic stands for (by
+// default one).
+func (o *Overlay) Weigh(topic string, members int) error {
+	o.lock.RLock()
+	top, ok := o.topics[pastry.Resolve(topic).String()]
+	o.lock.RUnlock()
+	if !ok {
+		return ErrNotSubscribed
+	}
+	top.Weigh(members)
+	return nil
+}
+
+// Queries the approximate membership of a topic, waiting at most timeout for
+// the topic tree to answer.
+func (o *Overlay) Census(topic string, timeout time.Duration) (*Census, error) {
+	// Register a census sink and send the query
+	o.censusLock.Lock()
+	o.censusIdx++
+	tag, sink := o.censusIdx, make(chan *Census, 1)
+	o.censuses[tag] = sink
+	o.censusLock.Unlock()
+
+	defer func() {
+		o.censusLock.Lock()
+		delete(o.censuses, tag)
+		o.censusLock.Unlock()
+	}()
+	o.sendCensus(pastry.Resolve(topic), tag)
+
+	select {
+	case census := <-sink:
+		return census, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Answers a census query if the local node is a member of the topic tree or the
+// topic root, returning whether the query was handled.
+func (o *Overlay) handleCensus(nodeId, topicId *big.Int, tag uint64, root bool) bool {
+	o.lock.RLock()
+	top, ok := o.topics[topicId.String()]
+	o.lock.RUnlock()
+	if !ok && !root {
+		return false
+	}
+	census := new(Census)
+	if ok {
+		census.Members, census.Capacity = top.Census()
+	}
+	o.sendCensusReply(nodeId, topicId, tag, census)
+	return true
+}
+
+// Delivers a census answer to the local query waiting for it.
+func (o *Overlay) handleCensusReply(tag uint64, census *Census) {
+	o.censusLock.Lock()
+	defer o.censusLock.Unlock()
+
+	if sink, ok := o.censuses[tag]; ok {
+		select {
+		case sink <- census:
+		default:
+			// Duplicate answer, already delivered
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the durable topic extension. Durable publishes are never caught in
+// flight, but are always routed to the topic root, which assigns them the next
+// sequence number, journals them and replicates them to the leaf set neighbors
+// closest to the topic (i.e. the nodes taking over the root on failure) before
+// distributing them through the topic tree.
+//
+// Replays are requested from the topic root, which streams back the journaled
+// events directly to the requesting node, terminated by an end marker carrying
+// the last assigned sequence number. Journals persisted on disk are pushed to
+// the current topic roots when booting, and every kept journal is handed over
+// to the current root (or by the root to its replicas) whenever the leaf set
+// changes, so that a new root continues the sequence. Events and end markers
+// carry the epoch of their sequence numbering, which changes only if a new root
+// had to start the journal without any history.
+
+package scribe
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/pastry"
+)
+
+// Publishes a message into a durable topic, to be journaled by the topic root
+// before being broadcast to everyone.
+func (o *Overlay) PublishDurable(topic string, msg *proto.Message) error {
+	id := pastry.Resolve(topic)
+	if !o.canPublish(id, o.localRoles()) {
+		return ErrDenied
+	}
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendDurable(id, msg)
+	return nil
+}
+
+// Requests the replay of a durable topic's journal from the given position. The
+// events are delivered through the application's replay handler, tagged with
+// the given id and terminated by a nil message.
+func (o *Overlay) Replay(topic string, from Cursor, tag uint64) error {
+	id := pastry.Resolve(topic)
+	if !o.canSubscribe(id, o.localRoles()) {
+		return ErrDenied
+	}
+	o.sendReplay(id, &from, tag)
+	return nil
+}
+
+// Retrieves the journal of a durable topic, creating it if needed.
+func (o *Overlay) journalOf(topicId *big.Int) (*journal, error) {
+	sid := topicId.String()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if j, ok := o.journals[sid]; ok {
+		return j, nil
+	}
+	j, err := newJournal(topicId)
+	if err != nil {
+		return nil, err
+	}
+	o.journals[sid] = j
+	return j, nil
+}
+
+// Loads the journals persisted in the configured folder, and pushes them to the
+// current roots of their topics.
+func (o *Overlay) loadJournals() error {
+	if config.ScribeJournalDir == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(config.ScribeJournalDir)
+	if err != nil {
+		return nil // Nothing persisted yet
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || filepath.Ext(name) != ".journal" {
+			continue
+		}
+		id, ok := new(big.Int).SetString(strings.TrimSuffix(name, ".journal"), 16)
+		if !ok {
+			log.Printf("scribe: skipping invalid journal file: %v.", name)
+			continue
+		}
+		j, err := o.journalOf(id)
+		if err != nil {
+			return err
+		}
+		o.pushJournal(id, j, j.since(Cursor{}))
+	}
+	return nil
+}
+
+// Hands the kept journals over if the leaf set changed since the last time: to
+// the topic root if it is a remote node, or if the local node is the root, to
+// the closest leaves replicating it.
+func (o *Overlay) handoverJournals() {
+	leaves := o.pastry.Leaves()
+	leafset := fmt.Sprint(leaves)
+
+	o.lock.Lock()
+	changed := leafset != o.leafset
+	o.leafset = leafset
+	journals := make([]*journal, 0, len(o.journals))
+	for _, j := range o.journals {
+		journals = append(journals, j)
+	}
+	o.lock.Unlock()
+
+	if !changed {
+		return
+	}
+	self := o.pastry.Self()
+	for _, j := range journals {
+		sort.Sort(&leafSorter{j.topic, leaves})
+		if len(leaves) > 0 && pastry.Distance(j.topic, leaves[0]).Cmp(pastry.Distance(j.topic, self)) < 0 {
+			o.pushJournal(j.topic, j, j.since(Cursor{}))
+			continue
+		}
+		replicas := leaves
+		if len(replicas) > config.ScribeJournalReplicas {
+			replicas = replicas[:config.ScribeJournalReplicas]
+		}
+		entries := j.since(Cursor{})
+		for _, leaf := range replicas {
+			o.pushJournal(leaf, j, entries)
+		}
+	}
+}
+
+// Closes all the journals, releasing their backing files.
+func (o *Overlay) closeJournals() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	var errv error
+	for _, j := range o.journals {
+		if err := j.close(); err != nil && errv == nil {
+			errv = err
+		}
+	}
+	return errv
+}
+
+// Handles a durable publish arriving at the topic root: the event is journaled,
+// replicated and then distributed like any other publish.
+func (o *Overlay) handleDurable(msg *proto.Message, topicId *big.Int) error {
+	head := msg.Head.Meta.(*header)
+	if !o.admit(head.Cred, opPublish, topicId, nil, msg.Data) {
+		return ErrDenied
+	}
+	j, err := o.journalOf(topicId)
+	if err != nil {
+		return err
+	}
+	// Journal the event in its encrypted form, without the scribe headers
+	stored := msg.Head
+	stored.Meta = head.Meta
+
+	e, err := j.append(head.Sender, stored, append([]byte{}, msg.Data...))
+	if err != nil {
+		return err
+	}
+	o.replicate(j, e)
+
+	// Stamp the sequence number and distribute
+	head.Epoch, _ = j.position()
+	head.Seq = e.Seq
+	hand, err := o.handlePublish(msg, topicId, nil)
+	if err != nil {
+		return err
+	}
+	if !hand && head.Ack != 0 {
+		o.ackEmpty(head)
+	}
+	return nil
+}
+
+// Replicates a freshly journaled event to the leaf set neighbors closest to the
+// topic id.
+func (o *Overlay) replicate(j *journal, e *entry) {
+	leaves := o.pastry.Leaves()
+	sort.Sort(&leafSorter{j.topic, leaves})
+	if len(leaves) > config.ScribeJournalReplicas {
+		leaves = leaves[:config.ScribeJournalReplicas]
+	}
+	for _, leaf := range leaves {
+		o.pushJournal(leaf, j, []*entry{e})
+	}
+}
+
+// Sends a batch of journal entries, along with the journal's high-water mark, to
+// a remote node to merge.
+func (o *Overlay) pushJournal(dest *big.Int, j *journal, entries []*entry) {
+	buffer := new(bytes.Buffer)
+	if err := gob.NewEncoder(buffer).Encode(entries); err != nil {
+		log.Printf("scribe: failed to encode journal entries: %v.", err)
+		return
+	}
+	msg := &proto.Message{Data: buffer.Bytes()}
+	if err := msg.Encrypt(); err != nil {
+		log.Printf("scribe: failed to encrypt journal entries: %v.", err)
+		return
+	}
+	epoch, high := j.position()
+	o.sendJournal(dest, j.topic, epoch, high, msg)
+}
+
+// Merges a batch of (already decrypted) replicated journal entries.
+func (o *Overlay) handleJournal(topicId *big.Int, epoch uint64, high uint64, data []byte) error {
+	entries := []*entry{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entries); err != nil {
+		return err
+	}
+	j, err := o.journalOf(topicId)
+	if err != nil {
+		return err
+	}
+	return j.merge(epoch, high, entries)
+}
+
+// Streams back the journaled events of a topic from the requested position to
+// the remote node, closing with an end marker.
+func (o *Overlay) handleReplay(nodeId *big.Int, topicId *big.Int, from *Cursor, tag uint64) error {
+	if from == nil {
+		from = new(Cursor)
+	}
+	o.lock.RLock()
+	j, ok := o.journals[topicId.String()]
+	o.lock.RUnlock()
+
+	epoch, last := uint64(0), uint64(0)
+	if ok {
+		// Fetch the end marker first, as events journaled meanwhile are delivered live
+		epoch, last = j.position()
+		for _, e := range j.since(*from) {
+			msg := &proto.Message{
+				Head: e.Head,
+				Data: append([]byte{}, e.Data...),
+			}
+			msg.KnownSecure()
+			o.sendHistory(nodeId, topicId, epoch, e.Seq, tag, msg)
+		}
+	}
+	o.sendHistoryEnd(nodeId, topicId, epoch, last, tag)
+	return nil
+}
+
+// Delivers a replayed event (or the replay end marker) to the application.
+func (o *Overlay) handleHistory(msg *proto.Message) error {
+	head := msg.Head.Meta.(*header)
+	if head.End {
+		o.app.HandleReplay(head.Tag, head.Epoch, head.Seq, nil)
+		return nil
+	}
+	msg.Head.Meta = head.Meta
+	if err := msg.Decrypt(); err != nil {
+		return err
+	}
+	o.app.HandleReplay(head.Tag, head.Epoch, head.Seq, msg)
+	return nil
+}
+
+// Sorter for the leaf set to order it by distance from a topic.
+type leafSorter struct {
+	topic  *big.Int
+	leaves []*big.Int
+}
+
+func (s *leafSorter) Len() int { return len(s.leaves) }
+func (s *leafSorter) Less(i, j int) bool {
+	return pastry.Distance(s.topic, s.leaves[i]).Cmp(pastry.Distance(s.topic, s.leaves[j])) < 0
+}
+func (s *leafSorter) Swap(i, j int) { s.leaves[i], s.leaves[j] = s.leaves[j], s.leaves[i] }
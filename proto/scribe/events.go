@@ -45,7 +45,11 @@
 //
 //  - Balance:
 //    It is essentially the same as publish, with the only difference that the
-//    message is send forward on only one edge of the multi-cast tree.
+//    message is send forward on only one edge of the multi-cast tree. Balances
+//    with a failover budget are retained by the forwarding node, and balanced
+//    again if the neighbor dies before the budget runs out. Balances carrying a
+//    routing key are never caught midway, but descend from the topic root along
+//    the edges chosen by rendezvous hashing, weighed by the member counts.
 //
 //  - Report:
 //    These are used to distribute load reports between members of a multi-cast
@@ -55,6 +59,24 @@
 //    As the name suggests, direct messages have a precise destination. Only the
 //    true recipient must handle it. Delivery to a non-precise destination means
 //    either the destination terminated, or pastry's mis-delivered (churn?).
+//
+//  - Acknowledgement:
+//    Reliable publishes are distributed like normal ones, but each node tracks
+//    the neighbors it forwarded to, and once all acknowledged (or timed out),
+//    acks the previous hop with the aggregated receipt. The tree entry point
+//    sends the final receipt directly to the publisher.
+//
+//  - Census:
+//    Membership queries are routed towards the topic root, but are answered by
+//    the first topic tree member reached, as each of them estimates the size of
+//    the whole tree from the member counts piggybacked on the load reports.
+//
+//  - Access control:
+//    Subscriptions and publishes carry the credential of the originating node
+//    (its declared roles, or its certificate chain and signature with node
+//    identities), which is checked against the topic ACL by every node handling
+//    them (including plain routers), dropping the message if denied. ACL updates are published
+//    into a reserved topic, or sent directly (precisely) to new members of it.
 
 package scribe
 
@@ -78,7 +100,7 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 		if head.Sender.Cmp(o.pastry.Self()) == 0 {
 			return
 		}
-		if err := o.handleSubscribe(head.Sender, key); err != nil {
+		if err := o.handleSubscribe(head.Sender, key, head.Cred); err != nil {
 			log.Printf("scribe: %v failed to handle delivered subscription %v to %v: %v.", o.pastry.Self(), head.Sender, key, err)
 		}
 	case opUnsubscribe:
@@ -91,15 +113,26 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 			log.Printf("scribe: failed to handle delivered unsubscription: %v.", err)
 		}
 	case opPublish:
+		// Virgin durable publishes arrive at the topic root to be journaled
+		if head.Durable && head.Prev == nil {
+			if err := o.handleDurable(msg, head.Topic); err != nil {
+				log.Printf("scribe: failed to handle durable publish: %v.", err)
+			}
+			return
+		}
 		// Non-virgin publishes must be delivered precisely
 		if head.Prev != nil && o.pastry.Self().Cmp(key) != 0 {
 			log.Printf("scribe: non-virgin publish at wrong destination (churn?): have %v, want %v.", key, o.pastry.Self())
 			return
 		}
-		if hand, err := o.handlePublish(msg, head.Topic, head.Prev); !hand || err != nil {
+		hand, err := o.handlePublish(msg, head.Topic, head.Prev)
+		if !hand || err != nil {
 			// Simple race condition between unsubscribe and publish, left in for debug
 			log.Printf("scribe: %v failed to handle delivered publish (churn?): %v %v.", o.pastry.Self(), hand, err)
 		}
+		if !hand && err == nil && head.Ack != 0 {
+			o.ackEmpty(head)
+		}
 	case opBalance:
 		// Non-virgin balances must be delivered precisely
 		if head.Prev != nil && o.pastry.Self().Cmp(key) != 0 {
@@ -128,6 +161,69 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 		if err := o.handleDirect(msg); err != nil {
 			log.Printf("scribe: failed to handle direct message: %v.", err)
 		}
+	case opAcl:
+		// Access control lists are always sent precisely
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: acl delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		msg.Head.Meta = head.Meta
+		if err := msg.Decrypt(); err != nil {
+			log.Printf("scribe: failed to decrypt acl: %v.", err)
+			return
+		}
+		if err := o.handleAcl(msg.Data); err != nil {
+			log.Printf("scribe: failed to handle acl: %v.", err)
+		}
+	case opJournal:
+		// Replicas are precise, persisted journals arrive at the topic root
+		msg.Head.Meta = head.Meta
+		if err := msg.Decrypt(); err != nil {
+			log.Printf("scribe: failed to decrypt journal entries: %v.", err)
+			return
+		}
+		if err := o.handleJournal(head.Topic, head.Epoch, head.Seq, msg.Data); err != nil {
+			log.Printf("scribe: failed to merge journal entries: %v.", err)
+		}
+	case opReplay:
+		if err := o.handleReplay(head.Sender, head.Topic, head.Cursor, head.Tag); err != nil {
+			log.Printf("scribe: failed to handle replay request: %v.", err)
+		}
+	case opHistory:
+		// Replayed events are always sent precisely
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: replayed event delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		if err := o.handleHistory(msg); err != nil {
+			log.Printf("scribe: failed to handle replayed event: %v.", err)
+		}
+	case opAck:
+		// Acknowledgements are always sent precisely
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: acknowledgement delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		if head.End {
+			o.handleReceipt(head.Ack, head.Receipt)
+		} else if err := o.handleAck(head.Sender, head.Origin, head.Ack, head.Receipt); err != nil {
+			log.Printf("scribe: failed to handle acknowledgement: %v.", err)
+		}
+	case opCensus:
+		// Queries reaching the root are answered, even if the topic does not exist
+		if !head.End {
+			o.handleCensus(head.Sender, head.Topic, head.Tag, true)
+			return
+		}
+		// Answers are always sent precisely
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: census answer delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		o.handleCensusReply(head.Tag, head.Census)
+	case opServed:
+		// Notices reaching a different node (tracker died) are simply not found
+		o.handleServed(head.Origin, head.Flight)
 	default:
 		log.Printf("unknown opcode received: %v, %v", head.Op, head)
 	}
@@ -144,8 +240,13 @@ func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
 		if head.Sender.Cmp(o.pastry.Self()) == 0 {
 			return true
 		}
+		// Credentials are bound to their subscriber, so nodes that could not join
+		// the tree on their own merely relay the subscription towards the root
+		if !o.canSubscribe(key, o.localRoles()) {
+			return true
+		}
 		// Integrate the subscription locally
-		if err := o.handleSubscribe(head.Sender, key); err != nil {
+		if err := o.handleSubscribe(head.Sender, key, head.Cred); err != nil {
 			// A failure most probably means double subscription caused by a race
 			// between parent discovery and parent response. Discard to prevent the
 			// node being registered into multiple subtrees.
@@ -153,19 +254,37 @@ func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
 			return false
 		}
 		// Integrated, cascade the subscription with the local node
-		head.Sender = o.pastry.Self()
+		o.lock.RLock()
+		head.Sender, head.Cred = o.pastry.Self(), o.creds[key.String()]
+		o.lock.RUnlock()
+		return true
+	}
+	// Durable publishes must reach the topic root, but are still access checked
+	if head.Op == opPublish && head.Prev == nil && head.Durable {
+		if !o.admit(head.Cred, opPublish, head.Topic, nil, msg.Data) {
+			log.Printf("scribe: failed to handle forwarding durable publish: %v.", ErrDenied)
+			return false
+		}
 		return true
 	}
 	// Catch virgin publish messages and only blindly forward if cannot handle
 	if head.Op == opPublish && head.Prev == nil {
 		if hand, err := o.handlePublish(msg, head.Topic, head.Prev); err != nil {
 			log.Printf("scribe: failed to handle forwarding publish: %v %v.", hand, err)
+			if err == ErrDenied {
+				return false
+			}
 		} else {
 			return !hand
 		}
 	}
-	// Catch virgin balance messages and only blindly forward if cannot handle
-	if head.Op == opBalance && head.Prev == nil {
+	// Catch census queries and only blindly forward if not a tree member
+	if head.Op == opCensus && !head.End {
+		return !o.handleCensus(head.Sender, head.Topic, head.Tag, false)
+	}
+	// Catch virgin balance messages and only blindly forward if cannot handle (key
+	// affine balances need the root to choose consistently)
+	if head.Op == opBalance && head.Prev == nil && head.Key == "" {
 		if hand, err := o.handleBalance(msg, head.Topic, head.Prev); err != nil {
 			log.Printf("scribe: failed to handle forwarding balance: %v %v.", hand, err)
 		} else {
@@ -175,11 +294,14 @@ func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
 	return true
 }
 
-// Handles the subscription event to a topic.
-func (o *Overlay) handleSubscribe(nodeId, topicId *big.Int) error {
-	// Generate the textual topic id
+// Handles the subscription event to a topic, given the subscriber's credential
+// is permitted by the topic ACL.
+func (o *Overlay) handleSubscribe(nodeId, topicId *big.Int, cred *credential) error {
+	// Generate the textual topic id and check the permissions
 	sid := topicId.String()
-
+	if !o.admit(cred, opSubscribe, topicId, nodeId, nil) {
+		return ErrDenied
+	}
 	// Make sure the requested topic exists, then subscribe
 	o.lock.Lock()
 	top, ok := o.topics[sid]
@@ -189,6 +311,14 @@ func (o *Overlay) handleSubscribe(nodeId, topicId *big.Int) error {
 	}
 	o.lock.Unlock()
 
+	// New topics need the local credential for cascading towards the root
+	if !ok {
+		own := o.attest(opSubscribe, topicId, nil)
+		o.lock.Lock()
+		o.creds[sid] = own
+		o.lock.Unlock()
+	}
+
 	// Subscribe node to the topic
 	if err := top.Subscribe(nodeId); err != nil {
 		return err
@@ -200,9 +330,14 @@ func (o *Overlay) handleSubscribe(nodeId, topicId *big.Int) error {
 		}
 		rep := &report{
 			Tops: []*big.Int{topicId},
-			Caps: []int{1},
+			Reps: []*topic.Report{{Capacity: 1}},
 		}
 		o.sendReport(nodeId, rep)
+
+		// Bring new members of the ACL distribution tree up to date
+		if topicId.Cmp(pastry.Resolve(aclTopic)) == 0 {
+			go o.pushAcl(nodeId)
+		}
 	}
 	return nil
 }
@@ -237,14 +372,22 @@ func (o *Overlay) handleUnsubscribe(nodeId, topicId *big.Int) error {
 			go o.sendUnsubscribe(parent, top.Self())
 		}
 		delete(o.topics, sid)
+		delete(o.creds, sid)
 	}
 	return nil
 }
 
-// Handles the publish event of a topic.
+// Handles the publish event of a topic. Publishes denied by the topic ACL are
+// reported handled (i.e. dropped).
 func (o *Overlay) handlePublish(msg *proto.Message, topicId *big.Int, prevHop *big.Int) (bool, error) {
 	sid := topicId.String()
 
+	// Extract the message headers and check the permissions
+	head := msg.Head.Meta.(*header)
+	if !o.admit(head.Cred, opPublish, topicId, nil, msg.Data) {
+		return true, ErrDenied
+	}
+
 	// Fetch the topic or report not found
 	o.lock.RLock()
 	top, ok := o.topics[sid]
@@ -258,9 +401,15 @@ func (o *Overlay) handlePublish(msg *proto.Message, topicId *big.Int, prevHop *b
 	if prevHop != nil && !top.Neighbor(prevHop) {
 		return true, fmt.Errorf("non-neighbor direct publish: %v", prevHop)
 	}
-	// Extract the message headers
-	head := msg.Head.Meta.(*header)
-
+	// Track reliable publishes, dropping retransmitted duplicates
+	var track *delivery
+	delivered := false
+	if head.Ack != 0 {
+		if track = o.trackDelivery(head, prevHop); track == nil {
+			return true, nil
+		}
+		defer func() { o.trackLocal(track, delivered) }()
+	}
 	// Get the batch of nodes to broadcast to
 	nodes, local := top.Broadcast(prevHop), false
 	owner := o.pastry.Self()
@@ -271,13 +420,24 @@ func (o *Overlay) handlePublish(msg *proto.Message, topicId *big.Int, prevHop *b
 			*cpy = *msg
 			cpy.Head.Meta = head.copy()
 
+			if track != nil {
+				o.trackForward(track, id, msg)
+			}
 			o.fwdPublish(id, cpy)
 		} else {
 			local = true
 		}
 	}
+	publishHandled.Inc()
+	if local {
+		publishFanout.Observe(float64(len(nodes) - 1))
+	} else {
+		publishFanout.Observe(float64(len(nodes)))
+	}
 	// If local subscription is present, decrypt and deliver
 	if local {
+		publishDelivered.Inc()
+
 		// Assemble a fresh copy for decryption
 		plain := &proto.Message{
 			Head: msg.Head,
@@ -286,12 +446,16 @@ func (o *Overlay) handlePublish(msg *proto.Message, topicId *big.Int, prevHop *b
 		plain.Head.Meta = msg.Head.Meta.(*header).Meta
 		copy(plain.Data, msg.Data)
 
-		// Decrypt the message and deliver upstream
+		// Decrypt the message and deliver upstream (or install if an ACL)
 		if err := plain.Decrypt(); err != nil {
 			// Cannot decrypt, report handled and also the error
 			return true, err
 		}
-		o.app.HandlePublish(head.Sender, topName, plain)
+		delivered = true
+		if topName == aclTopic {
+			return true, o.handleAcl(plain.Data)
+		}
+		o.app.HandlePublish(head.Sender, topName, head.Epoch, head.Seq, plain)
 	}
 	return true, nil
 }
@@ -310,22 +474,35 @@ func (o *Overlay) handleBalance(msg *proto.Message, topicId *big.Int, prevHop *b
 		return false, nil
 	}
 	// Fetch the recipient and either forward or deliver
-	node, err := top.Balance(prevHop)
+	head := msg.Head.Meta.(*header)
+
+	var node *big.Int
+	var err error
+	if head.Key != "" {
+		node, err = top.BalanceKey(head.Key, prevHop)
+	} else {
+		node, err = top.Balance(prevHop)
+	}
 	if err != nil {
 		return true, err
 	}
-	// If it's a remote node, forward
+	// If it's a remote node, forward (tracking it for failover if requested)
 	if node.Cmp(o.pastry.Self()) != 0 {
+		balanceForwarded.Inc()
+		o.trackBalance(node, msg, prevHop)
 		o.fwdBalance(node, msg)
 		return true, nil
 	}
+	balanceDelivered.Inc()
+
 	// Remove all carrier headers and decrypt
-	head := msg.Head.Meta.(*header)
 	msg.Head.Meta = head.Meta
 	if err := msg.Decrypt(); err != nil {
 		return true, err
 	}
-	// Deliver to the application on the specific topic
+	// Deliver to the application on the specific topic (awaiting its completion
+	// if tracked for failover)
+	o.serve(msg, head)
 	o.app.HandleBalance(head.Sender, topName, msg)
 	return true, nil
 }
@@ -359,7 +536,7 @@ func (o *Overlay) handleReport(src *big.Int, rep *report) error {
 			continue
 		}
 		// Insert the report into the topic and assign parent if needed
-		if err := top.ProcessReport(src, rep.Caps[i]); err != nil {
+		if err := top.ProcessReport(src, rep.Reps[i]); err != nil {
 			// Report arrived from untracked node, assign as parent?
 			if top.Parent() != nil {
 				// Nope, we already have a parent, bin it
@@ -380,7 +557,7 @@ func (o *Overlay) handleReport(src *big.Int, rep *report) error {
 			top.Reown(src)
 
 			// Insert the topic report now
-			if err := top.ProcessReport(src, rep.Caps[i]); err != nil {
+			if err := top.ProcessReport(src, rep.Reps[i]); err != nil {
 				errs = append(errs, fmt.Errorf("failed to process parent report: %v.", err))
 				continue
 			}
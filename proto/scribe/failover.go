@@ -0,0 +1,235 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the balanced request failover extension. Balances carrying a failover
+// budget are tracked by each node forwarding them, keyed by the neighbor they
+// were forwarded to. If the heartbeat reports that neighbor dead while budget is
+// still left, the tracked messages are balanced again among the remaining topic
+// members. If the local subtree emptied (e.g. the dead node linked it to the rest
+// of the tree), the retry is deferred for a few heartbeats to let the tree heal,
+// after which it is rerouted towards the topic untracked. Balances served by the
+// node they entered the tree at were never forwarded, so they cannot fail over.
+//
+// Every tracking node adds itself to the balance, so that once the application
+// of the serving node finished with it, all of them are notified directly and
+// forget it, failing over only the messages still in flight. As the notices are
+// not acknowledged, a lost one (or a node dying right after serving) may still
+// execute a request twice. Hence it is the requester's responsibility to only
+// ask for failover if its requests are idempotent.
+
+package scribe
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/pastry"
+)
+
+// Identifier of a failover balance, unique across the requesting nodes.
+type flight struct {
+	origin string // Textual id of the requesting node
+	id     uint64 // Requester assigned id of the balance
+}
+
+// A balanced message forwarded to a tree neighbor, retained for failover.
+type inflight struct {
+	key      flight         // Identifier to match the completion notice with
+	msg      *proto.Message // Copy of the forwarded message
+	prev     *big.Int       // Previous hop the message arrived from
+	deadline time.Time      // Local time after which failover is pointless
+	deferred int            // Number of heartbeats the failover was postponed
+}
+
+// Balances a message to one of the subscribed nodes, retrying on another one if
+// the chosen node dies within the budget.
+func (o *Overlay) BalanceFailover(topic string, msg *proto.Message, budget time.Duration) error {
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendFailover(pastry.Resolve(topic), budget, msg)
+	return nil
+}
+
+// Assigns an id to a locally requested failover balance.
+func (o *Overlay) nextFlight() uint64 {
+	o.flightLock.Lock()
+	defer o.flightLock.Unlock()
+
+	o.flightIdx++
+	return o.flightIdx
+}
+
+// Records a balanced message forwarded to a tree neighbor, if it carries any
+// failover budget, registering the local node for its completion notice.
+func (o *Overlay) trackBalance(dest *big.Int, msg *proto.Message, prevHop *big.Int) {
+	head := msg.Head.Meta.(*header)
+	if head.Budget <= 0 || head.Flight == 0 {
+		return
+	}
+	// Register for the completion notice (failovers are already registered)
+	self, tracking := o.pastry.Self(), false
+	for _, node := range head.Trackers {
+		if node.Cmp(self) == 0 {
+			tracking = true
+			break
+		}
+	}
+	if !tracking {
+		head.Trackers = append(append([]*big.Int{}, head.Trackers...), self)
+	}
+	// Retain an untouched copy for a possible failover
+	cpy := new(proto.Message)
+	*cpy = *msg
+	cpy.Head.Meta = head.copy()
+
+	key := flight{head.Sender.String(), head.Flight}
+
+	o.flightLock.Lock()
+	defer o.flightLock.Unlock()
+
+	flights, ok := o.inflight[dest.String()]
+	if !ok {
+		flights = make(map[flight]*inflight)
+		o.inflight[dest.String()] = flights
+	}
+	flights[key] = &inflight{
+		key:      key,
+		msg:      cpy,
+		prev:     prevHop,
+		deadline: time.Now().Add(head.Budget),
+	}
+}
+
+// Retains the header of a tracked balance delivered to the local application,
+// to notify its trackers when done.
+func (o *Overlay) serve(msg *proto.Message, head *header) {
+	if head.Flight == 0 || len(head.Trackers) == 0 {
+		return
+	}
+	o.flightLock.Lock()
+	o.serving[msg] = head
+	o.flightLock.Unlock()
+}
+
+// Notifies all the nodes tracking a balance that the local application finished
+// serving it.
+func (o *Overlay) served(msg *proto.Message) {
+	o.flightLock.Lock()
+	head, ok := o.serving[msg]
+	delete(o.serving, msg)
+	o.flightLock.Unlock()
+	if !ok {
+		return
+	}
+	self := o.pastry.Self()
+	for _, node := range head.Trackers {
+		if node.Cmp(self) == 0 {
+			o.handleServed(head.Sender, head.Flight)
+		} else {
+			o.sendServed(node, head.Sender, head.Flight)
+		}
+	}
+}
+
+// Forgets a tracked balance (whether still pending or postponed) after it was
+// served, so it is not failed over any more.
+func (o *Overlay) handleServed(origin *big.Int, id uint64) {
+	key := flight{origin.String(), id}
+
+	o.flightLock.Lock()
+	defer o.flightLock.Unlock()
+
+	for sid, flights := range o.inflight {
+		if _, ok := flights[key]; ok {
+			delete(flights, key)
+			if len(flights) == 0 {
+				delete(o.inflight, sid)
+			}
+			break
+		}
+	}
+	for i, f := range o.orphans {
+		if f.key == key {
+			o.orphans = append(o.orphans[:i], o.orphans[i+1:]...)
+			break
+		}
+	}
+}
+
+// Rebalances all the messages in flight towards a dead tree neighbor that still
+// have failover budget left.
+func (o *Overlay) failover(node *big.Int) {
+	o.flightLock.Lock()
+	flights := o.inflight[node.String()]
+	delete(o.inflight, node.String())
+	o.flightLock.Unlock()
+
+	for _, f := range flights {
+		balanceFailovers.Inc()
+		o.rebalance(f)
+	}
+}
+
+// Balances a failed over message again within the local subtree, postponing it
+// while the subtree is gone, and rerouting towards the topic if it doesn't heal
+// within the time needed to detect tree changes.
+func (o *Overlay) rebalance(f *inflight) {
+	head := f.msg.Head.Meta.(*header)
+	if head.Budget = f.deadline.Sub(time.Now()); head.Budget <= 0 {
+		return
+	}
+	if hand, err := o.handleBalance(f.msg, head.Topic, f.prev); hand && err == nil {
+		return
+	}
+	if f.deferred < config.ScribeKillCount {
+		f.deferred++
+
+		o.flightLock.Lock()
+		o.orphans = append(o.orphans, f)
+		o.flightLock.Unlock()
+		return
+	}
+	head.Prev = nil
+	o.pastry.Send(head.Topic, f.msg)
+}
+
+// Drops the tracked messages whose failover budget expired, and retries the
+// postponed failovers. Invoked on every heartbeat.
+func (o *Overlay) expireFlights() {
+	o.flightLock.Lock()
+	now := time.Now()
+	for sid, flights := range o.inflight {
+		for key, f := range flights {
+			if !now.Before(f.deadline) {
+				delete(flights, key)
+			}
+		}
+		if len(flights) == 0 {
+			delete(o.inflight, sid)
+		}
+	}
+	orphans := o.orphans
+	o.orphans = nil
+	o.flightLock.Unlock()
+
+	for _, f := range orphans {
+		o.rebalance(f)
+	}
+}
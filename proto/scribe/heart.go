@@ -25,12 +25,13 @@ import (
 	"math/big"
 
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/scribe/topic"
 )
 
 // Load report between two carrier nodes.
 type report struct {
-	Tops []*big.Int // Topics shared between two carrier nodes
-	Caps []int      // Capacity reports related to the topics above
+	Tops []*big.Int      // Topics shared between two carrier nodes
+	Reps []*topic.Report // Capacity, membership and load reports of the topics above
 }
 
 // Adds the node within the topic to the list of monitored entities.
@@ -51,10 +52,12 @@ func (o *Overlay) ping(topic *big.Int, node *big.Int) error {
 	return o.heart.Ping(id)
 }
 
-// Implements the heart.Callback.Beat method. At each heartbeat, the load stats
-// of all the topics are gathered, mapped to destination nodes and sent out. In
-// addition, each root topic sends a subscription message to discover newly
-// added roots.
+// Implements the heart.Callback.Beat method. At each heartbeat, the load stats,
+// member counts and strategies of all the topics are gathered, mapped to the
+// destination nodes and sent out. In addition, each root topic sends a
+// subscription message to discover newly added roots, timed out reliable
+// publishes are retransmitted, expired balance failovers forgotten and journals
+// handed over if the leaf set changed.
 func (o *Overlay) Beat() {
 	o.lock.RLock()
 	defer o.lock.RUnlock()
@@ -62,16 +65,16 @@ func (o *Overlay) Beat() {
 	// Collect and assemble load reports
 	reports := make(map[string]*report)
 	for _, top := range o.topics {
-		ids, caps := top.GenerateReports()
+		ids, reps := top.GenerateReports()
 		for i, id := range ids {
 			sid := id.String()
 			rep, ok := reports[id.String()]
 			if !ok {
-				rep = &report{[]*big.Int{}, []int{}}
+				rep = &report{[]*big.Int{}, []*topic.Report{}}
 				reports[sid] = rep
 			}
 			rep.Tops = append(rep.Tops, top.Self())
-			rep.Caps = append(rep.Caps, caps[i])
+			rep.Reps = append(rep.Reps, reps[i])
 		}
 		top.Cycle()
 	}
@@ -84,11 +87,17 @@ func (o *Overlay) Beat() {
 		}
 	}
 	// Subscribe all root topics
-	for _, top := range o.topics {
+	for sid, top := range o.topics {
 		if top.Parent() == nil {
-			go o.sendSubscribe(top.Self())
+			go o.sendSubscribe(top.Self(), o.creds[sid])
 		}
 	}
+	// Resend the unacknowledged reliable publishes and drop stale balances
+	o.retransmit()
+	o.expireFlights()
+
+	// Hand over the journals to the new roots and replicas, if any
+	go o.handoverJournals()
 }
 
 // Implements the heat.Callback.Dead method, monitoring the death events of
@@ -121,4 +130,8 @@ func (o *Overlay) Dead(id *big.Int) {
 			log.Printf("scribe: failed to unsubscribe dead node: %v.", err)
 		}
 	}
+	// Don't wait for acknowledgements from the dead subtree, and retry the
+	// balanced messages it did not finish
+	o.abandon(node)
+	o.failover(node)
 }
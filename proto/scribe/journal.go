@@ -0,0 +1,417 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the bounded event journal of a durable topic. Events are ordered by
+// the sequence numbers assigned by the topic root, and are evicted by count,
+// total payload size and age. If a journal folder is configured, the events are
+// also appended to a file as length prefixed gob records, which is compacted
+// whenever more than half of it consists of evicted events.
+//
+// The sequence numbering is identified by an epoch, and its high-water mark is
+// kept (and persisted) apart from the events, so that a journal whose events
+// were all evicted still continues its sequence. If the history of a topic is
+// lost regardless, the new journal starts a new epoch, letting subscribers
+// detect the regression.
+
+package scribe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Returned when a journal record exceeds the configured size limit.
+var errRecordLimit = errors.New("journal record exceeds size limit")
+
+// Position in a durable topic's journal to start a replay from. Both limits are
+// applied, the zero value replaying all retained events.
+type Cursor struct {
+	Seq  uint64    // First sequence number to replay
+	Time time.Time // Earliest journaling time to replay
+}
+
+// A single journaled event, kept in the encrypted form it was published in.
+type entry struct {
+	Seq    uint64       // Sequence number assigned by the topic root
+	Time   time.Time    // Time of journaling at the topic root
+	Sender *big.Int     // Origin node of the event
+	Head   proto.Header // Upper layer headers and payload crypto nonces
+	Data   []byte       // Encrypted event payload
+}
+
+// Bounded, optionally file backed event log of a single durable topic.
+type journal struct {
+	topic   *big.Int // Id of the durable topic
+	entries []*entry // Retained events, ordered by sequence number
+	size    int      // Total payload size of the retained events
+	epoch   uint64   // Identifier of the sequence numbering
+	next    uint64   // Sequence number to assign to the next event
+
+	file  *os.File // Backing file (nil if memory only)
+	mark  *os.File // High-water mark file (nil if memory only)
+	stale int      // Number of evicted events still in the backing file
+
+	lock sync.Mutex
+}
+
+// Returns the path of the backing file of a topic journal.
+func journalPath(topic *big.Int) string {
+	return filepath.Join(config.ScribeJournalDir, fmt.Sprintf("%x.journal", topic))
+}
+
+// Returns the path of the high-water mark file of a topic journal.
+func markPath(topic *big.Int) string {
+	return filepath.Join(config.ScribeJournalDir, fmt.Sprintf("%x.mark", topic))
+}
+
+// Generates the epoch of a new sequence numbering.
+func newEpoch() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+// Creates a journal for a durable topic, loading any previously persisted events
+// if a journal folder is configured.
+func newJournal(topic *big.Int) (*journal, error) {
+	j := &journal{
+		topic:   topic,
+		entries: []*entry{},
+		epoch:   newEpoch(),
+		next:    1,
+	}
+	if config.ScribeJournalDir == "" {
+		return j, nil
+	}
+	if err := os.MkdirAll(config.ScribeJournalDir, 0700); err != nil {
+		return nil, err
+	}
+	mark, err := os.OpenFile(markPath(topic), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var blob [16]byte
+	if _, err := io.ReadFull(mark, blob[:]); err == nil {
+		j.epoch = binary.BigEndian.Uint64(blob[:8])
+		j.next = binary.BigEndian.Uint64(blob[8:])
+	}
+	j.mark = mark
+
+	file, err := os.OpenFile(journalPath(topic), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		mark.Close()
+		return nil, err
+	}
+	j.file = file
+
+	// Load all the intact records, stopping at the first torn or oversized one
+	// (the tail is dropped by the compaction below)
+	entries := []*entry{}
+	for reader := bufio.NewReader(file); ; {
+		e, err := readEntry(reader)
+		if err != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	j.insert(entries)
+	j.evict()
+
+	// Rewrite the file to drop any torn tail and duplicates
+	if err := j.compact(); err != nil {
+		file.Close()
+		mark.Close()
+		return nil, err
+	}
+	if err := j.persistMark(); err != nil {
+		file.Close()
+		mark.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// Appends a new event to the journal, assigning it the next sequence number.
+func (j *journal) append(sender *big.Int, head proto.Header, data []byte) (*entry, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	e := &entry{
+		Seq:    j.next,
+		Time:   time.Now(),
+		Sender: sender,
+		Head:   head,
+		Data:   data,
+	}
+	// Persist the record first, so events that could not be reloaded are refused
+	// (a crash before the mark update is caught up when reloading the records)
+	if j.file != nil {
+		if err := writeEntry(j.file, e); err != nil {
+			return nil, err
+		}
+	}
+	j.entries = append(j.entries, e)
+	j.size += len(e.Data)
+	j.next++
+
+	if err := j.persistMark(); err != nil {
+		return nil, err
+	}
+	j.evict()
+	return e, nil
+}
+
+// Merges replicated (or handed over) events and the high-water mark of their
+// numbering into the journal, skipping already known events. If the numberings
+// differ, the one further ahead wins (ties broken by the epoch), dropping the
+// events of the other.
+func (j *journal) merge(epoch uint64, high uint64, entries []*entry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if epoch != j.epoch {
+		if last := j.next - 1; last > high || (last == high && j.epoch > epoch) {
+			return nil
+		}
+		j.entries, j.size = []*entry{}, 0
+		j.epoch, j.next = epoch, 1
+		if j.file != nil {
+			if err := j.compact(); err != nil {
+				return err
+			}
+		}
+	}
+	fresh := j.insert(entries)
+	if high >= j.next {
+		j.next = high + 1
+	}
+	if err := j.persistMark(); err != nil {
+		return err
+	}
+	if j.file != nil {
+		for _, e := range fresh {
+			if err := writeEntry(j.file, e); err != nil {
+				return err
+			}
+		}
+	}
+	j.evict()
+	return nil
+}
+
+// Overwrites the persisted high-water mark with the current numbering, if file
+// backed. The lock must be held by the caller.
+func (j *journal) persistMark() error {
+	if j.mark == nil {
+		return nil
+	}
+	var blob [16]byte
+	binary.BigEndian.PutUint64(blob[:8], j.epoch)
+	binary.BigEndian.PutUint64(blob[8:], j.next)
+	_, err := j.mark.WriteAt(blob[:], 0)
+	return err
+}
+
+// Inserts a batch of events into the ordered entry list, dropping duplicates,
+// and returns the newly inserted ones. The lock must be held by the caller.
+func (j *journal) insert(entries []*entry) []*entry {
+	known := make(map[uint64]struct{}, len(j.entries))
+	for _, e := range j.entries {
+		known[e.Seq] = struct{}{}
+	}
+	fresh := []*entry{}
+	for _, e := range entries {
+		if _, ok := known[e.Seq]; ok {
+			continue
+		}
+		known[e.Seq] = struct{}{}
+		fresh = append(fresh, e)
+
+		j.entries = append(j.entries, e)
+		j.size += len(e.Data)
+		if e.Seq >= j.next {
+			j.next = e.Seq + 1
+		}
+	}
+	sort.Sort(entrySorter(j.entries))
+	return fresh
+}
+
+// Returns the retained events at or after the given cursor.
+func (j *journal) since(from Cursor) []*entry {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.evict()
+
+	res := []*entry{}
+	for _, e := range j.entries {
+		if e.Seq >= from.Seq && !e.Time.Before(from.Time) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// Returns the sequence number of the last journaled event (0 if none yet).
+func (j *journal) last() uint64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.next - 1
+}
+
+// Returns the epoch of the sequence numbering and the last sequence number.
+func (j *journal) position() (uint64, uint64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.epoch, j.next - 1
+}
+
+// Returns the number and total payload size of the retained events.
+func (j *journal) usage() (int, int) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return len(j.entries), j.size
+}
+
+// Evicts the events violating the retention limits, compacting the backing file
+// if needed. The lock must be held by the caller.
+func (j *journal) evict() {
+	limit := time.Now().Add(-config.ScribeJournalAge)
+
+	drop := 0
+	for _, e := range j.entries {
+		if len(j.entries)-drop <= config.ScribeJournalCount && j.size <= config.ScribeJournalSize && !e.Time.Before(limit) {
+			break
+		}
+		j.size -= len(e.Data)
+		drop++
+	}
+	if drop == 0 {
+		return
+	}
+	j.entries = append([]*entry{}, j.entries[drop:]...)
+	j.stale += drop
+
+	if j.file != nil && j.stale > len(j.entries) {
+		if err := j.compact(); err != nil {
+			// Not fatal, the file will be compacted on the next eviction
+			j.stale = len(j.entries) + 1
+		}
+	}
+}
+
+// Rewrites the backing file with only the retained events. The lock must be held
+// by the caller.
+func (j *journal) compact() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.file.Seek(0, 0); err != nil {
+		return err
+	}
+	buffer := bufio.NewWriter(j.file)
+	for _, e := range j.entries {
+		if err := writeEntry(buffer, e); err != nil {
+			return err
+		}
+	}
+	if err := buffer.Flush(); err != nil {
+		return err
+	}
+	j.stale = 0
+	return nil
+}
+
+// Closes the backing and high-water mark files of the journal, if any.
+func (j *journal) close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	if merr := j.mark.Close(); err == nil {
+		err = merr
+	}
+	j.file, j.mark = nil, nil
+	return err
+}
+
+// Serializes a single event as a length prefixed gob record, refusing records
+// above the size limit (they would be dropped as torn when reloading).
+func writeEntry(w io.Writer, e *entry) error {
+	buffer := new(bytes.Buffer)
+	if err := gob.NewEncoder(buffer).Encode(e); err != nil {
+		return err
+	}
+	if buffer.Len() > config.ScribeJournalRecordLimit {
+		return errRecordLimit
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(buffer.Len()))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+// Deserializes a single length prefixed gob record. Records claiming a length
+// above the size limit can only be torn or corrupt, so they are not allocated.
+func readEntry(r io.Reader) (*entry, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(size[:])
+	if uint64(length) > uint64(config.ScribeJournalRecordLimit) {
+		return nil, errRecordLimit
+	}
+	blob := make([]byte, length)
+	if _, err := io.ReadFull(r, blob); err != nil {
+		return nil, err
+	}
+	e := new(entry)
+	if err := gob.NewDecoder(bytes.NewReader(blob)).Decode(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Sorter for the journal entries to order them by sequence number.
+type entrySorter []*entry
+
+func (s entrySorter) Len() int           { return len(s) }
+func (s entrySorter) Less(i, j int) bool { return s[i].Seq < s[j].Seq }
+func (s entrySorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,284 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package scribe
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Tests the journal retention limits.
+func TestJournalEviction(t *testing.T) {
+	defer func(count, size int) {
+		config.ScribeJournalCount, config.ScribeJournalSize = count, size
+	}(config.ScribeJournalCount, config.ScribeJournalSize)
+	config.ScribeJournalCount, config.ScribeJournalSize = 10, 1024
+
+	j, err := newJournal(big.NewInt(314))
+	if err != nil {
+		t.Fatalf("failed to create journal: %v.", err)
+	}
+	// Overflow the count limit
+	for i := 0; i < 15; i++ {
+		if _, err := j.append(big.NewInt(1), proto.Header{}, make([]byte, 10)); err != nil {
+			t.Fatalf("failed to append event: %v.", err)
+		}
+	}
+	if events, size := j.usage(); events != 10 || size != 100 {
+		t.Fatalf("usage mismatch: have %v/%v, want %v/%v.", events, size, 10, 100)
+	}
+	if entries := j.since(Cursor{}); entries[0].Seq != 6 {
+		t.Fatalf("first retained mismatch: have %v, want %v.", entries[0].Seq, 6)
+	}
+	// Overflow the size limit
+	if _, err := j.append(big.NewInt(1), proto.Header{}, make([]byte, 1000)); err != nil {
+		t.Fatalf("failed to append event: %v.", err)
+	}
+	if events, size := j.usage(); events != 3 || size != 1020 {
+		t.Fatalf("usage mismatch: have %v/%v, want %v/%v.", events, size, 3, 1020)
+	}
+	// Check the cursor filtering
+	if entries := j.since(Cursor{Seq: 15}); len(entries) != 2 {
+		t.Fatalf("replay count mismatch: have %v, want %v.", len(entries), 2)
+	}
+	if entries := j.since(Cursor{Time: time.Now().Add(time.Hour)}); len(entries) != 0 {
+		t.Fatalf("replay count mismatch: have %v, want %v.", len(entries), 0)
+	}
+	if last := j.last(); last != 16 {
+		t.Fatalf("last sequence mismatch: have %v, want %v.", last, 16)
+	}
+}
+
+// Tests that journals are persisted and reloaded, and that merges skip known
+// events.
+func TestJournalPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iris-journal")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(dir string) { config.ScribeJournalDir = dir }(config.ScribeJournalDir)
+	config.ScribeJournalDir = dir
+
+	topic := big.NewInt(2718)
+	j, err := newJournal(topic)
+	if err != nil {
+		t.Fatalf("failed to create journal: %v.", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := j.append(big.NewInt(1), proto.Header{}, []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to append event: %v.", err)
+		}
+	}
+	// Merge a partially overlapping batch
+	batch := []*entry{
+		{Seq: 4, Time: time.Now(), Data: []byte{0xff}},
+		{Seq: 7, Time: time.Now(), Data: []byte{7}},
+	}
+	epoch, _ := j.position()
+	if err := j.merge(epoch, 7, batch); err != nil {
+		t.Fatalf("failed to merge events: %v.", err)
+	}
+	if err := j.close(); err != nil {
+		t.Fatalf("failed to close journal: %v.", err)
+	}
+	// Reload and verify the contents
+	j, err = newJournal(topic)
+	if err != nil {
+		t.Fatalf("failed to reload journal: %v.", err)
+	}
+	defer j.close()
+
+	entries := j.since(Cursor{})
+	seqs := []uint64{}
+	for _, e := range entries {
+		seqs = append(seqs, e.Seq)
+	}
+	if len(seqs) != 6 || seqs[3] != 4 || seqs[5] != 7 {
+		t.Fatalf("sequence mismatch: have %v, want %v.", seqs, []uint64{1, 2, 3, 4, 5, 7})
+	}
+	if entries[3].Data[0] != 3 {
+		t.Fatalf("merge overwrote known event: have %v, want %v.", entries[3].Data[0], 3)
+	}
+	if last := j.last(); last != 7 {
+		t.Fatalf("last sequence mismatch: have %v, want %v.", last, 7)
+	}
+}
+
+// Tests that the sequence high-water mark survives the eviction of all events
+// and a reload, continuing the same numbering.
+func TestJournalMark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iris-journal")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(dir string, age time.Duration) {
+		config.ScribeJournalDir, config.ScribeJournalAge = dir, age
+	}(config.ScribeJournalDir, config.ScribeJournalAge)
+	config.ScribeJournalDir, config.ScribeJournalAge = dir, 50*time.Millisecond
+
+	topic := big.NewInt(1618)
+	j, err := newJournal(topic)
+	if err != nil {
+		t.Fatalf("failed to create journal: %v.", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := j.append(big.NewInt(1), proto.Header{}, []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to append event: %v.", err)
+		}
+	}
+	epoch, _ := j.position()
+
+	// Let all events expire, then reload the journal
+	time.Sleep(100 * time.Millisecond)
+	if entries := j.since(Cursor{}); len(entries) != 0 {
+		t.Fatalf("retained event count mismatch: have %v, want %v.", len(entries), 0)
+	}
+	if err := j.close(); err != nil {
+		t.Fatalf("failed to close journal: %v.", err)
+	}
+	j, err = newJournal(topic)
+	if err != nil {
+		t.Fatalf("failed to reload journal: %v.", err)
+	}
+	defer j.close()
+
+	if e, last := j.position(); e != epoch || last != 3 {
+		t.Fatalf("position mismatch: have %v/%v, want %v/%v.", e, last, epoch, 3)
+	}
+	e, err := j.append(big.NewInt(1), proto.Header{}, nil)
+	if err != nil {
+		t.Fatalf("failed to append event: %v.", err)
+	}
+	if e.Seq != 4 {
+		t.Fatalf("sequence mismatch: have %v, want %v.", e.Seq, 4)
+	}
+}
+
+// Tests that merging a different sequence numbering keeps the one further ahead.
+func TestJournalMergeEpochs(t *testing.T) {
+	j, err := newJournal(big.NewInt(1414))
+	if err != nil {
+		t.Fatalf("failed to create journal: %v.", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := j.append(big.NewInt(1), proto.Header{}, []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to append event: %v.", err)
+		}
+	}
+	local, _ := j.position()
+	remote := local + 1
+
+	// A numbering behind the local one is ignored
+	if err := j.merge(remote, 1, []*entry{{Seq: 1, Time: time.Now()}}); err != nil {
+		t.Fatalf("failed to merge events: %v.", err)
+	}
+	if epoch, last := j.position(); epoch != local || last != 2 {
+		t.Fatalf("position mismatch: have %v/%v, want %v/%v.", epoch, last, local, 2)
+	}
+	// A numbering ahead replaces the local one
+	if err := j.merge(remote, 10, []*entry{{Seq: 9, Time: time.Now()}, {Seq: 10, Time: time.Now()}}); err != nil {
+		t.Fatalf("failed to merge events: %v.", err)
+	}
+	if epoch, last := j.position(); epoch != remote || last != 10 {
+		t.Fatalf("position mismatch: have %v/%v, want %v/%v.", epoch, last, remote, 10)
+	}
+	if entries := j.since(Cursor{}); len(entries) != 2 || entries[0].Seq != 9 {
+		t.Fatalf("retained events mismatch: have %v, want seqs %v.", len(entries), []uint64{9, 10})
+	}
+	// A bare high-water mark advances the sequence without events
+	if err := j.merge(remote, 12, nil); err != nil {
+		t.Fatalf("failed to merge mark: %v.", err)
+	}
+	if e, _ := j.append(big.NewInt(1), proto.Header{}, nil); e.Seq != 13 {
+		t.Fatalf("sequence mismatch: have %v, want %v.", e.Seq, 13)
+	}
+}
+
+// Tests that oversized records are refused, and that a torn or corrupt tail is
+// dropped on reload without allocating its claimed length.
+func TestJournalTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iris-journal")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(dir string, limit int) {
+		config.ScribeJournalDir, config.ScribeJournalRecordLimit = dir, limit
+	}(config.ScribeJournalDir, config.ScribeJournalRecordLimit)
+	config.ScribeJournalDir, config.ScribeJournalRecordLimit = dir, 1024
+
+	topic := big.NewInt(1618)
+	j, err := newJournal(topic)
+	if err != nil {
+		t.Fatalf("failed to create journal: %v.", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := j.append(big.NewInt(1), proto.Header{}, []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to append event: %v.", err)
+		}
+	}
+	if _, err := j.append(big.NewInt(1), proto.Header{}, make([]byte, 2048)); err != errRecordLimit {
+		t.Fatalf("oversized append error mismatch: have %v, want %v.", err, errRecordLimit)
+	}
+	if last := j.last(); last != 3 {
+		t.Fatalf("last sequence mismatch: have %v, want %v.", last, 3)
+	}
+	if err := j.close(); err != nil {
+		t.Fatalf("failed to close journal: %v.", err)
+	}
+	// Append a record claiming 4 GiB, followed by a few stray bytes
+	info, err := os.Stat(journalPath(topic))
+	if err != nil {
+		t.Fatalf("failed to stat journal: %v.", err)
+	}
+	file, err := os.OpenFile(journalPath(topic), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("failed to open journal: %v.", err)
+	}
+	if _, err := file.Write([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3}); err != nil {
+		t.Fatalf("failed to corrupt journal: %v.", err)
+	}
+	file.Close()
+
+	// Reload and verify the intact records are kept and the tail truncated
+	j, err = newJournal(topic)
+	if err != nil {
+		t.Fatalf("failed to reload journal: %v.", err)
+	}
+	defer j.close()
+
+	if entries := j.since(Cursor{}); len(entries) != 3 {
+		t.Fatalf("entry count mismatch: have %v, want %v.", len(entries), 3)
+	}
+	if reload, err := os.Stat(journalPath(topic)); err != nil {
+		t.Fatalf("failed to stat journal: %v.", err)
+	} else if reload.Size() != info.Size() {
+		t.Fatalf("journal size mismatch: have %v, want %v.", reload.Size(), info.Size())
+	}
+}
@@ -0,0 +1,51 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the instrumentation counters of the scribe multicast layer.
+
+package scribe
+
+import (
+	"github.com/project-iris/iris/metrics"
+)
+
+// Buckets for the number of remote nodes a publish is forwarded to.
+var fanoutBuckets = []float64{0, 1, 2, 4, 8, 16, 32}
+
+// Number of publish events handled by the local topic trees.
+var publishHandled = metrics.NewCounter("iris_scribe_publish_handled_total", "Publish events handled by local topic tree nodes.")
+
+// Distribution of the remote nodes a handled publish is forwarded to.
+var publishFanout = metrics.NewHistogram("iris_scribe_publish_fanout", "Remote nodes a handled publish event is forwarded to.", fanoutBuckets)
+
+// Number of publish events delivered to local subscribers.
+var publishDelivered = metrics.NewCounter("iris_scribe_publish_delivered_total", "Publish events delivered to local subscribers.")
+
+// Number of reliable publish forwards resent due to missing acknowledgements.
+var publishResent = metrics.NewCounter("iris_scribe_publish_resent_total", "Reliable publish forwards resent after an acknowledgement timeout.")
+
+// Number of subtrees failing to acknowledge a reliable publish.
+var publishMissing = metrics.NewCounter("iris_scribe_publish_missing_total", "Subtrees given up on while awaiting reliable publish acknowledgements.")
+
+// Number of balance events forwarded to remote tree nodes.
+var balanceForwarded = metrics.NewCounter("iris_scribe_balance_forwarded_total", "Balance events forwarded to remote topic tree nodes.")
+
+// Number of balance events retried after the chosen node died.
+var balanceFailovers = metrics.NewCounter("iris_scribe_balance_failovers_total", "Balance events rebalanced after their recipient died.")
+
+// Number of balance events delivered to local subscribers.
+var balanceDelivered = metrics.NewCounter("iris_scribe_balance_delivered_total", "Balance events delivered to local subscribers.")
@@ -15,16 +15,21 @@
 // and conditions contained in a signed written agreement between you and the
 // author(s).
 
-// Package scribe contains a simplified version of Scribe, where no topic based
-// ACLs are defined.
+// Package scribe contains a simplified version of Scribe, extended with signed,
+// role based topic ACLs, durable (journaled and replayable) topics,
+// acknowledged publishes, key affine and failover balances and membership census
+// queries.
 package scribe
 
 import (
-	"crypto/rsa"
+	"crypto"
+	"crypto/x509"
 	"errors"
 	"log"
 	"math/big"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/heart"
@@ -35,35 +40,74 @@ import (
 
 // Custom topic error messages
 var ErrSubscribed = errors.New("already subscribed")
+var ErrNotSubscribed = errors.New("not subscribed")
 
 // Callback for events leaving the overlay network.
 type Callback interface {
-	HandlePublish(sender *big.Int, topic string, msg *proto.Message)
+	HandlePublish(sender *big.Int, topic string, epoch uint64, seq uint64, msg *proto.Message)
 	HandleBalance(sender *big.Int, topic string, msg *proto.Message)
 	HandleDirect(sender *big.Int, msg *proto.Message)
+	HandleReplay(tag uint64, epoch uint64, seq uint64, msg *proto.Message)
 }
 
 // The overlay implementation, receiving the overlay events and processing
 // them according to the protocol.
 type Overlay struct {
-	app Callback // Upstream application callback
+	app Callback      // Upstream application callback
+	key crypto.Signer // Cluster key (or node identity) of the local node
 
 	pastry *pastry.Overlay // Overlay network to route the messages
 	heart  *heart.Heart    // Heartbeat mechanism
 
 	topics map[string]*topic.Topic // Topics active in the local node
 	names  map[string]string       // Mapping from topic id to its textual name
+	creds  map[string]*credential  // Local credentials to cascade topic subscriptions with
+
+	admin crypto.PublicKey             // Authority the ACLs must be signed by (nil = cluster key)
+	acl   *acl                         // Current access control list
+	perms map[string]*perms            // Topic permissions resolved from the ACL
+	certs map[string]*x509.Certificate // Verified leaf certificates of remote credentials
+
+	journals map[string]*journal // Durable topic journals kept by the local node
+	leafset  string              // Leaf set the journals were last handed over in
+
+	acks       map[uint64]chan *Receipt // Receipt sinks of the local reliable publishes
+	ackIdx     uint64                   // Id to assign to the next reliable publish
+	deliveries map[string]*delivery     // Reliable publishes tracked by the local node
+	ackLock    sync.Mutex               // Mutex to protect the reliable publish state
+
+	inflight   map[string]map[flight]*inflight // Balanced messages in flight, keyed by neighbor
+	orphans    []*inflight                     // Failovers postponed until the next heartbeat
+	serving    map[*proto.Message]*header      // Failover balances delivered locally, awaiting completion
+	flightIdx  uint64                          // Id to assign to the next failover balance
+	flightLock sync.Mutex                      // Mutex to protect the in-flight balances
+
+	censuses   map[uint64]chan *Census // Answer sinks of the local census queries
+	censusIdx  uint64                  // Tag to assign to the next census query
+	censusLock sync.Mutex              // Mutex to protect the census queries
 
 	lock sync.RWMutex
 }
 
 // Creates a new scribe overlay.
-func New(overId string, key *rsa.PrivateKey, app Callback) *Overlay {
+func New(overId string, key crypto.Signer, app Callback) *Overlay {
 	// Create and initialize the overlay
 	o := &Overlay{
 		app:    app,
+		key:    key,
 		topics: make(map[string]*topic.Topic),
 		names:  make(map[string]string),
+		creds:  make(map[string]*credential),
+		perms:  make(map[string]*perms),
+		certs:  make(map[string]*x509.Certificate),
+
+		journals: make(map[string]*journal),
+
+		acks:       make(map[uint64]chan *Receipt),
+		deliveries: make(map[string]*delivery),
+		inflight:   make(map[string]map[flight]*inflight),
+		serving:    make(map[*proto.Message]*header),
+		censuses:   make(map[uint64]chan *Census),
 	}
 	o.pastry = pastry.New(overId, key, o)
 	o.heart = heart.New(config.ScribeBeatPeriod, config.ScribeKillCount, o)
@@ -82,6 +126,14 @@ func (o *Overlay) Boot() (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	// Join the access control list distribution tree
+	if err := o.Subscribe(aclTopic); err != nil {
+		return 0, err
+	}
+	// Hand any persisted durable topic journals over to the topic roots
+	if err := o.loadJournals(); err != nil {
+		return 0, err
+	}
 	return peers, nil
 }
 
@@ -98,15 +150,39 @@ func (o *Overlay) Shutdown() error {
 
 	// Terminate the heartbeat mechanism and shut down pastry
 	o.heart.Terminate()
-	return o.pastry.Shutdown()
+	if err := o.pastry.Shutdown(); err != nil {
+		o.closeJournals()
+		return err
+	}
+	return o.closeJournals()
 }
 
-// Subscribes to the specified scribe topic.
+// Returns the network interfaces the overlay listens on, as chosen during boot.
+func (o *Overlay) Interfaces() []*net.IPNet {
+	return o.pastry.Interfaces()
+}
+
+// Re-verifies the certificates of the connected peers, dropping the revoked ones.
+// The cached credential certificates are flushed, so they get verified anew.
+func (o *Overlay) Revalidate() int {
+	o.lock.Lock()
+	o.certs = make(map[string]*x509.Certificate)
+	o.lock.Unlock()
+
+	return o.pastry.Revalidate()
+}
+
+// Subscribes to the specified scribe topic, given the local node's roles permit
+// it.
 func (o *Overlay) Subscribe(topic string) error {
-	// Resolve the topic id
+	// Resolve the topic id and check the permissions
 	id := pastry.Resolve(topic)
 	sid := id.String()
 
+	if !o.canSubscribe(id, o.localRoles()) {
+		return ErrDenied
+	}
+
 	// Make sure we can map the id back to the textual name
 	o.lock.RLock()
 	_, ok := o.names[sid]
@@ -117,7 +193,7 @@ func (o *Overlay) Subscribe(topic string) error {
 		o.lock.Unlock()
 	}
 	// Subscribe the local node to the topic
-	return o.handleSubscribe(o.pastry.Self(), id)
+	return o.handleSubscribe(o.pastry.Self(), id, o.attest(opSubscribe, id, nil))
 }
 
 // Removes the subscription from topic.
@@ -135,12 +211,17 @@ func (o *Overlay) Unsubscribe(topic string) error {
 	return o.handleUnsubscribe(o.pastry.Self(), id)
 }
 
-// Publishes a message into topic to be broadcast to everyone.
+// Publishes a message into topic to be broadcast to everyone, given the local
+// node's roles permit it.
 func (o *Overlay) Publish(topic string, msg *proto.Message) error {
+	id := pastry.Resolve(topic)
+	if !o.canPublish(id, o.localRoles()) {
+		return ErrDenied
+	}
 	if err := msg.Encrypt(); err != nil {
 		return err
 	}
-	o.sendPublish(pastry.Resolve(topic), msg)
+	o.sendPublish(id, msg)
 	return nil
 }
 
@@ -153,6 +234,60 @@ func (o *Overlay) Balance(topic string, msg *proto.Message) error {
 	return nil
 }
 
+// Balances a message to the subscribed node owning the routing key, optionally
+// failing over to the next owner if it dies within the budget (zero disables).
+// The message is routed to the topic root, and descends the tree by rendezvous
+// hashing from there, so the same key reaches the same member while the tree
+// remains unchanged. As every hop only knows the member counts of its edges, a
+// membership change moves more than the minimal share of keys: the edges on the
+// changed member's path gain (or lose) keys, some landing on its old siblings.
+func (o *Overlay) BalanceKey(topic string, key string, msg *proto.Message, budget time.Duration) error {
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendKeyed(pastry.Resolve(topic), key, budget, msg)
+	return nil
+}
+
+// Requests a balancing strategy for a locally subscribed topic. The request is
+// spread through the topic tree along with the load reports, the strategy being
+// used by every node balancing within the tree.
+func (o *Overlay) Strategize(topic string, strategy string) error {
+	o.lock.RLock()
+	top, ok := o.topics[pastry.Resolve(topic).String()]
+	o.lock.RUnlock()
+	if !ok {
+		return ErrNotSubscribed
+	}
+	return top.Strategize(strategy)
+}
+
+// Sets the source of the local processing capacity reported for a subscribed
+// topic, replacing the default estimate based on cpu usage (nil to revert).
+func (o *Overlay) Provide(topic string, provider func() int) error {
+	o.lock.RLock()
+	top, ok := o.topics[pastry.Resolve(topic).String()]
+	o.lock.RUnlock()
+	if !ok {
+		return ErrNotSubscribed
+	}
+	top.Provide(provider)
+	return nil
+}
+
+// Marks a balanced message delivered to the application as processed, keeping
+// the outstanding message counts used by the strategies up to date, and letting
+// the nodes tracking it for failover know it was served.
+func (o *Overlay) Done(topic string, msg *proto.Message) {
+	o.lock.RLock()
+	top, ok := o.topics[pastry.Resolve(topic).String()]
+	o.lock.RUnlock()
+	if ok {
+		top.Done()
+	}
+	o.served(msg)
+}
+
 // Sends a direct message to a known node.
 func (o *Overlay) Direct(dest *big.Int, msg *proto.Message) error {
 	if err := msg.Encrypt(); err != nil {
@@ -18,28 +18,39 @@
 package scribe
 
 import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
 	"math/big"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/project-iris/iris/balancer"
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/crypto/keys"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/pastry"
 )
 
 type collector struct {
 	publish []*proto.Message
 	balance []*proto.Message
 	direct  []*proto.Message
+	replay  []*proto.Message
+	seqs    []uint64
 	lock    sync.Mutex
 }
 
-func (c *collector) HandlePublish(sender *big.Int, topic string, msg *proto.Message) {
+func (c *collector) HandlePublish(sender *big.Int, topic string, epoch uint64, seq uint64, msg *proto.Message) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	c.publish = append(c.publish, msg)
+	c.seqs = append(c.seqs, seq)
 }
 
 func (c *collector) HandleBalance(sender *big.Int, topic string, msg *proto.Message) {
@@ -56,6 +67,13 @@ func (c *collector) HandleDirect(sender *big.Int, msg *proto.Message) {
 	c.direct = append(c.direct, msg)
 }
 
+func (c *collector) HandleReplay(tag uint64, epoch uint64, seq uint64, msg *proto.Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.replay = append(c.replay, msg)
+}
+
 // Tests whether topic publishing work as expected.
 func TestPublish(t *testing.T) {
 	// Override the overlay configuration
@@ -354,3 +372,786 @@ func TestDirect(t *testing.T) {
 		time.Sleep(time.Second)
 	}
 }
+
+// Tests whether topic ACLs are distributed and enforced.
+func TestAcl(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	defer func(roles []string) { config.ScribeRoles = roles }(config.ScribeRoles)
+
+	// Load the private key, generate an ACL authority and start two scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	_, admin, _ := ed25519.GenerateKey(rand.Reader)
+	coll := &collector{}
+
+	live := make([]*Overlay, 0, 2)
+	for i := 0; i < 2; i++ {
+		node := New(overId, key, coll)
+		node.SetAclAuthority(admin.Public())
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+
+	// Install an ACL through the first node and wait for it to propagate
+	rules := []Rule{{Topic: topicId, Subscribe: []string{"reader"}, Publish: []string{"writer"}}}
+	if err := live[0].SetAcl(1, rules, admin); err != nil {
+		t.Fatalf("failed to set acl: %v.", err)
+	}
+	if err := live[0].SetAcl(1, rules, admin); err == nil {
+		t.Fatalf("stale acl accepted.")
+	}
+	if err := live[0].SetAcl(2, rules, key); err == nil {
+		t.Fatalf("acl signed by the cluster key accepted.")
+	}
+	time.Sleep(time.Second)
+
+	for i, node := range live {
+		node.lock.RLock()
+		version := uint64(0)
+		if node.acl != nil {
+			version = node.acl.Version
+		}
+		node.lock.RUnlock()
+		if version != 1 {
+			t.Fatalf("node %d: acl version mismatch: have %v, want %v.", i, version, 1)
+		}
+	}
+	// Verify subscription and publish enforcement on the remote node
+	config.ScribeRoles = []string{"writer"}
+	if err := live[1].Subscribe(topicId); err != ErrDenied {
+		t.Fatalf("unauthorized subscribe result mismatch: have %v, want %v.", err, ErrDenied)
+	}
+	config.ScribeRoles = []string{"reader"}
+	if err := live[1].Subscribe(topicId); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	if err := live[0].Publish(topicId, &proto.Message{Data: []byte{0x00}}); err != ErrDenied {
+		t.Fatalf("unauthorized publish result mismatch: have %v, want %v.", err, ErrDenied)
+	}
+	time.Sleep(time.Second)
+
+	config.ScribeRoles = []string{"writer"}
+	if err := live[0].Publish(topicId, &proto.Message{Data: []byte{0x01}}); err != nil {
+		t.Fatalf("failed to publish into topic: %v.", err)
+	}
+	time.Sleep(time.Second)
+
+	coll.lock.Lock()
+	defer coll.lock.Unlock()
+	if n := len(coll.publish); n != 1 {
+		t.Fatalf("publish count mismatch: have %v, want %v.", n, 1)
+	}
+}
+
+// Tests that tampered ACLs are rejected.
+func TestAclSignature(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	list := &acl{
+		Version: 1,
+		Rules:   []Rule{{Topic: topicId, Subscribe: []string{"reader"}}},
+	}
+	if err := list.sign(key); err != nil {
+		t.Fatalf("failed to sign acl: %v.", err)
+	}
+	if err := list.verify(&key.PublicKey); err != nil {
+		t.Fatalf("failed to verify acl: %v.", err)
+	}
+	list.Rules[0].Subscribe = append(list.Rules[0].Subscribe, "intruder")
+	if err := list.verify(&key.PublicKey); err == nil {
+		t.Fatalf("tampered acl verified.")
+	}
+}
+
+// Tests that only lists signed by the ACL authority are installed, falling back
+// to the cluster key if no authority is configured.
+func TestAclAuthority(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	_, admin, _ := ed25519.GenerateKey(rand.Reader)
+
+	rules := []Rule{{Topic: topicId, Subscribe: []string{"reader"}}}
+	sign := func(version uint64, signer crypto.Signer) *acl {
+		list := &acl{Version: version, Rules: rules}
+		if err := list.sign(signer); err != nil {
+			t.Fatalf("failed to sign acl: %v.", err)
+		}
+		return list
+	}
+	// Without an authority, any holder of the cluster key may issue lists
+	node := New(overId, key, &collector{})
+	if err := node.installAcl(sign(1, key)); err != nil {
+		t.Fatalf("failed to install cluster signed acl: %v.", err)
+	}
+	// With an authority, lists by anyone else are rejected, even if newer
+	node = New(overId, key, &collector{})
+	node.SetAclAuthority(admin.Public())
+
+	if err := node.installAcl(sign(1, admin)); err != nil {
+		t.Fatalf("failed to install authority signed acl: %v.", err)
+	}
+	if err := node.installAcl(sign(5, key)); err == nil {
+		t.Fatalf("newer non-authority acl accepted.")
+	}
+	if node.acl.Version != 1 {
+		t.Fatalf("acl version mismatch: have %v, want %v.", node.acl.Version, 1)
+	}
+	if err := node.installAcl(sign(2, admin)); err != nil {
+		t.Fatalf("failed to install newer authority signed acl: %v.", err)
+	}
+}
+
+// Issues a certificate for a key, listing the roles as organizational units. It
+// is self signed (a CA) if no issuer is given.
+func certify(t *testing.T, key crypto.Signer, serial int64, roles []string, issuer *x509.Certificate, issuerKey crypto.Signer) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: overId, OrganizationalUnit: roles},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  issuer == nil,
+	}
+	if issuer == nil {
+		issuer, issuerKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v.", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+// Tests that with node identities the ACLs are checked against the roles in the
+// node certificates, and that the credentials cannot be forged or reused.
+func TestAclCredential(t *testing.T) {
+	// Create a cluster CA and a node certified for each role
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca := certify(t, caKey, 1, nil, nil, nil)
+	auth, err := keys.NewAuthority([]*x509.Certificate{ca})
+	if err != nil {
+		t.Fatalf("failed to create authority: %v.", err)
+	}
+	_, admin, _ := ed25519.GenerateKey(rand.Reader)
+	list := &acl{Version: 1, Rules: []Rule{{Topic: topicId, Subscribe: []string{"reader"}, Publish: []string{"writer"}}}}
+	if err := list.sign(admin); err != nil {
+		t.Fatalf("failed to sign acl: %v.", err)
+	}
+	nodes := make(map[string]*Overlay)
+	for i, role := range []string{"reader", "writer"} {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		cert := certify(t, key, int64(i+2), []string{role}, ca, caKey)
+
+		identity, err := keys.NewIdentity(key, [][]byte{cert.Raw}, auth)
+		if err != nil {
+			t.Fatalf("%s: failed to create identity: %v.", role, err)
+		}
+		node := New(overId, identity, &collector{})
+		node.SetAclAuthority(admin.Public())
+		if err := node.installAcl(list); err != nil {
+			t.Fatalf("%s: failed to install acl: %v.", role, err)
+		}
+		nodes[role] = node
+	}
+	reader, writer := nodes["reader"], nodes["writer"]
+	id, data := pastry.Resolve(topicId), []byte("event")
+
+	// Certified roles are admitted, declared ones ignored
+	if !writer.admit(reader.attest(opSubscribe, id, nil), opSubscribe, id, reader.pastry.Self(), nil) {
+		t.Fatalf("certified subscriber denied.")
+	}
+	if !reader.admit(writer.attest(opPublish, id, data), opPublish, id, nil, data) {
+		t.Fatalf("certified publisher denied.")
+	}
+	forged := writer.attest(opSubscribe, id, nil)
+	forged.Roles = []string{"reader"}
+	if reader.admit(forged, opSubscribe, id, writer.pastry.Self(), nil) {
+		t.Fatalf("declared subscriber role admitted.")
+	}
+	if writer.admit(reader.attest(opPublish, id, data), opPublish, id, nil, data) {
+		t.Fatalf("uncertified publisher admitted.")
+	}
+	// Credentials are bound to the operation and the certificate holder
+	if reader.admit(writer.attest(opPublish, id, data), opPublish, id, nil, []byte("forged")) {
+		t.Fatalf("credential reused for different data.")
+	}
+	if writer.admit(reader.attest(opSubscribe, id, nil), opSubscribe, id, writer.pastry.Self(), nil) {
+		t.Fatalf("subscription credential replayed by another node.")
+	}
+	stolen := &credential{Chain: writer.attest(opPublish, id, data).Chain, Sig: reader.attest(opPublish, id, data).Sig}
+	if reader.admit(stolen, opPublish, id, nil, data) {
+		t.Fatalf("credential with foreign signature admitted.")
+	}
+	if reader.admit(nil, opPublish, id, nil, data) {
+		t.Fatalf("missing credential admitted.")
+	}
+	// Certificates not issued by the cluster CA are rejected
+	_, rogueKey, _ := ed25519.GenerateKey(rand.Reader)
+	rogue := certify(t, rogueKey, 4, []string{"writer"}, nil, nil)
+	sig, _ := keys.Sign(rand.Reader, rogueKey, config.ScribeAclHash, operationDigest(opPublish, id, nil, data))
+	if reader.admit(&credential{Chain: [][]byte{rogue.Raw}, Sig: sig}, opPublish, id, nil, data) {
+		t.Fatalf("uncertified credential admitted.")
+	}
+}
+
+// Tests that durable topics are journaled at the root and can be replayed.
+func TestDurable(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Load the private key and start two scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	coll := &collector{}
+
+	live := make([]*Overlay, 0, 2)
+	for i := 0; i < 2; i++ {
+		node := New(overId, key, coll)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+
+	// Publish a few events without any subscribers, then subscribe and publish some more
+	for i := 0; i < 3; i++ {
+		if err := live[0].PublishDurable(topicId, &proto.Message{Data: []byte{byte(i)}}); err != nil {
+			t.Fatalf("failed to publish into topic: %v.", err)
+		}
+	}
+	time.Sleep(250 * time.Millisecond)
+	if err := live[1].Subscribe(topicId); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+	for i := 3; i < 5; i++ {
+		if err := live[0].PublishDurable(topicId, &proto.Message{Data: []byte{byte(i)}}); err != nil {
+			t.Fatalf("failed to publish into topic: %v.", err)
+		}
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	coll.lock.Lock()
+	if len(coll.seqs) != 2 || coll.seqs[0] != 4 || coll.seqs[1] != 5 {
+		t.Errorf("live sequence mismatch: have %v, want %v.", coll.seqs, []uint64{4, 5})
+	}
+	coll.lock.Unlock()
+
+	// Replay from the middle of the journal
+	if err := live[1].Replay(topicId, Cursor{Seq: 2}, 1); err != nil {
+		t.Fatalf("failed to request replay: %v.", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	coll.lock.Lock()
+	defer coll.lock.Unlock()
+
+	if n := len(coll.replay); n != 5 {
+		t.Fatalf("replayed event count mismatch: have %v, want %v.", n, 5)
+	}
+	for i, msg := range coll.replay[:4] {
+		if msg == nil || msg.Data[0] != byte(i+1) {
+			t.Fatalf("replayed event %d mismatch: have %v, want %v.", i, msg, i+1)
+		}
+	}
+	if coll.replay[4] != nil {
+		t.Fatalf("replay end marker missing.")
+	}
+	// Both nodes should have the journal (root and replica)
+	for i, node := range live {
+		if stats := node.Stats(); len(stats.Journals) != 1 || stats.Journals[0].Last != 5 {
+			t.Fatalf("node %d: journal stats mismatch: have %+v.", i, stats.Journals)
+		}
+	}
+}
+
+// Tests that journals kept by a node other than the topic root are handed over
+// when the leaf set changes, and that the root continues their sequence.
+func TestJournalHandover(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	defer func(replicas int) { config.ScribeJournalReplicas = replicas }(config.ScribeJournalReplicas)
+	config.ScribeJournalReplicas = 0
+
+	// Start two scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	live := make([]*Overlay, 0, 2)
+	for i := 0; i < 2; i++ {
+		node := New(overId, key, &collector{})
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+
+	// Find a topic rooted at the first node, and leave a journal at the second
+	root, stale := live[0], live[1]
+	topic := ""
+	for i := 0; ; i++ {
+		topic = fmt.Sprintf("%s-%d", topicId, i)
+		id := pastry.Resolve(topic)
+		if pastry.Distance(id, root.pastry.Self()).Cmp(pastry.Distance(id, stale.pastry.Self())) < 0 {
+			break
+		}
+	}
+	j, err := stale.journalOf(pastry.Resolve(topic))
+	if err != nil {
+		t.Fatalf("failed to create journal: %v.", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := j.append(stale.pastry.Self(), proto.Header{}, []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to append event: %v.", err)
+		}
+	}
+	// Simulate a leaf set change and check that the root continues the sequence
+	stale.lock.Lock()
+	stale.leafset = ""
+	stale.lock.Unlock()
+
+	time.Sleep(250 * time.Millisecond)
+	if err := root.PublishDurable(topic, &proto.Message{Data: []byte{3}}); err != nil {
+		t.Fatalf("failed to publish into topic: %v.", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	stats := root.Stats()
+	if len(stats.Journals) != 1 || stats.Journals[0].Last != 4 {
+		t.Fatalf("root journal stats mismatch: have %+v, want last %v.", stats.Journals, 4)
+	}
+}
+
+// Tests that reliable publishes are acknowledged by all the subscribed nodes.
+func TestReliable(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Load the private key and start a few scribe nodes, all but the first subscribing
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	coll := &collector{}
+
+	live := make([]*Overlay, 0, 4)
+	for i := 0; i < 4; i++ {
+		node := New(overId, key, coll)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+
+	for _, node := range live[1:] {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Publish reliably and verify the receipt
+	rec, err := live[0].PublishReliable(topicId, &proto.Message{Data: []byte{0x01}}, false, time.Second)
+	if err != nil {
+		t.Fatalf("failed to publish reliably: %v.", err)
+	}
+	if len(rec.Missing) != 0 {
+		t.Fatalf("missing subtrees: have %v, want none.", rec.Missing)
+	}
+	delivered := make(map[string]struct{})
+	for _, id := range rec.Delivered {
+		delivered[id.String()] = struct{}{}
+	}
+	for i, node := range live[1:] {
+		if _, ok := delivered[node.pastry.Self().String()]; !ok {
+			t.Fatalf("subscriber %d missing from receipt: %v.", i+1, rec.Delivered)
+		}
+	}
+	if len(rec.Delivered) != 3 {
+		t.Fatalf("delivered count mismatch: have %v, want %v.", len(rec.Delivered), 3)
+	}
+	coll.lock.Lock()
+	if n := len(coll.publish); n != 3 {
+		t.Fatalf("arrive event mismatch: have %v, want %v.", n, 3)
+	}
+	coll.lock.Unlock()
+
+	// Publish into an empty topic, which should be acknowledged empty by the root
+	rec, err = live[0].PublishReliable("topic.empty", &proto.Message{Data: []byte{0x02}}, false, time.Second)
+	if err != nil {
+		t.Fatalf("failed to publish reliably: %v.", err)
+	}
+	if len(rec.Delivered) != 0 || len(rec.Missing) != 0 {
+		t.Fatalf("empty topic receipt mismatch: have %+v, want empty.", rec)
+	}
+}
+
+// Tests that balances with failover budget are retried when the serving node
+// crashes.
+func TestBalanceFailover(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Load the private key and start a few scribe nodes, all but the first subscribing
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	colls := make([]*collector, 3)
+	live := make([]*Overlay, 0, 3)
+	for i := 0; i < 3; i++ {
+		colls[i] = &collector{}
+		node := New(overId, key, colls[i])
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+
+	for _, node := range live[1:] {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Pick a subscriber below the topic root to crash (balances are only tracked
+	// once forwarded, so the ones the entry node serves itself cannot fail over)
+	victim := 1
+	live[victim].lock.RLock()
+	top := live[victim].topics[pastry.Resolve(topicId).String()]
+	live[victim].lock.RUnlock()
+	if top.Parent() == nil {
+		victim = 2
+	}
+	survivor := 3 - victim
+	for i, node := range live {
+		if i != victim {
+			defer node.Shutdown()
+		}
+	}
+	// Balance a batch of messages with failover enabled
+	msgs := 20
+	for i := 0; i < msgs; i++ {
+		if err := live[0].BalanceFailover(topicId, &proto.Message{Data: []byte{byte(i)}}, 10*time.Second); err != nil {
+			t.Fatalf("failed to balance message: %v.", err)
+		}
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	served := 0
+	for _, coll := range colls {
+		coll.lock.Lock()
+		served += len(coll.balance)
+		coll.lock.Unlock()
+	}
+	if served != msgs {
+		t.Fatalf("served message count mismatch: have %v, want %v.", served, msgs)
+	}
+	// Crash the chosen subscriber (no unsubscriptions), and check that all messages
+	// got served by the other one (none were completed, so all of them fail over)
+	live[victim].heart.Terminate()
+	live[victim].pastry.Shutdown()
+
+	time.Sleep(time.Duration(2*config.ScribeKillCount+2) * config.ScribeBeatPeriod)
+
+	colls[survivor].lock.Lock()
+	defer colls[survivor].lock.Unlock()
+
+	seen := make(map[byte]struct{})
+	for _, msg := range colls[survivor].balance {
+		seen[msg.Data[0]] = struct{}{}
+	}
+	if len(seen) != msgs {
+		t.Fatalf("failover served message mismatch: have %v, want %v.", len(seen), msgs)
+	}
+}
+
+// Tests that failover balances are forgotten by their trackers once served, and
+// are not executed again when the serving node crashes afterwards.
+func TestBalanceFailoverServed(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Load the private key and start a few scribe nodes, all but the first subscribing
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	colls := make([]*collector, 3)
+	live := make([]*Overlay, 0, 3)
+	for i := 0; i < 3; i++ {
+		colls[i] = &collector{}
+		node := New(overId, key, colls[i])
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		if i != 1 {
+			defer node.Shutdown()
+		}
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+
+	for _, node := range live[1:] {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Balance a batch of messages with failover enabled, and complete them all
+	msgs := 20
+	for i := 0; i < msgs; i++ {
+		if err := live[0].BalanceFailover(topicId, &proto.Message{Data: []byte{byte(i)}}, 10*time.Second); err != nil {
+			t.Fatalf("failed to balance message: %v.", err)
+		}
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	served := 0
+	for i, coll := range colls {
+		coll.lock.Lock()
+		for _, msg := range coll.balance {
+			live[i].Done(topicId, msg)
+		}
+		served += len(coll.balance)
+		coll.lock.Unlock()
+	}
+	if served != msgs {
+		t.Fatalf("served message count mismatch: have %v, want %v.", served, msgs)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	for i, node := range live {
+		node.flightLock.Lock()
+		tracked, pending := len(node.inflight), len(node.serving)
+		node.flightLock.Unlock()
+
+		if tracked != 0 || pending != 0 {
+			t.Fatalf("node %d: leftover flights: have %v tracked/%v serving, want none.", i, tracked, pending)
+		}
+	}
+	// Crash the first subscriber and check that nothing gets executed again
+	colls[2].lock.Lock()
+	before := len(colls[2].balance)
+	colls[2].lock.Unlock()
+
+	live[1].heart.Terminate()
+	live[1].pastry.Shutdown()
+
+	time.Sleep(time.Duration(2*config.ScribeKillCount+2) * config.ScribeBeatPeriod)
+
+	colls[2].lock.Lock()
+	defer colls[2].lock.Unlock()
+
+	if after := len(colls[2].balance); after != before {
+		t.Fatalf("served messages failed over: have %v, want %v.", after, before)
+	}
+}
+
+// Tests that the topic census converges to the weighted member count, and that
+// it can be queried both from inside and outside the topic tree.
+func TestCensus(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Load the private key and start a few scribe nodes, all but the first subscribing
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	live := make([]*Overlay, 0, 5)
+	for i := 0; i < 5; i++ {
+		node := New(overId, key, &collector{})
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+
+	for _, node := range live[1:] {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	if err := live[4].Weigh(topicId, 3); err != nil {
+		t.Fatalf("failed to weigh subscription: %v.", err)
+	}
+	if err := live[0].Weigh(topicId, 3); err != ErrNotSubscribed {
+		t.Fatalf("weighing unsubscribed topic mismatch: have %v, want %v.", err, ErrNotSubscribed)
+	}
+	time.Sleep(10 * config.ScribeBeatPeriod)
+
+	// Query the census from outside and inside the tree
+	for i, node := range []*Overlay{live[0], live[2]} {
+		census, err := node.Census(topicId, time.Second)
+		if err != nil {
+			t.Fatalf("query %d: failed to retrieve census: %v.", i, err)
+		}
+		if census.Members != 6 {
+			t.Fatalf("query %d: member count mismatch: have %v, want %v.", i, census.Members, 6)
+		}
+	}
+	// Query a non-existent topic, which should be answered empty by the root
+	if census, err := live[0].Census("topic.empty", time.Second); err != nil {
+		t.Fatalf("failed to retrieve empty census: %v.", err)
+	} else if census.Members != 0 || census.Capacity != 0 {
+		t.Fatalf("empty census mismatch: have %+v, want empty.", census)
+	}
+	// Drop a member and check that the census follows
+	if err := live[1].Unsubscribe(topicId); err != nil {
+		t.Fatalf("failed to unsubscribe from topic: %v.", err)
+	}
+	time.Sleep(10 * config.ScribeBeatPeriod)
+
+	census, err := live[0].Census(topicId, time.Second)
+	if err != nil {
+		t.Fatalf("failed to retrieve census: %v.", err)
+	}
+	if census.Members != 5 {
+		t.Fatalf("member count mismatch after leave: have %v, want %v.", census.Members, 5)
+	}
+}
+
+// Tests that key affine balances reach the same node for the same key, no matter
+// where they entered the overlay.
+func TestBalanceKey(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Load the private key and start a few scribe nodes, all but the first subscribing
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	colls := make([]*collector, 5)
+	live := make([]*Overlay, 0, 5)
+	for i := 0; i < 5; i++ {
+		colls[i] = &collector{}
+		node := New(overId, key, colls[i])
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+
+	for _, node := range live[1:] {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(4 * config.ScribeBeatPeriod)
+
+	// Balance a batch of keys, each from multiple entry points
+	keys := 32
+	for i, node := range live {
+		for k := 0; k < keys; k++ {
+			msg := &proto.Message{Data: []byte{byte(k), byte(i)}}
+			if err := node.BalanceKey(topicId, fmt.Sprintf("key-%d", k), msg, 0); err != nil {
+				t.Fatalf("failed to balance keyed message: %v.", err)
+			}
+		}
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	// Verify that all messages arrived, each key to a single node
+	owners := make(map[byte]int)
+	served := 0
+	for i, coll := range colls {
+		coll.lock.Lock()
+		for _, msg := range coll.balance {
+			if owner, ok := owners[msg.Data[0]]; ok && owner != i {
+				t.Fatalf("key %d served by multiple nodes: %d and %d.", msg.Data[0], owner, i)
+			}
+			owners[msg.Data[0]] = i
+			served++
+		}
+		coll.lock.Unlock()
+	}
+	if served != keys*len(live) {
+		t.Fatalf("served message count mismatch: have %v, want %v.", served, keys*len(live))
+	}
+	// Make sure the keys are actually spread between the members
+	nodes := make(map[int]struct{})
+	for _, owner := range owners {
+		nodes[owner] = struct{}{}
+	}
+	if len(nodes) < 2 {
+		t.Fatalf("keys not spread among members: owners %v.", nodes)
+	}
+}
+
+// Tests that a balancing strategy requested by a member spreads through the
+// whole topic tree, and that it is withdrawn when the member leaves.
+func TestStrategize(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Load the private key and start a few scribe nodes, all but the first subscribing
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	live := make([]*Overlay, 0, 5)
+	for i := 0; i < 5; i++ {
+		node := New(overId, key, &collector{})
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+
+	for _, node := range live[1:] {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	if err := live[0].Strategize(topicId, balancer.RoundRobin); err != ErrNotSubscribed {
+		t.Fatalf("strategizing unsubscribed topic mismatch: have %v, want %v.", err, ErrNotSubscribed)
+	}
+	if err := live[3].Strategize(topicId, "no-such-strategy"); err == nil {
+		t.Fatalf("unknown strategy accepted.")
+	}
+	if err := live[3].Strategize(topicId, balancer.RoundRobin); err != nil {
+		t.Fatalf("failed to set balancing strategy: %v.", err)
+	}
+	time.Sleep(10 * config.ScribeBeatPeriod)
+
+	// Check that every node in the topic tree switched over
+	check := func(want string) {
+		id := pastry.Resolve(topicId).String()
+		for i, node := range live {
+			node.lock.RLock()
+			top, ok := node.topics[id]
+			node.lock.RUnlock()
+			if !ok {
+				continue
+			}
+			if have := top.Strategy(); have != want {
+				t.Fatalf("node %d: strategy mismatch: have %v, want %v.", i, have, want)
+			}
+		}
+	}
+	check(balancer.RoundRobin)
+
+	// Drop the requesting member and check that the tree reverts to the default
+	if err := live[3].Unsubscribe(topicId); err != nil {
+		t.Fatalf("failed to unsubscribe from topic: %v.", err)
+	}
+	time.Sleep(10 * config.ScribeBeatPeriod)
+	check(balancer.WeightedRandom)
+}
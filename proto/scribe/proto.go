@@ -22,6 +22,7 @@ package scribe
 import (
 	"encoding/gob"
 	"math/big"
+	"time"
 
 	"github.com/project-iris/iris/proto"
 )
@@ -37,6 +38,13 @@ const (
 	opBalance                   // Topic balance
 	opReport                    // Load report
 	opDirect                    // Direct send
+	opAcl                       // Access control list transfer
+	opJournal                   // Durable topic journal replication
+	opReplay                    // Durable topic replay request
+	opHistory                   // Durable topic replayed event
+	opAck                       // Reliable publish acknowledgement
+	opCensus                    // Topic membership query (or answer)
+	opServed                    // Failover balance completion notice
 )
 
 // Extra headers for the scribe.
@@ -47,9 +55,32 @@ type header struct {
 	Sender *big.Int    // Origin overlay node
 
 	// Operation dependent fields
-	Topic  *big.Int // Topic id used during unsubscribing, broadcasting and balancing
-	Prev   *big.Int // Previous hop inside topic to prevent optimize routes
-	Report *report  // CPU load/capacity report
+	Topic  *big.Int    // Topic id used during unsubscribing, broadcasting and balancing
+	Prev   *big.Int    // Previous hop inside topic to prevent optimize routes
+	Report *report     // CPU load/capacity report
+	Cred   *credential // Access credential of the subscribing or publishing node
+
+	// Durable topic fields
+	Durable bool    // Flag whether the publish is to be journaled
+	Epoch   uint64  // Journal sequence numbering the sequence number belongs to
+	Seq     uint64  // Journal sequence number of the event (or last for the end marker)
+	Cursor  *Cursor // Journal position to replay from
+	Tag     uint64  // Requester specified replay (or census) identifier
+	End     bool    // Flag whether the replay stream (or ack aggregation) finished, or census answered
+
+	// Reliable publish fields
+	Ack     uint64   // Publisher assigned id of a reliable publish (0 if unreliable)
+	Origin  *big.Int // Publisher of the acknowledged event (or requester of a served balance)
+	Receipt *Receipt // Aggregated delivery report of an acknowledged subtree
+
+	// Balance failover and affinity fields
+	Budget   time.Duration // Remaining time to fail over a balanced message (0 = never)
+	Flight   uint64        // Requester assigned id of a failover balance (0 if untracked)
+	Trackers []*big.Int    // Nodes tracking a failover balance, notified once served
+	Key      string        // Routing key pinning a balance to a member (empty if random)
+
+	// Membership census fields
+	Census *Census // Approximate membership of the queried topic
 }
 
 // Creates a copy of the header needed by the broadcast.
@@ -98,10 +129,11 @@ func (o *Overlay) fwdDataPacket(dest *big.Int, msg *proto.Message) {
 	o.pastry.Send(dest, msg)
 }
 
-// Assembles a subscription message, consisting of the subscribe opcode and send
-// it towards the destination topic.
-func (o *Overlay) sendSubscribe(topicId *big.Int) {
-	o.sendPacket(topicId, &header{Op: opSubscribe})
+// Assembles a subscription message, consisting of the subscribe opcode and the
+// credential the subscription is made with, sending it towards the destination
+// topic.
+func (o *Overlay) sendSubscribe(topicId *big.Int, cred *credential) {
+	o.sendPacket(topicId, &header{Op: opSubscribe, Cred: cred})
 }
 
 // Assembles an unsubscription message, consisting of the unsubscribe opcode
@@ -111,10 +143,32 @@ func (o *Overlay) sendUnsubscribe(parentId *big.Int, topicId *big.Int) {
 	o.sendPacket(parentId, &header{Op: opUnsubscribe, Topic: topicId})
 }
 
-// Assembles a topic publish message, consisting of the publish opcode, and the
-// destination topic (to allow catching publishes in flight).
+// Assembles a topic publish message, consisting of the publish opcode, the
+// destination topic (to allow catching publishes in flight) and the credential
+// of the local node.
 func (o *Overlay) sendPublish(topicId *big.Int, msg *proto.Message) {
-	o.sendDataPacket(topicId, &header{Op: opPublish, Topic: topicId}, msg)
+	cred := o.attest(opPublish, topicId, msg.Data)
+	o.sendDataPacket(topicId, &header{Op: opPublish, Topic: topicId, Cred: cred}, msg)
+}
+
+// Assembles a durable topic publish message, which is identical to a normal one
+// apart from the durability flag preventing in-flight handling.
+func (o *Overlay) sendDurable(topicId *big.Int, msg *proto.Message) {
+	cred := o.attest(opPublish, topicId, msg.Data)
+	o.sendDataPacket(topicId, &header{Op: opPublish, Topic: topicId, Cred: cred, Durable: true}, msg)
+}
+
+// Assembles a reliable topic publish message, which is identical to a normal (or
+// durable) one apart from the publisher assigned id to acknowledge.
+func (o *Overlay) sendReliable(topicId *big.Int, ack uint64, durable bool, msg *proto.Message) {
+	cred := o.attest(opPublish, topicId, msg.Data)
+	o.sendDataPacket(topicId, &header{Op: opPublish, Topic: topicId, Cred: cred, Durable: durable, Ack: ack}, msg)
+}
+
+// Sends the delivery receipt of a subtree either to the previous hop in the
+// topic tree, or as the final receipt to the publisher.
+func (o *Overlay) sendAck(dest *big.Int, topicId *big.Int, origin *big.Int, ack uint64, rec *Receipt, final bool) {
+	o.sendPacket(dest, &header{Op: opAck, Topic: topicId, Origin: origin, Ack: ack, Receipt: rec, End: final})
 }
 
 // Reroutes a publish message to a new destination to traverse the topic tree
@@ -130,17 +184,78 @@ func (o *Overlay) sendBalance(topicId *big.Int, msg *proto.Message) {
 	o.sendDataPacket(topicId, &header{Op: opBalance, Topic: topicId}, msg)
 }
 
+// Assembles a topic balance message with a failover budget, which is identical
+// to a normal one apart from the budget enabling failover tracking.
+func (o *Overlay) sendFailover(topicId *big.Int, budget time.Duration, msg *proto.Message) {
+	o.sendDataPacket(topicId, &header{Op: opBalance, Topic: topicId, Budget: budget, Flight: o.nextFlight()}, msg)
+}
+
+// Assembles a key affine topic balance message, which apart from the routing key
+// (and optional failover budget) is identical to a normal one.
+func (o *Overlay) sendKeyed(topicId *big.Int, key string, budget time.Duration, msg *proto.Message) {
+	head := &header{Op: opBalance, Topic: topicId, Budget: budget, Key: key}
+	if budget > 0 {
+		head.Flight = o.nextFlight()
+	}
+	o.sendDataPacket(topicId, head, msg)
+}
+
 // Reroutes a balanced message to a new destination to traverse the topic tree
 // directly instead of going up till he root and back down.
 func (o *Overlay) fwdBalance(dest *big.Int, msg *proto.Message) {
 	o.fwdDataPacket(dest, msg)
 }
 
+// Notifies a node tracking a failover balance that it was served, consisting of
+// the requester and its id of the balance.
+func (o *Overlay) sendServed(dest *big.Int, origin *big.Int, flight uint64) {
+	o.sendPacket(dest, &header{Op: opServed, Origin: origin, Flight: flight})
+}
+
 // Assembles a scribe load report message and sends it to a peer.
 func (o *Overlay) sendReport(nodeId *big.Int, rep *report) {
 	o.sendPacket(nodeId, &header{Op: opReport, Report: rep})
 }
 
+// Sends an access control list directly to a specific node.
+func (o *Overlay) sendAcl(dest *big.Int, msg *proto.Message) {
+	o.sendDataPacket(dest, &header{Op: opAcl}, msg)
+}
+
+// Sends a batch of journal entries of a durable topic to a node, along with the
+// high-water mark of their sequence numbering.
+func (o *Overlay) sendJournal(dest *big.Int, topicId *big.Int, epoch uint64, high uint64, msg *proto.Message) {
+	o.sendDataPacket(dest, &header{Op: opJournal, Topic: topicId, Epoch: epoch, Seq: high}, msg)
+}
+
+// Assembles a replay request, consisting of the replay opcode, the position to
+// replay from and the requester's tag, sending it towards the topic root.
+func (o *Overlay) sendReplay(topicId *big.Int, from *Cursor, tag uint64) {
+	o.sendPacket(topicId, &header{Op: opReplay, Topic: topicId, Cursor: from, Tag: tag})
+}
+
+// Sends a single replayed event back to the replay requester.
+func (o *Overlay) sendHistory(dest *big.Int, topicId *big.Int, epoch uint64, seq uint64, tag uint64, msg *proto.Message) {
+	o.sendDataPacket(dest, &header{Op: opHistory, Topic: topicId, Epoch: epoch, Seq: seq, Tag: tag}, msg)
+}
+
+// Sends the replay end marker, containing the last journaled sequence number.
+func (o *Overlay) sendHistoryEnd(dest *big.Int, topicId *big.Int, epoch uint64, last uint64, tag uint64) {
+	o.sendPacket(dest, &header{Op: opHistory, Topic: topicId, Epoch: epoch, Seq: last, Tag: tag, End: true})
+}
+
+// Assembles a census query, consisting of the census opcode, the queried topic
+// (to allow answering midway) and the requester's tag, sending it towards the
+// topic root.
+func (o *Overlay) sendCensus(topicId *big.Int, tag uint64) {
+	o.sendPacket(topicId, &header{Op: opCensus, Topic: topicId, Tag: tag})
+}
+
+// Sends the answer of a census query directly back to the requester.
+func (o *Overlay) sendCensusReply(dest *big.Int, topicId *big.Int, tag uint64, census *Census) {
+	o.sendPacket(dest, &header{Op: opCensus, Topic: topicId, Tag: tag, Census: census, End: true})
+}
+
 // Sends out a message directed to a specific node.
 func (o *Overlay) sendDirect(dest *big.Int, msg *proto.Message) {
 	o.sendDataPacket(dest, &header{Op: opDirect}, msg)
@@ -0,0 +1,293 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the acknowledged (at-least-once) publish extension. A reliable
+// publish is distributed through the topic tree like any other, but each node
+// handling it tracks the neighbors it forwarded the event to, and waits for
+// them to acknowledge their whole subtree. Unacknowledged forwards are resent
+// on heartbeats after a timeout, and given up after a number of retries (or if
+// the neighbor is reported dead), marking the subtree as missing.
+//
+// Once all forwards are settled, the aggregated receipt is sent back towards
+// the previous hop, and finally from the tree entry point to the publisher.
+// Retransmitted duplicates are not delivered again, only re-acknowledged.
+
+package scribe
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/pastry"
+)
+
+// Reliable publish specific errors
+var ErrTimeout = errors.New("publish timed out")
+
+// Delivery report of a reliable publish.
+type Receipt struct {
+	Delivered []*big.Int // Nodes confirming the local delivery of the event
+	Missing   []*big.Int // Tree nodes whose subtrees failed to acknowledge the event
+}
+
+// A single forward of a reliable publish waiting for acknowledgement.
+type forward struct {
+	msg   *proto.Message // Message to retransmit (copied on each send)
+	sent  time.Time      // Time of the last (re)transmission
+	tries int            // Number of retransmissions done
+}
+
+// Tracking state of a reliable publish passing through the local node.
+type delivery struct {
+	origin *big.Int // Publisher of the event
+	ack    uint64   // Publisher assigned id of the event
+	topic  *big.Int // Topic the event was published into
+	prev   *big.Int // Hop to acknowledge to (nil if the tree entry point)
+
+	pending map[string]*forward // Unacknowledged forwards, keyed by neighbor id
+	local   bool                // Flag whether the local handling is still in progress
+	receipt *Receipt            // Aggregated receipt of the local subtree
+	expire  time.Time           // Time after which a settled delivery is forgotten
+}
+
+// Checks whether a delivery is complete, but not yet settled.
+func (d *delivery) complete() bool {
+	return !d.local && len(d.pending) == 0 && d.expire.IsZero()
+}
+
+// Generates the tracking key of a reliable publish.
+func ackKey(origin *big.Int, ack uint64) string {
+	return fmt.Sprintf("%v:%d", origin, ack)
+}
+
+// Publishes a message into topic, waiting until the topic tree acknowledges its
+// delivery or the timeout expires. The receipt reports which nodes delivered
+// the event and which subtrees failed to confirm it. Durable publishes are also
+// journaled by the topic root before distribution.
+func (o *Overlay) PublishReliable(topic string, msg *proto.Message, durable bool, timeout time.Duration) (*Receipt, error) {
+	id := pastry.Resolve(topic)
+	if !o.canPublish(id, o.localRoles()) {
+		return nil, ErrDenied
+	}
+	if err := msg.Encrypt(); err != nil {
+		return nil, err
+	}
+	// Register a receipt sink and publish
+	o.ackLock.Lock()
+	o.ackIdx++
+	ack, sink := o.ackIdx, make(chan *Receipt, 1)
+	o.acks[ack] = sink
+	o.ackLock.Unlock()
+
+	defer func() {
+		o.ackLock.Lock()
+		delete(o.acks, ack)
+		o.ackLock.Unlock()
+	}()
+	o.sendReliable(id, ack, durable, msg)
+
+	select {
+	case rec := <-sink:
+		return rec, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Starts tracking a reliable publish handled by the local node, returning nil
+// if it is a retransmitted duplicate (re-acknowledging it if already settled).
+func (o *Overlay) trackDelivery(head *header, prev *big.Int) *delivery {
+	key := ackKey(head.Sender, head.Ack)
+
+	o.ackLock.Lock()
+	defer o.ackLock.Unlock()
+
+	if d, ok := o.deliveries[key]; ok {
+		if !d.expire.IsZero() {
+			go o.settle(d)
+		}
+		return nil
+	}
+	d := &delivery{
+		origin:  head.Sender,
+		ack:     head.Ack,
+		topic:   head.Topic,
+		prev:    prev,
+		pending: make(map[string]*forward),
+		local:   true,
+		receipt: &Receipt{Delivered: []*big.Int{}, Missing: []*big.Int{}},
+	}
+	o.deliveries[key] = d
+	return d
+}
+
+// Records the forwarding of a reliable publish to a tree neighbor.
+func (o *Overlay) trackForward(d *delivery, dest *big.Int, msg *proto.Message) {
+	o.ackLock.Lock()
+	defer o.ackLock.Unlock()
+
+	d.pending[dest.String()] = &forward{msg: msg, sent: time.Now()}
+}
+
+// Finishes the local part of a reliable publish, noting whether the event was
+// delivered locally, and settles it if no forwards are pending.
+func (o *Overlay) trackLocal(d *delivery, local bool) {
+	o.ackLock.Lock()
+	defer o.ackLock.Unlock()
+
+	if local {
+		d.receipt.Delivered = append(d.receipt.Delivered, o.pastry.Self())
+	}
+	d.local = false
+	if d.complete() {
+		o.finish(d)
+	}
+}
+
+// Marks a delivery settled and sends its receipt upstream. The ack lock must be
+// held by the caller.
+func (o *Overlay) finish(d *delivery) {
+	d.expire = time.Now().Add(time.Duration(config.ScribeAckRetries+1) * config.ScribeAckTimeout)
+	go o.settle(d)
+}
+
+// Sends the receipt of a settled delivery to the previous hop, or if the local
+// node was the tree entry point, to the publisher.
+func (o *Overlay) settle(d *delivery) {
+	switch {
+	case d.prev != nil:
+		o.sendAck(d.prev, d.topic, d.origin, d.ack, d.receipt, false)
+	case d.origin.Cmp(o.pastry.Self()) != 0:
+		o.sendAck(d.origin, d.topic, d.origin, d.ack, d.receipt, true)
+	default:
+		o.handleReceipt(d.ack, d.receipt)
+	}
+}
+
+// Acknowledges a reliable publish that reached the topic root without finding
+// any subscribers.
+func (o *Overlay) ackEmpty(head *header) {
+	o.settle(&delivery{
+		origin:  head.Sender,
+		ack:     head.Ack,
+		topic:   head.Topic,
+		receipt: &Receipt{Delivered: []*big.Int{}, Missing: []*big.Int{}},
+	})
+}
+
+// Merges the receipt of an acknowledged subtree into the local delivery.
+func (o *Overlay) handleAck(src *big.Int, origin *big.Int, ack uint64, rec *Receipt) error {
+	o.ackLock.Lock()
+	defer o.ackLock.Unlock()
+
+	d, ok := o.deliveries[ackKey(origin, ack)]
+	if !ok {
+		return fmt.Errorf("unknown reliable publish: %v", ackKey(origin, ack))
+	}
+	sid := src.String()
+	if _, ok := d.pending[sid]; !ok {
+		return nil // Duplicate ack of a retransmission
+	}
+	delete(d.pending, sid)
+	if rec != nil {
+		d.receipt.Delivered = append(d.receipt.Delivered, rec.Delivered...)
+		d.receipt.Missing = append(d.receipt.Missing, rec.Missing...)
+	}
+	if d.complete() {
+		o.finish(d)
+	}
+	return nil
+}
+
+// Hands the final receipt of a reliable publish to the waiting publisher.
+func (o *Overlay) handleReceipt(ack uint64, rec *Receipt) {
+	o.ackLock.Lock()
+	defer o.ackLock.Unlock()
+
+	if sink, ok := o.acks[ack]; ok {
+		select {
+		case sink <- rec:
+		default:
+			// Duplicate receipt, already delivered
+		}
+	}
+}
+
+// Retransmits the timed out forwards of the reliable publishes, giving up on
+// those out of retries, and forgets about the long settled deliveries. Invoked
+// on every heartbeat.
+func (o *Overlay) retransmit() {
+	o.ackLock.Lock()
+	defer o.ackLock.Unlock()
+
+	now := time.Now()
+	for key, d := range o.deliveries {
+		if !d.expire.IsZero() {
+			if now.After(d.expire) {
+				delete(o.deliveries, key)
+			}
+			continue
+		}
+		for sid, fwd := range d.pending {
+			if now.Sub(fwd.sent) < config.ScribeAckTimeout {
+				continue
+			}
+			dest, _ := new(big.Int).SetString(sid, 10)
+			if fwd.tries >= config.ScribeAckRetries {
+				delete(d.pending, sid)
+				d.receipt.Missing = append(d.receipt.Missing, dest)
+				publishMissing.Inc()
+				continue
+			}
+			fwd.tries++
+			fwd.sent = now
+			publishResent.Inc()
+
+			cpy := new(proto.Message)
+			*cpy = *fwd.msg
+			cpy.Head.Meta = fwd.msg.Head.Meta.(*header).copy()
+			go o.fwdPublish(dest, cpy)
+		}
+		if d.complete() {
+			o.finish(d)
+		}
+	}
+}
+
+// Gives up on all the forwards pending to a dead tree neighbor, marking its
+// subtree missing.
+func (o *Overlay) abandon(node *big.Int) {
+	o.ackLock.Lock()
+	defer o.ackLock.Unlock()
+
+	sid := node.String()
+	for _, d := range o.deliveries {
+		if _, ok := d.pending[sid]; ok {
+			delete(d.pending, sid)
+			d.receipt.Missing = append(d.receipt.Missing, node)
+			publishMissing.Inc()
+
+			if d.complete() {
+				o.finish(d)
+			}
+		}
+	}
+}
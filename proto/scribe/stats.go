@@ -0,0 +1,112 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the statistics snapshot of the scribe overlay, exposing the topic
+// trees the local node participates in and the durable topic journals it keeps.
+
+package scribe
+
+import (
+	"sort"
+
+	"github.com/project-iris/iris/proto/pastry"
+)
+
+// Snapshot of the scribe overlay state.
+type Stats struct {
+	Topics   []TopicStats   `json:"topics"`             // Topic trees the local node is part of
+	Journals []JournalStats `json:"journals,omitempty"` // Durable topic journals (root or replica)
+	Pastry   *pastry.Stats  `json:"pastry,omitempty"`   // Snapshot of the underlying pastry overlay
+}
+
+// Snapshot of a single topic tree node.
+type TopicStats struct {
+	Id       string   `json:"id"`       // Topic id
+	Name     string   `json:"name"`     // Textual name (only if locally subscribed)
+	Parent   string   `json:"parent"`   // Parent node in the tree (empty if root)
+	Children []string `json:"children"` // Child nodes in the tree (including local)
+	Local    bool     `json:"local"`    // Whether the local node is subscribed
+}
+
+// Snapshot of a single durable topic journal.
+type JournalStats struct {
+	Id     string `json:"id"`     // Topic id
+	Last   uint64 `json:"last"`   // Last journaled sequence number
+	Events int    `json:"events"` // Number of retained events
+	Size   int    `json:"size"`   // Total payload size of the retained events
+}
+
+// Gathers a snapshot of the scribe and pastry overlay states.
+func (o *Overlay) Stats() *Stats {
+	self := o.pastry.Self()
+
+	o.lock.RLock()
+	stats := &Stats{
+		Topics: make([]TopicStats, 0, len(o.topics)),
+	}
+	for id, top := range o.topics {
+		topic := TopicStats{
+			Id:       id,
+			Name:     o.names[id],
+			Children: []string{},
+		}
+		if parent := top.Parent(); parent != nil {
+			topic.Parent = parent.String()
+		}
+		for _, node := range top.Nodes() {
+			if node.Cmp(self) == 0 {
+				topic.Local = true
+			}
+			topic.Children = append(topic.Children, node.String())
+		}
+		stats.Topics = append(stats.Topics, topic)
+	}
+	journals := make(map[string]*journal, len(o.journals))
+	for id, j := range o.journals {
+		journals[id] = j
+	}
+	o.lock.RUnlock()
+
+	sort.Sort(topicStatsSorter(stats.Topics))
+
+	for id, j := range journals {
+		events, size := j.usage()
+		stats.Journals = append(stats.Journals, JournalStats{
+			Id:     id,
+			Last:   j.last(),
+			Events: events,
+			Size:   size,
+		})
+	}
+	sort.Sort(journalStatsSorter(stats.Journals))
+	stats.Pastry = o.pastry.Stats()
+	return stats
+}
+
+// Sorter for the topic snapshots to get a stable listing.
+type topicStatsSorter []TopicStats
+
+func (s topicStatsSorter) Len() int           { return len(s) }
+func (s topicStatsSorter) Less(i, j int) bool { return s[i].Id < s[j].Id }
+func (s topicStatsSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Sorter for the journal snapshots to get a stable listing.
+type journalStatsSorter []JournalStats
+
+func (s journalStatsSorter) Len() int           { return len(s) }
+func (s journalStatsSorter) Less(i, j int) bool { return s[i].Id < s[j].Id }
+func (s journalStatsSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -35,6 +35,14 @@ import (
 var ErrSubscribed = errors.New("already subscribed")
 var ErrNotSubscribed = errors.New("not subscribed")
 
+// Report sent to a neighbor about the topic tree on the local side of the edge.
+type Report struct {
+	Capacity int    // Total message capacity of the members
+	Members  int    // Number of members
+	Pending  int    // Number of messages being processed by the members
+	Strategy string // Balancing strategy requested by the members (empty if none)
+}
+
 // The maintenance data related to a single topic.
 type Topic struct {
 	id      *big.Int            // Unique id of the topic
@@ -45,6 +53,15 @@ type Topic struct {
 
 	load *balancer.Balancer // Balancer to load-distribute messages
 	msgs int32              // Number of messages balanced to locals (atomic, take care)
+	pend int32              // Number of messages being processed by locals (atomic, take care)
+	prov func() int         // Source of the local capacity (nil to estimate from cpu usage)
+
+	weight int            // Number of local members the subscription stands for
+	census map[string]int // Members reported by neighbors for their side of the tree
+
+	strategy string            // Balancing strategy requested by the local members
+	strats   map[string]string // Strategies requested from each neighbor's side of the tree
+	active   string            // Balancing strategy currently in effect
 
 	lock sync.RWMutex
 }
@@ -58,6 +75,10 @@ func New(id, owner *big.Int) *Topic {
 		nodes:   []*big.Int{},
 		members: make(map[string]struct{}),
 		load:    balancer.New(),
+		weight:  1,
+		census:  make(map[string]int),
+		strats:  make(map[string]string),
+		active:  balancer.WeightedRandom,
 	}
 }
 
@@ -74,6 +95,17 @@ func (t *Topic) Parent() *big.Int {
 	return t.parent
 }
 
+// Returns the current children of the topic (including the local node if it
+// is subscribed).
+func (t *Topic) Nodes() []*big.Int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	nodes := make([]*big.Int, len(t.nodes))
+	copy(nodes, t.nodes)
+	return nodes
+}
+
 // Sets the topic parent to the one specified.
 func (t *Topic) Reown(parent *big.Int) {
 	t.lock.Lock()
@@ -85,6 +117,9 @@ func (t *Topic) Reown(parent *big.Int) {
 	if t.parent != nil {
 		t.load.Unregister(t.parent)
 		delete(t.members, t.parent.String())
+		delete(t.census, t.parent.String())
+		delete(t.strats, t.parent.String())
+		t.restrategize()
 	}
 	// Initialize and save the new parent if any
 	if parent != nil {
@@ -123,6 +158,9 @@ func (t *Topic) Subscribe(id *big.Int) error {
 
 	// Start load balancing to it too
 	t.load.Register(id)
+	if id.Cmp(t.owner) == 0 {
+		t.load.Weigh(id, t.weight)
+	}
 	return nil
 }
 
@@ -144,6 +182,12 @@ func (t *Topic) Unsubscribe(id *big.Int) error {
 	t.nodes = t.nodes[:last]
 	sortext.BigInts(t.nodes)
 	delete(t.members, id.String())
+	delete(t.census, id.String())
+	delete(t.strats, id.String())
+	if id.Cmp(t.owner) == 0 {
+		t.strategy = ""
+	}
+	t.restrategize()
 
 	// log.Printf("%v:%v: remed, state: %v.", t.owner, t.id, t.nodes)
 
@@ -201,15 +245,145 @@ func (t *Topic) Balance(ex *big.Int) (*big.Int, error) {
 	if err != nil {
 		return nil, err
 	}
-	// If the target is the local node, increment the task counter
+	// If the target is the local node, increment the task counters
 	if id.Cmp(t.owner) == 0 {
 		atomic.AddInt32(&t.msgs, 1)
+		atomic.AddInt32(&t.pend, 1)
 	}
 	return id, nil
 }
 
+// Returns the node id towards which the owner of a routing key resides. Each
+// node is weighed by the number of members on its side of the tree, so that the
+// keys are spread evenly among members, not nodes. An optional ex node can be
+// specified as in Balance.
+func (t *Topic) BalanceKey(key string, ex *big.Int) (*big.Int, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	id, err := t.load.BalanceKey(key, ex)
+	if err != nil {
+		return nil, err
+	}
+	if id.Cmp(t.owner) == 0 {
+		atomic.AddInt32(&t.msgs, 1)
+		atomic.AddInt32(&t.pend, 1)
+	}
+	return id, nil
+}
+
+// Marks a message balanced to the local node as processed.
+func (t *Topic) Done() {
+	if atomic.AddInt32(&t.pend, -1) < 0 {
+		atomic.AddInt32(&t.pend, 1) // Spurious completion, restore
+	}
+}
+
+// Sets the balancing strategy requested by the local members, which takes
+// precedence over the ones requested by remote members.
+func (t *Topic) Strategize(name string) error {
+	if _, err := balancer.NewStrategy(name); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.strategy = name
+	t.restrategize()
+	return nil
+}
+
+// Returns the balancing strategy requested on the local side of the edge to ex
+// (nil for the whole tree): the local one if set, otherwise the first (by name)
+// reported one. The lock should be held by the caller.
+func (t *Topic) requested(ex *big.Int) string {
+	if t.strategy != "" {
+		return t.strategy
+	}
+	skip := ""
+	if ex != nil {
+		skip = ex.String()
+	}
+	name := ""
+	for id, strat := range t.strats {
+		if id != skip && strat != "" && (name == "" || strat < name) {
+			name = strat
+		}
+	}
+	return name
+}
+
+// Switches the balancer over to the currently requested strategy, if changed
+// (keeping the old one if unknown locally). The lock should be held by the
+// caller.
+func (t *Topic) restrategize() {
+	name := t.requested(nil)
+	if name == "" {
+		name = balancer.WeightedRandom
+	}
+	if name != t.active && t.load.Strategize(name) == nil {
+		t.active = name
+	}
+}
+
+// Sets a source of the local processing capacity, reporting the number of
+// messages the local members can take over the next beat. Nil reverts to the
+// estimate based on the messages handled and the cpu usage.
+func (t *Topic) Provide(provider func() int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.prov = provider
+}
+
+// Returns the balancing strategy currently in effect within the topic.
+func (t *Topic) Strategy() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.active
+}
+
+// Sets the number of local members the local subscription stands for.
+func (t *Topic) Weigh(members int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.weight = members
+	t.load.Weigh(t.owner, members) // Fails if not subscribed, weighed on subscription
+}
+
+// Returns the approximate number of members and the total capacity of the whole
+// topic tree, as seen from the local node.
+func (t *Topic) Census() (int, int) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.count(nil), t.load.Capacity(nil)
+}
+
+// Counts the members of the topic tree, optionally with the side behind ex
+// excluded. The lock should be held by the caller.
+func (t *Topic) count(ex *big.Int) int {
+	total := 0
+	idx := sortext.SearchBigInts(t.nodes, t.owner)
+	if idx < len(t.nodes) && t.owner.Cmp(t.nodes[idx]) == 0 {
+		total += t.weight
+	}
+	skip := ""
+	if ex != nil {
+		skip = ex.String()
+	}
+	for id, mems := range t.census {
+		if id != skip {
+			total += mems
+		}
+	}
+	return total
+}
+
 // Returns the list of nodes to report to, and the report for each.
-func (t *Topic) GenerateReports() ([]*big.Int, []int) {
+func (t *Topic) GenerateReports() ([]*big.Int, []*Report) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
@@ -226,22 +400,45 @@ func (t *Topic) GenerateReports() ([]*big.Int, []int) {
 	if t.parent != nil {
 		ids = append(ids, t.parent)
 	}
-	// Calculate the capacities that should be reported to each
-	caps := make([]int, len(ids))
+	// Calculate the reports of the tree sides opposite to each
+	reps := make([]*Report, len(ids))
 	for i, id := range ids {
-		caps[i] = t.load.Capacity(id)
+		reps[i] = &Report{
+			Capacity: t.load.Capacity(id),
+			Members:  t.count(id),
+			Pending:  t.load.Pending(id),
+			Strategy: t.requested(id),
+		}
 	}
-	// Return the capacity with the nodes to report to
-	return ids, caps
+	// Return the reports with the nodes to report to
+	return ids, reps
 }
 
-// Sets the load capacity for a source node in the balancer.
-func (t *Topic) ProcessReport(id *big.Int, cap int) error {
-	return t.load.Update(id, cap)
+// Sets the load capacity and outstanding messages for a source node in the
+// balancer, along with the number of members and the requested strategy on its
+// side of the tree.
+func (t *Topic) ProcessReport(id *big.Int, rep *Report) error {
+	if err := t.load.Update(id, rep.Capacity); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Drop the rest if the node left meanwhile
+	if _, ok := t.members[id.String()]; ok {
+		t.census[id.String()] = rep.Members
+		t.load.Weigh(id, rep.Members)
+		t.load.UpdatePending(id, rep.Pending)
+
+		t.strats[id.String()] = rep.Strategy
+		t.restrategize()
+	}
+	return nil
 }
 
 // If local subscriptions are alive in the topic, updates the balancer according
-// to the messages processed since the last beat.
+// to the capacity provider if set, or the messages processed since the last beat
+// otherwise.
 func (t *Topic) Cycle() {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
@@ -250,10 +447,16 @@ func (t *Topic) Cycle() {
 	idx := sortext.SearchBigInts(t.nodes, t.owner)
 	if idx < len(t.nodes) && t.owner.Cmp(t.nodes[idx]) == 0 {
 		// Sanity check not to send some weird value
-		cap := math.Max(0, float64(atomic.LoadInt32(&t.msgs))/float64(system.CpuUsage()))
+		var cap float64
+		if t.prov != nil {
+			cap = math.Max(0, float64(t.prov()))
+		} else {
+			cap = math.Max(0, float64(atomic.LoadInt32(&t.msgs))/float64(system.CpuUsage()))
+		}
 		cap = math.Min(math.MaxInt32, cap)
 
 		t.load.Update(t.owner, int(cap))
+		t.load.UpdatePending(t.owner, int(atomic.LoadInt32(&t.pend)))
 	}
 	// Reset counters for next beat
 	atomic.StoreInt32(&t.msgs, 0)
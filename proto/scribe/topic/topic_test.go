@@ -21,6 +21,7 @@ import (
 	"math/big"
 	"testing"
 
+	"github.com/project-iris/iris/balancer"
 	"github.com/project-iris/iris/ext/sortext"
 )
 
@@ -107,25 +108,102 @@ func TestTopic(t *testing.T) {
 		t.Fatalf("failed to subscribe with local node: %v.", err)
 	}
 	// Check load report generation
-	ns, caps := top.GenerateReports()
-	if len(ns) != len(nodes) || len(caps) != len(nodes) {
-		t.Fatalf("report target size mismatch: have %v/%v nodes/caps, want %v.", len(ns), len(caps), len(nodes))
+	ns, reps := top.GenerateReports()
+	if len(ns) != len(nodes) || len(reps) != len(nodes) {
+		t.Fatalf("report target size mismatch: have %v/%v nodes/reps, want %v.", len(ns), len(reps), len(nodes))
 	}
-	for i, cap := range caps {
-		if cap != len(nodes) {
-			t.Fatalf("capacity %d mismatch: have %v, want %v", i, cap, len(nodes))
+	for i, rep := range reps {
+		if rep.Capacity != len(nodes) {
+			t.Fatalf("capacity %d mismatch: have %v, want %v", i, rep.Capacity, len(nodes))
 		}
 	}
 	// Check load processing
 	total := 1 // Local apps
 	for i, id := range nodes {
-		top.ProcessReport(id, 10*(i+1))
+		top.ProcessReport(id, &Report{Capacity: 10 * (i + 1), Members: i + 1})
 		total += 10 * (i + 1)
 	}
-	ns, caps = top.GenerateReports()
-	for i, cap := range caps {
-		if cap != total-10*(i+1) {
-			t.Fatalf("capacity %d mismatch: have %v, want %v", i, cap, total-10*(i+1))
+	ns, reps = top.GenerateReports()
+	for i, rep := range reps {
+		if rep.Capacity != total-10*(i+1) {
+			t.Fatalf("capacity %d mismatch: have %v, want %v", i, rep.Capacity, total-10*(i+1))
 		}
 	}
+	// Check member count aggregation (local weight + reported counts)
+	top.Weigh(3)
+	members := 3
+	for i := range nodes {
+		members += i + 1
+	}
+	ns, reps = top.GenerateReports()
+	for i, rep := range reps {
+		if rep.Members != members-(i+1) {
+			t.Fatalf("member report %d mismatch: have %v, want %v", i, rep.Members, members-(i+1))
+		}
+	}
+	// Check strategy propagation: remote requests spread to the other neighbors,
+	// the local one takes precedence
+	top.ProcessReport(nodes[1], &Report{Capacity: 20, Members: 2, Strategy: balancer.RoundRobin})
+	if top.active != balancer.RoundRobin {
+		t.Fatalf("active strategy mismatch: have %v, want %v.", top.active, balancer.RoundRobin)
+	}
+	ns, reps = top.GenerateReports()
+	for i, rep := range reps {
+		want := balancer.RoundRobin
+		if ns[i].Cmp(nodes[1]) == 0 {
+			want = ""
+		}
+		if rep.Strategy != want {
+			t.Fatalf("strategy report %d mismatch: have %v, want %v.", i, rep.Strategy, want)
+		}
+	}
+	if err := top.Strategize(balancer.LeastPending); err != nil {
+		t.Fatalf("failed to set local strategy: %v.", err)
+	}
+	if top.active != balancer.LeastPending {
+		t.Fatalf("active strategy mismatch: have %v, want %v.", top.active, balancer.LeastPending)
+	}
+	if err := top.Strategize("no-such-strategy"); err == nil {
+		t.Fatalf("unknown strategy accepted.")
+	}
+	if mem, cap := top.Census(); mem != members || cap != total {
+		t.Fatalf("census mismatch: have %v/%v members/capacity, want %v/%v.", mem, cap, members, total)
+	}
+	// Check that leaving nodes are dropped from the census
+	top.Unsubscribe(nodes[0])
+	if mem, _ := top.Census(); mem != members-1 {
+		t.Fatalf("census member mismatch after leave: have %v, want %v.", mem, members-1)
+	}
+	top.Unsubscribe(ownerId)
+	if mem, _ := top.Census(); mem != members-1-3 {
+		t.Fatalf("census member mismatch after local leave: have %v, want %v.", mem, members-1-3)
+	}
+}
+
+// Tests that a capacity provider overrides the cpu based estimate of the local
+// capacity, and that it ends up in the reports sent to the neighbors.
+func TestProvide(t *testing.T) {
+	top := New(big.NewInt(314), big.NewInt(141))
+	top.Subscribe(top.owner)
+	top.Subscribe(big.NewInt(1))
+
+	capacity := 42
+	top.Provide(func() int { return capacity })
+	top.Cycle()
+	if cap := top.load.Capacity(big.NewInt(1)); cap != capacity {
+		t.Fatalf("provided capacity mismatch: have %v, want %v.", cap, capacity)
+	}
+	ids, reps := top.GenerateReports()
+	if len(ids) != 1 || ids[0].Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("report destinations mismatch: have %v, want [1].", ids)
+	}
+	if reps[0].Capacity != capacity {
+		t.Fatalf("reported capacity mismatch: have %v, want %v.", reps[0].Capacity, capacity)
+	}
+	// Overloaded members should still be balanced to as a last resort
+	capacity = 0
+	top.Cycle()
+	if cap := top.load.Capacity(big.NewInt(1)); cap != 1 {
+		t.Fatalf("overloaded capacity mismatch: have %v, want %v.", cap, 1)
+	}
 }
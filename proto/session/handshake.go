@@ -18,6 +18,7 @@
 package session
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/gob"
@@ -27,12 +28,15 @@ import (
 	"math/big"
 	rng "math/rand"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/crypto/keys"
 	"github.com/project-iris/iris/crypto/sts"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/link"
 	"github.com/project-iris/iris/proto/stream"
 )
 
@@ -44,16 +48,26 @@ type initRequest struct {
 }
 
 // Authenticated connection request message. Contains the originators ID for
-// key lookup and the client exponential.
+// key lookup, the client exponential and the offered cipher suites (strongest
+// first, empty for legacy clients). The finite field and the elliptic curve
+// exponentials are only present if a suite of their kind is offered, the
+// certificate chain only if the client runs with a node identity.
 type authRequest struct {
-	Exp *big.Int
+	Exp      *big.Int
+	Suites   []byte
+	CurveExp *big.Int
+	Certs    [][]byte
 }
 
-// Authentication challenge message. Contains the server exponential and the
-// server side auth token (both verification and challenge at the same time).
+// Authentication challenge message. Contains the server exponential, the server
+// side auth token (both verification and challenge at the same time), the
+// chosen cipher suite (zero, i.e. legacy, for legacy servers) and the server's
+// certificate chain when running with node identities.
 type authChallenge struct {
 	Exp   *big.Int
 	Token []byte
+	Suite byte
+	Certs [][]byte
 }
 
 // Authentication challenge response message. Contains the client side token.
@@ -80,13 +94,13 @@ type Listener struct {
 	pendWait sync.WaitGroup                // Counter to prevent closing the session sink prematurely
 
 	socket *stream.Listener // Stream listener socket to accept connections on
-	key    *rsa.PrivateKey  // Private RSA key to authenticate with
+	key    crypto.Signer    // Private key (or key ring) to authenticate with
 	quit   chan chan error  // Termination synchronization channel
 }
 
 // Starts a TCP listener to accept incoming sessions, returning the socket ready
 // to accept. If an auto-port (0) is requested, the port is updated in the arg.
-func Listen(addr *net.TCPAddr, key *rsa.PrivateKey) (*Listener, error) {
+func Listen(addr *net.TCPAddr, key crypto.Signer) (*Listener, error) {
 	// Open the stream listener socket
 	sock, err := stream.Listen(addr)
 	if err != nil {
@@ -173,7 +187,7 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 	switch {
 	case req.Auth != nil:
 		// Authenticate and clean up if unsuccessful
-		secret, err := l.serverAuth(strm, req.Auth)
+		secret, suite, peer, err := l.serverAuth(strm, req.Auth)
 		if err != nil {
 			log.Printf("session: failed to authenticate remote stream: %v.", err)
 			if err = strm.Close(); err != nil {
@@ -182,7 +196,7 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 			return
 		}
 		// Create the session and link a data channel to it
-		sess := newSession(strm, secret, true)
+		sess := newSession(strm, secret, true, suite, peer)
 		if err = l.serverLink(sess); err != nil {
 			log.Printf("session: failed to retrieve data link: %v.", err)
 			if err = strm.Close(); err != nil {
@@ -220,24 +234,28 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 	}
 }
 
-// Connects to a remote node and negotiates a session.
-func Dial(host string, port int, key *rsa.PrivateKey) (*Session, error) {
+// Connects to a remote node and negotiates a session. The remote side must prove
+// the possession of a key accepted by the local one (a keys.Ring accepting more
+// than its primary key), and vice versa. With a keys.Identity, both sides must
+// instead present a certificate chain accepted by the cluster authority.
+func Dial(host string, port int, key crypto.Signer) (*Session, error) {
 	// Open the stream connection
-	addr := fmt.Sprintf("%s:%d", host, port)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
 	strm, err := stream.Dial(addr, config.SessionDialTimeout)
 	if err != nil {
 		return nil, err
 	}
 	// Set up the authenticated session
-	secret, err := clientAuth(strm, key)
+	secret, suite, peer, err := clientAuth(strm, key)
 	if err != nil {
 		log.Printf("session: failed to authenticate connection: %v.", err)
 		if err := strm.Close(); err != nil {
 			log.Printf("session: failed to close unauthenticated connection: %v.", err)
 		}
+		return nil, err
 	}
 	// Link a new data connection to it
-	sess := newSession(strm, secret, false)
+	sess := newSession(strm, secret, false, suite, peer)
 	if err = clientLink(sess); err != nil {
 		log.Printf("session: failed to link data connection: %v.", err)
 		if err := strm.Close(); err != nil {
@@ -249,77 +267,219 @@ func Dial(host string, port int, key *rsa.PrivateKey) (*Session, error) {
 }
 
 // Client side of the STS session negotiation.
-func clientAuth(strm *stream.Stream, key *rsa.PrivateKey) ([]byte, error) {
+func clientAuth(strm *stream.Stream, key crypto.Signer) ([]byte, *link.Suite, [][]byte, error) {
 	// Set an overall time limit for the handshake to complete
 	strm.Sock().SetDeadline(time.Now().Add(config.SessionShakeTimeout))
 	defer strm.Sock().SetDeadline(time.Time{})
 
-	// Create a new empty session
-	stsSess, err := sts.New(rand.Reader, config.StsGroup, config.StsGenerator, config.StsCipher, config.StsCipherBits, config.StsSigHash)
+	// Assemble the cipher suites permitted locally
+	offer, err := link.Offer()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new session: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to assemble suite offer: %v", err)
 	}
-	// Initiate a key exchange, send the exponential
-	exp, err := stsSess.Initiate()
-	if err != nil {
-		return nil, fmt.Errorf("failed to initiate key exchange: %v", err)
+	if offer = fitSuites(offer, key); len(offer) == 0 {
+		return nil, nil, nil, fmt.Errorf("failed to assemble suite offer: %v", link.ErrNoSuite)
+	}
+	// Initiate a key exchange for each kind of suite offered, send the exponentials
+	var groupSess, curveSess *sts.Session
+	var groupExp, curveExp *big.Int
+	for _, id := range offer {
+		suite, err := link.LookupId(id)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if suite.Curve == nil && groupSess == nil {
+			if groupSess, groupExp, err = initiateSts(suite); err != nil {
+				return nil, nil, nil, err
+			}
+		} else if suite.Curve != nil && curveSess == nil {
+			if curveSess, curveExp, err = initiateSts(suite); err != nil {
+				return nil, nil, nil, err
+			}
+		}
 	}
 	req := &initRequest{
-		Auth: &authRequest{exp},
+		Auth: &authRequest{groupExp, offer, curveExp, localChain(key)},
 	}
 	if err = strm.Send(req); err != nil {
-		return nil, fmt.Errorf("failed to send auth request: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to send auth request: %v", err)
 	}
 	if err = strm.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush auth request: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to flush auth request: %v", err)
 	}
-	// Receive the foreign exponential and auth token and if verifies, send own auth
+	// Receive the foreign exponential, auth token and chosen suite
 	chall := new(authChallenge)
 	if err = strm.Recv(chall); err != nil {
-		return nil, fmt.Errorf("failed to receive auth challenge: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to receive auth challenge: %v", err)
+	}
+	suite, err := link.Verify(offer, chall.Suite)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to verify chosen suite: %v", err)
+	}
+	// Node identities postdate suite negotiation, so their holders never need the
+	// legacy suite when stronger ones are offered
+	if len(chall.Certs) > 0 && link.Downgraded(offer, suite.Id) {
+		return nil, nil, nil, fmt.Errorf("failed to verify chosen suite: %v", link.ErrDowngrade)
+	}
+	stsSess := groupSess
+	if suite.Curve != nil {
+		stsSess = curveSess
+	}
+	// Authenticate the negotiation too unless talking to a legacy server
+	if suite.Name != link.LegacySuite {
+		if err := stsSess.Bind(suite.SigHash, link.Transcript(offer, suite.Id)); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to bind negotiated suite: %v", err)
+		}
+	}
+	// If the acceptor's auth verifies, send own auth
+	pkey, err := remoteKey(key, chall.Certs)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	token, err := stsSess.Verify(rand.Reader, key, &key.PublicKey, chall.Exp, chall.Token)
+	token, err := stsSess.Verify(rand.Reader, key, pkey, chall.Exp, chall.Token)
 	if err != nil {
-		return nil, fmt.Errorf("failed to verify acceptor auth token: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to verify acceptor auth token: %v", err)
 	}
 	if err = strm.Send(authResponse{token}); err != nil {
-		return nil, fmt.Errorf("failed to send auth response: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to send auth response: %v", err)
 	}
 	if err = strm.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush auth response: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to flush auth response: %v", err)
 	}
-	return stsSess.Secret()
+	secret, err := stsSess.Secret()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return secret, suite, chall.Certs, nil
 }
 
 // Executes the server side authentication and returns either the agreed secret
-// session key or the a failure reason.
-func (l *Listener) serverAuth(strm *stream.Stream, req *authRequest) ([]byte, error) {
-	// Create a new STS session
-	stsSess, err := sts.New(rand.Reader, config.StsGroup, config.StsGenerator,
-		config.StsCipher, config.StsCipherBits, config.StsSigHash)
+// session key, cipher suite and remote certificate chain (if any) or the a
+// failure reason.
+func (l *Listener) serverAuth(strm *stream.Stream, req *authRequest) ([]byte, *link.Suite, [][]byte, error) {
+	// Verify the client's identity before any expensive crypto
+	pkey, err := remoteKey(l.key, req.Certs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create STS session: %v", err)
+		return nil, nil, nil, err
+	}
+	// Pick the strongest cipher suite offered, permitted locally and usable with the key
+	offer := req.Suites
+	if len(offer) > 0 {
+		if offer = fitSuites(offer, l.key); len(offer) == 0 {
+			return nil, nil, nil, fmt.Errorf("failed to negotiate cipher suite: %v", link.ErrNoSuite)
+		}
+	}
+	suite, err := link.Choose(offer)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to negotiate cipher suite: %v", err)
+	}
+	// Clients with node identities always offer suites, an empty offer was stripped
+	if len(req.Certs) > 0 && link.Downgraded(req.Suites, suite.Id) {
+		return nil, nil, nil, fmt.Errorf("failed to negotiate cipher suite: %v", link.ErrDowngrade)
+	}
+	// Create a new STS session, authenticating the negotiation for modern clients
+	stsSess, err := newSts(suite)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create STS session: %v", err)
+	}
+	foreignExp := req.Exp
+	if suite.Curve != nil {
+		foreignExp = req.CurveExp
+	}
+	if foreignExp == nil {
+		return nil, nil, nil, errors.New("missing exponential for chosen suite")
+	}
+	if suite.Name != link.LegacySuite {
+		if err := stsSess.Bind(suite.SigHash, link.Transcript(req.Suites, suite.Id)); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to bind negotiated suite: %v", err)
+		}
 	}
 	// Accept the incoming key exchange request and send back own exp + auth token
-	exp, token, err := stsSess.Accept(rand.Reader, l.key, req.Exp)
+	exp, token, err := stsSess.Accept(rand.Reader, l.key, foreignExp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to accept incoming exchange: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to accept incoming exchange: %v", err)
 	}
-	if err = strm.Send(authChallenge{exp, token}); err != nil {
-		return nil, fmt.Errorf("failed to encode auth challenge: %v", err)
+	if err = strm.Send(authChallenge{exp, token, suite.Id, localChain(l.key)}); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to encode auth challenge: %v", err)
 	}
 	if err = strm.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush auth challenge: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to flush auth challenge: %v", err)
 	}
 	// Receive the foreign auth token and if verifies conclude session
 	resp := new(authResponse)
 	if err = strm.Recv(resp); err != nil {
-		return nil, fmt.Errorf("failed to decode auth response: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to decode auth response: %v", err)
+	}
+	if err = stsSess.Finalize(pkey, resp.Token); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to finalize exchange: %v", err)
+	}
+	secret, err := stsSess.Secret()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return secret, suite, req.Certs, nil
+}
+
+// Resolves the public key a remote peer must authenticate with: the one certified
+// by its chain when running with node identities, or the cluster key otherwise.
+func remoteKey(local crypto.Signer, chain [][]byte) (crypto.PublicKey, error) {
+	id, ok := local.(*keys.Identity)
+	if !ok {
+		return local.Public(), nil
+	}
+	leaf, err := id.Verify(chain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify remote certificate: %v", err)
+	}
+	return leaf.PublicKey, nil
+}
+
+// Returns the local certificate chain to present, if running with an identity.
+func localChain(local crypto.Signer) [][]byte {
+	if id, ok := local.(*keys.Identity); ok {
+		return id.Chain()
 	}
-	if err = stsSess.Finalize(&l.key.PublicKey, resp.Token); err != nil {
-		return nil, fmt.Errorf("failed to finalize exchange: %v", err)
+	return nil
+}
+
+// Creates an STS session for the key exchange of a cipher suite, running over the
+// suite's elliptic curve if it has one, or the configured cyclic group if not.
+func newSts(suite *link.Suite) (*sts.Session, error) {
+	if suite.Curve != nil {
+		return sts.NewCurve(rand.Reader, suite.Curve, config.StsCipher, config.StsCipherBits, config.StsSigHash)
+	}
+	return sts.New(rand.Reader, config.StsGroup, config.StsGenerator, config.StsCipher, config.StsCipherBits, config.StsSigHash)
+}
+
+// Creates and initiates an STS session for a cipher suite, returning the session
+// and the local exponential to send.
+func initiateSts(suite *link.Suite) (*sts.Session, *big.Int, error) {
+	sess, err := newSts(suite)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create new session: %v", err)
+	}
+	exp, err := sess.Initiate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initiate key exchange: %v", err)
+	}
+	return sess, exp, nil
+}
+
+// Drops the suites from an offer whose signatures don't fit into the RSA signing
+// key (a PKCS #1 v1.5 signature needs the digest, its ASN.1 prefix of at most 19
+// bytes and 11 bytes of padding). Elliptic curve keys sign digests of any size.
+func fitSuites(offer []byte, key crypto.Signer) []byte {
+	rsaKey, ok := keys.Unwrap(key).Public().(*rsa.PublicKey)
+	if !ok {
+		return offer
+	}
+	fit := []byte{}
+	for _, id := range offer {
+		if suite, err := link.LookupId(id); err == nil && suite.SigHash.Size()+30 <= (rsaKey.N.BitLen()+7)/8 {
+			fit = append(fit, id)
+		}
 	}
-	return stsSess.Secret()
+	return fit
 }
 
 // Initializes a data channel linking process, waiting for the data stream to be
@@ -18,11 +18,25 @@
 package session
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
 	"net"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/crypto/keys"
+	"github.com/project-iris/iris/crypto/sts"
+	"github.com/project-iris/iris/proto/link"
+	"github.com/project-iris/iris/proto/stream"
 )
 
 // Tests whether the session handshake works.
@@ -66,6 +80,408 @@ func TestHandshake(t *testing.T) {
 	}
 }
 
+// Tests that sessions negotiate the strongest cipher suite, and that a tampered
+// suite offer is detected.
+func TestSuiteNegotiation(t *testing.T) {
+	defer func(min string) { config.SessionMinSuite = min }(config.SessionMinSuite)
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	sock, err := Listen(addr, key)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	// Connect with a modern client and check the negotiated suite
+	client, err := Dial("localhost", addr.Port, key)
+	if err != nil {
+		t.Fatalf("failed to connect to the server: %v.", err)
+	}
+	select {
+	case server := <-sock.Sink:
+		if client.Suite().Name != "x25519-sha512-aes256-gcm" || server.Suite().Id != client.Suite().Id {
+			t.Fatalf("negotiated suite mismatch: client %v, server %v.", client.Suite().Name, server.Suite().Name)
+		}
+		client.Close()
+		server.Close()
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("server-side handshake timed out.")
+	}
+	// Connect with finite field and curve only clients, both should succeed
+	for _, min := range []string{"sha256-aes128-gcm", "x25519-sha256-aes128-gcm"} {
+		config.SessionMinSuite = min
+
+		// Strip the curve suites when requiring the finite field group
+		offer, _ := link.Offer()
+		if min == "sha256-aes128-gcm" {
+			offer = []byte{2, 1}
+		}
+		strm, err := stream.Dial(addr.String(), config.SessionDialTimeout)
+		if err != nil {
+			t.Fatalf("policy %s: failed to connect to the server: %v.", min, err)
+		}
+		suite, _ := link.LookupId(offer[0])
+		stsSess, exp, err := initiateSts(suite)
+		if err != nil {
+			t.Fatalf("policy %s: failed to initiate key exchange: %v.", min, err)
+		}
+		req := &authRequest{Suites: offer}
+		if suite.Curve != nil {
+			req.CurveExp = exp
+		} else {
+			req.Exp = exp
+		}
+		if err := strm.Send(&initRequest{Auth: req}); err != nil {
+			t.Fatalf("policy %s: failed to send auth request: %v.", min, err)
+		}
+		strm.Flush()
+
+		chall := new(authChallenge)
+		if err := strm.Recv(chall); err != nil {
+			t.Fatalf("policy %s: failed to receive auth challenge: %v.", min, err)
+		}
+		if chall.Suite != offer[0] {
+			t.Fatalf("policy %s: chosen suite mismatch: have %v, want %v.", min, chall.Suite, offer[0])
+		}
+		stsSess.Bind(suite.SigHash, link.Transcript(offer, suite.Id))
+		if _, err := stsSess.Verify(rand.Reader, key, &key.PublicKey, chall.Exp, chall.Token); err != nil {
+			t.Fatalf("policy %s: failed to verify negotiation: %v.", min, err)
+		}
+		strm.Close()
+	}
+	config.SessionMinSuite = "sha256-aes128-gcm"
+
+	// Simulate a man-in-the-middle stripping the strongest suite from the offer
+	strm, err := stream.Dial(addr.String(), config.SessionDialTimeout)
+	if err != nil {
+		t.Fatalf("failed to connect to the server: %v.", err)
+	}
+	defer strm.Close()
+
+	stsSess, _ := sts.New(rand.Reader, config.StsGroup, config.StsGenerator, config.StsCipher, config.StsCipherBits, config.StsSigHash)
+	exp, _ := stsSess.Initiate()
+	if err := strm.Send(&initRequest{Auth: &authRequest{exp, []byte{1}, nil, nil}}); err != nil {
+		t.Fatalf("failed to send auth request: %v.", err)
+	}
+	strm.Flush()
+
+	chall := new(authChallenge)
+	if err := strm.Recv(chall); err != nil {
+		t.Fatalf("failed to receive auth challenge: %v.", err)
+	}
+	suite, err := link.Verify([]byte{2, 1}, chall.Suite)
+	if err != nil {
+		t.Fatalf("failed to verify chosen suite: %v.", err)
+	}
+	stsSess.Bind(suite.SigHash, link.Transcript([]byte{2, 1}, suite.Id))
+	if _, err := stsSess.Verify(rand.Reader, key, &key.PublicKey, chall.Exp, chall.Token); err == nil {
+		t.Fatalf("downgraded negotiation verified.")
+	}
+}
+
+// Tests that a node predating suite negotiation can connect under the default
+// policy, allowing rolling upgrades, but is refused once the minimum is raised.
+func TestLegacyPeer(t *testing.T) {
+	defer func(min string) { config.SessionMinSuite = min }(config.SessionMinSuite)
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	sock, err := Listen(addr, key)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	policies := []struct {
+		min    string
+		accept bool
+	}{
+		{config.SessionMinSuite, true}, // Default policy
+		{"sha256-aes128-gcm", false},
+	}
+	for _, policy := range policies {
+		min := policy.min
+		config.SessionMinSuite = min
+
+		// Run the key exchange the way old nodes did: no offer, no binding
+		strm, err := stream.Dial(addr.String(), config.SessionDialTimeout)
+		if err != nil {
+			t.Fatalf("policy %s: failed to connect to the server: %v.", min, err)
+		}
+		stsSess, _ := sts.New(rand.Reader, config.StsGroup, config.StsGenerator, config.StsCipher, config.StsCipherBits, config.StsSigHash)
+		exp, _ := stsSess.Initiate()
+		if err := strm.Send(&initRequest{Auth: &authRequest{Exp: exp}}); err != nil {
+			t.Fatalf("policy %s: failed to send auth request: %v.", min, err)
+		}
+		strm.Flush()
+
+		chall := new(authChallenge)
+		err = strm.Recv(chall)
+		strm.Close()
+
+		if !policy.accept {
+			if err == nil {
+				t.Fatalf("policy %s: legacy peer accepted.", min)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("policy %s: failed to receive auth challenge: %v.", min, err)
+		}
+		if chall.Suite != 0 {
+			t.Fatalf("policy %s: chosen suite mismatch: have %v, want %v.", min, chall.Suite, 0)
+		}
+		if _, err := stsSess.Verify(rand.Reader, key, &key.PublicKey, chall.Exp, chall.Token); err != nil {
+			t.Fatalf("policy %s: failed to verify legacy exchange: %v.", min, err)
+		}
+	}
+}
+
+// Tests that sessions can be authenticated with elliptic curve keys too, both
+// with negotiated and legacy cipher suites.
+func TestKeyTypes(t *testing.T) {
+	defer func(min string) { config.SessionMinSuite = min }(config.SessionMinSuite)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for _, key := range []crypto.Signer{ecKey, edKey} {
+		for _, min := range []string{"sha256-aes128-gcm", link.LegacySuite} {
+			config.SessionMinSuite = min
+
+			addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+			sock, err := Listen(addr, key)
+			if err != nil {
+				t.Fatalf("%T/%s: failed to start the session listener: %v.", key, min, err)
+			}
+			sock.Accept(10 * time.Millisecond)
+
+			client, err := Dial("localhost", addr.Port, key)
+			if err != nil {
+				t.Fatalf("%T/%s: failed to connect to the server: %v.", key, min, err)
+			}
+			select {
+			case server := <-sock.Sink:
+				if server.Suite().Id != client.Suite().Id {
+					t.Fatalf("%T/%s: negotiated suite mismatch: client %v, server %v.", key, min, client.Suite().Name, server.Suite().Name)
+				}
+				client.Close()
+				server.Close()
+			case <-time.After(100 * time.Millisecond):
+				t.Fatalf("%T/%s: server-side handshake timed out.", key, min)
+			}
+			sock.Close()
+		}
+	}
+}
+
+// Tests that nodes mid key rotation (different primaries, but accepting each
+// other's) can connect, whereas nodes with unaccepted keys can't.
+func TestKeyRotation(t *testing.T) {
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, badKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	sock, err := Listen(addr, keys.NewRing(oldKey, newKey.Public()))
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	// Connect with an already switched node
+	client, err := Dial("localhost", addr.Port, keys.NewRing(newKey, oldKey.Public()))
+	if err != nil {
+		t.Fatalf("failed to connect to the server: %v.", err)
+	}
+	select {
+	case server := <-sock.Sink:
+		client.Close()
+		server.Close()
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("server-side handshake timed out.")
+	}
+	// Connect with nodes that either retired the server's key or never had it
+	for i, ring := range []*keys.Ring{keys.NewRing(newKey), keys.NewRing(badKey, oldKey.Public())} {
+		if client, err := Dial("localhost", addr.Port, ring); err == nil {
+			client.Close()
+			t.Fatalf("test %d: unaccepted key authenticated.", i)
+		}
+	}
+}
+
+// Issues a certificate for a key, self signed if no issuer is given.
+func certify(t *testing.T, key crypto.Signer, serial int64, issuer *x509.Certificate, issuerKey crypto.Signer) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "iris"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  issuer == nil,
+	}
+	if issuer == nil {
+		issuer, issuerKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v.", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+// Tests that nodes with their own certified identities can connect, whereas
+// revoked or uncertified ones can't.
+func TestIdentities(t *testing.T) {
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca := certify(t, caKey, 1, nil, nil)
+
+	crlDer, _ := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(4), RevocationTime: time.Now()}},
+	}, ca, caKey)
+	crl, _ := x509.ParseRevocationList(crlDer)
+
+	auth, err := keys.NewAuthority([]*x509.Certificate{ca}, crl)
+	if err != nil {
+		t.Fatalf("failed to create authority: %v.", err)
+	}
+	stale, _ := keys.NewAuthority([]*x509.Certificate{ca})
+
+	// Create a few node identities, the last one revoked (unknown to its own authority)
+	ids := make([]*keys.Identity, 3)
+	for i := 0; i < len(ids); i++ {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		cert := certify(t, key, int64(i+2), ca, caKey)
+
+		issuer := auth
+		if i == 2 {
+			issuer = stale
+		}
+		if ids[i], err = keys.NewIdentity(key, [][]byte{cert.Raw}, issuer); err != nil {
+			t.Fatalf("node %d: failed to create identity: %v.", i, err)
+		}
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	sock, err := Listen(addr, ids[0])
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	// Connect with a certified node and check the exchanged identities
+	client, err := Dial("localhost", addr.Port, ids[1])
+	if err != nil {
+		t.Fatalf("failed to connect to the server: %v.", err)
+	}
+	select {
+	case server := <-sock.Sink:
+		if have := client.Peer(); have == nil || have.SerialNumber.Int64() != 2 {
+			t.Fatalf("server identity mismatch: have %v, want serial %v.", have, 2)
+		}
+		if have := server.Peer(); have == nil || have.SerialNumber.Int64() != 3 {
+			t.Fatalf("client identity mismatch: have %v, want serial %v.", have, 3)
+		}
+		client.Close()
+		server.Close()
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("server-side handshake timed out.")
+	}
+	// Connect with a revoked node and with one using a shared key
+	_, shared, _ := ed25519.GenerateKey(rand.Reader)
+	for i, key := range []crypto.Signer{ids[2], keys.NewRing(shared)} {
+		if client, err := Dial("localhost", addr.Port, key); err == nil {
+			client.Close()
+			t.Fatalf("test %d: uncertified node authenticated.", i)
+		}
+	}
+}
+
+// Tests that nodes with identities refuse falling back to the legacy suite, even
+// under the default policy, when the offer was stripped by a man-in-the-middle.
+func TestIdentityDowngrade(t *testing.T) {
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca := certify(t, caKey, 1, nil, nil)
+
+	auth, err := keys.NewAuthority([]*x509.Certificate{ca})
+	if err != nil {
+		t.Fatalf("failed to create authority: %v.", err)
+	}
+	ids := make([]*keys.Identity, 2)
+	for i := 0; i < len(ids); i++ {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		cert := certify(t, key, int64(i+2), ca, caKey)
+
+		if ids[i], err = keys.NewIdentity(key, [][]byte{cert.Raw}, auth); err != nil {
+			t.Fatalf("node %d: failed to create identity: %v.", i, err)
+		}
+	}
+	// Send the server a certified auth request with the offer stripped
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	sock, err := Listen(addr, ids[0])
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	strm, err := stream.Dial(addr.String(), config.SessionDialTimeout)
+	if err != nil {
+		t.Fatalf("failed to connect to the server: %v.", err)
+	}
+	stsSess, _ := sts.New(rand.Reader, config.StsGroup, config.StsGenerator, config.StsCipher, config.StsCipherBits, config.StsSigHash)
+	exp, _ := stsSess.Initiate()
+	if err := strm.Send(&initRequest{Auth: &authRequest{Exp: exp, Certs: ids[1].Chain()}}); err != nil {
+		t.Fatalf("failed to send auth request: %v.", err)
+	}
+	strm.Flush()
+	if err := strm.Recv(new(authChallenge)); err == nil {
+		t.Fatalf("stripped offer accepted by the server.")
+	}
+	strm.Close()
+
+	// Answer a client with the legacy suite and the server's certificate chain
+	fakeAddr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	fake, err := stream.Listen(fakeAddr)
+	if err != nil {
+		t.Fatalf("failed to start the fake listener: %v.", err)
+	}
+	fake.Accept(time.Second)
+	defer fake.Close()
+
+	go func() {
+		strm := <-fake.Sink
+		defer strm.Close()
+
+		if err := strm.Recv(new(initRequest)); err != nil {
+			return
+		}
+		strm.Send(&authChallenge{Exp: exp, Token: []byte{0}, Suite: 0, Certs: ids[0].Chain()})
+		strm.Flush()
+		strm.Recv(new(authResponse))
+	}()
+	strm, err = stream.Dial(fakeAddr.String(), config.SessionDialTimeout)
+	if err != nil {
+		t.Fatalf("failed to connect to the fake server: %v.", err)
+	}
+	defer strm.Close()
+
+	if _, _, _, err := clientAuth(strm, ids[1]); err == nil || !strings.Contains(err.Error(), link.ErrDowngrade.Error()) {
+		t.Fatalf("downgraded answer mismatch: have %v, want %v.", err, link.ErrDowngrade)
+	}
+}
+
 // Benchmarks the session setup performance.
 func BenchmarkHandshake(b *testing.B) {
 	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
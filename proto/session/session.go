@@ -16,10 +16,12 @@
 // author(s).
 
 // Package session implements an encrypted data stream, authenticated through
-// the station-to-station key exchange.
+// the station-to-station key exchange, with the cipher suite negotiated during
+// the exchange.
 package session
 
 import (
+	"crypto/x509"
 	"hash"
 	"io"
 
@@ -31,7 +33,9 @@ import (
 
 // Accomplishes secure and authenticated full duplex communication.
 type Session struct {
-	kdf io.Reader // Key derivation function to expand the master key
+	kdf   io.Reader   // Key derivation function to expand the master key
+	suite *link.Suite // Cipher suite negotiated for the links
+	peer  [][]byte    // Certificate chain of the remote node, if any
 
 	CtrlLink *link.Link // Network connection for high priority control messages
 	DataLink *link.Link // Network connection for low priority data messages
@@ -39,21 +43,47 @@ type Session struct {
 
 // Creates a new, double link session for authenticated data transfer. The
 // initiator is used to decide the key derivation order for the channels.
-func newSession(conn *stream.Stream, secret []byte, server bool) *Session {
+func newSession(conn *stream.Stream, secret []byte, server bool, suite *link.Suite, peer [][]byte) *Session {
 	// Create the key derivation function
-	hasher := func() hash.Hash { return config.HkdfHash.New() }
+	hasher := func() hash.Hash { return suite.KdfHash.New() }
 	hkdf := hkdf.New(hasher, secret, config.HkdfSalt, config.HkdfInfo)
 
 	// Create the encrypted control link
 	return &Session{
 		kdf:      hkdf,
-		CtrlLink: link.New(conn, hkdf, server),
+		suite:    suite,
+		peer:     peer,
+		CtrlLink: link.New(conn, hkdf, server, suite),
 	}
 }
 
 // Finalizes a session by creating the secondary data link.
 func (s *Session) init(conn *stream.Stream, server bool) {
-	s.DataLink = link.New(conn, s.kdf, server)
+	s.DataLink = link.New(conn, s.kdf, server, s.suite)
+}
+
+// Returns the cipher suite negotiated for the session.
+func (s *Session) Suite() *link.Suite {
+	return s.suite
+}
+
+// Returns the certificate chain (leaf first) the remote node authenticated with,
+// or nil if not running with node identities.
+func (s *Session) PeerChain() [][]byte {
+	return s.peer
+}
+
+// Returns the certificate the remote node authenticated with, or nil if not
+// running with node identities.
+func (s *Session) Peer() *x509.Certificate {
+	if len(s.peer) == 0 {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(s.peer[0])
+	if err != nil {
+		return nil
+	}
+	return cert
 }
 
 // Starts the session data transfers on the control and data channels.
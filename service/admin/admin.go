@@ -0,0 +1,151 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Package admin implements a small HTTP server exposing the internal state of
+// the local node (pastry, scribe, iris and relay) as JSON documents, and the
+// instrumentation metrics in the Prometheus text format.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/project-iris/iris/metrics"
+	"github.com/project-iris/iris/proto/iris"
+	"github.com/project-iris/iris/service/relay"
+)
+
+// Admin service, listening on a TCP address and serving statistics requests.
+type Admin struct {
+	address  string        // Listener address
+	listener net.Listener  // Listener socket for the admin requests
+	iris     *iris.Overlay // Overlay to gather the network statistics from
+	relay    *relay.Relay  // Relay to gather the client statistics from
+
+	done chan error // Channel on which the server reports its termination
+}
+
+// Creates a new admin service attached to a carrier and a relay, listening on
+// the specified address once booted.
+func New(address string, overlay *iris.Overlay, relay *relay.Relay) *Admin {
+	return &Admin{
+		address: address,
+		iris:    overlay,
+		relay:   relay,
+		done:    make(chan error, 1),
+	}
+}
+
+// Opens the listener socket and starts serving the statistics.
+func (a *Admin) Boot() error {
+	sock, err := net.Listen("tcp", a.address)
+	if err != nil {
+		return err
+	}
+	a.listener = sock
+
+	go func() { a.done <- http.Serve(sock, a.handler()) }()
+	return nil
+}
+
+// Assembles the request multiplexer routing to the individual endpoints.
+func (a *Admin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", a.handleIndex)
+	mux.HandleFunc("/pastry", a.handlePastry)
+	mux.HandleFunc("/scribe", a.handleScribe)
+	mux.HandleFunc("/iris", a.handleIris)
+	mux.HandleFunc("/relay", a.handleRelay)
+	mux.HandleFunc("/metrics", a.handleMetrics)
+	return mux
+}
+
+// Returns the address the admin service is listening on.
+func (a *Admin) Addr() net.Addr {
+	return a.listener.Addr()
+}
+
+// Closes the listener socket and terminates the admin service.
+func (a *Admin) Terminate() error {
+	if err := a.listener.Close(); err != nil {
+		return err
+	}
+	// Serving always fails on a closed listener, nothing to report
+	<-a.done
+	return nil
+}
+
+// Lists the available statistics endpoints.
+func (a *Admin) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	a.reply(w, []string{"/pastry", "/scribe", "/iris", "/relay", "/metrics"})
+}
+
+// Serves the pastry live peers and routing table.
+func (a *Admin) handlePastry(w http.ResponseWriter, r *http.Request) {
+	a.reply(w, a.iris.Stats().Scribe.Pastry)
+}
+
+// Serves the scribe topic trees.
+func (a *Admin) handleScribe(w http.ResponseWriter, r *http.Request) {
+	stats := a.iris.Stats().Scribe
+	stats.Pastry = nil
+	a.reply(w, stats)
+}
+
+// Serves the iris connections and subscriptions.
+func (a *Admin) handleIris(w http.ResponseWriter, r *http.Request) {
+	stats := a.iris.Stats()
+	stats.Scribe = nil
+	a.reply(w, stats)
+}
+
+// Serves the relay client connections.
+func (a *Admin) handleRelay(w http.ResponseWriter, r *http.Request) {
+	if a.relay == nil {
+		http.NotFound(w, r)
+		return
+	}
+	a.reply(w, a.relay.Stats())
+}
+
+// Serves the instrumentation metrics in the Prometheus text format.
+func (a *Admin) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := metrics.Write(w); err != nil {
+		log.Printf("admin: failed to write metrics: %v.", err)
+	}
+}
+
+// Serializes a statistics snapshot into the response.
+func (a *Admin) reply(w http.ResponseWriter, stats interface{}) {
+	blob, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		log.Printf("admin: failed to encode statistics: %v.", err)
+		http.Error(w, fmt.Sprintf("failed to encode statistics: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(blob)
+	w.Write([]byte("\n"))
+}
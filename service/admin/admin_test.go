@@ -0,0 +1,137 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/iris"
+	"github.com/project-iris/iris/service/relay"
+)
+
+func TestEndpoints(t *testing.T) {
+	// Boot a single node overlay with a (not booted) relay attached
+	timeout := config.PastryBootTimeout
+	config.PastryBootTimeout = 500 * time.Millisecond
+	defer func() { config.PastryBootTimeout = timeout }()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v.", err)
+	}
+	overlay := iris.New("admin-test", key)
+	if _, err := overlay.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer overlay.Shutdown()
+
+	dir, err := ioutil.TempDir("", "admin-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "relay.sock")
+	rel, err := relay.New(0, socket, overlay)
+	if err != nil {
+		t.Fatalf("failed to create relay: %v.", err)
+	}
+	// Query each endpoint and check the returned documents
+	tests := []struct {
+		admin  *Admin
+		path   string
+		status int
+		ctype  string
+		fields []string // Top level JSON fields or text fragments expected
+	}{
+		{New("", overlay, rel), "/", http.StatusOK, "application/json", []string{"/pastry", "/scribe", "/iris", "/relay", "/metrics"}},
+		{New("", overlay, rel), "/pastry", http.StatusOK, "application/json", []string{"id", "addrs", "peers", "leaves", "routes"}},
+		{New("", overlay, rel), "/scribe", http.StatusOK, "application/json", []string{"topics"}},
+		{New("", overlay, rel), "/iris", http.StatusOK, "application/json", []string{"connections", "subscriptions"}},
+		{New("", overlay, rel), "/relay", http.StatusOK, "application/json", []string{"socket", "clients"}},
+		{New("", overlay, rel), "/metrics", http.StatusOK, "text/plain", []string{"iris_pastry_routed_messages_total"}},
+		{New("", overlay, nil), "/relay", http.StatusNotFound, "", nil},
+		{New("", overlay, rel), "/missing", http.StatusNotFound, "", nil},
+	}
+	for i, tt := range tests {
+		server := httptest.NewServer(tt.admin.handler())
+		res, err := http.Get(server.URL + tt.path)
+		if err != nil {
+			server.Close()
+			t.Fatalf("test %d: failed to query %v: %v.", i, tt.path, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		server.Close()
+		if err != nil {
+			t.Fatalf("test %d: failed to read %v: %v.", i, tt.path, err)
+		}
+		if res.StatusCode != tt.status {
+			t.Fatalf("test %d: status mismatch for %v: have %v, want %v.", i, tt.path, res.StatusCode, tt.status)
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if ctype := res.Header.Get("Content-Type"); !strings.HasPrefix(ctype, tt.ctype) {
+			t.Fatalf("test %d: content type mismatch for %v: have %v, want %v.", i, tt.path, ctype, tt.ctype)
+		}
+		switch {
+		case tt.path == "/":
+			var index []string
+			if err := json.Unmarshal(body, &index); err != nil {
+				t.Fatalf("test %d: failed to decode index: %v.", i, err)
+			}
+			if strings.Join(index, ",") != strings.Join(tt.fields, ",") {
+				t.Fatalf("test %d: index mismatch: have %v, want %v.", i, index, tt.fields)
+			}
+		case tt.ctype == "application/json":
+			doc := make(map[string]interface{})
+			if err := json.Unmarshal(body, &doc); err != nil {
+				t.Fatalf("test %d: failed to decode %v: %v.", i, tt.path, err)
+			}
+			for _, field := range tt.fields {
+				if _, ok := doc[field]; !ok {
+					t.Fatalf("test %d: field %v missing from %v: %s.", i, field, tt.path, body)
+				}
+			}
+			// Each endpoint should only expose its own layer
+			for _, field := range []string{"scribe", "pastry"} {
+				if _, ok := doc[field]; ok {
+					t.Fatalf("test %d: nested layer %v leaked into %v.", i, field, tt.path)
+				}
+			}
+		default:
+			for _, field := range tt.fields {
+				if !strings.Contains(string(body), field) {
+					t.Fatalf("test %d: metric %v missing from %v.", i, field, tt.path)
+				}
+			}
+		}
+	}
+}
@@ -28,6 +28,7 @@ import (
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto/iris"
+	"github.com/project-iris/iris/proto/scribe"
 )
 
 // Forwards a broadcast arriving from the Iris network to the attached binding.
@@ -40,6 +41,10 @@ func (r *relay) HandleBroadcast(msg []byte) {
 
 // Forwards a broadcast from the attached binding to the Iris network.
 func (r *relay) handleBroadcast(app string, msg []byte) {
+	if err := r.grant.check("broadcast", app); err != nil {
+		r.deny(err)
+		return
+	}
 	if err := r.iris.Broadcast(app, msg); err != nil {
 		log.Printf("relay: broadcast error: %v.", err)
 		r.drop()
@@ -92,6 +97,10 @@ func (r *relay) HandleRequest(request []byte, timeout time.Duration) ([]byte, er
 // Forwards a request arriving from the attached binding to the Iris network, and
 // waits for a reply to arrive back which can be forwarded.
 func (r *relay) handleRequest(cluster string, id uint64, request []byte, timeout time.Duration) {
+	if err := r.grant.check("request", cluster); err != nil {
+		r.deny(err)
+		return
+	}
 	reply, err := r.iris.Request(cluster, request, timeout)
 	switch {
 	case err == iris.ErrTimeout || err == iris.ErrTerminating:
@@ -103,6 +112,41 @@ func (r *relay) handleRequest(cluster string, id uint64, request []byte, timeout
 	}
 }
 
+// Forwards a scatter-gather request arriving from the attached binding to the
+// Iris network, and forwards back the replies gathered until the timeout. Those
+// gathered from a partially answering cluster are forwarded too, as the protocol
+// has no means to carry the missing members alongside.
+func (r *relay) handleRequestAll(cluster string, id uint64, request []byte, timeout time.Duration) {
+	if err := r.grant.check("request", cluster); err != nil {
+		r.deny(err)
+		return
+	}
+	replies, err := r.iris.RequestAll(cluster, request, timeout)
+	if _, ok := err.(*iris.GatherError); ok {
+		err = nil
+	}
+	if err != nil {
+		r.sendReplyAll(id, nil, err.Error())
+		return
+	}
+	r.sendReplyAll(id, replies, "")
+}
+
+// Forwards a cluster presence query arriving from the attached binding to the
+// Iris network, and forwards back the approximate membership.
+func (r *relay) handlePresence(cluster string, id uint64, timeout time.Duration) {
+	if err := r.grant.check("request", cluster); err != nil {
+		r.deny(err)
+		return
+	}
+	pres, err := r.iris.Presence(cluster, timeout)
+	if err != nil {
+		r.sendPresence(id, nil, err.Error())
+		return
+	}
+	r.sendPresence(id, pres, "")
+}
+
 // Forwards a reply arriving from the attached binding to the Iris network by
 // looking up the pending request channel and if still live, injecting the result.
 func (r *relay) handleReply(id uint64, reply []byte, fault string) {
@@ -144,9 +188,73 @@ func (s *subscriptionHandler) HandleEvent(msg []byte) {
 	}
 }
 
+// Forwards an arriving durable topic event to the attached binding, including
+// the sequence number if the binding supports it.
+func (s *subscriptionHandler) HandleDurableEvent(seq uint64, msg []byte) {
+	if s.relay.rev < revReplay {
+		s.HandleEvent(msg)
+		return
+	}
+	if err := s.relay.sendEvent(s.topic, seq, msg); err != nil {
+		log.Printf("relay: event forward error: %v.", err)
+		s.relay.drop()
+	}
+}
+
+// Handler for a cluster membership watch. Forwards the joins and leaves to the
+// attached binding.
+type membershipHandler struct {
+	relay   *relay
+	cluster string
+}
+
+// Forwards members joining the cluster to the attached binding.
+func (p *membershipHandler) HandleJoin(count int, now *iris.Presence) {
+	if err := p.relay.sendWatch(p.cluster, true, count, now); err != nil {
+		log.Printf("relay: presence forward error: %v.", err)
+		p.relay.drop()
+	}
+}
+
+// Forwards members leaving the cluster to the attached binding.
+func (p *membershipHandler) HandleLeave(count int, now *iris.Presence) {
+	if err := p.relay.sendWatch(p.cluster, false, count, now); err != nil {
+		log.Printf("relay: presence forward error: %v.", err)
+		p.relay.drop()
+	}
+}
+
+// Forwards a cluster membership watch setup or removal arriving from the attached
+// binding to the Iris node.
+func (r *relay) handleWatch(cluster string, watch bool) {
+	if !watch {
+		if err := r.iris.UnwatchMembership(cluster); err != nil {
+			log.Printf("relay: presence unwatch error: %v.", err)
+			r.drop()
+		}
+		return
+	}
+	if err := r.grant.check("request", cluster); err != nil {
+		r.deny(err)
+		return
+	}
+	handler := &membershipHandler{
+		relay:   r,
+		cluster: cluster,
+	}
+	if err := r.iris.WatchMembership(cluster, handler); err != nil {
+		log.Printf("relay: presence watch error: %v.", err)
+		r.drop()
+	}
+}
+
 // Forwards a topic subscription arriving from the attached binding to the Iris
 // node and creates a new subscription handler to process the published events.
 func (r *relay) handleSubscribe(topic string) {
+	if err := r.grant.check("subscribe", topic); err != nil {
+		r.deny(err)
+		return
+	}
 	// Create the event forwarder
 	handler := &subscriptionHandler{
 		relay: r,
@@ -159,6 +267,23 @@ func (r *relay) handleSubscribe(topic string) {
 	}
 }
 
+// Forwards a durable topic subscription with replay arriving from the attached
+// binding to the Iris node.
+func (r *relay) handleReplay(topic string, from scribe.Cursor) {
+	if err := r.grant.check("subscribe", topic); err != nil {
+		r.deny(err)
+		return
+	}
+	handler := &subscriptionHandler{
+		relay: r,
+		topic: topic,
+	}
+	if err := r.iris.SubscribeReplay(topic, handler, from); err != nil {
+		log.Printf("relay: replaying subscription error: %v.", err)
+		r.drop()
+	}
+}
+
 // Forwards a topic subscription removal arriving from the attached binding to
 // the Iris node.
 func (r *relay) handleUnsubscribe(topic string) {
@@ -170,6 +295,10 @@ func (r *relay) handleUnsubscribe(topic string) {
 
 // Forwards a publish event arriving from the attached binding to the Iris node.
 func (r *relay) handlePublish(topic string, msg []byte) {
+	if err := r.grant.check("publish", topic); err != nil {
+		r.deny(err)
+		return
+	}
 	if err := r.iris.Publish(topic, msg); err != nil {
 		log.Printf("relay: publish error: %v.", err)
 		r.drop()
@@ -211,6 +340,10 @@ func (r *relay) HandleTunnel(tun *iris.Tunnel) {
 // Forwards a tunnel construction request from the attached binding to the Iris
 // node and relay the result back to the binding.
 func (r *relay) handleTunnelInit(id uint64, cluster string, timeout time.Duration) {
+	if err := r.grant.check("tunnel", cluster); err != nil {
+		r.deny(err)
+		return
+	}
 	// Create the tunnel
 	tun, err := r.iris.Tunnel(cluster, timeout)
 	if err != nil {
@@ -0,0 +1,58 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the instrumentation counters of the relay service, along with a
+// socket wrapper measuring the relayed traffic.
+
+package relay
+
+import (
+	"net"
+
+	"github.com/project-iris/iris/metrics"
+)
+
+// Number of client applications currently attached.
+var relayClients = metrics.NewGauge("iris_relay_clients", "Client applications currently attached to the relay.")
+
+// Number of bytes read from the attached applications.
+var relayBytesIn = metrics.NewCounter("iris_relay_received_bytes_total", "Bytes received from attached client applications.")
+
+// Number of bytes written to the attached applications.
+var relayBytesOut = metrics.NewCounter("iris_relay_sent_bytes_total", "Bytes sent to attached client applications.")
+
+// Number of times a tunnel transfer had to wait for an allowance grant.
+var tunnelStalls = metrics.NewCounter("iris_relay_tunnel_stalls_total", "Tunnel transfers blocked waiting for client allowance.")
+
+// Network connection wrapper counting the relayed bytes.
+type meteredConn struct {
+	net.Conn
+}
+
+// Reads from the wrapped connection, counting the inbound bytes.
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	relayBytesIn.Add(uint64(n))
+	return n, err
+}
+
+// Writes to the wrapped connection, counting the outbound bytes.
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	relayBytesOut.Add(uint64(n))
+	return n, err
+}
@@ -0,0 +1,183 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the client authentication and authorization policy of the relay. A
+// policy lists the applications permitted to attach, each identified by a token
+// and granted a set of cluster and topic name patterns it may operate on. Names
+// are matched segment-wise, same as wildcard subscriptions: '*' stands for one
+// dot separated segment and a trailing '>' for one or more (a lone '>' thus
+// grants everything). Wildcard subscriptions are only permitted if a grant
+// covers every topic they may match. Connections without credentials are mapped
+// to the optional anonymous grant, or refused if none is defined. Operations
+// outside the grant are refused by closing the connection with the reason.
+
+package relay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/project-iris/iris/proto/iris"
+)
+
+// Access rights of a single client application.
+type Grant struct {
+	Name      string   `json:"name"`      // Application name for logging and statistics
+	Token     string   `json:"token"`     // Plain or "sha256:<hex>" hashed access token
+	Register  []string `json:"register"`  // Clusters the application may register into
+	Request   []string `json:"request"`   // Clusters the application may request or tunnel to
+	Broadcast []string `json:"broadcast"` // Clusters the application may broadcast to
+	Subscribe []string `json:"subscribe"` // Topics the application may subscribe to
+	Publish   []string `json:"publish"`   // Topics the application may publish to
+}
+
+// Authentication and authorization policy of the relay.
+type Policy struct {
+	Apps      []*Grant `json:"apps"`      // Applications authenticated by tokens
+	Anonymous *Grant   `json:"anonymous"` // Rights of clients without credentials (nil = refused)
+}
+
+// Loads a JSON policy file, verifying that every application has a unique token
+// and that all name patterns are well formed.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	policy := new(Policy)
+	if err := dec.Decode(policy); err != nil {
+		return nil, err
+	}
+	// Validate the individual grants
+	tokens := make(map[string]struct{})
+	for i, grant := range policy.Apps {
+		if grant == nil {
+			return nil, fmt.Errorf("app #%d: empty grant", i)
+		}
+		if grant.Token == "" {
+			return nil, fmt.Errorf("app %s: missing token", grant.Name)
+		}
+		if strings.HasPrefix(grant.Token, "sha256:") {
+			if hash, err := hex.DecodeString(grant.Token[7:]); err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("app %s: invalid token hash", grant.Name)
+			}
+		}
+		if _, ok := tokens[grant.Token]; ok {
+			return nil, fmt.Errorf("app %s: duplicate token", grant.Name)
+		}
+		tokens[grant.Token] = struct{}{}
+
+		if err := grant.validate(); err != nil {
+			return nil, fmt.Errorf("app %s: %v", grant.Name, err)
+		}
+	}
+	if policy.Anonymous != nil {
+		if policy.Anonymous.Token != "" {
+			return nil, fmt.Errorf("anonymous: token not allowed")
+		}
+		if err := policy.Anonymous.validate(); err != nil {
+			return nil, fmt.Errorf("anonymous: %v", err)
+		}
+	}
+	return policy, nil
+}
+
+// Looks up the grant belonging to a client credential, or nil if the client is
+// not permitted to attach. An empty credential maps to the anonymous grant.
+func (p *Policy) authenticate(credential []byte) *Grant {
+	if len(credential) == 0 {
+		return p.Anonymous
+	}
+	hash := sha256.Sum256(credential)
+	hashed := "sha256:" + hex.EncodeToString(hash[:])
+
+	var match *Grant
+	for _, grant := range p.Apps {
+		token := []byte(grant.Token)
+		if strings.HasPrefix(grant.Token, "sha256:") {
+			if subtle.ConstantTimeCompare(token, []byte(hashed)) == 1 {
+				match = grant
+			}
+		} else if subtle.ConstantTimeCompare(token, credential) == 1 {
+			match = grant
+		}
+	}
+	return match
+}
+
+// Checks that all the name patterns in the grant are well formed: no empty
+// segments and a multi-segment wildcard only at the end.
+func (g *Grant) validate() error {
+	for _, list := range [][]string{g.Register, g.Request, g.Broadcast, g.Subscribe, g.Publish} {
+		for _, pattern := range list {
+			segs := strings.Split(pattern, ".")
+			for i, seg := range segs {
+				if seg == "" || (seg == ">" && i != len(segs)-1) {
+					return fmt.Errorf("invalid pattern %s", pattern)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Checks whether a name (or wildcard pattern) is covered by any of the permitted
+// patterns.
+func permitted(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if iris.CoversTopic(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifies that the grant permits an operation on a cluster or topic. A nil
+// grant (i.e. no policy configured) permits everything.
+func (g *Grant) check(op string, name string) error {
+	if g == nil {
+		return nil
+	}
+	var patterns []string
+	switch op {
+	case "register":
+		patterns = g.Register
+	case "request", "tunnel":
+		patterns = g.Request
+	case "broadcast":
+		patterns = g.Broadcast
+	case "subscribe":
+		patterns = g.Subscribe
+	case "publish":
+		patterns = g.Publish
+	default:
+		panic(fmt.Sprintf("unknown operation: %s", op))
+	}
+	if !permitted(patterns, name) {
+		return fmt.Errorf("permission denied: %s %s", op, name)
+	}
+	return nil
+}
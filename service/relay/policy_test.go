@@ -0,0 +1,134 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package relay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-policy")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash := sha256.Sum256([]byte("secret"))
+	hashed := "sha256:" + hex.EncodeToString(hash[:])
+
+	tests := []struct {
+		policy string
+		valid  bool
+	}{
+		{`{"apps": [{"name": "a", "token": "x", "subscribe": ["orders.>", "*.created"]}]}`, true},
+		{`{"apps": [{"name": "a", "token": "` + hashed + `"}], "anonymous": {"request": [">"]}}`, true},
+		{`{"apps": [{"name": "a", "token": "x", "unknown": true}]}`, false},
+		{`{"apps": [null]}`, false},
+		{`{"apps": [{"name": "a"}]}`, false},
+		{`{"apps": [{"name": "a", "token": "sha256:abcd"}]}`, false},
+		{`{"apps": [{"name": "a", "token": "x"}, {"name": "b", "token": "x"}]}`, false},
+		{`{"apps": [{"name": "a", "token": "x", "publish": ["orders..created"]}]}`, false},
+		{`{"apps": [{"name": "a", "token": "x", "publish": ["orders.>.created"]}]}`, false},
+		{`{"anonymous": {"token": "x"}}`, false},
+		{`{"anonymous": {"broadcast": [""]}}`, false},
+	}
+	for i, tt := range tests {
+		file := filepath.Join(dir, "policy.json")
+		if err := ioutil.WriteFile(file, []byte(tt.policy), 0600); err != nil {
+			t.Fatalf("test %d: failed to write policy: %v.", i, err)
+		}
+		if _, err := LoadPolicy(file); (err == nil) != tt.valid {
+			t.Errorf("test %d: validity mismatch: have %v, want %v.", i, err, tt.valid)
+		}
+	}
+	if _, err := LoadPolicy(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("loaded missing policy file.")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	hash := sha256.Sum256([]byte("hashed-secret"))
+
+	plain := &Grant{Name: "plain", Token: "plain-secret"}
+	hashed := &Grant{Name: "hashed", Token: "sha256:" + hex.EncodeToString(hash[:])}
+	anon := &Grant{Name: "anonymous"}
+
+	tests := []struct {
+		policy     *Policy
+		credential string
+		grant      *Grant
+	}{
+		{&Policy{Apps: []*Grant{plain, hashed}}, "plain-secret", plain},
+		{&Policy{Apps: []*Grant{plain, hashed}}, "hashed-secret", hashed},
+		{&Policy{Apps: []*Grant{plain, hashed}}, "sha256:" + hex.EncodeToString(hash[:]), nil},
+		{&Policy{Apps: []*Grant{plain, hashed}}, "wrong-secret", nil},
+		{&Policy{Apps: []*Grant{plain, hashed}}, "", nil},
+		{&Policy{Apps: []*Grant{plain, hashed}, Anonymous: anon}, "", anon},
+		{&Policy{Apps: []*Grant{plain, hashed}, Anonymous: anon}, "wrong-secret", nil},
+	}
+	for i, tt := range tests {
+		if grant := tt.policy.authenticate([]byte(tt.credential)); grant != tt.grant {
+			t.Errorf("test %d: grant mismatch: have %v, want %v.", i, grant, tt.grant)
+		}
+	}
+}
+
+func TestGrantCheck(t *testing.T) {
+	grant := &Grant{
+		Register:  []string{"billing"},
+		Request:   []string{"billing", "search.*"},
+		Broadcast: []string{">"},
+		Subscribe: []string{"orders.*", "metrics.>"},
+		Publish:   []string{"orders.*.created"},
+	}
+	tests := []struct {
+		grant   *Grant
+		op      string
+		name    string
+		allowed bool
+	}{
+		{grant, "register", "billing", true},
+		{grant, "register", "search", false},
+		{grant, "request", "billing", true},
+		{grant, "tunnel", "search.eu", true},
+		{grant, "request", "search", false},
+		{grant, "request", "search.eu.west", false},
+		{grant, "broadcast", "anything.at.all", true},
+		{grant, "subscribe", "orders.eu", true},
+		{grant, "subscribe", "orders.a.b.c", false},
+		{grant, "subscribe", "orders.>", false},
+		{grant, "subscribe", "orders.*", true},
+		{grant, "subscribe", "metrics.cpu.load", true},
+		{grant, "subscribe", "metrics.*.load", true},
+		{grant, "subscribe", "metrics.>", true},
+		{grant, "subscribe", "metrics", false},
+		{grant, "publish", "orders.eu.created", true},
+		{grant, "publish", "orders.eu.deleted", false},
+		{nil, "publish", "anything", true},
+	}
+	for i, tt := range tests {
+		if err := tt.grant.check(tt.op, tt.name); (err == nil) != tt.allowed {
+			t.Errorf("test %d: %s %s permission mismatch: have %v, want %v.", i, tt.op, tt.name, err, tt.allowed)
+		}
+	}
+}
@@ -17,8 +17,37 @@
 
 // Contains the wire protocol for communicating with an Iris binding.
 
-// The specification version implemented is v1.0-draft2, available at:
+// The base specification implemented is v1.0-draft2, available at:
 // http://iris.karalabe.com/specs/relay-protocol-v1.0-draft2.pdf
+//
+// The later drafts form a single line of revisions, each one strictly extending
+// the previous with a new capability. A client announces the revision it speaks
+// in the connection initiation, and the relay enables every capability up to it
+// (see protoVersions), refusing unknown ones. Until folded into the published
+// specification, the revisions are defined here:
+//
+//  - v1.0-draft3: a binary credential is appended to the connection initiation
+//    packet, used to authenticate the client against the relay policy.
+//  - v1.0-draft4: durable topic replays, i.e. a replaying subscription carrying
+//    the journal position (sequence number and unix nano timestamp, zero meaning
+//    no limit) to start from, and a durable event delivery carrying the sequence
+//    number of each event.
+//  - v1.0-draft5: scatter-gather requests, i.e. a request initiation to all the
+//    members of a cluster (same layout as a plain request), and a gathered reply
+//    delivery listing the member id and reply (or fault) of every member that
+//    answered before the timeout.
+//  - v1.0-draft6: cluster presence, i.e. a presence query (request id, cluster
+//    and timeout) answered by the approximate member count and capacity (in
+//    requests per second) of the cluster (or a fault), and a watch toggle of a
+//    cluster's membership, after which join and leave notifications are sent,
+//    carrying the direction, the number of members that came or went (more than
+//    one only when reconciled with the census) and the updated presence.
+//  - v1.0-draft7: a balancing strategy name is appended to the connection
+//    initiation packet after the credential, selecting how requests are spread
+//    within the registered cluster (empty meaning the node's default).
+//  - v1.0-draft8: a registered service may report its processing capacity in
+//    requests per second (zero reverting to the relay's measurement of the
+//    request latency and queue depth), weighing the traffic it is assigned.
 
 package relay
 
@@ -27,6 +56,9 @@ import (
 	"io"
 	"sync/atomic"
 	"time"
+
+	"github.com/project-iris/iris/proto/iris"
+	"github.com/project-iris/iris/proto/scribe"
 )
 
 // Packet opcodes
@@ -48,15 +80,57 @@ const (
 	opTunAllow    = 0x0b // In: tunnel transfer allowance      | Out: <same as out>
 	opTunTransfer = 0x0c // In: tunnel data exchange           | Out: <same as out>
 	opTunClose    = 0x0d // In: tunnel termination request     | Out: tunnel termination notification
+
+	opReplay = 0x0e // In: durable topic subscription with replay | Out: <never sent>
+	opEvent  = 0x0f // In: <never received>                      | Out: durable topic event delivery
+
+	opRequestAll = 0x10 // In: scatter-gather request initiation | Out: <never sent>
+	opReplyAll   = 0x11 // In: <never received>                  | Out: gathered member replies delivery
+
+	opPresence = 0x12 // In: cluster presence query          | Out: cluster presence reply
+	opWatch    = 0x13 // In: cluster presence watch (un)setup | Out: cluster member join/leave notification
+
+	opCapacity = 0x14 // In: service capacity report | Out: <never sent>
+)
+
+// Protocol revisions accepted by the relay, ordered by the capability each adds.
+var protoVersions = []string{
+	revBase:     "v1.0-draft2",
+	revAuth:     "v1.0-draft3",
+	revReplay:   "v1.0-draft4",
+	revGather:   "v1.0-draft5",
+	revPresence: "v1.0-draft6",
+	revStrategy: "v1.0-draft7",
+	revCapacity: "v1.0-draft8",
+}
+
+// Protocol revision indexes, a client speaking one supporting all before it.
+const (
+	revBase     = iota // Base specification
+	revAuth            // Client credentials
+	revReplay          // Durable topic replays
+	revGather          // Scatter-gather requests
+	revPresence        // Cluster presence
+	revStrategy        // Balancing strategy selection
+	revCapacity        // Service capacity reports
 )
 
 // Protocol constants
 var (
-	protoVersion = "v1.0-draft2"
-	clientMagic  = "iris-client-magic"
-	relayMagic   = "iris-relay-magic"
+	clientMagic = "iris-client-magic"
+	relayMagic  = "iris-relay-magic"
 )
 
+// Resolves a protocol version into its revision index, or -1 if unsupported.
+func revision(version string) int {
+	for rev, known := range protoVersions {
+		if version == known {
+			return rev
+		}
+	}
+	return -1
+}
+
 // Serializes a single byte into the relay connection.
 func (r *relay) sendByte(data byte) error {
 	return r.sockBuf.WriteByte(data)
@@ -122,14 +196,14 @@ func (r *relay) sendPacket(closure func() error) error {
 }
 
 // Sends a connection acceptance.
-func (r *relay) sendInit() error {
+func (r *relay) sendInit(version string) error {
 	if err := r.sendByte(opInit); err != nil {
 		return err
 	}
 	if err := r.sendString(relayMagic); err != nil {
 		return err
 	}
-	if err := r.sendString(protoVersion); err != nil {
+	if err := r.sendString(version); err != nil {
 		return err
 	}
 	return r.sockBuf.Flush()
@@ -213,6 +287,95 @@ func (r *relay) sendReply(id uint64, reply []byte, fault string) error {
 	})
 }
 
+// Sends the gathered member replies of a scatter-gather request. A request side
+// failure (e.g. permission denied) is sent instead of the member list.
+func (r *relay) sendReplyAll(id uint64, replies []*iris.MemberReply, fault string) error {
+	return r.sendPacket(func() error {
+		if err := r.sendByte(opReplyAll); err != nil {
+			return err
+		}
+		if err := r.sendVarint(id); err != nil {
+			return err
+		}
+		success := (len(fault) == 0)
+		if err := r.sendBool(success); err != nil {
+			return err
+		}
+		if !success {
+			return r.sendString(fault)
+		}
+		if err := r.sendVarint(uint64(len(replies))); err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if err := r.sendString(reply.Member); err != nil {
+				return err
+			}
+			if err := r.sendBool(reply.Err == nil); err != nil {
+				return err
+			}
+			var err error
+			if reply.Err == nil {
+				err = r.sendBinary(reply.Reply)
+			} else {
+				err = r.sendString(reply.Err.Error())
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Sends the reply of a cluster presence query. A query failure (e.g. permission
+// denied or timeout) is sent instead of the presence.
+func (r *relay) sendPresence(id uint64, pres *iris.Presence, fault string) error {
+	return r.sendPacket(func() error {
+		if err := r.sendByte(opPresence); err != nil {
+			return err
+		}
+		if err := r.sendVarint(id); err != nil {
+			return err
+		}
+		success := (len(fault) == 0)
+		if err := r.sendBool(success); err != nil {
+			return err
+		}
+		if !success {
+			return r.sendString(fault)
+		}
+		if err := r.sendVarint(uint64(pres.Members)); err != nil {
+			return err
+		}
+		return r.sendVarint(uint64(pres.Capacity))
+	})
+}
+
+// Sends a membership change notification of a watched cluster, consisting of the
+// direction of the change, the number of members joined or left and the updated
+// presence.
+func (r *relay) sendWatch(cluster string, joined bool, count int, pres *iris.Presence) error {
+	return r.sendPacket(func() error {
+		if err := r.sendByte(opWatch); err != nil {
+			return err
+		}
+		if err := r.sendString(cluster); err != nil {
+			return err
+		}
+		if err := r.sendBool(joined); err != nil {
+			return err
+		}
+		if err := r.sendVarint(uint64(count)); err != nil {
+			return err
+		}
+		if err := r.sendVarint(uint64(pres.Members)); err != nil {
+			return err
+		}
+		return r.sendVarint(uint64(pres.Capacity))
+	})
+}
+
 // Sends a topic event delivery.
 func (r *relay) sendPublish(topic string, event []byte) error {
 	return r.sendPacket(func() error {
@@ -226,6 +389,22 @@ func (r *relay) sendPublish(topic string, event []byte) error {
 	})
 }
 
+// Sends a durable topic event delivery, along with its journal sequence number.
+func (r *relay) sendEvent(topic string, seq uint64, event []byte) error {
+	return r.sendPacket(func() error {
+		if err := r.sendByte(opEvent); err != nil {
+			return err
+		}
+		if err := r.sendString(topic); err != nil {
+			return err
+		}
+		if err := r.sendVarint(seq); err != nil {
+			return err
+		}
+		return r.sendBinary(event)
+	})
+}
+
 // Sends a tunnel initiation.
 func (r *relay) sendTunnelInit(id uint64, chunkLimit int) error {
 	return r.sendPacket(func() error {
@@ -362,31 +541,49 @@ func (r *relay) recvString() (string, error) {
 	}
 }
 
-// Retrieves a connection initiation request.
-func (r *relay) procInit() (string, string, error) {
+// Retrieves a connection initiation request. The credential is only present if
+// the client's revision supports authentication, the balancing strategy only if
+// it supports strategy selection.
+func (r *relay) procInit() (string, string, []byte, string, error) {
 	// Retrieve the init code
 	if op, err := r.recvByte(); err != nil {
-		return "", "", err
+		return "", "", nil, "", err
 	} else if op != opInit {
-		return "", "", fmt.Errorf("protocol violation: invalid init code: %v.", op)
+		return "", "", nil, "", fmt.Errorf("protocol violation: invalid init code: %v.", op)
 	}
 	// Retrieve and check the client side magic
 	if magic, err := r.recvString(); err != nil {
-		return "", "", err
+		return "", "", nil, "", err
 	} else if magic != clientMagic {
-		return "", "", fmt.Errorf("protocol violation: invalid client magic: %s", magic)
+		return "", "", nil, "", fmt.Errorf("protocol violation: invalid client magic: %s", magic)
 	}
 	// Retrieve the protocol version
 	version, err := r.recvString()
 	if err != nil {
-		return "", "", err
+		return "", "", nil, "", err
 	}
 	// Retrieve the cluster id
 	cluster, err := r.recvString()
 	if err != nil {
-		return "", "", err
+		return "", "", nil, "", err
+	}
+	// Retrieve the credential if supported by the protocol
+	rev := revision(version)
+
+	var credential []byte
+	if rev >= revAuth {
+		if credential, err = r.recvBinary(); err != nil {
+			return "", "", nil, "", err
+		}
+	}
+	// Retrieve the balancing strategy if supported by the protocol
+	var strategy string
+	if rev >= revStrategy {
+		if strategy, err = r.recvString(); err != nil {
+			return "", "", nil, "", err
+		}
 	}
-	return version, cluster, nil
+	return version, cluster, credential, strategy, nil
 }
 
 // Retrieves a connection tear-down initiation.
@@ -431,6 +628,85 @@ func (r *relay) procRequest() error {
 	return nil
 }
 
+// Retrieves a scatter-gather request initiation, which shares the layout of a
+// plain request.
+func (r *relay) procRequestAll() error {
+	if r.rev < revGather {
+		return fmt.Errorf("protocol violation: scatter-gather request on %v", protoVersions[r.rev])
+	}
+	id, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	cluster, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	request, err := r.recvBinary()
+	if err != nil {
+		return err
+	}
+	timeout, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	go r.handleRequestAll(cluster, id, request, time.Duration(timeout)*time.Millisecond)
+	return nil
+}
+
+// Retrieves a cluster presence query.
+func (r *relay) procPresence() error {
+	if r.rev < revPresence {
+		return fmt.Errorf("protocol violation: presence query on %v", protoVersions[r.rev])
+	}
+	id, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	cluster, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	timeout, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	go r.handlePresence(cluster, id, time.Duration(timeout)*time.Millisecond)
+	return nil
+}
+
+// Retrieves a cluster presence watch setup (or removal).
+func (r *relay) procWatch() error {
+	if r.rev < revPresence {
+		return fmt.Errorf("protocol violation: presence watch on %v", protoVersions[r.rev])
+	}
+	cluster, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	watch, err := r.recvBool()
+	if err != nil {
+		return err
+	}
+	r.workers.Schedule(func() { r.handleWatch(cluster, watch) })
+	return nil
+}
+
+// Retrieves a service capacity report.
+func (r *relay) procCapacity() error {
+	if r.rev < revCapacity {
+		return fmt.Errorf("protocol violation: capacity report on %v", protoVersions[r.rev])
+	}
+	capacity, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	if err := r.iris.ReportCapacity(int(capacity)); err != nil {
+		return fmt.Errorf("protocol violation: capacity report: %v", err)
+	}
+	return nil
+}
+
 // Retrieves an application reply delivery.
 func (r *relay) procReply() error {
 	id, err := r.recvVarint()
@@ -467,6 +743,32 @@ func (r *relay) procSubscribe() error {
 	return nil
 }
 
+// Retrieves a durable topic subscription with the journal position to replay
+// from.
+func (r *relay) procReplay() error {
+	if r.rev < revReplay {
+		return fmt.Errorf("protocol violation: replaying subscription on %v", protoVersions[r.rev])
+	}
+	topic, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	seq, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	nanos, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	from := scribe.Cursor{Seq: seq}
+	if nanos != 0 {
+		from.Time = time.Unix(0, int64(nanos))
+	}
+	r.workers.Schedule(func() { r.handleReplay(topic, from) })
+	return nil
+}
+
 // Retrieves a topic subscription removal.
 func (r *relay) procUnsubscribe() error {
 	topic, err := r.recvString()
@@ -579,6 +881,14 @@ func (r *relay) process() {
 				err = r.procBroadcast()
 			case opRequest:
 				err = r.procRequest()
+			case opRequestAll:
+				err = r.procRequestAll()
+			case opPresence:
+				err = r.procPresence()
+			case opWatch:
+				err = r.procWatch()
+			case opCapacity:
+				err = r.procCapacity()
 			case opReply:
 				err = r.procReply()
 			case opSubscribe:
@@ -587,6 +897,8 @@ func (r *relay) process() {
 				err = r.procUnsubscribe()
 			case opPublish:
 				err = r.procPublish()
+			case opReplay:
+				err = r.procReplay()
 			case opTunInit:
 				err = r.procTunnelInit()
 			case opTunConfirm:
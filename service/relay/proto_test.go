@@ -0,0 +1,44 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package relay
+
+import "testing"
+
+func TestRevision(t *testing.T) {
+	tests := []struct {
+		version string
+		rev     int
+	}{
+		{"v1.0-draft2", revBase},
+		{"v1.0-draft3", revAuth},
+		{"v1.0-draft5", revGather},
+		{"v1.0-draft8", revCapacity},
+		{"v1.0-draft9", -1},
+		{"v1.0-draft1", -1},
+		{"", -1},
+	}
+	for i, tt := range tests {
+		if rev := revision(tt.version); rev != tt.rev {
+			t.Fatalf("test %d: revision mismatch: have %v, want %v.", i, rev, tt.rev)
+		}
+	}
+	// Ensure every capability has a protocol version announcing it
+	if have, want := len(protoVersions), revCapacity+1; have != want {
+		t.Fatalf("protocol version count mismatch: have %v, want %v.", have, want)
+	}
+}
@@ -22,7 +22,9 @@ package relay
 import (
 	"bufio"
 	"fmt"
+	"log"
 	"net"
+	"strings"
 	"sync"
 
 	"github.com/project-iris/iris/config"
@@ -33,7 +35,10 @@ import (
 // Message relay between the local carrier and an attached binding.
 type relay struct {
 	// Application layer fields
-	iris *iris.Connection // Interface into the iris overlay
+	iris    *iris.Connection // Interface into the iris overlay
+	cluster string           // Cluster the client registered into (empty for pure clients)
+	grant   *Grant           // Access rights of the client (nil if no policy is enforced)
+	rev     int              // Protocol revision of the client, gating its capabilities
 
 	reqIdx  uint64                 // Index to assign the next request
 	reqReps map[uint64]chan []byte // Reply channels for active requests
@@ -73,7 +78,7 @@ func (r *Relay) acceptRelay(sock net.Conn) (*relay, error) {
 
 		// Network layer
 		sock:    sock,
-		sockBuf: bufio.NewReadWriter(bufio.NewReader(sock), bufio.NewWriter(sock)),
+		sockBuf: bufio.NewReadWriter(bufio.NewReader(&meteredConn{sock}), bufio.NewWriter(&meteredConn{sock})),
 
 		// Quality of service
 		workers: pool.NewThreadPool(config.RelayHandlerThreads),
@@ -88,36 +93,74 @@ func (r *Relay) acceptRelay(sock net.Conn) (*relay, error) {
 	defer rel.sockLock.Unlock()
 
 	// Initialize the relay
-	version, cluster, err := rel.procInit()
+	version, cluster, credential, strategy, err := rel.procInit()
 	if err != nil {
 		rel.drop()
 		return nil, err
 	}
 	// Make sure the protocol version is compatible
-	if version != protoVersion {
+	if rel.rev = revision(version); rel.rev < 0 {
 		// Drop the connection in either error branch
 		defer rel.drop()
 
-		reason := fmt.Sprintf("Unsupported protocol. Client: %s. Iris: %s.", version, protoVersion)
+		supported := strings.Join(protoVersions, ", ")
+		reason := fmt.Sprintf("Unsupported protocol. Client: %s. Iris: %s.", version, supported)
 		if err := rel.sendDeny(reason); err != nil {
 			return nil, err
 		}
-		return nil, fmt.Errorf("relay: unsupported client protocol version: have %v, want %v", version, protoVersion)
+		return nil, fmt.Errorf("relay: unsupported client protocol version: have %v, want one of %v", version, supported)
+	}
+	// Refuse new connections if the relay is being drained
+	r.lock.RLock()
+	draining := r.draining
+	r.lock.RUnlock()
+	if draining {
+		defer rel.drop()
+
+		if err := rel.sendDeny("Iris node draining, connect elsewhere."); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("relay: node draining, connection refused")
+	}
+	// Authenticate the client and authorize the requested cluster if a policy is set
+	r.lock.RLock()
+	policy := r.policy
+	r.lock.RUnlock()
+	if policy != nil {
+		if rel.grant = policy.authenticate(credential); rel.grant == nil {
+			defer rel.drop()
+
+			if err := rel.sendDeny("Authentication failed."); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("relay: client authentication failed")
+		}
+		if cluster != "" {
+			if err := rel.grant.check("register", cluster); err != nil {
+				defer rel.drop()
+
+				if err := rel.sendDeny(fmt.Sprintf("Cluster registration denied: %s.", cluster)); err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("relay: %s: %v", rel.grant.Name, err)
+			}
+		}
 	}
 	// Connect to the Iris network either as a service or as a client
 	var handler iris.ConnectionHandler
 	if cluster != "" {
 		handler = rel
 	}
-	conn, err := r.iris.Connect(cluster, handler)
+	conn, err := r.iris.ConnectWithOptions(cluster, handler, &iris.ConnectOptions{Strategy: strategy})
 	if err != nil {
 		rel.drop()
 		return nil, err
 	}
 	rel.iris = conn
+	rel.cluster = cluster
 
 	// Report the connection accepted
-	if err := rel.sendInit(); err != nil {
+	if err := rel.sendInit(version); err != nil {
 		rel.drop()
 		return nil, err
 	}
@@ -127,6 +170,29 @@ func (r *Relay) acceptRelay(sock net.Conn) (*relay, error) {
 	return rel, nil
 }
 
+// Checks whether the relay has inbound requests or tunnels in flight.
+func (r *relay) busy() bool {
+	r.reqLock.RLock()
+	reqs := len(r.reqReps)
+	r.reqLock.RUnlock()
+
+	r.tunLock.RLock()
+	tuns := len(r.tunPend) + len(r.tunLive)
+	r.tunLock.RUnlock()
+
+	return reqs > 0 || tuns > 0
+}
+
+// Notifies the attached binding of an authorization violation and drops the
+// connection.
+func (r *relay) deny(err error) {
+	log.Printf("relay: %s: %v.", r.grant.Name, err)
+	if err := r.sendClose(err.Error()); err != nil {
+		log.Printf("relay: denial notification error: %v.", err)
+	}
+	r.drop()
+}
+
 // Forcefully drops the relay connection. Used during irrecoverable errors.
 func (r *relay) drop() {
 	r.sock.Close()
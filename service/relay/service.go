@@ -18,43 +18,75 @@
 package relay
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto/iris"
 )
 
 // Rate at which to check for relay termination.
 var acceptPollRate = time.Second
 
-// Relay service, listening on a local TCP port and accepting connections for
-// joining the Iris network.
+// Rate at which to check for in-flight operations while draining.
+var drainPollRate = 100 * time.Millisecond
+
+// Stream listener socket with an accept timeout (TCP or Unix domain).
+type listener interface {
+	net.Listener
+	SetDeadline(t time.Time) error
+}
+
+// Relay service, listening on a local TCP port and/or Unix domain socket and
+// accepting connections for joining the Iris network.
 type Relay struct {
-	address  *net.TCPAddr     // Listener address
-	listener *net.TCPListener // Listener socket for the locally joining apps
-	iris     *iris.Overlay    // Overlay through which connections are relayed
+	address   *net.TCPAddr  // TCP listener address (nil if disabled)
+	path      string        // Unix socket listener path (empty if disabled)
+	listeners []listener    // Listener sockets for the locally joining apps
+	iris      *iris.Overlay // Overlay through which connections are relayed
 
-	clients map[*relay]struct{} // Active client connections
+	clients  map[*relay]struct{} // Active client connections
+	draining bool                // Whether new connections are refused
+	policy   *Policy             // Client authorization policy (nil = permit all)
+	lock     sync.RWMutex        // Mutex to protect the client set, drain flag and policy
 
-	done chan *relay     // Channel on which active clients signal termination
-	quit chan chan error // Quit channel to synchronize relay termination
+	conns chan net.Conn   // Channel on which the listeners pass inbound connections
+	stop  chan struct{}   // Channel closed to signal listener termination
+	pend  sync.WaitGroup  // Listener routines still running
+	done  chan *relay     // Channel on which active clients signal termination
+	quit  chan chan error // Quit channel to synchronize relay termination
 }
 
-// Creates a new relay attached to a carrier and opens the listener socket on
-// the specified local port.
-func New(port int, overlay *iris.Overlay) (*Relay, error) {
-	// Assemble the listener address
-	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
-	if err != nil {
-		return nil, err
+// Creates a new relay attached to a carrier, which will listen on the specified
+// local TCP port and/or Unix domain socket path. A zero port or empty path will
+// disable the corresponding listener.
+func New(port int, path string, overlay *iris.Overlay) (*Relay, error) {
+	if port == 0 && path == "" {
+		return nil, errors.New("no relay endpoint specified")
+	}
+	// Assemble the TCP listener address if requested
+	var addr *net.TCPAddr
+	if port != 0 {
+		var err error
+		if addr, err = net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port)); err != nil {
+			return nil, err
+		}
 	}
 	// Return the relay service endpoint
 	return &Relay{
 		address: addr,
+		path:    path,
 		iris:    overlay,
 		clients: make(map[*relay]struct{}),
+		conns:   make(chan net.Conn),
+		stop:    make(chan struct{}),
 		done:    make(chan *relay),
 		quit:    make(chan chan error),
 	}, nil
@@ -62,17 +94,92 @@ func New(port int, overlay *iris.Overlay) (*Relay, error) {
 
 // Starts accepting local relay connections.
 func (r *Relay) Boot() error {
-	// Open the server socket
-	if sock, err := net.ListenTCP("tcp", r.address); err != nil {
-		return err
-	} else {
-		r.listener = sock
+	// Open the server sockets
+	if r.address != nil {
+		sock, err := net.ListenTCP("tcp", r.address)
+		if err != nil {
+			return err
+		}
+		r.listeners = append(r.listeners, sock)
+	}
+	if r.path != "" {
+		sock, err := listenUnix(r.path)
+		if err != nil {
+			for _, sock := range r.listeners {
+				sock.Close()
+			}
+			return err
+		}
+		r.listeners = append(r.listeners, sock)
 	}
 	// Start accepting connections
+	for _, sock := range r.listeners {
+		r.pend.Add(1)
+		go r.listen(sock)
+	}
 	go r.acceptor()
 	return nil
 }
 
+// Opens a Unix domain socket listener at the given path, removing any stale
+// socket file left behind and restricting access to the configured permissions.
+func listenUnix(path string) (*net.UnixListener, error) {
+	// Parse the access permissions before touching the file system
+	mode, err := strconv.ParseUint(config.RelaySocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return nil, fmt.Errorf("invalid socket mode: %v", config.RelaySocketMode)
+	}
+	gid := -1
+	if config.RelaySocketGroup != "" {
+		group, err := user.LookupGroup(config.RelaySocketGroup)
+		if err != nil {
+			return nil, err
+		}
+		if gid, err = strconv.Atoi(group.Gid); err != nil {
+			return nil, err
+		}
+	}
+	// Remove any stale socket, but don't hijack a live one
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// Open the listener and set the permissions
+	sock, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	if gid != -1 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			sock.Close()
+			return nil, err
+		}
+	}
+	return sock, nil
+}
+
+// Sets the authentication and authorization policy to enforce on the attaching
+// clients. Already connected clients retain their original rights. A nil policy
+// disables enforcement.
+func (r *Relay) SetPolicy(policy *Policy) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.policy = policy
+}
+
 // Closes all open connections and terminates the relaying service.
 func (r *Relay) Terminate() error {
 	errc := make(chan error, 1)
@@ -80,6 +187,83 @@ func (r *Relay) Terminate() error {
 	return <-errc
 }
 
+// Gracefully drains the relay: new connections are refused and the attached
+// services are unregistered so no new requests are routed to the node, after
+// which the in-flight requests and tunnels are given time to finish before the
+// relay is terminated.
+func (r *Relay) Drain(timeout time.Duration) error {
+	// Refuse new connections and unregister the existing services
+	r.lock.Lock()
+	r.draining = true
+	clients := make([]*relay, 0, len(r.clients))
+	for rel, _ := range r.clients {
+		clients = append(clients, rel)
+	}
+	r.lock.Unlock()
+
+	for _, rel := range clients {
+		if rel.cluster != "" {
+			if err := rel.iris.Unregister(); err != nil {
+				log.Printf("relay: failed to unregister service: %v.", err)
+			}
+		}
+	}
+	// Wait for the pending operations to finish, or the deadline to expire
+	deadline := time.After(timeout)
+	for r.busy() {
+		select {
+		case <-deadline:
+			log.Printf("relay: drain timed out with pending operations.")
+			return r.Terminate()
+		case <-time.After(drainPollRate):
+		}
+	}
+	return r.Terminate()
+}
+
+// Checks whether any attached client has in-flight operations.
+func (r *Relay) busy() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for rel, _ := range r.clients {
+		if rel.busy() {
+			return true
+		}
+	}
+	return false
+}
+
+// Accepts inbound connections on a single listener socket till the service is
+// terminated, passing them to the acceptor for handling.
+func (r *Relay) listen(sock listener) {
+	defer r.pend.Done()
+
+	for {
+		// Accept an incoming connection but without blocking for too long
+		sock.SetDeadline(time.Now().Add(acceptPollRate))
+		conn, err := sock.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+				log.Printf("relay: accept failed: %v, terminating.", err)
+				return
+			}
+			select {
+			case <-r.stop:
+				return
+			default:
+				continue
+			}
+		}
+		select {
+		case r.conns <- conn:
+		case <-r.stop:
+			conn.Close()
+			return
+		}
+	}
+}
+
 // Accepts inbound connections till the service is terminated. For each one it
 // starts a new handler and hands the socket over.
 func (r *Relay) acceptor() {
@@ -91,36 +275,50 @@ func (r *Relay) acceptor() {
 			break
 		case client := <-r.done:
 			// A client terminated, remove from active list
+			r.lock.Lock()
 			delete(r.clients, client)
+			r.lock.Unlock()
+			relayClients.Dec()
 			if err := client.report(); err != nil {
 				log.Printf("relay: closing client error: %v.", err)
 			}
-		default:
-			// Accept an incoming connection but without blocking for too long
-			r.listener.SetDeadline(time.Now().Add(acceptPollRate))
-			if sock, err := r.listener.Accept(); err == nil {
-				if rel, err := r.acceptRelay(sock); err != nil {
-					log.Printf("relay: accept failed: %v.", err)
-				} else {
-					r.clients[rel] = struct{}{}
-				}
-			} else if !err.(net.Error).Timeout() {
-				log.Printf("relay: accept failed: %v, terminating.", err)
+		case sock := <-r.conns:
+			if rel, err := r.acceptRelay(sock); err != nil {
+				log.Printf("relay: accept failed: %v.", err)
+			} else {
+				r.lock.Lock()
+				r.clients[rel] = struct{}{}
+				r.lock.Unlock()
+				relayClients.Inc()
 			}
 		}
 	}
-	// In case of failure, wait for termination request
-	if errc == nil {
-		errc = <-r.quit
-	}
+	// Stop the listeners
+	close(r.stop)
+	r.pend.Wait()
+
 	// Forcefully close all active client connections
 	for rel, _ := range r.clients {
 		rel.drop()
 		<-r.done
+		relayClients.Dec()
 	}
 	for rel, _ := range r.clients {
 		rel.report()
 	}
 	// Clean up and report
-	errc <- r.listener.Close()
+	errs := []error{}
+	for _, sock := range r.listeners {
+		if err := sock.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch len(errs) {
+	case 0:
+		errc <- nil
+	case 1:
+		errc <- errs[0]
+	default:
+		errc <- fmt.Errorf("%v", errs)
+	}
 }
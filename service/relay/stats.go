@@ -0,0 +1,91 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the statistics snapshot of the relay service, exposing the locally
+// attached client applications.
+
+package relay
+
+import (
+	"sort"
+)
+
+// Snapshot of the relay service state.
+type Stats struct {
+	Address string        `json:"address,omitempty"` // TCP listener address of the relay
+	Socket  string        `json:"socket,omitempty"`  // Unix socket path of the relay
+	Clients []ClientStats `json:"clients"`           // Attached client applications
+}
+
+// Snapshot of a single attached client.
+type ClientStats struct {
+	Remote   string `json:"remote"`        // Remote address of the client socket
+	App      string `json:"app,omitempty"` // Application name from the relay policy
+	Cluster  string `json:"cluster"`       // Cluster registered into (empty for clients)
+	Requests int    `json:"requests"`      // Inbound requests awaiting the reply
+	Tunnels  int    `json:"tunnels"`       // Live tunnels
+}
+
+// Gathers a snapshot of the relay service state.
+func (r *Relay) Stats() *Stats {
+	r.lock.RLock()
+	clients := make([]*relay, 0, len(r.clients))
+	for rel, _ := range r.clients {
+		clients = append(clients, rel)
+	}
+	r.lock.RUnlock()
+
+	stats := &Stats{
+		Socket:  r.path,
+		Clients: make([]ClientStats, 0, len(clients)),
+	}
+	if r.address != nil {
+		stats.Address = r.address.String()
+	}
+	for _, rel := range clients {
+		stats.Clients = append(stats.Clients, rel.stats())
+	}
+	sort.Sort(clientStatsSorter(stats.Clients))
+	return stats
+}
+
+// Gathers a snapshot of the client connection state.
+func (r *relay) stats() ClientStats {
+	stats := ClientStats{
+		Remote:  r.sock.RemoteAddr().String(),
+		Cluster: r.cluster,
+	}
+	if r.grant != nil {
+		stats.App = r.grant.Name
+	}
+	r.reqLock.RLock()
+	stats.Requests = len(r.reqReps)
+	r.reqLock.RUnlock()
+
+	r.tunLock.RLock()
+	stats.Tunnels = len(r.tunLive)
+	r.tunLock.RUnlock()
+
+	return stats
+}
+
+// Sorter for the client snapshots to get a stable listing.
+type clientStatsSorter []ClientStats
+
+func (s clientStatsSorter) Len() int           { return len(s) }
+func (s clientStatsSorter) Less(i, j int) bool { return s[i].Remote < s[j].Remote }
+func (s clientStatsSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -211,6 +211,7 @@ func (t *tunnel) receiver() {
 				break
 			}
 			// Wait for a potential allowance grant
+			tunnelStalls.Inc()
 			select {
 			case errc = <-t.quit:
 			case <-t.itoaSign:
@@ -0,0 +1,196 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the network interface enumeration, selecting the local addresses the
+// overlay listeners should be started on, and the mapping of those addresses to
+// the ones advertised to remote peers.
+
+package system
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strconv"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Collects the local interface addresses the overlay should operate on. By
+// default only the non-loopback IPv4 ones are returned, whereas in loopback mode
+// the loopback ones exclusively (i.e. single host cluster). IPv6 addresses are
+// opt-in. The results are further filtered by the interface name and network
+// allow/deny lists.
+func InterfaceAddrs() ([]*net.IPNet, error) {
+	// Parse the network filters
+	allowNets, err := parseNets(config.NetAllowNets)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := parseNets(config.NetDenyNets)
+	if err != nil {
+		return nil, err
+	}
+	// Gather the addresses of all the permitted interfaces
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	ipnets := []*net.IPNet{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if len(config.NetAllowIfaces) > 0 && !matchName(config.NetAllowIfaces, iface.Name) {
+			continue
+		}
+		if matchName(config.NetDenyIfaces, iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			// Workaround for upstream Go issue #5395, construct an IPNet if IPAddr is returned
+			var ipnet *net.IPNet
+			switch addr := addr.(type) {
+			case *net.IPNet:
+				ipnet = addr
+			case *net.IPAddr:
+				log.Printf("system: OS returned no network mask, using defaults...")
+				ipnet = &net.IPNet{
+					IP:   addr.IP,
+					Mask: addr.IP.DefaultMask(),
+				}
+			default:
+				log.Printf("system: unknown interface address type for: %v.", addr)
+				continue
+			}
+			if !usableIP(ipnet.IP) {
+				continue
+			}
+			if len(allowNets) > 0 && !matchNet(allowNets, ipnet.IP) {
+				continue
+			}
+			if matchNet(denyNets, ipnet.IP) {
+				continue
+			}
+			ipnets = append(ipnets, ipnet)
+		}
+	}
+	return ipnets, nil
+}
+
+// Checks whether an address is of a family and scope usable by the overlay.
+// Link-local IPv6 addresses are skipped, since they are ambiguous without a zone.
+func usableIP(ip net.IP) bool {
+	if ip.IsLoopback() != config.NetLoopback {
+		return false
+	}
+	if ip.To4() != nil {
+		return config.NetIPv4
+	}
+	if !config.NetIPv6 || ip.IsLinkLocalUnicast() {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsGlobalUnicast()
+}
+
+// Lists the IPv4 loopback addresses (from 127.0.0.1 onward) the nodes of a single
+// host cluster may spread over, in order of preference, instead of exhausting
+// the bootstrap ports of a single address. Non-loopback networks yield nothing.
+func LoopbackHosts(ipnet *net.IPNet) []*net.IPNet {
+	if !ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+		return nil
+	}
+	hosts := []*net.IPNet{}
+
+	base := binary.BigEndian.Uint32(ipnet.IP.To4().Mask(ipnet.Mask))
+	for i := 1; i <= config.NetLoopbackHosts; i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, base+uint32(i))
+		if !ipnet.Contains(ip) {
+			break
+		}
+		hosts = append(hosts, &net.IPNet{IP: ip, Mask: ipnet.Mask})
+	}
+	return hosts
+}
+
+// Converts a local listener address into the one advertised to remote peers,
+// replacing the host with the configured override if any.
+func AdvertisedAddr(addr *net.TCPAddr) string {
+	if config.NetAdvertise == "" {
+		return addr.String()
+	}
+	return net.JoinHostPort(config.NetAdvertise, strconv.Itoa(addr.Port))
+}
+
+// Verifies that the network selection options are well formed.
+func CheckNetConfig() error {
+	if !config.NetIPv4 && !config.NetIPv6 {
+		return fmt.Errorf("both IPv4 and IPv6 disabled")
+	}
+	if _, err := parseNets(config.NetAllowNets); err != nil {
+		return err
+	}
+	if _, err := parseNets(config.NetDenyNets); err != nil {
+		return err
+	}
+	for _, pattern := range append(append([]string{}, config.NetAllowIfaces...), config.NetDenyIfaces...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid interface pattern %s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Parses a list of CIDR network specifications.
+func parseNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// Checks whether an interface name matches any of the (glob) patterns.
+func matchName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether an IP address is contained in any of the networks.
+func matchNet(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}